@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotStoreAnalyzes(t *testing.T) {
+	var inferred string
+	store := &SnapshotStore{Dir: t.TempDir(), MaxFiles: 1, Analyze: true, Client: cameraDevice(t, http.StatusOK, &inferred), Now: stepClock()}
+	for i := 0; i < 2; i++ {
+		if err := store.Capture(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var req map[string]string
+	if err := json.Unmarshal([]byte(inferred), &req); err != nil {
+		t.Fatal(err)
+	}
+	if jpeg, _ := base64.StdEncoding.DecodeString(req["image_b64"]); string(jpeg) != "\xff\xd8jpeg\xff\xd9" {
+		t.Fatalf("inference got image %q", jpeg)
+	}
+
+	list, _ := store.List()
+	if len(list) != 1 || list[0].Analysis != "20240501_100002.json" {
+		t.Fatalf("stored %+v, want one analyzed snapshot", list)
+	}
+	result, err := os.ReadFile(filepath.Join(store.Dir, list[0].Analysis))
+	if err != nil || string(result) != `{"label":"person"}` {
+		t.Fatalf("sidecar = %q, %v", result, err)
+	}
+	// Pruning the first snapshot removes its sidecar too
+	if _, err := os.Stat(filepath.Join(store.Dir, "20240501_100001.json")); !os.IsNotExist(err) {
+		t.Fatalf("pruned sidecar still present: %v", err)
+	}
+}
+
+func TestSnapshotKeptWhenAnalysisFails(t *testing.T) {
+	store := &SnapshotStore{Dir: t.TempDir(), MaxFiles: 5, Analyze: true, Client: cameraDevice(t, http.StatusInternalServerError, nil), Now: stepClock()}
+	err := store.Capture(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "analyze snapshot") {
+		t.Fatalf("err = %v, want an analysis error", err)
+	}
+	list, _ := store.List()
+	if len(list) != 1 || list[0].Analysis != "" {
+		t.Fatalf("stored %+v, want the snapshot without a sidecar", list)
+	}
+}
+
+func TestSnapshotStoreReconfigureAnalyze(t *testing.T) {
+	var inferred string
+	store := &SnapshotStore{Dir: t.TempDir(), MaxFiles: 5, Client: cameraDevice(t, http.StatusOK, &inferred), Now: stepClock()}
+	store.Capture(context.Background())
+	if inferred != "" {
+		t.Fatal("inference called with Analyze off")
+	}
+	store.Reconfigure(5, true)
+	store.Capture(context.Background())
+	if inferred == "" {
+		t.Fatal("inference not called after enabling Analyze")
+	}
+}
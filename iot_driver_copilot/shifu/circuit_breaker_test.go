@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeDevice answers every request with the status configured for the host
+// it currently points at, without touching the network.
+type fakeDevice struct {
+	*DeviceClient
+	status map[string]int
+	calls  int
+}
+
+func newFakeDevice(cfg *Config, status map[string]int) *fakeDevice {
+	return &fakeDevice{DeviceClient: NewDeviceClient(cfg), status: status}
+}
+
+func (f *fakeDevice) reply() (*http.Response, error) {
+	f.calls++
+	return &http.Response{StatusCode: f.status[f.Host()], Body: http.NoBody}, nil
+}
+
+func (f *fakeDevice) Get(ctx context.Context, path string) (*http.Response, error) {
+	return f.reply()
+}
+
+func (f *fakeDevice) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	return f.reply()
+}
+
+// breakerConfig gives every circuit a threshold of 2 and a one-minute reset.
+func breakerConfig() *Config {
+	cfg := loadConfig()
+	cfg.ShifuIP, cfg.ShifuAPIBase = "10.0.0.1", ""
+	cfg.CircuitThreshold, cfg.CircuitReset = 2, time.Minute
+	cfg.CircuitTelemetry, cfg.CircuitTelemetryReset = 2, time.Minute
+	cfg.CircuitControl, cfg.CircuitControlReset = 2, time.Minute
+	cfg.CircuitOTA, cfg.CircuitOTAReset = 2, time.Minute
+	cfg.CircuitInfer, cfg.CircuitInferReset = 2, time.Minute
+	return cfg
+}
+
+func TestCircuitBreakerSetHostClosesCircuit(t *testing.T) {
+	dev := newFakeDevice(breakerConfig(), map[string]int{"10.0.0.1": 503, "10.0.0.2": 200})
+	b := NewCircuitBreaker(dev)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		b.Get(ctx, "/api/v1/status")
+	}
+	if s := b.State(EndpointTelemetry); s != CircuitOpen {
+		t.Fatalf("state after 2 failures = %s, want open", s)
+	}
+	b.SetHost("10.0.0.2")
+	if s := b.State(EndpointTelemetry); s != CircuitClosed {
+		t.Fatalf("state after SetHost = %s, want closed", s)
+	}
+	resp, err := b.Get(ctx, "/api/v1/status")
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("request to the new host: %v, %v", resp, err)
+	}
+	// The failure count starts over too: one more failure must not reopen it
+	dev.status["10.0.0.2"] = 503
+	b.Get(ctx, "/api/v1/status")
+	if s := b.State(EndpointTelemetry); s != CircuitClosed {
+		t.Fatalf("state after 1 failure on the new host = %s, want closed", s)
+	}
+}
+
+func TestCircuitBreakerDefaultThreshold(t *testing.T) {
+	reloadEnv(t)
+	t.Setenv("CIRCUIT_OPEN_THRESHOLD", "")
+	cfg := loadConfig()
+	cfg.ShifuIP, cfg.ShifuAPIBase = "10.0.0.1", ""
+	dev := newFakeDevice(cfg, map[string]int{"10.0.0.1": 503})
+	b := NewCircuitBreaker(dev)
+	ctx := context.Background()
+	for i := 1; i <= 4; i++ {
+		b.Get(ctx, "/api/v1/status")
+		if s := b.State(EndpointTelemetry); s != CircuitClosed {
+			t.Fatalf("state after %d failures = %s, want closed", i, s)
+		}
+	}
+	b.Get(ctx, "/api/v1/status")
+	if s := b.State(EndpointTelemetry); s != CircuitOpen {
+		t.Fatalf("state after 5 failures = %s, want open", s)
+	}
+	if _, err := b.Get(ctx, "/api/v1/status"); !errors.Is(err, ErrCircuitOpen) || dev.calls != 5 {
+		t.Fatalf("open circuit: err %v after %d device calls, want ErrCircuitOpen after 5", err, dev.calls)
+	}
+}
+
+// tripAll opens every circuit by sending threshold failing requests to a
+// path of each endpoint.
+func tripAll(t *testing.T, b *CircuitBreaker) {
+	t.Helper()
+	ctx := context.Background()
+	paths := []string{"/api/v1/info", "/api/v1/status", "/api/v1/control", "/api/v1/upgrade", "/api/v1/infer"}
+	for _, path := range paths {
+		for i := 0; i < 2; i++ {
+			b.Get(ctx, path)
+		}
+	}
+	for endpoint, state := range b.States() {
+		if state != CircuitOpen {
+			t.Fatalf("%s circuit is %s after 2 failures, want open", endpoint, state)
+		}
+	}
+}
+
+func TestCircuitBreakerAddressChangeResetsAllCircuits(t *testing.T) {
+	for name, move := range map[string]func(b *CircuitBreaker){
+		"SetHost": func(b *CircuitBreaker) { b.SetHost("10.0.0.2") },
+		"reload": func(b *CircuitBreaker) {
+			cfg := *b.Config()
+			cfg.ShifuIP = "10.0.0.2"
+			b.SetConfig(&cfg)
+		},
+	} {
+		b := NewCircuitBreaker(newFakeDevice(breakerConfig(), map[string]int{"10.0.0.1": 503}))
+		tripAll(t, b)
+		move(b)
+		states := b.States()
+		if len(states) != 5 {
+			t.Fatalf("%s: %d circuits, want 5", name, len(states))
+		}
+		for endpoint, state := range states {
+			if state != CircuitClosed {
+				t.Errorf("%s: %s circuit is %s, want closed", name, endpoint, state)
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerReloadKeepsCircuitsForSameAddress(t *testing.T) {
+	b := NewCircuitBreaker(newFakeDevice(breakerConfig(), map[string]int{"10.0.0.1": 503}))
+	tripAll(t, b)
+	cfg := *b.Config()
+	cfg.CameraSnapshot = "/api/v1/snapshot.jpg"
+	b.SetConfig(&cfg)
+	if s := b.State(EndpointControl); s != CircuitOpen {
+		t.Fatalf("control circuit is %s after an unrelated reload, want open", s)
+	}
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	dev := newFakeDevice(breakerConfig(), map[string]int{"10.0.0.1": 503})
+	b := NewCircuitBreaker(dev)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	b.Now = func() time.Time { return now }
+	ctx := context.Background()
+
+	b.Get(ctx, "/api/v1/status")
+	if s := b.State(EndpointTelemetry); s != CircuitClosed {
+		t.Fatalf("after 1 failure: %s, want closed", s)
+	}
+	b.Get(ctx, "/api/v1/status")
+	if s := b.State(EndpointTelemetry); s != CircuitOpen {
+		t.Fatalf("after 2 failures: %s, want open", s)
+	}
+	if _, err := b.Get(ctx, "/api/v1/status"); !errors.Is(err, ErrCircuitOpen) || dev.calls != 2 {
+		t.Fatalf("open circuit: err %v after %d device calls, want ErrCircuitOpen after 2", err, dev.calls)
+	}
+
+	// After the reset interval one probe goes through; a failed probe reopens
+	now = now.Add(time.Minute)
+	if s := b.State(EndpointTelemetry); s != CircuitHalfOpen {
+		t.Fatalf("after the reset interval: %s, want half-open", s)
+	}
+	b.Get(ctx, "/api/v1/status")
+	if s := b.State(EndpointTelemetry); s != CircuitOpen || dev.calls != 3 {
+		t.Fatalf("after a failed probe: %s with %d calls, want open with 3", s, dev.calls)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	dev.status["10.0.0.1"] = 200
+	if resp, err := b.Get(ctx, "/api/v1/status"); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("probe: %v, %v", resp, err)
+	}
+	if s := b.State(EndpointTelemetry); s != CircuitClosed {
+		t.Fatalf("after a successful probe: %s, want closed", s)
+	}
+}
+
+func TestCircuitBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	cfg := breakerConfig()
+	b := NewCircuitBreaker(newFakeDevice(cfg, map[string]int{"10.0.0.1": 503}))
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	b.Now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		b.Get(context.Background(), "/api/v1/control")
+	}
+	now = now.Add(time.Minute)
+	if _, err := b.allow("/api/v1/control"); err != nil {
+		t.Fatalf("first probe refused: %v", err)
+	}
+	if _, err := b.allow("/api/v1/control"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second request during the probe: %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerEndpointsAreIndependent(t *testing.T) {
+	dev := newFakeDevice(breakerConfig(), map[string]int{"10.0.0.1": 503})
+	b := NewCircuitBreaker(dev)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		b.Post(ctx, "/api/v1/infer", "application/json", nil)
+	}
+	if s := b.State(EndpointInfer); s != CircuitOpen {
+		t.Fatalf("infer circuit: %s, want open", s)
+	}
+	dev.status["10.0.0.1"] = 200
+	if resp, err := b.Get(ctx, "/api/v1/status"); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("telemetry blocked by the infer circuit: %v, %v", resp, err)
+	}
+	for endpoint, state := range b.States() {
+		if endpoint != EndpointInfer && state != CircuitClosed {
+			t.Errorf("%s circuit: %s, want closed", endpoint, state)
+		}
+	}
+}
+
+func TestCircuitBreakerThresholdZeroDisables(t *testing.T) {
+	cfg := breakerConfig()
+	cfg.CircuitOTA = 0
+	dev := newFakeDevice(cfg, map[string]int{"10.0.0.1": 503})
+	b := NewCircuitBreaker(dev)
+	for i := 0; i < 5; i++ {
+		if _, err := b.Post(context.Background(), "/api/v1/upgrade", "application/json", nil); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	if dev.calls != 5 {
+		t.Fatalf("device called %d times, want 5", dev.calls)
+	}
+}
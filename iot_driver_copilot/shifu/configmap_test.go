@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useConfigSources sets the ConfigMap and CONFIG_FILE values for the test.
+func useConfigSources(t *testing.T, configMap, file map[string]string) {
+	t.Helper()
+	configMu.Lock()
+	prevMap, prevFile := configMapVals, fileConfig
+	configMapVals, fileConfig = configMap, file
+	configMu.Unlock()
+	t.Cleanup(func() {
+		configMu.Lock()
+		configMapVals, fileConfig = prevMap, prevFile
+		configMu.Unlock()
+	})
+}
+
+func TestKubeClientReadsConfigMap(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/edge/configmaps/shifu-driver" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"data": {"SHIFU_PORT": "9090"}}`)
+	}))
+	defer srv.Close()
+	k := &kubeClient{BaseURL: srv.URL, Token: "sa-token", Client: srv.Client()}
+
+	data, err := k.ConfigMap(context.Background(), "edge", "shifu-driver")
+	if err != nil || data["SHIFU_PORT"] != "9090" {
+		t.Fatalf("ConfigMap = %v, %v", data, err)
+	}
+	if _, err := k.ConfigMap(context.Background(), "edge", "missing"); err == nil {
+		t.Fatal("missing ConfigMap returned no error")
+	}
+	k.Token = "wrong"
+	if _, err := k.ConfigMap(context.Background(), "edge", "shifu-driver"); err == nil {
+		t.Fatal("unauthorized request returned no error")
+	}
+}
+
+func TestConfigSourcePrecedence(t *testing.T) {
+	useConfigSources(t,
+		map[string]string{"SHIFU_PORT": "8002", "HTTP_RETRY_BASE_DELAY_MS": "1500"},
+		map[string]string{"SHIFU_PORT": "8003", "HTTP_RETRY_BASE_DELAY_MS": "2500", "SHIFU_IP": "10.1.1.1"})
+	t.Setenv("SHIFU_PORT", "8001")
+
+	if got := getEnv("SHIFU_PORT", "80"); got != "8001" {
+		t.Errorf("SHIFU_PORT = %s, want the environment value", got)
+	}
+	if got := getEnvInt("HTTP_RETRY_BASE_DELAY_MS", 0); got != 1500 {
+		t.Errorf("HTTP_RETRY_BASE_DELAY_MS = %d, want the ConfigMap value", got)
+	}
+	if got := getEnv("SHIFU_IP", ""); got != "10.1.1.1" {
+		t.Errorf("SHIFU_IP = %s, want the config file value", got)
+	}
+	if got := getEnv("SHIFU_API_BASE", "fallback"); got != "fallback" {
+		t.Errorf("SHIFU_API_BASE = %s, want the default", got)
+	}
+}
+
+func TestLoadConfigSourcesOutsideCluster(t *testing.T) {
+	useConfigSources(t, map[string]string{}, map[string]string{})
+	t.Setenv("CONFIGMAP_NAME", "shifu-driver")
+	t.Setenv("CONFIGMAP_NAMESPACE", "edge")
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := loadConfigSources(); err != nil {
+		t.Fatalf("outside a cluster: %v, want the environment to be used", err)
+	}
+}
@@ -2,223 +2,4161 @@ package main
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// Configuration loaded from environment variables
+// Configuration loaded from environment variables. The env tag names the
+// variables a field is read from, the first set one winning; fields without
+// one are derived from others.
 type Config struct {
-	ShifuIP         string
-	ShifuPort       string
-	ShifuAPIBase    string
-	ServerHost      string
-	ServerPort      string
-	CameraSnapshot  string
+	ShifuIP         string        `env:"SHIFU_IP"`
+	ShifuPort       string        `env:"SHIFU_PORT"`
+	ShifuAPIBase    string        `env:"SHIFU_API_BASE"`
+	ServerHost      string        `env:"SERVER_HOST"`
+	ServerPort      string        `env:"SERVER_PORT"`
+	CameraSnapshot  string        `env:"CAMERA_SNAPSHOT_PATH"`
+	CameraPTZ       string        `env:"CAMERA_PTZ_PATH"`
+	DeviceHostname  string        `env:"DEVICE_HOSTNAME"`
+	HostnameRefresh time.Duration `env:"DEVICE_HOSTNAME_REFRESH_S"`
+	// Heartbeat
+	HeartbeatInterval time.Duration `env:"HEARTBEAT_INTERVAL_S"`
+	HeartbeatStale    time.Duration `env:"HEARTBEAT_STALE_THRESHOLD_S,HEARTBEAT_INTERVAL_S"`
+	HeartbeatWebhook  string        `env:"HEARTBEAT_WEBHOOK_URL" secret:"true"`
+	// Discovery runs when no device address is configured
+	Discovery        bool
+	MDNSServiceType  string        `env:"MDNS_SERVICE_TYPE"`
+	DiscoveryRefresh time.Duration `env:"MDNS_REFRESH_S"`
+	RegistryFile     string        `env:"DEVICE_REGISTRY_FILE"`
+	// /readyz reuses a successful device check younger than this
+	ReadyzStaleTolerance time.Duration `env:"READYZ_STALE_TOLERANCE_S"`
+	// Upper bound for /device/reachable?timeout_ms=
+	ReachabilityMaxTimeout time.Duration `env:"REACHABILITY_MAX_TIMEOUT_MS"`
+	// Largest device response body the driver will read, in bytes
+	UpstreamMaxBody int64 `env:"UPSTREAM_MAX_RESPONSE_BODY_MB"`
+	// Add X-Response-Hash to JSON responses
+	ResponseHash bool `env:"RESPONSE_HASH_HEADER"`
+	// Serve HTTPS when both files are set
+	TLSCertFile     string `env:"TLS_CERT_FILE"`
+	TLSKeyFile      string `env:"TLS_KEY_FILE"`
+	TLSMinVersion   string `env:"TLS_MIN_VERSION"`
+	TLSMaxVersion   string `env:"TLS_MAX_VERSION"`
+	TLSCipherSuites string `env:"TLS_CIPHER_SUITES"`
+	// Fraction of /infer requests forwarded to the device; the rest get 429
+	InferSampleRate  float64 `env:"INFER_SAMPLE_RATE"`
+	InferServeCached bool    `env:"INFER_SAMPLE_SERVE_CACHED"`
+	// Serve canned device responses instead of calling the device
+	MockMode          bool          `env:"DEVICE_MOCK_MODE"`
+	MockResponsesFile string        `env:"MOCK_RESPONSES_FILE"`
+	MockLatency       time.Duration `env:"MOCK_LATENCY_MS"`
+	MockErrorRate     float64       `env:"MOCK_ERROR_RATE"`
+	// Periodic snapshots saved to disk; 0 disables
+	SnapshotInterval time.Duration `env:"CAMERA_SNAPSHOT_INTERVAL_S"`
+	SnapshotDir      string        `env:"CAMERA_SNAPSHOT_DIR"`
+	SnapshotMaxFiles int           `env:"CAMERA_SNAPSHOT_MAX_FILES"`
+	SnapshotAnalyze  bool          `env:"CAMERA_ANALYZE_ON_SNAPSHOT"`
+	// Finished /infer/async jobs kept for polling
+	InferJobHistory int `env:"INFER_JOB_HISTORY_MAX"`
+	// /infer/async jobs run at once; further submissions get 429
+	InferWorkers int `env:"INFER_ASYNC_WORKERS"`
+	// Default target of POST /device/wol
+	DeviceMAC string `env:"DEVICE_MAC_ADDRESS"`
+	// Bearer token for the endpoints behind requireAdminToken; unset disables them
+	AdminToken string `env:"ADMIN_TOKEN" secret:"true"`
+	// Comma-separated proxy IPs or CIDRs whose X-Forwarded-For is trusted
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
+	// How long identical /infer requests are answered from cache; 0 disables
+	InferCacheTTL time.Duration `env:"INFER_CACHE_TTL_S"`
+	// Cached /infer responses kept; the oldest is evicted past this
+	InferCacheMax int `env:"INFER_CACHE_MAX_ENTRIES"`
+	// Consecutive device failures that open the circuit breaker; 0 disables
+	CircuitThreshold int           `env:"CIRCUIT_OPEN_THRESHOLD"`
+	CircuitReset     time.Duration `env:"CIRCUIT_RESET_INTERVAL_S"`
+	// Device process API; DELETE <path>/<pid> terminates a process
+	ProcessListPath string `env:"DEVICE_PROCESS_LIST_PATH"`
+	// Comma-separated PIDs that DELETE /device/process/{pid} may terminate
+	ProcessKillAllowedPIDs string `env:"PROCESS_KILL_ALLOWED_PIDS"`
+	// Retries of transient device failures, backing off from the base delay
+	RetryMax       int           `env:"HTTP_RETRY_MAX"`
+	RetryBaseDelay time.Duration `env:"HTTP_RETRY_BASE_DELAY_MS"`
+	// Comma-separated device response headers passed on to clients
+	UpstreamAllowedHeaders string `env:"UPSTREAM_ALLOWED_RESPONSE_HEADERS"`
+	// Connection pool of the device HTTP client. The header timeout does not
+	// apply to inference and firmware upgrade requests (slowDevicePaths).
+	HTTPMaxIdle        int           `env:"HTTP_MAX_IDLE_CONNS"`
+	HTTPMaxIdlePerHost int           `env:"HTTP_MAX_IDLE_CONNS_PER_HOST"`
+	HTTPIdleTimeout    time.Duration `env:"HTTP_IDLE_CONN_TIMEOUT_S"`
+	HTTPHeaderTimeout  time.Duration `env:"HTTP_RESPONSE_HEADER_TIMEOUT_S"`
+	// JSON map of POST /device/exec command IDs to device API paths
+	ExecMapFile string `env:"DEVICE_EXEC_MAP_FILE"`
+	// Per-endpoint circuit breakers; each defaults to CircuitThreshold and
+	// CircuitReset
+	CircuitTelemetry      int           `env:"CIRCUIT_BREAKER_TELEMETRY_THRESHOLD,CIRCUIT_OPEN_THRESHOLD"`
+	CircuitTelemetryReset time.Duration `env:"CIRCUIT_BREAKER_TELEMETRY_TIMEOUT_S,CIRCUIT_RESET_INTERVAL_S"`
+	CircuitControl        int           `env:"CIRCUIT_BREAKER_CONTROL_THRESHOLD,CIRCUIT_OPEN_THRESHOLD"`
+	CircuitControlReset   time.Duration `env:"CIRCUIT_BREAKER_CONTROL_TIMEOUT_S,CIRCUIT_RESET_INTERVAL_S"`
+	CircuitOTA            int           `env:"CIRCUIT_BREAKER_OTA_THRESHOLD,CIRCUIT_OPEN_THRESHOLD"`
+	CircuitOTAReset       time.Duration `env:"CIRCUIT_BREAKER_OTA_TIMEOUT_S,CIRCUIT_RESET_INTERVAL_S"`
+	CircuitInfer          int           `env:"CIRCUIT_BREAKER_INFER_THRESHOLD,CIRCUIT_OPEN_THRESHOLD"`
+	CircuitInferReset     time.Duration `env:"CIRCUIT_BREAKER_INFER_TIMEOUT_S,CIRCUIT_RESET_INTERVAL_S"`
 }
 
 func loadConfig() *Config {
+	circuitThreshold := getEnvInt("CIRCUIT_OPEN_THRESHOLD", 5)
+	circuitReset := getEnvInt("CIRCUIT_RESET_INTERVAL_S", 30)
 	return &Config{
-		ShifuIP:        getEnv("SHIFU_IP", "127.0.0.1"),
-		ShifuPort:      getEnv("SHIFU_PORT", "8080"),
-		ShifuAPIBase:   getEnv("SHIFU_API_BASE", ""),
-		ServerHost:     getEnv("SERVER_HOST", "0.0.0.0"),
-		ServerPort:     getEnv("SERVER_PORT", "8081"),
-		CameraSnapshot: getEnv("CAMERA_SNAPSHOT_PATH", "/api/v1/camera/snapshot"),
+		ShifuIP:         getEnv("SHIFU_IP", "127.0.0.1"),
+		ShifuPort:       getEnv("SHIFU_PORT", "8080"),
+		ShifuAPIBase:    getEnv("SHIFU_API_BASE", ""),
+		ServerHost:      getEnv("SERVER_HOST", "0.0.0.0"),
+		ServerPort:      getEnv("SERVER_PORT", "8081"),
+		CameraSnapshot:  getEnv("CAMERA_SNAPSHOT_PATH", "/api/v1/camera/snapshot"),
+		CameraPTZ:       getEnv("CAMERA_PTZ_PATH", "/api/v1/camera/ptz"),
+		DeviceHostname:  getEnv("DEVICE_HOSTNAME", ""),
+		HostnameRefresh: time.Duration(getEnvInt("DEVICE_HOSTNAME_REFRESH_S", 30)) * time.Second,
+		// A device is stale after three missed heartbeats unless configured otherwise
+		HeartbeatInterval:      time.Duration(getEnvInt("HEARTBEAT_INTERVAL_S", 30)) * time.Second,
+		HeartbeatStale:         time.Duration(getEnvInt("HEARTBEAT_STALE_THRESHOLD_S", 3*getEnvInt("HEARTBEAT_INTERVAL_S", 30))) * time.Second,
+		HeartbeatWebhook:       getEnv("HEARTBEAT_WEBHOOK_URL", ""),
+		Discovery:              getEnv("SHIFU_IP", "") == "" && getEnv("SHIFU_API_BASE", "") == "" && getEnv("DEVICE_HOSTNAME", "") == "",
+		MDNSServiceType:        getEnv("MDNS_SERVICE_TYPE", "_shifu._tcp"),
+		DiscoveryRefresh:       time.Duration(getEnvInt("MDNS_REFRESH_S", 60)) * time.Second,
+		RegistryFile:           getEnv("DEVICE_REGISTRY_FILE", ""),
+		ReadyzStaleTolerance:   time.Duration(getEnvInt("READYZ_STALE_TOLERANCE_S", 0)) * time.Second,
+		ReachabilityMaxTimeout: time.Duration(getEnvInt("REACHABILITY_MAX_TIMEOUT_MS", 5000)) * time.Millisecond,
+		UpstreamMaxBody:        int64(getEnvInt("UPSTREAM_MAX_RESPONSE_BODY_MB", 10)) << 20,
+		ResponseHash:           getEnv("RESPONSE_HASH_HEADER", "false") == "true",
+		TLSCertFile:            getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:             getEnv("TLS_KEY_FILE", ""),
+		TLSMinVersion:          getEnv("TLS_MIN_VERSION", "TLS12"),
+		TLSMaxVersion:          getEnv("TLS_MAX_VERSION", ""),
+		TLSCipherSuites:        getEnv("TLS_CIPHER_SUITES", ""),
+		InferSampleRate:        getEnvFloat("INFER_SAMPLE_RATE", 1.0),
+		InferServeCached:       getEnv("INFER_SAMPLE_SERVE_CACHED", "false") == "true",
+		MockMode:               getEnv("DEVICE_MOCK_MODE", "false") == "true",
+		MockResponsesFile:      getEnv("MOCK_RESPONSES_FILE", ""),
+		MockLatency:            time.Duration(getEnvInt("MOCK_LATENCY_MS", 0)) * time.Millisecond,
+		MockErrorRate:          getEnvFloat("MOCK_ERROR_RATE", 0),
+		SnapshotInterval:       time.Duration(getEnvInt("CAMERA_SNAPSHOT_INTERVAL_S", 0)) * time.Second,
+		SnapshotDir:            getEnv("CAMERA_SNAPSHOT_DIR", "/var/shifu/snapshots"),
+		SnapshotMaxFiles:       getEnvInt("CAMERA_SNAPSHOT_MAX_FILES", 100),
+		SnapshotAnalyze:        getEnv("CAMERA_ANALYZE_ON_SNAPSHOT", "false") == "true",
+		InferJobHistory:        getEnvInt("INFER_JOB_HISTORY_MAX", 50),
+		InferWorkers:           getEnvInt("INFER_ASYNC_WORKERS", 4),
+		DeviceMAC:              getEnv("DEVICE_MAC_ADDRESS", ""),
+		AdminToken:             getEnv("ADMIN_TOKEN", ""),
+		TrustedProxies:         getEnv("TRUSTED_PROXIES", ""),
+		InferCacheTTL:          time.Duration(getEnvInt("INFER_CACHE_TTL_S", 30)) * time.Second,
+		InferCacheMax:          getEnvInt("INFER_CACHE_MAX_ENTRIES", 256),
+		CircuitThreshold:       circuitThreshold,
+		CircuitReset:           time.Duration(circuitReset) * time.Second,
+		ProcessListPath:        getEnv("DEVICE_PROCESS_LIST_PATH", "/api/v1/processes"),
+		ProcessKillAllowedPIDs: getEnv("PROCESS_KILL_ALLOWED_PIDS", ""),
+		RetryMax:               getEnvInt("HTTP_RETRY_MAX", 3),
+		RetryBaseDelay:         time.Duration(getEnvInt("HTTP_RETRY_BASE_DELAY_MS", 100)) * time.Millisecond,
+		UpstreamAllowedHeaders: getEnv("UPSTREAM_ALLOWED_RESPONSE_HEADERS", "Content-Type,Content-Length,Last-Modified,ETag"),
+		HTTPMaxIdle:            getEnvInt("HTTP_MAX_IDLE_CONNS", 100),
+		HTTPMaxIdlePerHost:     getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 10),
+		HTTPIdleTimeout:        time.Duration(getEnvInt("HTTP_IDLE_CONN_TIMEOUT_S", 90)) * time.Second,
+		HTTPHeaderTimeout:      time.Duration(getEnvInt("HTTP_RESPONSE_HEADER_TIMEOUT_S", 10)) * time.Second,
+		ExecMapFile:            getEnv("DEVICE_EXEC_MAP_FILE", ""),
+		CircuitTelemetry:       getEnvInt("CIRCUIT_BREAKER_TELEMETRY_THRESHOLD", circuitThreshold),
+		CircuitTelemetryReset:  time.Duration(getEnvInt("CIRCUIT_BREAKER_TELEMETRY_TIMEOUT_S", circuitReset)) * time.Second,
+		CircuitControl:         getEnvInt("CIRCUIT_BREAKER_CONTROL_THRESHOLD", circuitThreshold),
+		CircuitControlReset:    time.Duration(getEnvInt("CIRCUIT_BREAKER_CONTROL_TIMEOUT_S", circuitReset)) * time.Second,
+		CircuitOTA:             getEnvInt("CIRCUIT_BREAKER_OTA_THRESHOLD", circuitThreshold),
+		CircuitOTAReset:        time.Duration(getEnvInt("CIRCUIT_BREAKER_OTA_TIMEOUT_S", circuitReset)) * time.Second,
+		CircuitInfer:           getEnvInt("CIRCUIT_BREAKER_INFER_THRESHOLD", circuitThreshold),
+		CircuitInferReset:      time.Duration(getEnvInt("CIRCUIT_BREAKER_INFER_TIMEOUT_S", circuitReset)) * time.Second,
 	}
 }
 
+// Configuration sources other than the environment, keyed by environment
+// variable name and ordered by precedence: the ConfigMap, then CONFIG_FILE.
+// The environment always wins over both.
+var (
+	configMu      sync.RWMutex
+	configMapVals = map[string]string{}
+	fileConfig    = map[string]string{}
+)
+
 func getEnv(key, fallback string) string {
 	val := os.Getenv(key)
+	if val == "" {
+		configMu.RLock()
+		val = configMapVals[key]
+		if val == "" {
+			val = fileConfig[key]
+		}
+		configMu.RUnlock()
+	}
 	if val == "" {
 		return fallback
 	}
 	return val
 }
 
-// Helper to build the Shifu device API URL
-func (c *Config) deviceURL(path string) string {
-	base := c.ShifuAPIBase
-	if base == "" {
-		base = fmt.Sprintf("http://%s:%s", c.ShifuIP, c.ShifuPort)
+func getEnvInt(key string, fallback int) int {
+	if val := getEnv(key, ""); val != "" {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+		log.Printf("Invalid value for %s: %q, using %d", key, val, fallback)
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if val := getEnv(key, ""); val != "" {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+		log.Printf("Invalid value for %s: %q, using %v", key, val, fallback)
+	}
+	return fallback
+}
+
+// configKeys maps CONFIG_FILE keys to the environment variables they set.
+var configKeys = map[string]string{
+	"device.ip":                          "SHIFU_IP",
+	"device.port":                        "SHIFU_PORT",
+	"device.api_base":                    "SHIFU_API_BASE",
+	"device.camera_snapshot_path":        "CAMERA_SNAPSHOT_PATH",
+	"device.camera_ptz_path":             "CAMERA_PTZ_PATH",
+	"camera.snapshot_interval_s":         "CAMERA_SNAPSHOT_INTERVAL_S",
+	"camera.snapshot_dir":                "CAMERA_SNAPSHOT_DIR",
+	"camera.snapshot_max_files":          "CAMERA_SNAPSHOT_MAX_FILES",
+	"camera.analyze_on_snapshot":         "CAMERA_ANALYZE_ON_SNAPSHOT",
+	"device.hostname":                    "DEVICE_HOSTNAME",
+	"device.hostname_refresh_s":          "DEVICE_HOSTNAME_REFRESH_S",
+	"http.host":                          "SERVER_HOST",
+	"http.port":                          "SERVER_PORT",
+	"heartbeat.interval_s":               "HEARTBEAT_INTERVAL_S",
+	"heartbeat.stale_threshold_s":        "HEARTBEAT_STALE_THRESHOLD_S",
+	"heartbeat.webhook_url":              "HEARTBEAT_WEBHOOK_URL",
+	"discovery.service_type":             "MDNS_SERVICE_TYPE",
+	"discovery.refresh_s":                "MDNS_REFRESH_S",
+	"discovery.registry_file":            "DEVICE_REGISTRY_FILE",
+	"device.reachability_max_timeout_ms": "REACHABILITY_MAX_TIMEOUT_MS",
+	"http.readyz_stale_tolerance_s":      "READYZ_STALE_TOLERANCE_S",
+	"device.max_response_body_mb":        "UPSTREAM_MAX_RESPONSE_BODY_MB",
+	"device.mac_address":                 "DEVICE_MAC_ADDRESS",
+	"device.circuit_open_threshold":      "CIRCUIT_OPEN_THRESHOLD",
+	"device.circuit_reset_interval_s":    "CIRCUIT_RESET_INTERVAL_S",
+	"device.circuit_telemetry_threshold": "CIRCUIT_BREAKER_TELEMETRY_THRESHOLD",
+	"device.circuit_telemetry_timeout_s": "CIRCUIT_BREAKER_TELEMETRY_TIMEOUT_S",
+	"device.circuit_control_threshold":   "CIRCUIT_BREAKER_CONTROL_THRESHOLD",
+	"device.circuit_control_timeout_s":   "CIRCUIT_BREAKER_CONTROL_TIMEOUT_S",
+	"device.circuit_ota_threshold":       "CIRCUIT_BREAKER_OTA_THRESHOLD",
+	"device.circuit_ota_timeout_s":       "CIRCUIT_BREAKER_OTA_TIMEOUT_S",
+	"device.circuit_infer_threshold":     "CIRCUIT_BREAKER_INFER_THRESHOLD",
+	"device.circuit_infer_timeout_s":     "CIRCUIT_BREAKER_INFER_TIMEOUT_S",
+	"device.process_list_path":           "DEVICE_PROCESS_LIST_PATH",
+	"device.process_kill_allowed_pids":   "PROCESS_KILL_ALLOWED_PIDS",
+	"device.http_retry_max":              "HTTP_RETRY_MAX",
+	"device.http_retry_base_delay_ms":    "HTTP_RETRY_BASE_DELAY_MS",
+	"http.upstream_allowed_headers":      "UPSTREAM_ALLOWED_RESPONSE_HEADERS",
+	"http.client.max_idle_conns":         "HTTP_MAX_IDLE_CONNS",
+	"http.client.max_idle_per_host":      "HTTP_MAX_IDLE_CONNS_PER_HOST",
+	"http.client.idle_timeout_s":         "HTTP_IDLE_CONN_TIMEOUT_S",
+	"http.client.header_timeout_s":       "HTTP_RESPONSE_HEADER_TIMEOUT_S",
+	"device.exec_map_file":               "DEVICE_EXEC_MAP_FILE",
+	"http.response_hash_header":          "RESPONSE_HASH_HEADER",
+	"http.admin_token":                   "ADMIN_TOKEN",
+	"http.trusted_proxies":               "TRUSTED_PROXIES",
+	"http.tls.cert_file":                 "TLS_CERT_FILE",
+	"http.tls.key_file":                  "TLS_KEY_FILE",
+	"http.tls.min_version":               "TLS_MIN_VERSION",
+	"http.tls.max_version":               "TLS_MAX_VERSION",
+	"http.tls.cipher_suites":             "TLS_CIPHER_SUITES",
+	"infer.sample_rate":                  "INFER_SAMPLE_RATE",
+	"infer.serve_cached":                 "INFER_SAMPLE_SERVE_CACHED",
+	"infer.job_history_max":              "INFER_JOB_HISTORY_MAX",
+	"infer.async_workers":                "INFER_ASYNC_WORKERS",
+	"infer.cache_ttl_s":                  "INFER_CACHE_TTL_S",
+	"infer.cache_max_entries":            "INFER_CACHE_MAX_ENTRIES",
+	"mock.enabled":                       "DEVICE_MOCK_MODE",
+	"mock.responses_file":                "MOCK_RESPONSES_FILE",
+	"mock.latency_ms":                    "MOCK_LATENCY_MS",
+	"mock.error_rate":                    "MOCK_ERROR_RATE",
+}
+
+// configValue is a scalar from the config file and the line it came from.
+type configValue struct {
+	Value string
+	Line  int
+}
+
+// loadConfigSources refreshes the ConfigMap and CONFIG_FILE values and builds
+// the Config from them and the environment.
+func loadConfigSources() (*Config, error) {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+	}
+	name, namespace := os.Getenv("CONFIGMAP_NAME"), os.Getenv("CONFIGMAP_NAMESPACE")
+	if name != "" && namespace != "" {
+		k, err := inClusterClient()
+		if err != nil {
+			log.Printf("Not running in a cluster (%v), using environment variables only", err)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			data, err := k.ConfigMap(ctx, namespace, name)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("configmap %s/%s: %w", namespace, name, err)
+			}
+			configMu.Lock()
+			configMapVals = data
+			configMu.Unlock()
+		}
+	}
+	return loadConfig(), nil
+}
+
+// kubeClient reads ConfigMaps from the Kubernetes API with the pod's service
+// account.
+type kubeClient struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// inClusterClient builds a kubeClient from the service account mounted into
+// the pod, failing when the driver is not running in a cluster.
+func inClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST/PORT not set")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account ca.crt")
+	}
+	return &kubeClient{
+		BaseURL: "https://" + net.JoinHostPort(host, port),
+		Token:   strings.TrimSpace(string(token)),
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// ConfigMap returns the data of a ConfigMap. Its keys are environment
+// variable names.
+func (k *kubeClient) ConfigMap(ctx context.Context, namespace, name string) (map[string]string, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps/%s", k.BaseURL, url.PathEscape(namespace), url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.Token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("kubernetes API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return nil, err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	return cm.Data, nil
+}
+
+// loadConfigFile reads a YAML or JSON config file into fileConfig. Only
+// nested maps of scalars are supported, which is all the config needs.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]configValue
+	if strings.HasSuffix(path, ".json") || strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		values, err = parseJSONConfig(data)
+	} else {
+		values, err = parseYAMLConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	parsed := map[string]string{}
+	for key, v := range values {
+		env, ok := configKeys[key]
+		if !ok {
+			return fmt.Errorf("%s line %d: unknown key %q", path, v.Line, key)
+		}
+		if strings.HasSuffix(env, "_S") || strings.HasSuffix(env, "_MS") {
+			if _, err := strconv.Atoi(v.Value); err != nil {
+				return fmt.Errorf("%s line %d: key %q must be an integer, got %q", path, v.Line, key, v.Value)
+			}
+		}
+		parsed[env] = v.Value
+	}
+	configMu.Lock()
+	fileConfig = parsed
+	configMu.Unlock()
+	return nil
+}
+
+func parseYAMLConfig(data []byte) (map[string]configValue, error) {
+	type section struct {
+		indent int
+		prefix string
+	}
+	values := map[string]configValue{}
+	stack := []section{{indent: -1}}
+	for i, raw := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		line := strings.TrimRight(stripYAMLComment(raw), " \r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		indent := len(line) - len(trimmed)
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		key, val, ok := strings.Cut(trimmed, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.HasPrefix(key, "-") {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		full := stack[len(stack)-1].prefix + key
+		val = strings.TrimSpace(val)
+		if val == "" {
+			stack = append(stack, section{indent: indent, prefix: full + "."})
+			continue
+		}
+		if strings.HasPrefix(val, "[") || strings.HasPrefix(val, "{") || strings.HasPrefix(val, "|") || strings.HasPrefix(val, ">") {
+			return nil, fmt.Errorf("line %d: key %q: only scalar values are supported", lineNo, full)
+		}
+		unquoted, err := unquoteYAML(val)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key %q: %v", lineNo, full, err)
+		}
+		values[full] = configValue{Value: unquoted, Line: lineNo}
+	}
+	return values, nil
+}
+
+// stripYAMLComment removes a trailing # comment that is not inside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYAML(val string) (string, error) {
+	switch {
+	case strings.HasPrefix(val, `"`):
+		return strconv.Unquote(val)
+	case strings.HasPrefix(val, "'"):
+		if len(val) < 2 || !strings.HasSuffix(val, "'") {
+			return "", fmt.Errorf("unterminated string %s", val)
+		}
+		return strings.ReplaceAll(val[1:len(val)-1], "''", "'"), nil
+	}
+	return val, nil
+}
+
+func parseJSONConfig(data []byte) (map[string]configValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, fmt.Errorf("line %d: %v", lineAt(data, int(syntaxErr.Offset)), err)
+		}
+		return nil, err
+	}
+	values := map[string]configValue{}
+	var walk func(prefix string, m map[string]interface{}) error
+	walk = func(prefix string, m map[string]interface{}) error {
+		for k, v := range m {
+			full := prefix + k
+			line := lineAt(data, bytes.Index(data, []byte(`"`+k+`"`)))
+			switch v := v.(type) {
+			case map[string]interface{}:
+				if err := walk(full+".", v); err != nil {
+					return err
+				}
+			case string:
+				values[full] = configValue{Value: v, Line: line}
+			case json.Number, bool:
+				values[full] = configValue{Value: fmt.Sprint(v), Line: line}
+			case nil:
+			default:
+				return fmt.Errorf("line %d: key %q: only scalar values are supported", line, full)
+			}
+		}
+		return nil
+	}
+	return values, walk("", doc)
+}
+
+// lineAt returns the 1-based line number of byte offset off in data.
+func lineAt(data []byte, off int) int {
+	if off < 0 {
+		return 0
+	}
+	return bytes.Count(data[:min(off, len(data))], []byte("\n")) + 1
+}
+
+// ValidateConfig checks the configuration before any listener is started and
+// reports every problem found, each as a sentence naming the setting to fix.
+func ValidateConfig(cfg *Config) error {
+	var errs []error
+	if !cfg.Discovery && cfg.ShifuAPIBase == "" && net.ParseIP(cfg.ShifuIP) == nil && !validHostname(cfg.ShifuIP) {
+		errs = append(errs, fmt.Errorf("SHIFU_IP %q is neither an IP address nor a hostname; set it to the device's address, e.g. 192.168.1.50", cfg.ShifuIP))
+	}
+	if cfg.DeviceHostname != "" && !validHostname(cfg.DeviceHostname) {
+		errs = append(errs, fmt.Errorf("DEVICE_HOSTNAME %q is not a valid hostname; set it to a DNS name such as camera-01.local", cfg.DeviceHostname))
+	}
+	if cfg.DeviceHostname != "" && cfg.HostnameRefresh <= 0 {
+		errs = append(errs, errors.New("DEVICE_HOSTNAME_REFRESH_S must be at least 1 when DEVICE_HOSTNAME is set; set it to how often to re-resolve the hostname, in seconds"))
+	}
+	for _, p := range []struct{ name, val string }{{"SHIFU_PORT", cfg.ShifuPort}, {"SERVER_PORT", cfg.ServerPort}} {
+		if n, err := strconv.Atoi(p.val); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("%s %q is not a valid port; set it to a number between 1 and 65535", p.name, p.val))
+		}
+	}
+	if cfg.ServerHost != "" && net.ParseIP(cfg.ServerHost) == nil && !validHostname(cfg.ServerHost) {
+		errs = append(errs, fmt.Errorf("SERVER_HOST %q is not a valid listen address; set it to an IP such as 0.0.0.0", cfg.ServerHost))
+	}
+	for _, u := range []struct{ name, val string }{{"SHIFU_API_BASE", cfg.ShifuAPIBase}, {"HEARTBEAT_WEBHOOK_URL", cfg.HeartbeatWebhook}} {
+		if u.val == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.val); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is not a valid URL; set it to an absolute http:// or https:// URL or leave it unset", u.name))
+		}
+	}
+	if !strings.HasPrefix(cfg.CameraSnapshot, "/") {
+		errs = append(errs, fmt.Errorf("CAMERA_SNAPSHOT_PATH %q must be a path on the device API; set it to something like /api/v1/camera/snapshot", cfg.CameraSnapshot))
+	}
+	if !strings.HasPrefix(cfg.CameraPTZ, "/") {
+		errs = append(errs, fmt.Errorf("CAMERA_PTZ_PATH %q must be a path on the device API; set it to something like /api/v1/camera/ptz", cfg.CameraPTZ))
+	}
+	if cfg.ExecMapFile != "" {
+		if _, err := os.Stat(cfg.ExecMapFile); err != nil {
+			errs = append(errs, fmt.Errorf("DEVICE_EXEC_MAP_FILE %s cannot be read (%v); point it at a JSON file mapping command IDs to device API paths or leave it unset", cfg.ExecMapFile, err))
+		}
+	}
+	if cfg.RegistryFile != "" {
+		if _, err := os.Stat(cfg.RegistryFile); err != nil {
+			errs = append(errs, fmt.Errorf("DEVICE_REGISTRY_FILE %s cannot be read (%v); point it at an existing registry file or leave it unset", cfg.RegistryFile, err))
+		}
+	}
+	if cfg.HeartbeatInterval > 0 && cfg.HeartbeatStale < cfg.HeartbeatInterval {
+		errs = append(errs, fmt.Errorf("HEARTBEAT_STALE_THRESHOLD_S (%v) is shorter than HEARTBEAT_INTERVAL_S (%v), so the device would always look stale; raise the threshold", cfg.HeartbeatStale, cfg.HeartbeatInterval))
+	}
+	if cfg.UpstreamMaxBody <= 0 {
+		errs = append(errs, errors.New("UPSTREAM_MAX_RESPONSE_BODY_MB must be at least 1; set it to the largest device response to accept, in megabytes"))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("only one of TLS_CERT_FILE and TLS_KEY_FILE is set; set both to serve HTTPS, or neither for plain HTTP"))
+	}
+	for _, f := range []struct{ name, path string }{{"TLS_CERT_FILE", cfg.TLSCertFile}, {"TLS_KEY_FILE", cfg.TLSKeyFile}} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s cannot be read (%v); point it at the PEM file mounted from the TLS secret", f.name, f.path, err))
+		}
+	}
+	if _, err := serverTLSConfig(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.InferSampleRate < 0 || cfg.InferSampleRate > 1 || math.IsNaN(cfg.InferSampleRate) {
+		errs = append(errs, fmt.Errorf("INFER_SAMPLE_RATE %v is out of range; set it between 0.0 (reject all) and 1.0 (forward all)", cfg.InferSampleRate))
+	}
+	if cfg.MockMode {
+		if cfg.MockResponsesFile == "" {
+			errs = append(errs, errors.New("DEVICE_MOCK_MODE is on but MOCK_RESPONSES_FILE is not set; point it at a JSON file mapping device paths to responses"))
+		} else if _, err := os.Stat(cfg.MockResponsesFile); err != nil {
+			errs = append(errs, fmt.Errorf("MOCK_RESPONSES_FILE %s cannot be read (%v); point it at a JSON file mapping device paths to responses", cfg.MockResponsesFile, err))
+		}
+	}
+	if cfg.SnapshotInterval < 0 {
+		errs = append(errs, errors.New("CAMERA_SNAPSHOT_INTERVAL_S must not be negative; set it to 0 to disable scheduled snapshots"))
+	}
+	if cfg.DeviceMAC != "" {
+		if _, err := parseWakeMAC(cfg.DeviceMAC); err != nil {
+			errs = append(errs, fmt.Errorf("DEVICE_MAC_ADDRESS %q is not usable (%v); set it to the device's Ethernet address like AA:BB:CC:DD:EE:FF", cfg.DeviceMAC, err))
+		}
+	}
+	if cfg.SnapshotInterval > 0 && cfg.SnapshotMaxFiles < 1 {
+		errs = append(errs, fmt.Errorf("CAMERA_SNAPSHOT_MAX_FILES %d must be at least 1 when CAMERA_SNAPSHOT_INTERVAL_S is set", cfg.SnapshotMaxFiles))
+	}
+	if cfg.ReadyzStaleTolerance < 0 {
+		errs = append(errs, errors.New("READYZ_STALE_TOLERANCE_S must not be negative; set it to 0 to probe the device on every /readyz"))
+	}
+	if cfg.MockErrorRate < 0 || cfg.MockErrorRate > 1 || math.IsNaN(cfg.MockErrorRate) {
+		errs = append(errs, fmt.Errorf("MOCK_ERROR_RATE %v is out of range; set it between 0.0 (never fail) and 1.0 (always fail)", cfg.MockErrorRate))
+	}
+	if cfg.InferWorkers < 1 {
+		errs = append(errs, errors.New("INFER_ASYNC_WORKERS must be at least 1; set it to how many /infer/async jobs may run at once"))
+	}
+	if !strings.HasPrefix(cfg.ProcessListPath, "/") {
+		errs = append(errs, fmt.Errorf("DEVICE_PROCESS_LIST_PATH %q must be a path on the device API; set it to something like /api/v1/processes", cfg.ProcessListPath))
+	}
+	if _, err := parsePIDList(cfg.ProcessKillAllowedPIDs); err != nil {
+		errs = append(errs, fmt.Errorf("PROCESS_KILL_ALLOWED_PIDS is invalid (%v); set it to a comma-separated list of process IDs, e.g. 1201,1202", err))
+	}
+	if _, err := parseProxyList(cfg.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("TRUSTED_PROXIES is invalid (%v); set it to a comma-separated list of proxy addresses or CIDRs, e.g. 10.0.0.1,10.1.0.0/16", err))
+	}
+	for _, n := range []struct {
+		name string
+		val  int64
+	}{
+		{"HTTP_MAX_IDLE_CONNS", int64(cfg.HTTPMaxIdle)},
+		{"HTTP_MAX_IDLE_CONNS_PER_HOST", int64(cfg.HTTPMaxIdlePerHost)},
+		{"HTTP_IDLE_CONN_TIMEOUT_S", int64(cfg.HTTPIdleTimeout)},
+		{"HTTP_RESPONSE_HEADER_TIMEOUT_S", int64(cfg.HTTPHeaderTimeout)},
+	} {
+		if n.val < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative; set it to 0 for no limit", n.name))
+		}
+	}
+	if cfg.RetryMax < 0 {
+		errs = append(errs, errors.New("HTTP_RETRY_MAX must not be negative; set it to 0 to disable retries"))
+	}
+	if cfg.RetryBaseDelay < 0 {
+		errs = append(errs, errors.New("HTTP_RETRY_BASE_DELAY_MS must not be negative"))
+	}
+	if cfg.CircuitThreshold < 0 {
+		errs = append(errs, errors.New("CIRCUIT_OPEN_THRESHOLD must not be negative; set it to 0 to disable the circuit breaker"))
+	}
+	if cfg.CircuitThreshold > 0 && cfg.CircuitReset <= 0 {
+		errs = append(errs, errors.New("CIRCUIT_RESET_INTERVAL_S must be at least 1 when CIRCUIT_OPEN_THRESHOLD is set; set it to how long to wait before probing a failed device"))
+	}
+	for _, c := range []struct {
+		name      string
+		threshold int
+		reset     time.Duration
+	}{
+		{"TELEMETRY", cfg.CircuitTelemetry, cfg.CircuitTelemetryReset},
+		{"CONTROL", cfg.CircuitControl, cfg.CircuitControlReset},
+		{"OTA", cfg.CircuitOTA, cfg.CircuitOTAReset},
+		{"INFER", cfg.CircuitInfer, cfg.CircuitInferReset},
+	} {
+		if c.threshold < 0 {
+			errs = append(errs, fmt.Errorf("CIRCUIT_BREAKER_%s_THRESHOLD must not be negative; set it to 0 to disable that circuit breaker", c.name))
+		}
+		if c.threshold > 0 && c.reset <= 0 {
+			errs = append(errs, fmt.Errorf("CIRCUIT_BREAKER_%s_TIMEOUT_S must be at least 1 when CIRCUIT_BREAKER_%s_THRESHOLD is set; set it to how long to wait before probing the endpoint", c.name, c.name))
+		}
+	}
+	if cfg.InferCacheTTL < 0 {
+		errs = append(errs, errors.New("INFER_CACHE_TTL_S must not be negative; set it to 0 to disable the inference cache"))
+	}
+	if cfg.InferCacheTTL > 0 && cfg.InferCacheMax < 1 {
+		errs = append(errs, fmt.Errorf("INFER_CACHE_MAX_ENTRIES %d must be at least 1 while the inference cache is enabled; set it to how many responses to keep, or INFER_CACHE_TTL_S=0 to disable the cache", cfg.InferCacheMax))
+	}
+	if cfg.MockLatency < 0 {
+		errs = append(errs, errors.New("MOCK_LATENCY_MS must not be negative"))
+	}
+	if cfg.Discovery && cfg.DiscoveryRefresh > 0 && cfg.MDNSServiceType == "" {
+		errs = append(errs, errors.New("MDNS_SERVICE_TYPE is empty; set it to the service to browse for, e.g. _shifu._tcp"))
+	}
+	return errors.Join(errs...)
+}
+
+// tlsVersions maps TLS_MIN_VERSION/TLS_MAX_VERSION values to crypto/tls
+// constants.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// serverTLSConfig builds the HTTPS server's tls.Config from TLS_MIN_VERSION,
+// TLS_MAX_VERSION and TLS_CIPHER_SUITES. Cipher suites use the names from
+// Go's crypto/tls (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); TLS 1.3
+// suites are fixed by Go and cannot be restricted.
+func serverTLSConfig(cfg *Config) (*tls.Config, error) {
+	tc := &tls.Config{}
+	if cfg.TLSMinVersion != "" {
+		v, ok := tlsVersions[strings.ToUpper(cfg.TLSMinVersion)]
+		if !ok {
+			return nil, fmt.Errorf("TLS_MIN_VERSION %q is not a TLS version; set it to one of TLS10, TLS11, TLS12 or TLS13", cfg.TLSMinVersion)
+		}
+		tc.MinVersion = v
+	}
+	if cfg.TLSMaxVersion != "" {
+		v, ok := tlsVersions[strings.ToUpper(cfg.TLSMaxVersion)]
+		if !ok {
+			return nil, fmt.Errorf("TLS_MAX_VERSION %q is not a TLS version; set it to one of TLS10, TLS11, TLS12 or TLS13", cfg.TLSMaxVersion)
+		}
+		tc.MaxVersion = v
+	}
+	if tc.MaxVersion != 0 && tc.MaxVersion < tc.MinVersion {
+		return nil, fmt.Errorf("TLS_MAX_VERSION %s is lower than TLS_MIN_VERSION %s; raise the maximum or lower the minimum", cfg.TLSMaxVersion, cfg.TLSMinVersion)
+	}
+	if cfg.TLSCipherSuites == "" {
+		return tc, nil
+	}
+	known := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	var unknown []string
+	for _, name := range strings.Split(cfg.TLSCipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("TLS_CIPHER_SUITES contains unknown cipher suite(s) %s; use names from Go's crypto/tls such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", strings.Join(unknown, ", "))
+	}
+	return tc, nil
+}
+
+// validHostname reports whether name is a syntactically valid DNS hostname.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// redactedValue replaces the value of secret settings in logs and GET /config.
+const redactedValue = "***"
+
+// Redacted renders the configuration for logging, hiding fields tagged
+// secret:"true".
+func (c *Config) Redacted() string {
+	v := reflect.ValueOf(c).Elem()
+	parts := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		val := fmt.Sprint(v.Field(i).Interface())
+		if field.Tag.Get("secret") == "true" && val != "" {
+			val = redactedValue
+		}
+		parts = append(parts, field.Name+"="+val)
+	}
+	return strings.Join(parts, " ")
+}
+
+// DeviceAPI is the device as seen by the HTTP handlers. DeviceClient talks
+// to a real device; MockDeviceClient answers from MOCK_RESPONSES_FILE.
+type DeviceAPI interface {
+	Config() *Config
+	SetConfig(cfg *Config)
+	Host() string
+	SetHost(host string)
+	URL(path string) string
+	Addr() (string, int, error)
+	Get(ctx context.Context, path string) (*http.Response, error)
+	Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error)
+	Delete(ctx context.Context, path string) (*http.Response, error)
+	Snapshot(ctx context.Context) (*http.Response, error)
+	Trace(ctx context.Context, path string) (RequestTrace, error)
+	Reachable(timeout time.Duration) (Reachability, error)
+}
+
+// DeviceClient talks to the Shifu device API. The configuration can be
+// reloaded (SIGHUP) and the device host can change at runtime (see
+// DeviceIPWatcher), so both are stored atomically and read on every request.
+type DeviceClient struct {
+	cfg    atomic.Value // *Config
+	host   atomic.Value // string
+	client *http.Client // pool settings are fixed at startup
+	slow   *http.Client // for slowDevicePaths, without the header timeout
+}
+
+// slowDevicePaths are device endpoints that may legitimately take longer
+// than HTTP_RESPONSE_HEADER_TIMEOUT_S to answer: a model run or a firmware
+// flash. Requests to them are bounded by their context instead.
+var slowDevicePaths = map[string]bool{
+	"/api/v1/infer":   true,
+	"/api/v1/upgrade": true,
+}
+
+func NewDeviceClient(cfg *Config) *DeviceClient {
+	d := &DeviceClient{client: newDeviceHTTPClient(cfg, cfg.HTTPHeaderTimeout), slow: newDeviceHTTPClient(cfg, 0)}
+	d.cfg.Store(cfg)
+	d.host.Store(cfg.ShifuIP)
+	return d
+}
+
+// newDeviceHTTPClient returns a client for device requests, with the
+// connection pool limited by the HTTP_* settings so a busy driver does not
+// run out of file descriptors. 0 means no limit.
+func newDeviceHTTPClient(cfg *Config, headerTimeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = cfg.HTTPMaxIdle
+	t.MaxIdleConnsPerHost = cfg.HTTPMaxIdlePerHost
+	t.IdleConnTimeout = cfg.HTTPIdleTimeout
+	t.ResponseHeaderTimeout = headerTimeout
+	return &http.Client{Transport: t}
+}
+
+// clientFor returns the client to use for a device path.
+func (d *DeviceClient) clientFor(path string) *http.Client {
+	if p, _, _ := strings.Cut(path, "?"); slowDevicePaths[p] {
+		return d.slow
+	}
+	return d.client
+}
+
+// Config returns the configuration currently in effect
+func (d *DeviceClient) Config() *Config {
+	return d.cfg.Load().(*Config)
+}
+
+// SetConfig switches to a reloaded configuration. Requests already in flight
+// finish with the configuration they started with.
+func (d *DeviceClient) SetConfig(cfg *Config) {
+	old := d.Config()
+	d.cfg.Store(cfg)
+	if cfg.ShifuIP != old.ShifuIP {
+		d.SetHost(cfg.ShifuIP)
+	}
+}
+
+// Host returns the device address currently in use
+func (d *DeviceClient) Host() string {
+	return d.host.Load().(string)
+}
+
+// SetHost switches requests to a new device address
+func (d *DeviceClient) SetHost(host string) {
+	d.host.Store(host)
+}
+
+// Helper to build the Shifu device API URL
+func (d *DeviceClient) URL(path string) string {
+	cfg := d.Config()
+	base := cfg.ShifuAPIBase
+	if base == "" {
+		base = "http://" + net.JoinHostPort(d.Host(), cfg.ShifuPort)
+	}
+	return fmt.Sprintf("%s%s", base, path)
+}
+
+// Addr returns the device's TCP host and port.
+func (d *DeviceClient) Addr() (string, int, error) {
+	cfg := d.Config()
+	if cfg.ShifuAPIBase == "" {
+		port, err := strconv.Atoi(cfg.ShifuPort)
+		return d.Host(), port, err
+	}
+	u, err := url.Parse(cfg.ShifuAPIBase)
+	if err != nil {
+		return "", 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	n, err := strconv.Atoi(port)
+	return u.Hostname(), n, err
+}
+
+// Get fetches path from the device
+func (d *DeviceClient) Get(ctx context.Context, path string) (*http.Response, error) {
+	return d.do(ctx, d.clientFor(path), http.MethodGet, path, "", nil)
+}
+
+// Post sends body to path on the device
+func (d *DeviceClient) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	return d.do(ctx, d.clientFor(path), http.MethodPost, path, contentType, body)
+}
+
+// Delete sends a DELETE for path to the device
+func (d *DeviceClient) Delete(ctx context.Context, path string) (*http.Response, error) {
+	return d.do(ctx, d.clientFor(path), http.MethodDelete, path, "", nil)
+}
+
+// Snapshot fetches a still image from CAMERA_SNAPSHOT_PATH
+func (d *DeviceClient) Snapshot(ctx context.Context) (*http.Response, error) {
+	client := &http.Client{
+		Transport: d.client.Transport,
+		Timeout:   10 * time.Second,
+	}
+	return d.do(ctx, client, http.MethodGet, d.Config().CameraSnapshot, "", nil)
+}
+
+// maxRetryDelay caps the backoff between device retries.
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns HTTP_RETRY_BASE_DELAY_MS * 2^n, capped at maxRetryDelay.
+func retryDelay(base time.Duration, n int) time.Duration {
+	delay := base
+	for i := 0; i < n && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// do sends a request to the device, retrying transient failures up to
+// HTTP_RETRY_MAX times. The delay before retry n (from 0) is retryDelay plus
+// up to one base delay of jitter; the wait ends early with ctx's error if
+// ctx is done. The request ID in ctx, if any, is forwarded as X-Request-ID.
+func (d *DeviceClient) do(ctx context.Context, client *http.Client, method, path, contentType string, body []byte) (*http.Response, error) {
+	cfg := d.Config()
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, d.URL(path), reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if id := RequestID(ctx); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		resp, err := client.Do(req)
+		if attempt >= cfg.RetryMax || ctx.Err() != nil || !retryable(method, resp, err) {
+			return d.limitBody(path, resp, err)
+		}
+		cause := fmt.Sprint(err)
+		if err == nil {
+			cause = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		delay := retryDelay(cfg.RetryBaseDelay, attempt)
+		if cfg.RetryBaseDelay > 0 {
+			delay += rand.N(cfg.RetryBaseDelay)
+		}
+		logf(ctx, "WARNING: device %s %s failed (%s), retry %d/%d in %v", method, path, cause, attempt+1, cfg.RetryMax, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a device request may be sent again. A refused
+// connection never reached the device, so any method is retried. Timeouts
+// and gateway errors (502, 503, 504) are only retried for GET and DELETE:
+// a POST such as a control command may already have run on the device.
+// Other replies, including every 4xx, are final.
+func retryable(method string, resp *http.Response, err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	if method == http.MethodPost {
+		return false
+	}
+	var netErr net.Error
+	if err != nil {
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ResponseTooLargeError is returned when a device response body is larger
+// than UPSTREAM_MAX_RESPONSE_BODY_MB.
+type ResponseTooLargeError struct {
+	Endpoint string
+	Limit    int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("device response from %s exceeds %d bytes", e.Endpoint, e.Limit)
+}
+
+// upstreamTruncated counts oversized device responses by endpoint for
+// upstream_response_truncated_total.
+var upstreamTruncated = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: map[string]uint64{}}
+
+// limitBody reads at most the configured limit of resp's body so a
+// malfunctioning device cannot make the driver buffer or relay gigabytes.
+// An oversized response is dropped along with its connection and reported
+// as a *ResponseTooLargeError.
+func (d *DeviceClient) limitBody(endpoint string, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	limit := d.Config().UpstreamMaxBody
+	var data []byte
+	if resp.ContentLength <= limit {
+		data, err = io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	}
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > limit || int64(len(data)) > limit {
+		upstreamTruncated.Lock()
+		upstreamTruncated.counts[endpoint]++
+		upstreamTruncated.Unlock()
+		logf(resp.Request.Context(), "Device response from %s exceeded %d bytes, dropped", endpoint, limit)
+		return nil, &ResponseTooLargeError{Endpoint: endpoint, Limit: limit}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// Device endpoints with their own circuit. Requests to any other path share
+// the device circuit.
+const (
+	EndpointDevice    = "device"
+	EndpointTelemetry = "telemetry"
+	EndpointControl   = "control"
+	EndpointOTA       = "ota"
+	EndpointInfer     = "infer"
+)
+
+// circuitEndpoints maps device API paths to the endpoint whose circuit
+// guards them.
+var circuitEndpoints = map[string]string{
+	"/api/v1/status":  EndpointTelemetry,
+	"/api/v1/metrics": EndpointTelemetry,
+	"/api/v1/control": EndpointControl,
+	"/api/v1/upgrade": EndpointOTA,
+	"/api/v1/infer":   EndpointInfer,
+}
+
+// circuitEndpoint returns the endpoint whose circuit guards path.
+func circuitEndpoint(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	if endpoint, ok := circuitEndpoints[path]; ok {
+		return endpoint
+	}
+	return EndpointDevice
+}
+
+// circuitSettings returns the failure threshold and reset interval of an
+// endpoint's circuit.
+func (c *Config) circuitSettings(endpoint string) (int, time.Duration) {
+	switch endpoint {
+	case EndpointTelemetry:
+		return c.CircuitTelemetry, c.CircuitTelemetryReset
+	case EndpointControl:
+		return c.CircuitControl, c.CircuitControlReset
+	case EndpointOTA:
+		return c.CircuitOTA, c.CircuitOTAReset
+	case EndpointInfer:
+		return c.CircuitInfer, c.CircuitInferReset
+	}
+	return c.CircuitThreshold, c.CircuitReset
+}
+
+// ErrCircuitOpen is returned without contacting the device while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("device circuit breaker is open")
+
+// CircuitBreaker wraps a DeviceAPI so a device that is down fails requests
+// immediately instead of after the full HTTP timeout. Telemetry, control,
+// OTA and inference requests each have their own circuit, so an overloaded
+// inference endpoint can't block telemetry polling; everything else shares
+// the device circuit.
+//
+// A circuit opens after its threshold of consecutive failures (transport
+// errors or 5xx replies). After its reset interval it turns half-open and
+// lets one request through as a probe: success closes it, failure opens it
+// again.
+type CircuitBreaker struct {
+	DeviceAPI
+	Now func() time.Time // defaults to time.Now
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// circuit is the state of one endpoint's breaker.
+type circuit struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(dev DeviceAPI) *CircuitBreaker {
+	b := &CircuitBreaker{DeviceAPI: dev, circuits: map[string]*circuit{}}
+	for _, endpoint := range []string{EndpointDevice, EndpointTelemetry, EndpointControl, EndpointOTA, EndpointInfer} {
+		b.circuits[endpoint] = &circuit{state: CircuitClosed}
+	}
+	return b
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// State returns the state of an endpoint's circuit, moving it to half-open
+// if the reset interval has passed.
+func (b *CircuitBreaker) State(endpoint string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(endpoint)
+	return b.circuits[endpoint].state
+}
+
+// States returns the state of every circuit by endpoint.
+func (b *CircuitBreaker) States() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make(map[string]string, len(b.circuits))
+	for endpoint, c := range b.circuits {
+		b.expire(endpoint)
+		states[endpoint] = c.state
+	}
+	return states
+}
+
+// expire moves an open circuit to half-open once its reset interval has
+// passed. b.mu must be held.
+func (b *CircuitBreaker) expire(endpoint string) {
+	_, reset := b.Config().circuitSettings(endpoint)
+	c := b.circuits[endpoint]
+	if c.state == CircuitOpen && b.now().Sub(c.openedAt) >= reset {
+		b.setState(endpoint, CircuitHalfOpen)
+	}
+}
+
+// setState switches a circuit's state and logs the transition. b.mu must be
+// held.
+func (b *CircuitBreaker) setState(endpoint, state string) {
+	c := b.circuits[endpoint]
+	if state == c.state {
+		return
+	}
+	log.Printf("Device circuit breaker (%s) %s -> %s", endpoint, c.state, state)
+	c.state = state
+}
+
+// SetHost points the device at a new address and closes its circuits: the
+// failures that opened them were against the old address.
+func (b *CircuitBreaker) SetHost(host string) {
+	b.DeviceAPI.SetHost(host)
+	b.reset()
+}
+
+// SetConfig applies a reloaded configuration, closing the circuits if it
+// moves the device to another address.
+func (b *CircuitBreaker) SetConfig(cfg *Config) {
+	old := b.Config()
+	b.DeviceAPI.SetConfig(cfg)
+	if cfg.ShifuIP != old.ShifuIP || cfg.ShifuAPIBase != old.ShifuAPIBase {
+		b.reset()
+	}
+}
+
+// reset closes every circuit and clears its failure count.
+func (b *CircuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for endpoint, c := range b.circuits {
+		b.setState(endpoint, CircuitClosed)
+		c.failures, c.probing = 0, false
+	}
+}
+
+// allow reports whether a request to path may go to the device, returning
+// the endpoint it counts against. In half-open state only the single probe
+// request is allowed.
+func (b *CircuitBreaker) allow(path string) (string, error) {
+	endpoint := circuitEndpoint(path)
+	if threshold, _ := b.Config().circuitSettings(endpoint); threshold <= 0 {
+		return endpoint, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(endpoint)
+	c := b.circuits[endpoint]
+	switch c.state {
+	case CircuitOpen:
+		return endpoint, fmt.Errorf("%w for %s requests", ErrCircuitOpen, endpoint)
+	case CircuitHalfOpen:
+		if c.probing {
+			return endpoint, fmt.Errorf("%w for %s requests", ErrCircuitOpen, endpoint)
+		}
+		c.probing = true
+	}
+	return endpoint, nil
+}
+
+// done records the outcome of a request that allow let through.
+func (b *CircuitBreaker) done(endpoint string, resp *http.Response, err error) (*http.Response, error) {
+	// An oversized reply or a client that went away says nothing about the
+	// device's health
+	var tooLarge *ResponseTooLargeError
+	failed := (err != nil && !errors.As(err, &tooLarge) && !errors.Is(err, context.Canceled)) || (resp != nil && resp.StatusCode >= 500)
+	threshold, _ := b.Config().circuitSettings(endpoint)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[endpoint]
+	c.probing = false
+	if !failed {
+		c.failures = 0
+		b.setState(endpoint, CircuitClosed)
+		return resp, err
+	}
+	c.failures++
+	if threshold > 0 && (c.state == CircuitHalfOpen || c.failures >= threshold) {
+		c.openedAt = b.now()
+		b.setState(endpoint, CircuitOpen)
+	}
+	return resp, err
+}
+
+// Get fetches path from the device unless its circuit is open
+func (b *CircuitBreaker) Get(ctx context.Context, path string) (*http.Response, error) {
+	endpoint, err := b.allow(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.DeviceAPI.Get(ctx, path)
+	return b.done(endpoint, resp, err)
+}
+
+// Post sends body to path on the device unless its circuit is open
+func (b *CircuitBreaker) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	endpoint, err := b.allow(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.DeviceAPI.Post(ctx, path, contentType, body)
+	return b.done(endpoint, resp, err)
+}
+
+// Delete sends a DELETE for path unless its circuit is open
+func (b *CircuitBreaker) Delete(ctx context.Context, path string) (*http.Response, error) {
+	endpoint, err := b.allow(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.DeviceAPI.Delete(ctx, path)
+	return b.done(endpoint, resp, err)
+}
+
+// Snapshot fetches a still image unless the device circuit is open
+func (b *CircuitBreaker) Snapshot(ctx context.Context) (*http.Response, error) {
+	endpoint, err := b.allow(b.Config().CameraSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.DeviceAPI.Snapshot(ctx)
+	return b.done(endpoint, resp, err)
+}
+
+// MockResponse is a canned device response from MOCK_RESPONSES_FILE. Body
+// is sent as JSON unless it is a JSON string, which is sent as is; BodyFile
+// serves a file instead (e.g. a camera snapshot). LatencyMs and ErrorRate
+// override MOCK_LATENCY_MS and MOCK_ERROR_RATE for this endpoint.
+type MockResponse struct {
+	Status    int               `json:"status,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	BodyFile  string            `json:"body_file,omitempty"`
+	LatencyMs *int              `json:"latency_ms,omitempty"`
+	ErrorRate *float64          `json:"error_rate,omitempty"`
+
+	body []byte
+}
+
+// MockDeviceClient stands in for the device when DEVICE_MOCK_MODE=true so
+// the handlers can be exercised without hardware. Responses are keyed by
+// device path, optionally prefixed with the method ("POST /api/v1/control");
+// unknown paths get a 404. Addressing comes from the embedded DeviceClient.
+type MockDeviceClient struct {
+	*DeviceClient
+	responses map[string]*MockResponse
+}
+
+// ErrMockFailure is the error returned for requests failed by the error rate.
+var ErrMockFailure = errors.New("mock device: injected failure")
+
+func NewMockDeviceClient(cfg *Config) (*MockDeviceClient, error) {
+	data, err := os.ReadFile(cfg.MockResponsesFile)
+	if err != nil {
+		return nil, err
+	}
+	var responses map[string]*MockResponse
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", cfg.MockResponsesFile, err)
+	}
+	for key, r := range responses {
+		if r == nil {
+			return nil, fmt.Errorf("%s: response for %q is null", cfg.MockResponsesFile, key)
+		}
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+		switch {
+		case r.BodyFile != "":
+			if r.body, err = os.ReadFile(r.BodyFile); err != nil {
+				return nil, fmt.Errorf("%s: response for %q: %w", cfg.MockResponsesFile, key, err)
+			}
+		case len(r.Body) > 0 && r.Body[0] == '"':
+			var text string
+			json.Unmarshal(r.Body, &text)
+			r.body = []byte(text)
+		case len(r.Body) > 0:
+			r.body = r.Body
+			if _, ok := r.Headers["Content-Type"]; !ok {
+				r.Headers = mergeHeaders(r.Headers, "Content-Type", "application/json")
+			}
+		}
+	}
+	return &MockDeviceClient{DeviceClient: NewDeviceClient(cfg), responses: responses}, nil
+}
+
+func mergeHeaders(h map[string]string, key, value string) map[string]string {
+	if h == nil {
+		h = map[string]string{}
+	}
+	h[key] = value
+	return h
+}
+
+// respond looks up the canned response, then applies latency and error rate.
+// The request ID in ctx is echoed as X-Request-ID, as a device that logs it
+// would, and the latency is cut short if ctx is done.
+func (m *MockDeviceClient) respond(ctx context.Context, method, path string) (*http.Response, error) {
+	cfg := m.Config()
+	r, ok := m.responses[method+" "+path]
+	if !ok {
+		r, ok = m.responses[path]
+	}
+	latency, errorRate := cfg.MockLatency, cfg.MockErrorRate
+	if ok && r.LatencyMs != nil {
+		latency = time.Duration(*r.LatencyMs) * time.Millisecond
+	}
+	if ok && r.ErrorRate != nil {
+		errorRate = *r.ErrorRate
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if errorRate > 0 && rand.Float64() < errorRate {
+		return nil, ErrMockFailure
+	}
+	if !ok {
+		r = &MockResponse{
+			Status:  http.StatusNotFound,
+			Headers: map[string]string{"Content-Type": "application/json"},
+			body:    []byte(fmt.Sprintf(`{"error":"no mock response for %s %s"}`, method, path)),
+		}
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+	}
+	for k, v := range r.Headers {
+		resp.Header.Set(k, v)
+	}
+	if id := RequestID(ctx); id != "" {
+		resp.Header.Set(requestIDHeader, id)
+	}
+	return resp, nil
+}
+
+func (m *MockDeviceClient) Get(ctx context.Context, path string) (*http.Response, error) {
+	return m.respond(ctx, http.MethodGet, path)
+}
+
+func (m *MockDeviceClient) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	return m.respond(ctx, http.MethodPost, path)
+}
+
+func (m *MockDeviceClient) Delete(ctx context.Context, path string) (*http.Response, error) {
+	return m.respond(ctx, http.MethodDelete, path)
+}
+
+func (m *MockDeviceClient) Snapshot(ctx context.Context) (*http.Response, error) {
+	return m.respond(ctx, http.MethodGet, m.Config().CameraSnapshot)
+}
+
+// Trace times the canned response; there are no network phases to report.
+func (m *MockDeviceClient) Trace(ctx context.Context, path string) (RequestTrace, error) {
+	result := RequestTrace{Endpoint: path, URL: m.URL(path)}
+	start := time.Now()
+	resp, err := m.respond(ctx, http.MethodGet, path)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+	}
+	result.TotalMs = millis(time.Since(start))
+	return result, nil
+}
+
+// Reachable reports the mock as reachable after MOCK_LATENCY_MS, unless
+// MOCK_ERROR_RATE fails the attempt.
+func (m *MockDeviceClient) Reachable(timeout time.Duration) (Reachability, error) {
+	host, port, err := m.Addr()
+	if err != nil {
+		return Reachability{}, err
+	}
+	result := Reachability{Host: host, Port: port}
+	cfg := m.Config()
+	latency := min(cfg.MockLatency, timeout)
+	time.Sleep(latency)
+	result.LatencyMs = millis(latency)
+	switch {
+	case cfg.MockLatency > timeout:
+		result.Error = "mock device: dial timeout"
+	case cfg.MockErrorRate > 0 && rand.Float64() < cfg.MockErrorRate:
+		result.Error = ErrMockFailure.Error()
+	default:
+		result.Reachable = true
+	}
+	return result, nil
+}
+
+// For returns a mock for another device that answers from the same canned
+// responses, so registry devices stay off the network in mock mode.
+func (m *MockDeviceClient) For(cfg *Config) DeviceAPI {
+	return &MockDeviceClient{DeviceClient: NewDeviceClient(cfg), responses: m.responses}
+}
+
+// DeviceIPWatcher re-resolves DEVICE_HOSTNAME periodically and points the
+// DeviceClient at the new address when the device's IP changes, e.g. after a
+// DHCP lease renewal.
+type DeviceIPWatcher struct {
+	Hostname string
+	Interval time.Duration
+	Client   DeviceAPI
+}
+
+// Check resolves the hostname once and re-targets the client if the address
+// changed.
+func (w *DeviceIPWatcher) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, w.Hostname)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", w.Hostname)
+	}
+	if err != nil {
+		log.Printf("Failed to resolve device hostname %s: %v", w.Hostname, err)
+		return err
+	}
+	current := w.Client.Host()
+	for _, a := range addrs {
+		if a == current {
+			return nil
+		}
+	}
+	next := addrs[0]
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			next = a
+			break
+		}
+	}
+	w.Client.SetHost(next)
+	log.Printf("Device %s changed address: %s -> %s", w.Hostname, current, next)
+	return nil
+}
+
+// DeviceInfo describes a Shifu device found through mDNS discovery.
+type DeviceInfo struct {
+	Name         string            `json:"name"`
+	Host         string            `json:"host"`
+	IP           string            `json:"ip"`
+	Port         int               `json:"port"`
+	Capabilities []string          `json:"capabilities"`
+	TXT          map[string]string `json:"txt,omitempty"`
+}
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS resource record types used by mDNS service discovery
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+// DiscoverDevices browses the local network for instances of serviceType
+// (e.g. "_shifu._tcp") and returns them once ctx is done, or after three
+// seconds if ctx has no deadline. The query is sent from an ephemeral port, so
+// responders answer by unicast (RFC 6762 section 6.7).
+func DiscoverDevices(ctx context.Context, serviceType string) ([]*DeviceInfo, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+	}
+	service := strings.ToLower(strings.TrimSuffix(serviceType, ".")) + ".local."
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(buildDNSQuery(service, dnsTypePTR), mdnsGroup); err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+
+	instances := map[string]bool{}
+	srv := map[string]dnsSRV{}
+	txt := map[string]map[string]string{}
+	addrs := map[string][]net.IP{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // read deadline reached
+		}
+		records, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, rr := range records {
+			switch rr.Type {
+			case dnsTypePTR:
+				if rr.Name == service {
+					instances[rr.Target] = true
+				}
+			case dnsTypeSRV:
+				srv[rr.Name] = rr.SRV
+			case dnsTypeTXT:
+				txt[rr.Name] = rr.TXT
+			case dnsTypeA, dnsTypeAAAA:
+				addrs[rr.Name] = append(addrs[rr.Name], rr.IP)
+			}
+		}
+	}
+
+	var devices []*DeviceInfo
+	for instance := range instances {
+		s, ok := srv[instance]
+		if !ok {
+			continue
+		}
+		dev := &DeviceInfo{
+			Name:         strings.TrimSuffix(instance, "."+service),
+			Host:         s.Target,
+			Port:         s.Port,
+			Capabilities: []string{},
+			TXT:          txt[instance],
+		}
+		for _, ip := range addrs[s.Target] {
+			if dev.IP == "" || ip.To4() != nil {
+				dev.IP = ip.String()
+			}
+		}
+		if dev.IP == "" {
+			lookupCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			if ips, err := net.DefaultResolver.LookupHost(lookupCtx, strings.TrimSuffix(s.Target, ".")); err == nil && len(ips) > 0 {
+				dev.IP = ips[0]
+			}
+			cancel()
+		}
+		if caps := dev.TXT["capabilities"]; caps != "" {
+			dev.Capabilities = strings.Split(caps, ",")
+		}
+		devices = append(devices, dev)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+type dnsSRV struct {
+	Target string
+	Port   int
+}
+
+// dnsRecord is the subset of a resource record that discovery needs.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string // PTR
+	SRV    dnsSRV
+	TXT    map[string]string
+	IP     net.IP // A, AAAA
+}
+
+var errShortDNS = errors.New("truncated DNS message")
+
+func buildDNSQuery(name string, qtype uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1) // class IN
+}
+
+// parseDNSMessage returns the answer, authority and additional records of a
+// DNS response.
+func parseDNSMessage(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errShortDNS
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	var records []dnsRecord
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errShortDNS
+		}
+		rr := dnsRecord{Name: strings.ToLower(name), Type: binary.BigEndian.Uint16(msg[next:])}
+		rdLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rd := next + 10
+		if rd+rdLen > len(msg) {
+			return nil, errShortDNS
+		}
+		switch rr.Type {
+		case dnsTypePTR:
+			if rr.Target, _, err = readDNSName(msg, rd); err != nil {
+				return nil, err
+			}
+			rr.Target = strings.ToLower(rr.Target)
+		case dnsTypeSRV:
+			if rdLen < 7 {
+				return nil, errShortDNS
+			}
+			rr.SRV.Port = int(binary.BigEndian.Uint16(msg[rd+4:]))
+			if rr.SRV.Target, _, err = readDNSName(msg, rd+6); err != nil {
+				return nil, err
+			}
+			rr.SRV.Target = strings.ToLower(rr.SRV.Target)
+		case dnsTypeTXT:
+			rr.TXT = map[string]string{}
+			for p := rd; p < rd+rdLen; {
+				n := int(msg[p])
+				if p+1+n > rd+rdLen {
+					return nil, errShortDNS
+				}
+				k, v, _ := strings.Cut(string(msg[p+1:p+1+n]), "=")
+				if k != "" {
+					rr.TXT[strings.ToLower(k)] = v
+				}
+				p += 1 + n
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			rr.IP = net.IP(append([]byte(nil), msg[rd:rd+rdLen]...))
+		}
+		records = append(records, rr)
+		off = rd + rdLen
+	}
+	return records, nil
+}
+
+// readDNSName decodes a possibly compressed name at off and returns it with
+// the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errShortDNS
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errShortDNS
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errShortDNS
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errors.New("DNS name has too many compression pointers")
+}
+
+// RegistryEntry describes one device in the DeviceRegistry. Entries come
+// from DEVICE_REGISTRY_FILE (a JSON array of these) or from mDNS discovery.
+type RegistryEntry struct {
+	Name         string   `json:"name"`
+	IP           string   `json:"ip,omitempty"`
+	Port         int      `json:"port,omitempty"`
+	APIBase      string   `json:"api_base,omitempty"`
+	Source       string   `json:"source,omitempty"` // "file" or "mdns"
+	URL          string   `json:"url,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type registeredDevice struct {
+	entry  RegistryEntry
+	client DeviceAPI
+}
+
+// DeviceRegistry holds a device client per named device. While it is empty
+// the driver serves the single device from its own configuration.
+type DeviceRegistry struct {
+	// NewClient creates the client of a registered device; NewDeviceClient
+	// when nil.
+	NewClient func(cfg *Config) DeviceAPI
+
+	cfg     *Config
+	mu      sync.RWMutex
+	devices map[string]*registeredDevice
+}
+
+func NewDeviceRegistry(cfg *Config) *DeviceRegistry {
+	return &DeviceRegistry{cfg: cfg, devices: map[string]*registeredDevice{}}
+}
+
+// LoadFile adds the devices listed in a DEVICE_REGISTRY_FILE.
+func (reg *DeviceRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []RegistryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, e := range entries {
+		if e.Name == "" || (e.IP == "" && e.APIBase == "") {
+			return fmt.Errorf("%s: entry %d needs a name and an ip or api_base", path, i)
+		}
+		e.Source = "file"
+		reg.Add(e)
+	}
+	return nil
+}
+
+// Add registers or replaces a device.
+func (reg *DeviceRegistry) Add(e RegistryEntry) {
+	c := *reg.cfg
+	c.ShifuIP, c.ShifuAPIBase = e.IP, e.APIBase
+	if e.Port != 0 {
+		c.ShifuPort = strconv.Itoa(e.Port)
+	}
+	var client DeviceAPI
+	if reg.NewClient != nil {
+		client = reg.NewClient(&c)
+	} else {
+		client = NewDeviceClient(&c)
+	}
+	e.URL = client.URL("")
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.devices[e.Name] = &registeredDevice{entry: e, client: client}
+}
+
+// Get returns the client for the named device.
+func (reg *DeviceRegistry) Get(name string) (DeviceAPI, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	d, ok := reg.devices[name]
+	if !ok {
+		return nil, false
+	}
+	return d.client, true
+}
+
+// List returns the registered devices sorted by name.
+func (reg *DeviceRegistry) List() []RegistryEntry {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	entries := make([]RegistryEntry, 0, len(reg.devices))
+	for _, d := range reg.devices {
+		entries = append(entries, d.entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Names returns the registered device names, sorted.
+func (reg *DeviceRegistry) Names() []string {
+	var names []string
+	for _, e := range reg.List() {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// Discover adds mDNS-discovered devices to the registry. Devices that stop
+// answering are kept, since a missed browse is common on busy networks.
+func (reg *DeviceRegistry) Discover(ctx context.Context, serviceType string) error {
+	devices, err := DiscoverDevices(ctx, serviceType)
+	if err != nil {
+		log.Printf("mDNS discovery failed: %v", err)
+		return err
+	}
+	for _, d := range devices {
+		if d.IP == "" {
+			continue
+		}
+		reg.Add(RegistryEntry{Name: d.Name, IP: d.IP, Port: d.Port, Source: "mdns", Capabilities: d.Capabilities})
+	}
+	log.Printf("mDNS discovery found %d %s device(s)", len(devices), serviceType)
+	return nil
+}
+
+// DeviceResult is one device's answer in a broadcast response.
+type DeviceResult struct {
+	StatusCode int         `json:"status_code,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// broadcast sends the same request to every registered device in parallel.
+func (reg *DeviceRegistry) broadcast(ctx context.Context, method, path, contentType string, body []byte) map[string]DeviceResult {
+	reg.mu.RLock()
+	targets := make(map[string]DeviceAPI, len(reg.devices))
+	for name, d := range reg.devices {
+		targets[name] = d.client
+	}
+	reg.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]DeviceResult, len(targets))
+	for name, client := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res DeviceResult
+			var resp *http.Response
+			var err error
+			if method == http.MethodGet {
+				resp, err = client.Get(ctx, path)
+			} else {
+				resp, err = client.Post(ctx, path, contentType, body)
+			}
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				data, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				res.StatusCode = resp.StatusCode
+				var v interface{}
+				if json.Unmarshal(data, &v) == nil {
+					res.Body = v
+				} else {
+					res.Body = string(data)
+				}
+			}
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// fleetHandler routes a request to the device named by ?device=, or
+// broadcasts it to every registered device and aggregates the answers. With
+// an empty registry it falls through to the single-device handler.
+func fleetHandler(reg *DeviceRegistry, path string, single http.HandlerFunc, perDevice func(DeviceAPI) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if name := r.URL.Query().Get("device"); name != "" {
+			client, ok := reg.Get(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown device %q, known devices: %s", name, strings.Join(reg.Names(), ", ")), http.StatusNotFound)
+				return
+			}
+			perDevice(client)(w, r)
+			return
+		}
+		if len(reg.Names()) == 0 {
+			single(w, r)
+			return
+		}
+		var body []byte
+		if r.Method != http.MethodGet {
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		results := reg.broadcast(r.Context(), r.Method, path, r.Header.Get("Content-Type"), body)
+		status := http.StatusBadGateway
+		for _, res := range results {
+			if res.Error == "" {
+				status = http.StatusOK
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": results})
+	}
+}
+
+// Handler for /devices
+func devicesHandler(reg *DeviceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reg.List())
+	}
+}
+
+// HeartbeatMonitor polls the device status endpoint in the background and
+// remembers when the device last answered, so /status can report a device
+// that has silently gone away.
+type HeartbeatMonitor struct {
+	Client     DeviceAPI
+	Interval   time.Duration
+	StaleAfter time.Duration
+	WebhookURL string // optional, notified when the device goes stale or recovers
+
+	mu       sync.Mutex
+	started  time.Time
+	lastSeen time.Time
+	stale    bool
+}
+
+// Check polls the device once and fires the webhook if its staleness
+// changed. The returned error is the heartbeat failure, if any.
+func (m *HeartbeatMonitor) Check(ctx context.Context) error {
+	m.mu.Lock()
+	if m.started.IsZero() {
+		m.started = time.Now()
+	}
+	m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, min(m.Interval, 10*time.Second))
+	defer cancel()
+	resp, err := m.Client.Get(ctx, "/api/v1/status")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			m.mu.Lock()
+			m.lastSeen = time.Now()
+			m.mu.Unlock()
+		} else {
+			err = fmt.Errorf("device status returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Heartbeat to device failed: %v", err)
+	}
+
+	lastSeen, stale := m.Status()
+	m.mu.Lock()
+	changed := stale != m.stale
+	m.stale = stale
+	webhookURL := m.WebhookURL
+	m.mu.Unlock()
+	if !changed {
+		return err
+	}
+	event := "device.recovered"
+	if stale {
+		event = "device.stale"
+		log.Printf("Device is stale: no heartbeat since %v", lastSeen)
+	} else {
+		log.Printf("Device heartbeat recovered")
+	}
+	if webhookURL != "" {
+		go m.notify(webhookURL, event, lastSeen)
+	}
+	return err
+}
+
+// Status returns the last successful heartbeat (zero if none yet) and whether
+// the device is stale. A device that has never answered is only stale once
+// the threshold has passed since monitoring began.
+func (m *HeartbeatMonitor) Status() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref := m.lastSeen
+	if ref.IsZero() {
+		ref = m.started
+	}
+	return m.lastSeen, !ref.IsZero() && time.Since(ref) > m.StaleAfter
+}
+
+// Reconfigure changes the stale threshold and webhook of a running monitor.
+func (m *HeartbeatMonitor) Reconfigure(staleAfter time.Duration, webhookURL string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.StaleAfter = staleAfter
+	m.WebhookURL = webhookURL
+}
+
+func (m *HeartbeatMonitor) notify(webhookURL, event string, lastSeen time.Time) {
+	payload := map[string]interface{}{
+		"event":     event,
+		"device":    m.Client.URL(""),
+		"timestamp": time.Now().UTC(),
+	}
+	if !lastSeen.IsZero() {
+		payload["last_heartbeat"] = lastSeen.UTC()
+	}
+	body, _ := json.Marshal(payload)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to deliver %s webhook: %v", event, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// restartOnly lists the settings that are only read at startup, by Config
+// field and environment variable. A reload that changes one of them keeps the
+// startup value and reports the variable in restart_required instead.
+var restartOnly = []struct{ Field, Env string }{
+	{"ServerHost", "SERVER_HOST"},
+	{"ServerPort", "SERVER_PORT"},
+	{"TLSCertFile", "TLS_CERT_FILE"},
+	{"TLSKeyFile", "TLS_KEY_FILE"},
+	{"TLSMinVersion", "TLS_MIN_VERSION"},
+	{"TLSMaxVersion", "TLS_MAX_VERSION"},
+	{"TLSCipherSuites", "TLS_CIPHER_SUITES"},
+	{"DeviceHostname", "DEVICE_HOSTNAME"},
+	{"HostnameRefresh", "DEVICE_HOSTNAME_REFRESH_S"},
+	{"HeartbeatInterval", "HEARTBEAT_INTERVAL_S"},
+	{"MDNSServiceType", "MDNS_SERVICE_TYPE"},
+	{"DiscoveryRefresh", "MDNS_REFRESH_S"},
+	{"RegistryFile", "DEVICE_REGISTRY_FILE"},
+	{"ExecMapFile", "DEVICE_EXEC_MAP_FILE"},
+	{"MockMode", "DEVICE_MOCK_MODE"},
+	{"MockResponsesFile", "MOCK_RESPONSES_FILE"},
+	{"SnapshotInterval", "CAMERA_SNAPSHOT_INTERVAL_S"},
+	{"SnapshotDir", "CAMERA_SNAPSHOT_DIR"},
+	{"InferJobHistory", "INFER_JOB_HISTORY_MAX"},
+	{"InferWorkers", "INFER_ASYNC_WORKERS"},
+	{"HTTPMaxIdle", "HTTP_MAX_IDLE_CONNS"},
+	{"HTTPMaxIdlePerHost", "HTTP_MAX_IDLE_CONNS_PER_HOST"},
+	{"HTTPIdleTimeout", "HTTP_IDLE_CONN_TIMEOUT_S"},
+	{"HTTPHeaderTimeout", "HTTP_RESPONSE_HEADER_TIMEOUT_S"},
+}
+
+// restartRequired returns the environment variables of the startup-only
+// settings that differ between the running configuration and cfg.
+func restartRequired(old, cfg *Config) []string {
+	a, b := reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem()
+	var envs []string
+	for _, s := range restartOnly {
+		if a.FieldByName(s.Field).Interface() != b.FieldByName(s.Field).Interface() {
+			envs = append(envs, s.Env)
+		}
+	}
+	return envs
+}
+
+// keepRestartOnly copies the startup-only settings of startup into cfg, so a
+// reloaded configuration matches what the driver is actually running with.
+func keepRestartOnly(startup, cfg *Config) {
+	a, b := reflect.ValueOf(startup).Elem(), reflect.ValueOf(cfg).Elem()
+	for _, s := range restartOnly {
+		b.FieldByName(s.Field).Set(a.FieldByName(s.Field))
+	}
+}
+
+// ReloadStatus is the outcome of the last configuration reload, reported by
+// GET /config.
+type ReloadStatus struct {
+	LastAttempt     time.Time `json:"last_attempt,omitempty"`
+	LastSuccess     time.Time `json:"last_success,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	RestartRequired []string  `json:"restart_required,omitempty"`
+}
+
+// ConfigReloader reloads the configuration from its sources on SIGHUP or
+// POST /config/reload and switches the device client over to it. A reload
+// that fails to load or validate keeps the current configuration.
+type ConfigReloader struct {
+	Client DeviceAPI
+	// Apply pushes reloadable settings into components that copied them at
+	// startup; optional.
+	Apply func(cfg *Config)
+
+	mu      sync.Mutex
+	startup *Config // what the startup-only settings are still running with
+	status  ReloadStatus
+}
+
+// Reload loads and validates the configuration and applies it.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.LastAttempt = time.Now()
+	cfg, err := loadConfigSources()
+	if err == nil {
+		err = ValidateConfig(cfg)
+	}
+	if err != nil {
+		r.status.Error = err.Error()
+		log.Printf("Config reload failed, keeping current configuration:\n%v", err)
+		return err
+	}
+	if r.startup == nil {
+		r.startup = r.Client.Config()
+	}
+	r.status.RestartRequired = restartRequired(r.startup, cfg)
+	keepRestartOnly(r.startup, cfg)
+	r.Client.SetConfig(cfg)
+	if r.Apply != nil {
+		r.Apply(cfg)
+	}
+	log.Printf("Configuration reloaded: %s", cfg.Redacted())
+	if len(r.status.RestartRequired) > 0 {
+		log.Printf("Changes to %s take effect after a restart", strings.Join(r.status.RestartRequired, ", "))
+	}
+	r.status.LastSuccess = r.status.LastAttempt
+	r.status.Error = ""
+	return nil
+}
+
+// Status returns the outcome of the last reload.
+func (r *ConfigReloader) Status() ReloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.status
+	st.RestartRequired = slices.Clone(st.RestartRequired)
+	return st
+}
+
+// Watch reloads the configuration on every SIGHUP until ctx is done.
+func (r *ConfigReloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.Reload()
+		}
+	}
+}
+
+// ConfigValue is one setting as reported by GET /config: its value, the
+// environment variable it was read from and where that was set ("env",
+// "configmap", "file" or "default"). Derived settings have no variable and
+// report "derived".
+type ConfigValue struct {
+	Value  interface{} `json:"value"`
+	Env    string      `json:"env,omitempty"`
+	Source string      `json:"source"`
+}
+
+// configSource returns the first of the comma-separated variables in envs
+// that is set, and the source it is set in. With none set it returns the
+// first variable and "default".
+func configSource(envs string) (string, string) {
+	names := strings.Split(envs, ",")
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, name := range names {
+		switch {
+		case os.Getenv(name) != "":
+			return name, "env"
+		case configMapVals[name] != "":
+			return name, "configmap"
+		case fileConfig[name] != "":
+			return name, "file"
+		}
+	}
+	return names[0], "default"
+}
+
+// Values returns the configuration by field name, with secrets redacted.
+func (c *Config) Values() map[string]ConfigValue {
+	v := reflect.ValueOf(c).Elem()
+	values := make(map[string]ConfigValue, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		val := v.Field(i).Interface()
+		if d, ok := val.(time.Duration); ok {
+			val = d.String()
+		}
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			val = redactedValue
+		}
+		cv := ConfigValue{Value: val, Source: "derived"}
+		if envs := field.Tag.Get("env"); envs != "" {
+			cv.Env, cv.Source = configSource(envs)
+		}
+		values[field.Name] = cv
+	}
+	return values
+}
+
+// requireAdminToken serves next only to requests carrying
+// "Authorization: Bearer <ADMIN_TOKEN>". Without ADMIN_TOKEN the endpoint is
+// refused outright. It guards /config, the scheduler job actions,
+// POST /device/wol, POST /device/exec and DELETE /device/process/{pid}.
+func requireAdminToken(dev DeviceAPI, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := dev.Config().AdminToken
+		if token == "" {
+			http.Error(w, "Forbidden: set ADMIN_TOKEN to enable this endpoint", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized: expected Authorization: Bearer <ADMIN_TOKEN>", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Handler for GET /config
+func configHandler(dev DeviceAPI, reloader *ConfigReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"config": dev.Config().Values(),
+			"reload": reloader.Status(),
+		})
+	}
+}
+
+// Handler for POST /config/reload
+func configReloadHandler(reloader *ConfigReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := reloader.Reload(); err != nil {
+			http.Error(w, fmt.Sprintf("Config reload failed, keeping current configuration: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reloader.Status())
+	}
+}
+
+// Handler for /status. When a heartbeat monitor is running, last_heartbeat
+// and is_stale are added to the device's JSON status object; with a circuit
+// breaker, circuit_breaker (the telemetry circuit /status goes through) and
+// circuit_breakers (every endpoint's) are added too.
+func statusHandler(dev DeviceAPI, hb *HeartbeatMonitor, cb *CircuitBreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Get(r.Context(), "/api/v1/status")
+		if errors.Is(err, ErrCircuitOpen) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "circuit_breaker": CircuitOpen})
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch status: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
+		if hb == nil && cb == nil {
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read status: %v", err), http.StatusBadGateway)
+			return
+		}
+		var status map[string]interface{}
+		if json.Unmarshal(body, &status) == nil && status != nil {
+			if hb != nil {
+				lastSeen, stale := hb.Status()
+				status["last_heartbeat"] = nil
+				if !lastSeen.IsZero() {
+					status["last_heartbeat"] = lastSeen.UTC().Format(time.RFC3339)
+				}
+				status["is_stale"] = stale
+			}
+			if cb != nil {
+				status["circuit_breaker"] = cb.State(EndpointTelemetry)
+				status["circuit_breakers"] = cb.States()
+			}
+			body, _ = json.Marshal(status)
+			w.Header().Del("Content-Length")
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+	}
+}
+
+// Handler for /metrics
+func metricsHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Get(r.Context(), "/api/v1/metrics")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch metrics: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+// Handler for /driver/metrics, the driver's own Prometheus metrics (/metrics
+// proxies the device's).
+func driverMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	upstreamTruncated.Lock()
+	endpoints := make([]string, 0, len(upstreamTruncated.counts))
+	for e := range upstreamTruncated.counts {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP upstream_response_truncated_total Device responses dropped for exceeding UPSTREAM_MAX_RESPONSE_BODY_MB.")
+	fmt.Fprintln(w, "# TYPE upstream_response_truncated_total counter")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "upstream_response_truncated_total{endpoint=%q} %d\n", e, upstreamTruncated.counts[e])
+	}
+	upstreamTruncated.Unlock()
+}
+
+// Handler for /upgrade
+func upgradeHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		resp, err := dev.Post(r.Context(), "/api/v1/upgrade", r.Header.Get("Content-Type"), body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to upgrade: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+// Handler for /control
+func controlHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		resp, err := dev.Post(r.Context(), "/api/v1/control", r.Header.Get("Content-Type"), body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to send control command: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+// inferResult is the last successful inference response, replayed to
+// sampled-out requests when INFER_SAMPLE_SERVE_CACHED is set.
+type inferResult struct {
+	Header http.Header
+	Body   []byte
+}
+
+// InferenceCache holds successful JSON inference responses keyed by the
+// SHA-256 of the request body, so identical requests (same image, same
+// model) are answered without a device round trip.
+type InferenceCache struct {
+	Now func() time.Time // defaults to time.Now
+
+	mu      sync.Mutex
+	entries map[string]cachedInference
+}
+
+type cachedInference struct {
+	inferResult
+	StoredAt time.Time
+}
+
+func (c *InferenceCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// InferenceCacheKey returns the cache key of a request body.
+func InferenceCacheKey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the response cached under key if it is younger than ttl,
+// along with its age.
+func (c *InferenceCache) Get(key string, ttl time.Duration) (*inferResult, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	age := c.now().Sub(e.StoredAt)
+	if age >= ttl {
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	return &e.inferResult, age, true
+}
+
+// Put caches a response under key and drops entries older than ttl. If the
+// cache still holds max entries, the oldest ones are evicted to make room.
+func (c *InferenceCache) Put(key string, res *inferResult, ttl time.Duration, max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.entries == nil {
+		c.entries = map[string]cachedInference{}
+	}
+	for k, e := range c.entries {
+		if now.Sub(e.StoredAt) >= ttl {
+			delete(c.entries, k)
+		}
+	}
+	delete(c.entries, key)
+	for len(c.entries) > 0 && len(c.entries) >= max {
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.StoredAt.Before(c.entries[oldest].StoredAt) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = cachedInference{inferResult: *res, StoredAt: now}
+}
+
+// writeCachedInference replays a cached response with X-Cache: HIT and, for
+// a JSON object, a cache_age_ms field.
+func writeCachedInference(w http.ResponseWriter, res *inferResult, age time.Duration, allowed string) {
+	body := res.Body
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(body, &obj) == nil && obj != nil {
+		obj["cache_age_ms"] = json.RawMessage(strconv.FormatInt(age.Milliseconds(), 10))
+		if b, err := json.Marshal(obj); err == nil {
+			body = b
+		}
+	}
+	copyHeader(w.Header(), res.Header, allowed)
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// inferSampledOut sheds load on the device's model: only INFER_SAMPLE_RATE
+// of the inference requests are forwarded.
+func inferSampledOut(cfg *Config) bool {
+	return cfg.InferSampleRate < 1 && rand.Float64() >= cfg.InferSampleRate
+}
+
+// Handler for /infer
+func inferHandler(dev DeviceAPI, cache *InferenceCache) http.HandlerFunc {
+	var (
+		mu   sync.Mutex
+		last *inferResult
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		cfg := dev.Config()
+		key := InferenceCacheKey(body)
+		if cfg.InferCacheTTL > 0 {
+			if res, age, ok := cache.Get(key, cfg.InferCacheTTL); ok {
+				writeCachedInference(w, res, age, cfg.UpstreamAllowedHeaders)
+				return
+			}
+		}
+		if inferSampledOut(cfg) {
+			mu.Lock()
+			cached := last
+			mu.Unlock()
+			if cfg.InferServeCached && cached != nil {
+				copyHeader(w.Header(), cached.Header, cfg.UpstreamAllowedHeaders)
+				w.Header().Set("X-Infer-Cache", "true")
+				w.WriteHeader(http.StatusOK)
+				w.Write(cached.Body)
+				return
+			}
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Inference request rejected by sampling, retry later", http.StatusTooManyRequests)
+			return
+		}
+		resp, err := dev.Post(r.Context(), "/api/v1/infer", r.Header.Get("Content-Type"), body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to trigger inference: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		result, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read inference result: %v", err), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode == http.StatusOK {
+			res := &inferResult{Header: resp.Header.Clone(), Body: result}
+			mu.Lock()
+			last = res
+			mu.Unlock()
+			if cfg.InferCacheTTL > 0 && json.Valid(result) {
+				cache.Put(key, res, cfg.InferCacheTTL, cfg.InferCacheMax)
+			}
+		}
+		copyHeader(w.Header(), resp.Header, cfg.UpstreamAllowedHeaders)
+		if cfg.InferCacheTTL > 0 {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(result)
+	}
+}
+
+// Inference job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// InferJob tracks an inference request run in the background by
+// POST /infer/async.
+type InferJob struct {
+	ID         string      `json:"job_id"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code,omitempty"` // device reply
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+// InferJobStore keeps the most recent inference jobs in memory
+// (INFER_JOB_HISTORY_MAX), evicting the oldest finished job first. At most
+// INFER_ASYNC_WORKERS jobs run at once; pending and running jobs are never
+// evicted, so a client can always poll its job to completion.
+type InferJobStore struct {
+	mu    sync.Mutex
+	max   int
+	order []string // job IDs, oldest first
+	jobs  map[string]*InferJob
+	slots chan struct{}
+}
+
+// ErrInferBusy is returned by Submit while every worker is running a job.
+var ErrInferBusy = errors.New("all inference workers are busy")
+
+func NewInferJobStore(max, workers int) *InferJobStore {
+	if max < 1 {
+		max = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &InferJobStore{max: max, jobs: map[string]*InferJob{}, slots: make(chan struct{}, workers)}
+}
+
+// Add stores a job, evicting the oldest finished jobs beyond the limit.
+func (s *InferJobStore) Add(job *InferJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	s.evict()
+}
+
+// evict drops the oldest finished jobs until the store is within its limit
+// or only unfinished jobs are left. s.mu must be held.
+func (s *InferJobStore) evict() {
+	for i := 0; len(s.order) > s.max && i < len(s.order); {
+		if status := s.jobs[s.order[i]].Status; status != JobDone && status != JobFailed {
+			i++
+			continue
+		}
+		delete(s.jobs, s.order[i])
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// Update applies fn to the job under the store lock.
+func (s *InferJobStore) Update(id string, fn func(*InferJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+		job.UpdatedAt = time.Now().UTC()
+	}
+	s.evict()
+}
+
+// Get returns a copy of the job with the given ID.
+func (s *InferJobStore) Get(id string) (InferJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return InferJob{}, false
+	}
+	return *job, true
+}
+
+// List returns copies of the stored jobs, newest first.
+func (s *InferJobStore) List() []InferJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]InferJob, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[s.order[i]])
+	}
+	return jobs
+}
+
+// Submit records a pending job and runs the inference in the background. It
+// returns ErrInferBusy without recording a job when no worker is free.
+func (s *InferJobStore) Submit(ctx context.Context, dev DeviceAPI, contentType string, body []byte) (InferJob, error) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return InferJob{}, ErrInferBusy
+	}
+	now := time.Now().UTC()
+	job := &InferJob{ID: newJobID(), Status: JobPending, CreatedAt: now, UpdatedAt: now}
+	snapshot := *job
+	s.Add(job)
+	// The job outlives the request but keeps its request ID
+	go s.run(context.WithoutCancel(ctx), dev, job.ID, contentType, body)
+	return snapshot, nil
+}
+
+// inferJobTimeout bounds a background inference, which has no client
+// connection to end it, so a hung device can't hold a worker forever.
+const inferJobTimeout = 5 * time.Minute
+
+func (s *InferJobStore) run(ctx context.Context, dev DeviceAPI, id, contentType string, body []byte) {
+	defer func() { <-s.slots }()
+	ctx, cancel := context.WithTimeout(ctx, inferJobTimeout)
+	defer cancel()
+	s.Update(id, func(job *InferJob) { job.Status = JobRunning })
+	var result []byte
+	resp, err := dev.Post(ctx, "/api/v1/infer", contentType, body)
+	if err == nil {
+		result, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	s.Update(id, func(job *InferJob) {
+		switch {
+		case err != nil:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		case resp.StatusCode != http.StatusOK:
+			job.Status = JobFailed
+			job.StatusCode = resp.StatusCode
+			job.Error = "device returned " + resp.Status
+			job.Result = decodeResult(result)
+		default:
+			job.Status = JobDone
+			job.StatusCode = resp.StatusCode
+			job.Result = decodeResult(result)
+		}
+	})
+}
+
+// newJobID returns a random 128-bit hex ID.
+func newJobID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// decodeResult returns the device reply as JSON when it parses, else as text.
+func decodeResult(body []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		return v
+	}
+	return string(body)
+}
+
+// Handler for POST /infer/async
+func inferAsyncHandler(dev DeviceAPI, jobs *InferJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if inferSampledOut(dev.Config()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Inference request rejected by sampling, retry later", http.StatusTooManyRequests)
+			return
+		}
+		job, err := jobs.Submit(r.Context(), dev, r.Header.Get("Content-Type"), body)
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many inference jobs running, retry later", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/infer/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID, "status": job.Status})
+	}
+}
+
+// Handler for GET /infer/jobs
+func inferJobsHandler(jobs *InferJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs.List())
+	}
+}
+
+// Handler for GET /infer/jobs/{id}
+func inferJobHandler(jobs *InferJobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Unknown job", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// Handler for /camera
+func cameraHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// GET a snapshot from the camera and proxy back to HTTP
+		resp, err := dev.Snapshot(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get camera snapshot: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "image/jpeg"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
+
+// snapshotLayout names stored snapshots by capture time (UTC); the inference
+// result for a snapshot is stored next to it as sidecarLayout.
+const (
+	snapshotLayout = "20060102_150405.jpg"
+	sidecarLayout  = "20060102_150405.json"
+)
+
+// sidecarName returns the name of the inference sidecar for a snapshot.
+func sidecarName(snapshot string) string {
+	return strings.TrimSuffix(snapshot, ".jpg") + ".json"
+}
+
+// SnapshotStore captures camera snapshots into a directory on a schedule
+// (CAMERA_SNAPSHOT_INTERVAL_S) and keeps the newest CAMERA_SNAPSHOT_MAX_FILES.
+// With Analyze set (CAMERA_ANALYZE_ON_SNAPSHOT) each snapshot is also run
+// through the device's inference endpoint.
+type SnapshotStore struct {
+	Dir      string
+	MaxFiles int
+	Analyze  bool
+	Client   DeviceAPI
+	Now      func() time.Time // defaults to time.Now
+
+	mu sync.Mutex // guards MaxFiles and Analyze once capturing has started
+}
+
+// Reconfigure changes the retention and analysis settings of a running store.
+func (s *SnapshotStore) Reconfigure(maxFiles int, analyze bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MaxFiles = maxFiles
+	s.Analyze = analyze
+}
+
+func (s *SnapshotStore) settings() (maxFiles int, analyze bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MaxFiles, s.Analyze
+}
+
+// StoredSnapshot is one entry of GET /camera/snapshots.
+type StoredSnapshot struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	CapturedAt time.Time `json:"captured_at"`
+	Analysis   string    `json:"analysis,omitempty"` // sidecar file name, if analyzed
+}
+
+// analyzeImage sends a JPEG to the device's inference endpoint as
+// {"image_b64": ...} and returns the raw JSON result.
+func analyzeImage(ctx context.Context, dev DeviceAPI, jpeg []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"image_b64": base64.StdEncoding.EncodeToString(jpeg)})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dev.Post(ctx, "/api/v1/infer", "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inference returned %s", resp.Status)
+	}
+	return result, nil
+}
+
+// writeFileAtomic writes data to a temporary file in dir and renames it into
+// place, so readers never see a partial file.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Capture saves one snapshot and prunes the oldest files beyond the limit.
+func (s *SnapshotStore) Capture(ctx context.Context) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	resp, err := s.Client.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("camera snapshot returned %s", resp.Status)
+	}
+	jpeg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	at := now().UTC()
+	if err := writeFileAtomic(s.Dir, at.Format(snapshotLayout), jpeg); err != nil {
+		return err
+	}
+	// The snapshot is kept even if analysis fails; the error is still
+	// reported so the scheduler records it.
+	var analyzeErr error
+	if _, analyze := s.settings(); analyze {
+		result, err := analyzeImage(ctx, s.Client, jpeg)
+		if err == nil {
+			err = writeFileAtomic(s.Dir, at.Format(sidecarLayout), result)
+		}
+		if err != nil {
+			analyzeErr = fmt.Errorf("analyze snapshot: %w", err)
+		}
+	}
+	if err := s.prune(); err != nil {
+		return err
+	}
+	return analyzeErr
+}
+
+// List returns the stored snapshots, oldest first.
+func (s *SnapshotStore) List() ([]StoredSnapshot, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []StoredSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []StoredSnapshot{}
+	for _, e := range entries {
+		at, err := time.Parse(snapshotLayout, e.Name())
+		if err != nil || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snap := StoredSnapshot{Name: e.Name(), Size: info.Size(), CapturedAt: at}
+		if _, err := os.Stat(filepath.Join(s.Dir, sidecarName(e.Name()))); err == nil {
+			snap.Analysis = sidecarName(e.Name())
+		}
+		list = append(list, snap)
+	}
+	// Names sort in capture order
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *SnapshotStore) prune() error {
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+	maxFiles, _ := s.settings()
+	for len(list) > maxFiles {
+		if err := os.Remove(filepath.Join(s.Dir, list[0].Name)); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(s.Dir, sidecarName(list[0].Name))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		list = list[1:]
+	}
+	return nil
+}
+
+// Handler for GET /camera/snapshots
+func snapshotsHandler(store *SnapshotStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := store.List()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list snapshots: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// Handler for GET /camera/snapshots/{filename}
+func snapshotFileHandler(store *SnapshotStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("filename")
+		if _, err := time.Parse(snapshotLayout, name); err == nil {
+			w.Header().Set("Content-Type", "image/jpeg")
+		} else if _, err := time.Parse(sidecarLayout, name); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(store.Dir, name))
+	}
+}
+
+// Handler for POST /camera/analyze
+func cameraAnalyzeHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Snapshot(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get camera snapshot: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, fmt.Sprintf("Camera snapshot returned %s", resp.Status), http.StatusBadGateway)
+			return
+		}
+		jpeg, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read camera snapshot: %v", err), http.StatusBadGateway)
+			return
+		}
+		result, err := analyzeImage(r.Context(), dev, jpeg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to analyze snapshot: %v", err), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+	}
+}
+
+// PTZCommand is the body of POST /camera/ptz. Pan and tilt are in degrees,
+// zoom is a magnification factor; omitted axes are left where they are.
+type PTZCommand struct {
+	Pan  *float64 `json:"pan,omitempty"`
+	Tilt *float64 `json:"tilt,omitempty"`
+	Zoom *float64 `json:"zoom,omitempty"`
+}
+
+// Validate checks every axis that is set against the camera's range.
+func (c PTZCommand) Validate() error {
+	if c.Pan == nil && c.Tilt == nil && c.Zoom == nil {
+		return errors.New("at least one of pan, tilt or zoom is required")
 	}
-	return fmt.Sprintf("%s%s", base, path)
+	for _, axis := range []struct {
+		name     string
+		val      *float64
+		min, max float64
+	}{{"pan", c.Pan, -180, 180}, {"tilt", c.Tilt, -180, 180}, {"zoom", c.Zoom, 0.1, 10}} {
+		if axis.val != nil && (*axis.val < axis.min || *axis.val > axis.max || math.IsNaN(*axis.val)) {
+			return fmt.Errorf("%s %v is out of range [%v, %v]", axis.name, *axis.val, axis.min, axis.max)
+		}
+	}
+	return nil
 }
 
-// Handler for /status
-func statusHandler(cfg *Config) http.HandlerFunc {
+// Handler for /camera/ptz
+func cameraPTZHandler(dev DeviceAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := cfg.deviceURL("/api/v1/status")
-		resp, err := http.Get(target)
+		var cmd PTZCommand
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cmd); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid PTZ command: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := cmd.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid PTZ command: %v", err), http.StatusBadRequest)
+			return
+		}
+		body, _ := json.Marshal(cmd)
+		resp, err := dev.Post(r.Context(), dev.Config().CameraPTZ, "application/json", body)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch status: %v", err), http.StatusBadGateway)
+			http.Error(w, fmt.Sprintf("Failed to send PTZ command: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
 		w.WriteHeader(resp.StatusCode)
 		io.Copy(w, resp.Body)
 	}
 }
 
-// Handler for /metrics
-func metricsHandler(cfg *Config) http.HandlerFunc {
+// RequestTrace is the timing breakdown returned by /trace. Durations are in
+// milliseconds; phases that did not happen (e.g. TLS over plain HTTP) are 0.
+type RequestTrace struct {
+	Endpoint   string  `json:"endpoint"`
+	URL        string  `json:"url"`
+	StatusCode int     `json:"status_code,omitempty"`
+	DNSMs      float64 `json:"dns_ms"`
+	ConnectMs  float64 `json:"connect_ms"`
+	TLSMs      float64 `json:"tls_ms"`
+	SendMs     float64 `json:"send_ms"`
+	TTFBMs     float64 `json:"ttfb_ms"`
+	TotalMs    float64 `json:"total_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Handler for /trace?endpoint=/path
+func traceHandler(dev DeviceAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := cfg.deviceURL("/api/v1/metrics")
-		resp, err := http.Get(target)
+		endpoint := r.URL.Query().Get("endpoint")
+		if endpoint == "" || endpoint[0] != '/' {
+			http.Error(w, "endpoint query parameter must be a path starting with /", http.StatusBadRequest)
+			return
+		}
+		result, err := dev.Trace(r.Context(), endpoint)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch metrics: %v", err), http.StatusBadGateway)
+			http.Error(w, fmt.Sprintf("Invalid endpoint: %v", err), http.StatusBadRequest)
 			return
 		}
-		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
 	}
 }
 
-// Handler for /upgrade
-func upgradeHandler(cfg *Config) http.HandlerFunc {
+// Trace GETs path from the device and times each phase of the request. The
+// error is only for a path that does not make a valid URL; request failures
+// are reported in the trace.
+func (d *DeviceClient) Trace(ctx context.Context, path string) (RequestTrace, error) {
+	result := RequestTrace{Endpoint: path, URL: d.URL(path)}
+
+	var dnsStart, connStart, tlsStart, gotConn, wrote time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { result.DNSMs = millis(time.Since(dnsStart)) },
+		ConnectStart:      func(string, string) { connStart = time.Now() },
+		ConnectDone:       func(string, string, error) { result.ConnectMs = millis(time.Since(connStart)) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { result.TLSMs = millis(time.Since(tlsStart)) },
+		GotConn:           func(httptrace.GotConnInfo) { gotConn = time.Now() },
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			wrote = time.Now()
+			result.SendMs = millis(wrote.Sub(gotConn))
+		},
+		GotFirstResponseByte: func() { result.TTFBMs = millis(time.Since(wrote)) },
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, result.URL, nil)
+	if err != nil {
+		return result, err
+	}
+	// A fresh connection every time, otherwise a pooled connection would
+	// hide the DNS, connect and TLS phases.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+	}
+	result.TotalMs = millis(time.Since(start))
+	return result, nil
+}
+
+// Reachability is the body of GET /device/reachable.
+type Reachability struct {
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latency_ms"`
+	Host      string  `json:"host"`
+	Port      int     `json:"port"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Handler for /device/reachable?timeout_ms=N. It only dials the device's TCP
+// port, so it answers even when the device's HTTP server is down.
+func reachableHandler(dev DeviceAPI, reg *DeviceRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := cfg.deviceURL("/api/v1/upgrade")
-		body, err := io.ReadAll(r.Body)
+		maxTimeout := dev.Config().ReachabilityMaxTimeout
+		target := dev
+		if name := r.URL.Query().Get("device"); name != "" {
+			client, ok := reg.Get(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown device %q, known devices: %s", name, strings.Join(reg.Names(), ", ")), http.StatusNotFound)
+				return
+			}
+			target = client
+		}
+		timeout := maxTimeout
+		if v := r.URL.Query().Get("timeout_ms"); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms <= 0 {
+				http.Error(w, "timeout_ms must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			timeout = min(time.Duration(ms)*time.Millisecond, maxTimeout)
+		}
+		result, err := target.Reachable(timeout)
 		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Invalid device address: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Reachable dials the device's TCP port. The error is only for an invalid
+// device address; a failed dial is reported in the result.
+func (d *DeviceClient) Reachable(timeout time.Duration) (Reachability, error) {
+	host, port, err := d.Addr()
+	if err != nil {
+		return Reachability{}, err
+	}
+	result := Reachability{Host: host, Port: port}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	result.LatencyMs = millis(time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		conn.Close()
+		result.Reachable = true
+	}
+	return result, nil
+}
+
+// wolBroadcastAddr is where Wake-on-LAN magic packets are sent.
+const wolBroadcastAddr = "255.255.255.255:9"
+
+// parseWakeMAC parses a 48-bit Ethernet address, the only kind a magic
+// packet can carry.
+func parseWakeMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("%d-byte address, Wake-on-LAN needs 6 bytes", len(mac))
+	}
+	return mac, nil
+}
+
+// magicPacket builds a Wake-on-LAN payload: 6 bytes of 0xFF followed by the
+// MAC repeated 16 times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// WakeRequest is the optional body of POST /device/wol.
+type WakeRequest struct {
+	MACAddress string `json:"mac_address"`
+}
+
+// Handler for POST /device/wol
+func wolHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req WakeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		target := req.MACAddress
+		if target == "" {
+			target = dev.Config().DeviceMAC
+		}
+		if target == "" {
+			http.Error(w, "No MAC address: set DEVICE_MAC_ADDRESS or send {\"mac_address\": \"AA:BB:CC:DD:EE:FF\"}", http.StatusBadRequest)
 			return
 		}
-		req, err := http.NewRequest(http.MethodPost, target, bytes.NewBuffer(body))
+		mac, err := parseWakeMAC(target)
 		if err != nil {
-			http.Error(w, "Failed to build request", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Invalid MAC address %q: %v", target, err), http.StatusBadRequest)
 			return
 		}
-		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-		resp, err := http.DefaultClient.Do(req)
+		logf(r.Context(), "Sending Wake-on-LAN packet for %s to %s", mac, wolBroadcastAddr)
+		conn, err := net.Dial("udp4", wolBroadcastAddr)
+		if err == nil {
+			_, err = conn.Write(magicPacket(mac))
+			conn.Close()
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to upgrade: %v", err), http.StatusBadGateway)
+			logf(r.Context(), "Wake-on-LAN for %s failed: %v", mac, err)
+			http.Error(w, fmt.Sprintf("Failed to send Wake-on-LAN packet: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"mac_address": mac.String(), "sent_to": wolBroadcastAddr})
+	}
+}
+
+// parsePIDList parses a comma-separated list of process IDs.
+func parsePIDList(list string) ([]int, error) {
+	var pids []int
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		pid, err := strconv.Atoi(f)
+		if err != nil || pid < 1 {
+			return nil, fmt.Errorf("%q is not a process ID", f)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// parseProxyList parses a comma-separated list of IP addresses and CIDRs. A
+// bare address matches only itself.
+func parseProxyList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", f)
+			}
+			bits := 128
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientIdentity describes who sent r for the audit log. X-Forwarded-For is
+// only believed when the request comes from one of TRUSTED_PROXIES; anyone
+// else could put any address in it, so they are identified by r.RemoteAddr.
+func clientIdentity(r *http.Request, trustedProxies string) string {
+	fwd := r.Header.Get("X-Forwarded-For")
+	if fwd == "" {
+		return r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	// Already checked by ValidateConfig
+	proxies, _ := parseProxyList(trustedProxies)
+	for _, n := range proxies {
+		if ip != nil && n.Contains(ip) {
+			client := strings.TrimSpace(strings.Split(fwd, ",")[0])
+			return fmt.Sprintf("%s (via proxy %s)", client, r.RemoteAddr)
+		}
+	}
+	return r.RemoteAddr
+}
+
+// Handler for GET /device/process
+func processListHandler(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Get(r.Context(), dev.Config().ProcessListPath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list processes: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
 		w.WriteHeader(resp.StatusCode)
 		io.Copy(w, resp.Body)
 	}
 }
 
-// Handler for /control
-func controlHandler(cfg *Config) http.HandlerFunc {
+// Handler for DELETE /device/process/{pid}?reason=. Only PIDs listed in
+// PROCESS_KILL_ALLOWED_PIDS can be terminated; every attempt is logged with
+// the client and reason.
+func processKillHandler(dev DeviceAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := cfg.deviceURL("/api/v1/control")
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		pid, err := strconv.Atoi(r.PathValue("pid"))
+		if err != nil || pid < 1 {
+			http.Error(w, "Invalid process ID", http.StatusBadRequest)
 			return
 		}
-		req, err := http.NewRequest(http.MethodPost, target, bytes.NewBuffer(body))
-		if err != nil {
-			http.Error(w, "Failed to build request", http.StatusInternalServerError)
+		cfg := dev.Config()
+		client, reason := clientIdentity(r, cfg.TrustedProxies), r.URL.Query().Get("reason")
+		// Already checked by ValidateConfig
+		allowed, _ := parsePIDList(cfg.ProcessKillAllowedPIDs)
+		if !slices.Contains(allowed, pid) {
+			logf(r.Context(), "Process termination denied: pid=%d client=%s reason=%q (not in PROCESS_KILL_ALLOWED_PIDS)", pid, client, reason)
+			http.Error(w, fmt.Sprintf("Process %d is not in PROCESS_KILL_ALLOWED_PIDS", pid), http.StatusForbidden)
 			return
 		}
-		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := dev.Delete(r.Context(), fmt.Sprintf("%s/%d", strings.TrimSuffix(cfg.ProcessListPath, "/"), pid))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to send control command: %v", err), http.StatusBadGateway)
+			logf(r.Context(), "Process termination failed: pid=%d client=%s reason=%q: %v", pid, client, reason, err)
+			http.Error(w, fmt.Sprintf("Failed to terminate process: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
+		logf(r.Context(), "Process termination requested: pid=%d client=%s reason=%q device replied %s", pid, client, reason, resp.Status)
+		copyHeader(w.Header(), resp.Header, cfg.UpstreamAllowedHeaders)
 		w.WriteHeader(resp.StatusCode)
 		io.Copy(w, resp.Body)
 	}
 }
 
-// Handler for /infer
-func inferHandler(cfg *Config) http.HandlerFunc {
+// loadExecMap reads DEVICE_EXEC_MAP_FILE: a JSON object mapping each command
+// ID allowed on POST /device/exec to the device API path that runs it, e.g.
+// {"diagnostics_run": "/api/v1/diagnostics/run"}.
+func loadExecMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var commands map[string]string
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for id, p := range commands {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("%s: command %q maps to %q, which is not a device API path", path, id, p)
+		}
+	}
+	return commands, nil
+}
+
+// ExecRequest is the body of POST /device/exec.
+type ExecRequest struct {
+	CommandID string `json:"command_id"`
+}
+
+// Handler for POST /device/exec. Only command IDs listed in
+// DEVICE_EXEC_MAP_FILE run; the device path comes from the map, never from
+// the client. Every attempt is logged with the command ID and client.
+func execHandler(dev DeviceAPI, commands map[string]string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := cfg.deviceURL("/api/v1/infer")
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if len(commands) == 0 {
+			http.Error(w, "No commands configured: set DEVICE_EXEC_MAP_FILE", http.StatusNotFound)
 			return
 		}
-		req, err := http.NewRequest(http.MethodPost, target, bytes.NewBuffer(body))
-		if err != nil {
-			http.Error(w, "Failed to build request", http.StatusInternalServerError)
+		var req ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CommandID == "" {
+			http.Error(w, "Invalid JSON body, expected {\"command_id\": \"...\"}", http.StatusBadRequest)
 			return
 		}
-		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-		resp, err := http.DefaultClient.Do(req)
+		client := clientIdentity(r, dev.Config().TrustedProxies)
+		path, ok := commands[req.CommandID]
+		if !ok {
+			logf(r.Context(), "Device exec denied: command_id=%q client=%s (not in DEVICE_EXEC_MAP_FILE)", req.CommandID, client)
+			http.Error(w, fmt.Sprintf("Unknown command_id %q", req.CommandID), http.StatusForbidden)
+			return
+		}
+		resp, err := dev.Post(r.Context(), path, "", nil)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to trigger inference: %v", err), http.StatusBadGateway)
+			logf(r.Context(), "Device exec failed: command_id=%q client=%s: %v", req.CommandID, client, err)
+			http.Error(w, fmt.Sprintf("Failed to run command: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
-		copyHeader(w.Header(), resp.Header)
+		logf(r.Context(), "Device exec: command_id=%q client=%s device replied %s", req.CommandID, client, resp.Status)
+		copyHeader(w.Header(), resp.Header, dev.Config().UpstreamAllowedHeaders)
 		w.WriteHeader(resp.StatusCode)
 		io.Copy(w, resp.Body)
 	}
 }
 
-// Handler for /camera
-func cameraHandler(cfg *Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// GET a snapshot from the camera and proxy back to HTTP
-		target := cfg.deviceURL(cfg.CameraSnapshot)
-		client := &http.Client{
-			Timeout: 10 * time.Second,
+// hashingResponseWriter feeds a JSON response body into a SHA-256 hash so it
+// can be sent as X-Response-Hash. Headers go out before the body, so JSON
+// bodies are held until the handler returns; any other content type (camera
+// images, streams) is passed straight through unhashed.
+type hashingResponseWriter struct {
+	http.ResponseWriter
+	hash     hash.Hash
+	buf      bytes.Buffer
+	status   int
+	decided  bool
+	buffered bool
+}
+
+func (h *hashingResponseWriter) WriteHeader(status int) {
+	if h.decided {
+		return
+	}
+	h.decided = true
+	h.status = status
+	h.buffered = strings.HasPrefix(h.Header().Get("Content-Type"), "application/json")
+	if !h.buffered {
+		h.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (h *hashingResponseWriter) Write(p []byte) (int, error) {
+	if !h.decided {
+		h.WriteHeader(http.StatusOK)
+	}
+	if !h.buffered {
+		return h.ResponseWriter.Write(p)
+	}
+	h.hash.Write(p)
+	return h.buf.Write(p)
+}
+
+// Flush passes through for unbuffered responses; a buffered JSON body is
+// only complete, and its hash known, once the handler returns.
+func (h *hashingResponseWriter) Flush() {
+	if h.decided && !h.buffered {
+		if f, ok := h.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
 		}
-		resp, err := client.Get(target)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get camera snapshot: %v", err), http.StatusBadGateway)
+	}
+}
+
+func (h *hashingResponseWriter) finish() {
+	if !h.buffered {
+		return
+	}
+	h.Header().Set("X-Response-Hash", "sha256="+hex.EncodeToString(h.hash.Sum(nil)))
+	h.Header().Del("Content-Length")
+	h.ResponseWriter.WriteHeader(h.status)
+	h.ResponseWriter.Write(h.buf.Bytes())
+}
+
+// hashResponses adds X-Response-Hash: sha256=<hex> to JSON responses while
+// RESPONSE_HASH_HEADER=true. The setting is read per request so a SIGHUP
+// reload can turn it on or off.
+func hashResponses(dev DeviceAPI, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dev.Config().ResponseHash {
+			next.ServeHTTP(w, r)
 			return
 		}
-		defer resp.Body.Close()
-		contentType := resp.Header.Get("Content-Type")
-		if contentType == "" {
-			contentType = "image/jpeg"
+		hw := &hashingResponseWriter{ResponseWriter: w, hash: sha256.New()}
+		defer hw.finish()
+		next.ServeHTTP(hw, r)
+	})
+}
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestID returns the request ID stored in ctx by withRequestID, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID accepts caller-supplied IDs of up to 128 printable ASCII
+// characters so they can't break up log lines or response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
 		}
-		w.Header().Set("Content-Type", contentType)
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+	}
+	return true
+}
+
+// withRequestID takes the caller's X-Request-ID, or generates one, stores it
+// in the request context and echoes it on the response. DeviceClient
+// forwards it to the device so one ID ties together the client, driver and
+// device logs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// logf logs like log.Printf, prefixed with the request ID in ctx if there
+// is one.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := RequestID(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// copyHeader copies the device response headers named in allowed
+// (UPSTREAM_ALLOWED_RESPONSE_HEADERS) to dst. Anything else, such as a
+// Set-Cookie or X-Frame-Options from a misbehaving device, is dropped.
+func copyHeader(dst, src http.Header, allowed string) {
+	for _, name := range strings.Split(allowed, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		for _, v := range src[name] {
+			dst.Add(name, v)
+		}
+	}
+}
+
+// Scheduler runs the driver's periodic background tasks and lets operators
+// inspect, trigger and pause them over HTTP.
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs []*ScheduledJob
+}
+
+// ScheduledJob is a named task run every Interval. A paused job skips its
+// ticks but can still be run by hand.
+type ScheduledJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+
+	trigger  chan struct{}
+	mu       sync.Mutex
+	paused   bool
+	nextRun  time.Time
+	lastRun  time.Time
+	lastErr  error
+	runCount int
+}
+
+// JobStatus is the JSON view of a scheduled job.
+type JobStatus struct {
+	Name      string     `json:"name"`
+	IntervalS float64    `json:"interval_s"`
+	NextRun   *time.Time `json:"next_run"`
+	LastRun   *time.Time `json:"last_run"`
+	LastError string     `json:"last_error"`
+	RunCount  int        `json:"run_count"`
+	Paused    bool       `json:"paused"`
+}
+
+// Add registers a job. Jobs added after Start are not run.
+func (s *Scheduler) Add(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &ScheduledJob{Name: name, Interval: interval, Run: run, trigger: make(chan struct{}, 1)})
+}
+
+// Start runs every job immediately and then on its interval until ctx is
+// cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		go j.loop(ctx)
+	}
+}
+
+// Job returns the job with the given name, or nil.
+func (s *Scheduler) Job(name string) *ScheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// List returns the status of every job in registration order.
+func (s *Scheduler) List() []JobStatus {
+	s.mu.Lock()
+	jobs := append([]*ScheduledJob(nil), s.jobs...)
+	s.mu.Unlock()
+	out := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, j.Status())
+	}
+	return out
+}
+
+func (j *ScheduledJob) loop(ctx context.Context) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	j.execute(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if j.Paused() {
+				continue
+			}
+		case <-j.trigger:
+			ticker.Reset(j.Interval)
+		}
+		j.execute(ctx)
+	}
+}
+
+func (j *ScheduledJob) execute(ctx context.Context) {
+	start := time.Now()
+	err := j.Run(ctx)
+	j.mu.Lock()
+	j.lastRun = start
+	j.lastErr = err
+	j.runCount++
+	j.nextRun = time.Now().Add(j.Interval)
+	j.mu.Unlock()
+}
+
+// Trigger asks the job to run as soon as possible, even if it is paused.
+func (j *ScheduledJob) Trigger() {
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetPaused suspends or resumes the job's periodic runs.
+func (j *ScheduledJob) SetPaused(paused bool) {
+	j.mu.Lock()
+	j.paused = paused
+	j.mu.Unlock()
+}
+
+// Paused reports whether the job's periodic runs are suspended.
+func (j *ScheduledJob) Paused() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.paused
+}
+
+// Status returns a snapshot of the job's schedule and last result.
+func (j *ScheduledJob) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := JobStatus{
+		Name:      j.Name,
+		IntervalS: j.Interval.Seconds(),
+		RunCount:  j.runCount,
+		Paused:    j.paused,
+	}
+	if !j.nextRun.IsZero() && !j.paused {
+		t := j.nextRun
+		st.NextRun = &t
+	}
+	if !j.lastRun.IsZero() {
+		t := j.lastRun
+		st.LastRun = &t
+	}
+	if j.lastErr != nil {
+		st.LastError = j.lastErr.Error()
+	}
+	return st
+}
+
+// Handler for /scheduler/jobs
+func schedulerJobsHandler(s *Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.List())
 	}
 }
 
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
+// Handler for /scheduler/jobs/{name}/{action}
+func schedulerJobActionHandler(s *Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j := s.Job(r.PathValue("name"))
+		if j == nil {
+			http.Error(w, "Unknown job", http.StatusNotFound)
+			return
 		}
+		switch r.PathValue("action") {
+		case "run":
+			j.Trigger()
+		case "pause":
+			j.SetPaused(true)
+		case "resume":
+			j.SetPaused(false)
+		default:
+			http.Error(w, "Unknown action", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(j.Status())
 	}
 }
 
+// HealthCheck is one condition reported by /healthz/live and /healthz/ready.
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is the body of /healthz, /healthz/live and /healthz/ready.
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// Handler for /healthz and /healthz/live. Liveness never depends on the
+// device: an unreachable device fails readiness, it doesn't need a restart.
 func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"status":"ok"}`))
+	json.NewEncoder(w).Encode(Health{
+		Status: "ok",
+		Checks: map[string]HealthCheck{
+			"process":     {OK: true, Detail: fmt.Sprintf("pid %d", os.Getpid())},
+			"http_server": {OK: true},
+		},
+	})
+}
+
+// Handler for /healthz/ready. The device is ready while its heartbeat is
+// fresh; without a heartbeat monitor the device status is probed the same
+// way as for /readyz.
+func healthzReadyHandler(p *ReadinessProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := Health{Status: "ready", Checks: map[string]HealthCheck{}}
+		if p.Heartbeat != nil {
+			check := HealthCheck{Detail: "no heartbeat yet"}
+			lastSeen, stale := p.Heartbeat.Status()
+			if !lastSeen.IsZero() {
+				check.OK = !stale
+				check.Detail = "last heartbeat " + lastSeen.UTC().Format(time.RFC3339)
+			}
+			health.Checks["device_heartbeat"] = check
+		} else {
+			result := p.Check(r.Context())
+			health.Checks["device_status"] = HealthCheck{OK: result.Status == "ready", Detail: result.Error}
+		}
+		for _, check := range health.Checks {
+			if !check.OK {
+				health.Status = "unready"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if health.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+// ReadinessProbe backs /readyz by checking the device's status endpoint.
+// Within READYZ_STALE_TOLERANCE_S of the last successful check, by this probe
+// or by the heartbeat monitor, the device is reported ready without a new
+// request, so a loaded device that is slow to answer doesn't flap the pod.
+type ReadinessProbe struct {
+	Client    DeviceAPI
+	Heartbeat *HeartbeatMonitor // optional
+
+	mu     sync.Mutex
+	lastOK time.Time
+}
+
+// Readiness is the body of GET /readyz.
+type Readiness struct {
+	Status    string     `json:"status"`
+	Cached    bool       `json:"cached,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// lastSuccess returns the most recent successful device check.
+func (p *ReadinessProbe) lastSuccess() time.Time {
+	p.mu.Lock()
+	last := p.lastOK
+	p.mu.Unlock()
+	if p.Heartbeat != nil {
+		if seen, _ := p.Heartbeat.Status(); seen.After(last) {
+			last = seen
+		}
+	}
+	return last
+}
+
+// Check reports whether the device is ready, probing it unless a recent
+// success is within the stale tolerance.
+func (p *ReadinessProbe) Check(ctx context.Context) Readiness {
+	cfg := p.Client.Config()
+	if cfg.MockMode {
+		return Readiness{Status: "ready"}
+	}
+	if last := p.lastSuccess(); cfg.ReadyzStaleTolerance > 0 && !last.IsZero() && time.Since(last) <= cfg.ReadyzStaleTolerance {
+		log.Printf("WARNING: /readyz serving cached readiness from %v ago", time.Since(last).Round(time.Second))
+		at := last.UTC()
+		return Readiness{Status: "ready", Cached: true, LastCheck: &at}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Client.URL("/api/v1/status"), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("device status returned %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		return Readiness{Status: "unready", Error: err.Error()}
+	}
+	now := time.Now()
+	p.mu.Lock()
+	p.lastOK = now
+	p.mu.Unlock()
+	at := now.UTC()
+	return Readiness{Status: "ready", LastCheck: &at}
+}
+
+// Handler for /readyz
+func readyzHandler(p *ReadinessProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := p.Check(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if result.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
 }
 
 func main() {
-	cfg := loadConfig()
+	cfg, err := loadConfigSources()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	log.Printf("Effective configuration: %s", cfg.Redacted())
+	var dev DeviceAPI = NewDeviceClient(cfg)
+	var mock *MockDeviceClient
+	if cfg.MockMode {
+		if mock, err = NewMockDeviceClient(cfg); err != nil {
+			log.Fatalf("Failed to load mock responses: %v", err)
+		}
+		dev = mock
+		log.Printf("Device mock mode: serving %d canned response(s) from %s", len(mock.responses), cfg.MockResponsesFile)
+	}
+	breaker := NewCircuitBreaker(dev)
+	dev = breaker
+	scheduler := &Scheduler{}
+	if cfg.DeviceHostname != "" && !cfg.MockMode {
+		watcher := &DeviceIPWatcher{Hostname: cfg.DeviceHostname, Interval: cfg.HostnameRefresh, Client: dev}
+		scheduler.Add("device-ip-watch", watcher.Interval, watcher.Check)
+	}
+	registry := NewDeviceRegistry(cfg)
+	if mock != nil {
+		registry.NewClient = mock.For
+	}
+	if cfg.RegistryFile != "" {
+		if err := registry.LoadFile(cfg.RegistryFile); err != nil {
+			log.Fatalf("Failed to load device registry: %v", err)
+		}
+	}
+	if cfg.Discovery && cfg.DiscoveryRefresh > 0 && !cfg.MockMode {
+		scheduler.Add("mdns-discovery", cfg.DiscoveryRefresh, func(ctx context.Context) error {
+			return registry.Discover(ctx, cfg.MDNSServiceType)
+		})
+	}
+	var execCommands map[string]string
+	if cfg.ExecMapFile != "" {
+		if execCommands, err = loadExecMap(cfg.ExecMapFile); err != nil {
+			log.Fatalf("Failed to load device exec map: %v", err)
+		}
+		log.Printf("Device exec: %d command(s) from %s", len(execCommands), cfg.ExecMapFile)
+	}
+	var heartbeat *HeartbeatMonitor
+	if cfg.HeartbeatInterval > 0 {
+		heartbeat = &HeartbeatMonitor{
+			Client:     dev,
+			Interval:   cfg.HeartbeatInterval,
+			StaleAfter: cfg.HeartbeatStale,
+			WebhookURL: cfg.HeartbeatWebhook,
+		}
+		scheduler.Add("heartbeat", heartbeat.Interval, heartbeat.Check)
+	}
+	snapshots := &SnapshotStore{Dir: cfg.SnapshotDir, MaxFiles: cfg.SnapshotMaxFiles, Analyze: cfg.SnapshotAnalyze, Client: dev}
+	if cfg.SnapshotInterval > 0 {
+		if err := os.MkdirAll(cfg.SnapshotDir, 0o755); err != nil {
+			log.Fatalf("Failed to create snapshot directory: %v", err)
+		}
+		scheduler.Add("camera-snapshot", cfg.SnapshotInterval, snapshots.Capture)
+	}
+	scheduler.Start(context.Background())
+
+	reloader := &ConfigReloader{Client: dev, Apply: func(cfg *Config) {
+		if heartbeat != nil {
+			heartbeat.Reconfigure(cfg.HeartbeatStale, cfg.HeartbeatWebhook)
+		}
+		snapshots.Reconfigure(cfg.SnapshotMaxFiles, cfg.SnapshotAnalyze)
+	}}
+	go reloader.Watch(context.Background())
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/status", statusHandler(cfg))
-	mux.HandleFunc("/metrics", metricsHandler(cfg))
-	mux.HandleFunc("/upgrade", upgradeHandler(cfg))
-	mux.HandleFunc("/control", controlHandler(cfg))
-	mux.HandleFunc("/infer", inferHandler(cfg))
-	mux.HandleFunc("/camera", cameraHandler(cfg))
+	mux.HandleFunc("/status", fleetHandler(registry, "/api/v1/status", statusHandler(dev, heartbeat, breaker), func(d DeviceAPI) http.HandlerFunc {
+		return statusHandler(d, nil, nil)
+	}))
+	mux.HandleFunc("/metrics", metricsHandler(dev))
+	mux.HandleFunc("GET /driver/metrics", driverMetricsHandler)
+	mux.HandleFunc("/upgrade", upgradeHandler(dev))
+	mux.HandleFunc("/control", fleetHandler(registry, "/api/v1/control", controlHandler(dev), controlHandler))
+	mux.HandleFunc("/infer", inferHandler(dev, &InferenceCache{}))
+	inferJobs := NewInferJobStore(cfg.InferJobHistory, cfg.InferWorkers)
+	mux.HandleFunc("POST /infer/async", inferAsyncHandler(dev, inferJobs))
+	mux.HandleFunc("GET /infer/jobs", inferJobsHandler(inferJobs))
+	mux.HandleFunc("GET /infer/jobs/{id}", inferJobHandler(inferJobs))
+	mux.HandleFunc("/camera", cameraHandler(dev))
+	mux.HandleFunc("POST /camera/ptz", cameraPTZHandler(dev))
+	mux.HandleFunc("POST /camera/analyze", cameraAnalyzeHandler(dev))
+	mux.HandleFunc("GET /camera/snapshots", snapshotsHandler(snapshots))
+	mux.HandleFunc("GET /camera/snapshots/{filename}", snapshotFileHandler(snapshots))
+	readiness := &ReadinessProbe{Client: dev, Heartbeat: heartbeat}
 	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/healthz/live", healthzHandler)
+	mux.HandleFunc("/healthz/ready", healthzReadyHandler(readiness))
+	mux.HandleFunc("/readyz", readyzHandler(readiness))
+	mux.HandleFunc("GET /trace", traceHandler(dev))
+	mux.HandleFunc("GET /devices", devicesHandler(registry))
+	mux.HandleFunc("GET /device/reachable", reachableHandler(dev, registry))
+	mux.HandleFunc("POST /device/wol", requireAdminToken(dev, wolHandler(dev)))
+	mux.HandleFunc("GET /device/process", processListHandler(dev))
+	mux.HandleFunc("DELETE /device/process/{pid}", requireAdminToken(dev, processKillHandler(dev)))
+	mux.HandleFunc("POST /device/exec", requireAdminToken(dev, execHandler(dev, execCommands)))
+	mux.HandleFunc("GET /config", requireAdminToken(dev, configHandler(dev, reloader)))
+	mux.HandleFunc("POST /config/reload", requireAdminToken(dev, configReloadHandler(reloader)))
+	mux.HandleFunc("GET /scheduler/jobs", schedulerJobsHandler(scheduler))
+	mux.HandleFunc("POST /scheduler/jobs/{name}/{action}", requireAdminToken(dev, schedulerJobActionHandler(scheduler)))
 
 	serverAddr := net.JoinHostPort(cfg.ServerHost, cfg.ServerPort)
 	server := &http.Server{
 		Addr:    serverAddr,
-		Handler: mux,
+		Handler: withRequestID(hashResponses(dev, mux)),
 	}
 
+	if cfg.TLSCertFile != "" {
+		// Already checked by ValidateConfig
+		server.TLSConfig, _ = serverTLSConfig(cfg)
+		if len(server.TLSConfig.CipherSuites) > 0 && server.TLSConfig.MinVersion == tls.VersionTLS13 {
+			log.Printf("TLS_CIPHER_SUITES has no effect when TLS_MIN_VERSION is TLS13")
+		}
+		log.Printf("Shifu driver HTTPS server started at %s", serverAddr)
+		if err := server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	}
 	log.Printf("Shifu driver HTTP server started at %s", serverAddr)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
-}
\ No newline at end of file
+}
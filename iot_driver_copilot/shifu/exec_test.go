@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecRunsMappedCommand(t *testing.T) {
+	dev, seen := recordingDevice(t, loadConfig())
+	h := execHandler(dev, map[string]string{"diagnostics_run": "/api/v1/diagnostics/run"})
+
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"command_id":"diagnostics_run"}`, http.StatusOK},
+		{`{"command_id":"/api/v1/reboot"}`, http.StatusForbidden},
+		{`{"command_id":""}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/device/exec", strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.body, w.Code, c.want)
+		}
+	}
+	if got := seen(); !reflect.DeepEqual(got, []string{"POST /api/v1/diagnostics/run"}) {
+		t.Fatalf("device saw %v, want only the mapped path", got)
+	}
+}
+
+func TestExecRequiresAdminToken(t *testing.T) {
+	cfg := loadConfig()
+	cfg.AdminToken = "s3cret"
+	dev, seen := recordingDevice(t, cfg)
+	h := requireAdminToken(dev, execHandler(dev, map[string]string{"diagnostics_run": "/api/v1/diagnostics/run"}))
+	for _, c := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", "/device/exec", strings.NewReader(`{"command_id":"diagnostics_run"}`))
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != c.want {
+			t.Errorf("Authorization %q: status %d, want %d", c.auth, w.Code, c.want)
+		}
+	}
+	if got := seen(); len(got) != 1 {
+		t.Fatalf("device saw %v, want only the authorized request", got)
+	}
+}
+
+func TestExecWithoutCommands(t *testing.T) {
+	w := httptest.NewRecorder()
+	execHandler(offlineDevice(t), nil)(w, httptest.NewRequest("POST", "/device/exec", strings.NewReader(`{"command_id":"x"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", w.Code)
+	}
+}
+
+func TestLoadExecMap(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	commands, err := loadExecMap(write("ok.json", `{"diagnostics_run": "/api/v1/diagnostics/run"}`))
+	if err != nil || commands["diagnostics_run"] != "/api/v1/diagnostics/run" {
+		t.Fatalf("loadExecMap = %v, %v", commands, err)
+	}
+	for name, data := range map[string]string{
+		"url.json":     `{"x": "http://evil/run"}`,
+		"invalid.json": `{"x": `,
+	} {
+		if _, err := loadExecMap(write(name, data)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHealth(t *testing.T, h http.HandlerFunc, path string) (int, Health) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", path, nil))
+	var health Health
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("%s: %v: %s", path, err, w.Body.String())
+	}
+	return w.Code, health
+}
+
+func TestHealthzLiveWhileDeviceOffline(t *testing.T) {
+	probe := &ReadinessProbe{Client: offlineDevice(t)}
+
+	code, live := getHealth(t, healthzHandler, "/healthz/live")
+	if code != http.StatusOK || live.Status != "ok" {
+		t.Fatalf("live: %d %+v, want 200 ok", code, live)
+	}
+	for _, name := range []string{"process", "http_server"} {
+		if !live.Checks[name].OK {
+			t.Errorf("live check %s not ok", name)
+		}
+	}
+
+	code, ready := getHealth(t, healthzReadyHandler(probe), "/healthz/ready")
+	if code != http.StatusServiceUnavailable || ready.Status != "unready" {
+		t.Fatalf("ready: %d %+v, want 503 unready", code, ready)
+	}
+	if check := ready.Checks["device_status"]; check.OK || check.Detail == "" {
+		t.Fatalf("device_status check = %+v, want a failure with detail", check)
+	}
+}
+
+func TestHealthzReadyWhileDeviceOnline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	probe := &ReadinessProbe{Client: NewDeviceClient(cfg)}
+	code, ready := getHealth(t, healthzReadyHandler(probe), "/healthz/ready")
+	if code != http.StatusOK || ready.Status != "ready" || !ready.Checks["device_status"].OK {
+		t.Fatalf("ready: %d %+v, want 200 ready", code, ready)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookEvents returns a webhook URL and a channel of the "event" field of
+// each payload posted to it.
+func webhookEvents(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		events <- payload["event"].(string)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, events
+}
+
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+		return ""
+	}
+}
+
+func TestHeartbeatStaleAndRecovered(t *testing.T) {
+	var up atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.RetryMax = 0 // one request per heartbeat, so the 50ms threshold holds
+	webhook, events := webhookEvents(t)
+	m := &HeartbeatMonitor{Client: NewDeviceClient(cfg), Interval: time.Second, StaleAfter: 50 * time.Millisecond, WebhookURL: webhook}
+	ctx := context.Background()
+
+	// A device that never answered is not stale until the threshold passes
+	if err := m.Check(ctx); err == nil {
+		t.Fatal("Check succeeded against a 503")
+	}
+	if _, stale := m.Status(); stale {
+		t.Fatal("stale immediately after monitoring began")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	m.Check(ctx)
+	if lastSeen, stale := m.Status(); !stale || !lastSeen.IsZero() {
+		t.Fatalf("Status = %v, %v; want stale with no heartbeat", lastSeen, stale)
+	}
+	if e := nextEvent(t, events); e != "device.stale" {
+		t.Fatalf("webhook event %q, want device.stale", e)
+	}
+
+	up.Store(true)
+	if err := m.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lastSeen, stale := m.Status(); stale || lastSeen.IsZero() {
+		t.Fatalf("Status = %v, %v; want fresh", lastSeen, stale)
+	}
+	if e := nextEvent(t, events); e != "device.recovered" {
+		t.Fatalf("webhook event %q, want device.recovered", e)
+	}
+
+	// No change, no webhook
+	m.Check(ctx)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected webhook %q", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
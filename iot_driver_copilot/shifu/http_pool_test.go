@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeviceClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	dev := NewDeviceClient(cfg)
+	for i := 0; i < 5; i++ {
+		resp, err := dev.Get(context.Background(), "/api/v1/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("5 sequential requests opened %d connections, want 1", n)
+	}
+}
+
+func TestDeviceClientHeaderTimeoutSkipsSlowPaths(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.HTTPHeaderTimeout = 50 * time.Millisecond
+	cfg.RetryMax = 0
+	dev := NewDeviceClient(cfg)
+	ctx := context.Background()
+	if _, err := dev.Get(ctx, "/api/v1/status"); err == nil {
+		t.Fatal("slow /api/v1/status reply did not hit the header timeout")
+	}
+	for _, path := range []string{"/api/v1/infer", "/api/v1/upgrade"} {
+		resp, err := dev.Post(ctx, path, "application/json", []byte("{}"))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+}
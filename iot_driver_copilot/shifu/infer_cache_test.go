@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// inferDevice returns a DeviceClient for a device whose /api/v1/infer
+// answers with a JSON label, and the count of inference calls.
+func inferDevice(t *testing.T, ttl time.Duration) (*DeviceClient, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"label":"cat","score":0.9}`)
+	}))
+	t.Cleanup(srv.Close)
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.InferCacheTTL, cfg.InferSampleRate = ttl, 1
+	return NewDeviceClient(cfg), &calls
+}
+
+func postInfer(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/infer", strings.NewReader(body)))
+	return w
+}
+
+func TestInferCacheAnswersRepeatedRequest(t *testing.T) {
+	dev, calls := inferDevice(t, 30*time.Second)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	cache := &InferenceCache{Now: func() time.Time { return now }}
+	h := inferHandler(dev, cache)
+
+	first := postInfer(h, `{"image":"abc"}`)
+	if first.Code != http.StatusOK || first.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first: status %d X-Cache %q", first.Code, first.Header().Get("X-Cache"))
+	}
+	now = now.Add(1500 * time.Millisecond)
+	second := postInfer(h, `{"image":"abc"}`)
+	if second.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("second: X-Cache %q, want HIT", second.Header().Get("X-Cache"))
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("device called %d times, want 1", n)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(second.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["label"] != "cat" || body["cache_age_ms"] != float64(1500) {
+		t.Fatalf("cached body = %v", body)
+	}
+
+	// A different body is a different key
+	postInfer(h, `{"image":"xyz"}`)
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("device called %d times after a new request, want 2", n)
+	}
+}
+
+func TestInferCacheExpires(t *testing.T) {
+	dev, calls := inferDevice(t, 30*time.Second)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	h := inferHandler(dev, &InferenceCache{Now: func() time.Time { return now }})
+	postInfer(h, `{"image":"abc"}`)
+	now = now.Add(30 * time.Second)
+	if w := postInfer(h, `{"image":"abc"}`); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("after the TTL: X-Cache %q, want MISS", w.Header().Get("X-Cache"))
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("device called %d times, want 2", n)
+	}
+}
+
+func TestInferCacheDisabled(t *testing.T) {
+	dev, calls := inferDevice(t, 0)
+	h := inferHandler(dev, &InferenceCache{})
+	for i := 0; i < 2; i++ {
+		if w := postInfer(h, `{"image":"abc"}`); w.Header().Get("X-Cache") != "" {
+			t.Fatalf("X-Cache %q with INFER_CACHE_TTL_S=0", w.Header().Get("X-Cache"))
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("device called %d times, want 2", n)
+	}
+}
+
+func TestInferCacheEvictsOldest(t *testing.T) {
+	dev, calls := inferDevice(t, 30*time.Second)
+	cfg := *dev.Config()
+	cfg.InferCacheMax = 2
+	dev.SetConfig(&cfg)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	h := inferHandler(dev, &InferenceCache{Now: func() time.Time { return now }})
+	for _, body := range []string{`{"image":"a"}`, `{"image":"b"}`, `{"image":"c"}`} {
+		postInfer(h, body)
+		now = now.Add(time.Second)
+	}
+
+	// "a" was evicted to make room for "c"; "b" and "c" are still cached
+	for _, c := range []struct{ body, want string }{
+		{`{"image":"c"}`, "HIT"},
+		{`{"image":"b"}`, "HIT"},
+		{`{"image":"a"}`, "MISS"},
+	} {
+		if w := postInfer(h, c.body); w.Header().Get("X-Cache") != c.want {
+			t.Fatalf("%s: X-Cache %q, want %s", c.body, w.Header().Get("X-Cache"), c.want)
+		}
+	}
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("device called %d times, want 4", n)
+	}
+}
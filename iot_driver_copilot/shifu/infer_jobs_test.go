@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// heldDevice answers inference requests only once release is closed.
+type heldDevice struct {
+	*DeviceClient
+	release chan struct{}
+}
+
+func newHeldDevice(cfg *Config) *heldDevice {
+	return &heldDevice{DeviceClient: NewDeviceClient(cfg), release: make(chan struct{})}
+}
+
+func (d *heldDevice) Post(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	<-d.release
+	return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader(`{"label":"cat"}`))}, nil
+}
+
+// waitFinished polls until the job is done or failed.
+func waitFinished(t *testing.T, jobs *InferJobStore, id string) InferJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := jobs.Get(id); ok && (job.Status == JobDone || job.Status == JobFailed) {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return InferJob{}
+}
+
+func TestInferJobStoreCapsWorkers(t *testing.T) {
+	dev := newHeldDevice(loadConfig())
+	jobs := NewInferJobStore(10, 1)
+	ctx := context.Background()
+	first, err := jobs.Submit(ctx, dev, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Submit(ctx, dev, "application/json", nil); !errors.Is(err, ErrInferBusy) {
+		t.Fatalf("second submit: %v, want ErrInferBusy", err)
+	}
+	if n := len(jobs.List()); n != 1 {
+		t.Fatalf("%d jobs recorded, want only the accepted one", n)
+	}
+	close(dev.release)
+	if job := waitFinished(t, jobs, first.ID); job.Status != JobDone {
+		t.Fatalf("first job %s: %s", job.Status, job.Error)
+	}
+	// The worker is freed once the job has finished
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := jobs.Submit(ctx, dev, "application/json", nil); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker not released after the job finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInferJobStoreEvictsOnlyFinishedJobs(t *testing.T) {
+	dev := newHeldDevice(loadConfig())
+	jobs := NewInferJobStore(1, 3)
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := jobs.Submit(ctx, dev, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	for _, id := range ids {
+		if _, ok := jobs.Get(id); !ok {
+			t.Fatalf("unfinished job %s was evicted", id)
+		}
+	}
+	close(dev.release)
+	// Once all three have finished, the store is back within its limit
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := jobs.List()
+		if len(list) == 1 && list[0].Status == JobDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs after finishing: %+v, want one done job", list)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInferAsyncHandlerSampling(t *testing.T) {
+	cfg := loadConfig()
+	cfg.InferSampleRate = 0
+	jobs := NewInferJobStore(10, 4)
+	w := httptest.NewRecorder()
+	inferAsyncHandler(newHeldDevice(cfg), jobs)(w, httptest.NewRequest("POST", "/infer/async", strings.NewReader("{}")))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	if n := len(jobs.List()); n != 0 {
+		t.Fatalf("%d jobs recorded for a sampled-out request", n)
+	}
+}
+
+func TestInferAsyncHandlerBusy(t *testing.T) {
+	dev := newHeldDevice(loadConfig())
+	defer close(dev.release)
+	jobs := NewInferJobStore(10, 1)
+	handler := inferAsyncHandler(dev, jobs)
+	var codes []int
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/infer/async", strings.NewReader("{}")))
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusAccepted || codes[1] != http.StatusTooManyRequests {
+		t.Fatalf("statuses %v, want [202 429]", codes)
+	}
+}
+
+// pollInferJob submits an inference to POST /infer/async and polls GET
+// /infer/jobs/{id} until the job has finished.
+func pollInferJob(t *testing.T, dev DeviceAPI) InferJob {
+	t.Helper()
+	jobs := NewInferJobStore(10, 1)
+	w := httptest.NewRecorder()
+	inferAsyncHandler(dev, jobs)(w, httptest.NewRequest("POST", "/infer/async", strings.NewReader(`{"image":"cat.jpg"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit: status %d, want 202", w.Code)
+	}
+	var accepted map[string]string
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := httptest.NewRequest("GET", "/infer/jobs/"+accepted["job_id"], nil)
+		r.SetPathValue("id", accepted["job_id"])
+		w := httptest.NewRecorder()
+		inferJobHandler(jobs)(w, r)
+		var job InferJob
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("poll: status %d %s", w.Code, w.Body.String())
+		}
+		if job.Status == JobDone || job.Status == JobFailed {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", job.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInferJobResultMatchesDevice(t *testing.T) {
+	job := pollInferJob(t, mockDevice(t, `{"/api/v1/infer": {"body": {"label": "cat", "score": 0.97}}}`))
+	want := map[string]interface{}{"label": "cat", "score": 0.97}
+	if job.Status != JobDone || job.StatusCode != http.StatusOK || !reflect.DeepEqual(job.Result, want) {
+		t.Fatalf("job %s %d result %v, want done 200 with %v", job.Status, job.StatusCode, job.Result, want)
+	}
+}
+
+func TestInferJobDeviceError(t *testing.T) {
+	job := pollInferJob(t, mockDevice(t, `{"/api/v1/infer": {"status": 503, "body": {"error": "model loading"}}}`))
+	want := map[string]interface{}{"error": "model loading"}
+	if job.Status != JobFailed || job.StatusCode != http.StatusServiceUnavailable || !strings.Contains(job.Error, "503") {
+		t.Fatalf("job %s %d error %q, want failed with the device's 503", job.Status, job.StatusCode, job.Error)
+	}
+	if !reflect.DeepEqual(job.Result, want) {
+		t.Fatalf("result %v, want the device's error body %v", job.Result, want)
+	}
+}
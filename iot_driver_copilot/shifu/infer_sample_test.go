@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// setSampling changes the device's sampling settings in place, as a config
+// reload would.
+func setSampling(dev *DeviceClient, rate float64, serveCached bool) {
+	cfg := *dev.Config()
+	cfg.InferSampleRate, cfg.InferServeCached = rate, serveCached
+	dev.SetConfig(&cfg)
+}
+
+func TestInferSampling(t *testing.T) {
+	dev, calls := inferDevice(t, 0)
+	h := inferHandler(dev, &InferenceCache{})
+
+	setSampling(dev, 0, false)
+	w := postInfer(h, `{"image":"abc"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || calls.Load() != 0 {
+		t.Fatalf("rate 0 without a cached result: status %d Retry-After %q, %d device call(s); want 429, 1, 0",
+			w.Code, w.Header().Get("Retry-After"), calls.Load())
+	}
+
+	setSampling(dev, 1, true)
+	if w := postInfer(h, `{"image":"abc"}`); w.Code != http.StatusOK || calls.Load() != 1 {
+		t.Fatalf("rate 1: status %d, %d device call(s); want 200 and 1", w.Code, calls.Load())
+	}
+
+	setSampling(dev, 0, true)
+	w = postInfer(h, `{"image":"xyz"}`)
+	if w.Code != http.StatusOK || w.Header().Get("X-Infer-Cache") != "true" || w.Body.String() != `{"label":"cat","score":0.9}` {
+		t.Fatalf("rate 0 with a cached result: status %d X-Infer-Cache %q body %s; want the last result",
+			w.Code, w.Header().Get("X-Infer-Cache"), w.Body.String())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("device called %d times, want the sampled-out request kept off it", n)
+	}
+}
+
+func TestValidateConfigSampleRate(t *testing.T) {
+	for _, c := range []struct {
+		rate float64
+		ok   bool
+	}{{0, true}, {0.5, true}, {1, true}, {-0.1, false}, {1.5, false}} {
+		cfg := loadConfig()
+		cfg.InferSampleRate = c.rate
+		if err := ValidateConfig(cfg); (err == nil) != c.ok {
+			t.Errorf("INFER_SAMPLE_RATE=%v: %v", c.rate, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mockDevice(t *testing.T, responses string) *MockDeviceClient {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mock.json")
+	if err := os.WriteFile(path, []byte(responses), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := loadConfig()
+	cfg.MockMode, cfg.MockResponsesFile = true, path
+	mock, err := NewMockDeviceClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock
+}
+
+// offlineMock is a mock device whose address (TEST-NET-1) nothing answers
+// on, so any real network request fails.
+func offlineMock(t *testing.T) *MockDeviceClient {
+	t.Helper()
+	mock := mockDevice(t, `{"/api/v1/status": {"body": {"state": "ok"}}}`)
+	cfg := *mock.Config()
+	cfg.ShifuIP, cfg.ReachabilityMaxTimeout = "192.0.2.1", 200*time.Millisecond
+	mock.SetConfig(&cfg)
+	mock.SetHost(cfg.ShifuIP)
+	return mock
+}
+
+func TestMockTrace(t *testing.T) {
+	w := httptest.NewRecorder()
+	traceHandler(offlineMock(t))(w, httptest.NewRequest("GET", "/trace?endpoint=/api/v1/status", nil))
+	var result RequestTrace
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusOK || result.StatusCode != http.StatusOK || result.Error != "" {
+		t.Fatalf("status %d, trace %+v; want the canned response", w.Code, result)
+	}
+}
+
+func TestMockReachable(t *testing.T) {
+	mock := offlineMock(t)
+	w := httptest.NewRecorder()
+	reachableHandler(mock, NewDeviceRegistry(mock.Config()))(w, httptest.NewRequest("GET", "/device/reachable", nil))
+	var result Reachability
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if !result.Reachable || result.Host != "192.0.2.1" {
+		t.Fatalf("reachability %+v, want the mock reachable", result)
+	}
+}
+
+func TestMockHeartbeat(t *testing.T) {
+	m := &HeartbeatMonitor{Client: offlineMock(t), Interval: time.Second, StaleAfter: time.Minute}
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lastSeen, _ := m.Status(); lastSeen.IsZero() {
+		t.Fatal("mock heartbeat not recorded")
+	}
+}
+
+func TestMockRegistryDevices(t *testing.T) {
+	mock := offlineMock(t)
+	reg := NewDeviceRegistry(mock.Config())
+	reg.NewClient = mock.For
+	reg.Add(RegistryEntry{Name: "cam-2", IP: "192.0.2.2"})
+
+	w := getFleet(fleetHandler(reg, "/api/v1/status", echoDevice(mock), echoDevice), "")
+	var body struct {
+		Devices map[string]DeviceResult `json:"devices"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if res := body.Devices["cam-2"]; w.Code != http.StatusOK || res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, cam-2 %+v; want the canned response", w.Code, res)
+	}
+}
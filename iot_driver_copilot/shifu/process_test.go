@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingDevice returns a DeviceClient for a device that answers every
+// request with {"ok":true} and records each as "METHOD path".
+func recordingDevice(t *testing.T, cfg *Config) (*DeviceClient, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	t.Cleanup(srv.Close)
+	cfg.ShifuAPIBase = srv.URL
+	return NewDeviceClient(cfg), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestProcessListForwarded(t *testing.T) {
+	cfg := loadConfig()
+	cfg.ProcessListPath = "/api/v1/processes"
+	dev, seen := recordingDevice(t, cfg)
+	w := httptest.NewRecorder()
+	processListHandler(dev)(w, httptest.NewRequest("GET", "/device/process", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"ok":true}` {
+		t.Fatalf("status %d body %q", w.Code, w.Body.String())
+	}
+	if got := seen(); !reflect.DeepEqual(got, []string{"GET /api/v1/processes"}) {
+		t.Fatalf("device saw %v", got)
+	}
+}
+
+func TestProcessKillAllowList(t *testing.T) {
+	cfg := loadConfig()
+	cfg.ProcessListPath, cfg.ProcessKillAllowedPIDs = "/api/v1/processes/", "42, 43"
+	dev, seen := recordingDevice(t, cfg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /device/process/{pid}", processKillHandler(dev))
+
+	for _, c := range []struct {
+		pid  string
+		want int
+	}{
+		{"42", http.StatusOK},
+		{"7", http.StatusForbidden},
+		{"0", http.StatusBadRequest},
+		{"abc", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/device/process/"+c.pid+"?reason=hung", nil))
+		if w.Code != c.want {
+			t.Errorf("pid %s: status %d, want %d", c.pid, w.Code, c.want)
+		}
+	}
+	if got := seen(); !reflect.DeepEqual(got, []string{"DELETE /api/v1/processes/42"}) {
+		t.Fatalf("device saw %v, want only the allowed PID", got)
+	}
+}
+
+func TestParsePIDList(t *testing.T) {
+	if pids, err := parsePIDList(" 1, 22,,333 "); err != nil || !reflect.DeepEqual(pids, []int{1, 22, 333}) {
+		t.Fatalf("parsePIDList = %v, %v", pids, err)
+	}
+	for _, bad := range []string{"1,x", "-4", "0"} {
+		if _, err := parsePIDList(bad); err == nil {
+			t.Errorf("parsePIDList(%q) accepted", bad)
+		}
+	}
+}
+
+func TestProcessKillRequiresAdminToken(t *testing.T) {
+	cfg := loadConfig()
+	cfg.ProcessKillAllowedPIDs, cfg.AdminToken = "42", "s3cret"
+	dev, seen := recordingDevice(t, cfg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /device/process/{pid}", requireAdminToken(dev, processKillHandler(dev)))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/device/process/42", nil))
+	if w.Code != http.StatusUnauthorized || len(seen()) != 0 {
+		t.Fatalf("without a token: status %d, device saw %v", w.Code, seen())
+	}
+	r := httptest.NewRequest("DELETE", "/device/process/42", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || len(seen()) != 1 {
+		t.Fatalf("with the token: status %d, device saw %v", w.Code, seen())
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	for _, c := range []struct {
+		remote, fwd, trusted, want string
+	}{
+		{"10.0.0.1:5000", "", "10.0.0.1", "10.0.0.1:5000"},
+		{"192.0.2.7:5000", "203.0.113.9", "", "192.0.2.7:5000"},
+		{"192.0.2.7:5000", "203.0.113.9", "10.0.0.1", "192.0.2.7:5000"},
+		{"10.0.0.1:5000", "203.0.113.9, 10.0.0.2", "10.0.0.1", "203.0.113.9 (via proxy 10.0.0.1:5000)"},
+		{"10.1.2.3:5000", "203.0.113.9", "10.1.0.0/16", "203.0.113.9 (via proxy 10.1.2.3:5000)"},
+		{"[fd00::1]:5000", "203.0.113.9", "fd00::1", "203.0.113.9 (via proxy [fd00::1]:5000)"},
+	} {
+		r := httptest.NewRequest("DELETE", "/device/process/42", nil)
+		r.RemoteAddr = c.remote
+		if c.fwd != "" {
+			r.Header.Set("X-Forwarded-For", c.fwd)
+		}
+		if got := clientIdentity(r, c.trusted); got != c.want {
+			t.Errorf("clientIdentity(%s, X-Forwarded-For %q, TRUSTED_PROXIES=%q) = %q, want %q", c.remote, c.fwd, c.trusted, got, c.want)
+		}
+	}
+}
+
+func TestParseProxyList(t *testing.T) {
+	nets, err := parseProxyList(" 10.0.0.1, 10.1.0.0/16,,fd00::1 ")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("parseProxyList = %v, %v", nets, err)
+	}
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33", "proxy.local"} {
+		if _, err := parseProxyList(bad); err == nil {
+			t.Errorf("parseProxyList(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCameraPTZForwardsCommand(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(b)
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"moving":true}`)
+	}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase, cfg.CameraPTZ = srv.URL, "/api/v1/camera/ptz"
+	h := cameraPTZHandler(NewDeviceClient(cfg))
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/camera/ptz", strings.NewReader(`{"pan":45,"zoom":2}`)))
+	if w.Code != http.StatusAccepted || w.Body.String() != `{"moving":true}` {
+		t.Fatalf("status %d body %q", w.Code, w.Body.String())
+	}
+	if gotPath != "/api/v1/camera/ptz" || gotBody != `{"pan":45,"zoom":2}` {
+		t.Fatalf("device got %s %s", gotPath, gotBody)
+	}
+}
+
+func TestCameraPTZRejectsInvalidCommand(t *testing.T) {
+	h := cameraPTZHandler(offlineDevice(t))
+	for _, body := range []string{
+		`{}`,
+		`{"pan":181}`,
+		`{"tilt":-200}`,
+		`{"zoom":0}`,
+		`{"pan":10,"roll":5}`,
+		`not json`,
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/camera/ptz", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+// offlineDevice is a DeviceClient for a device that refuses connections.
+func offlineDevice(t *testing.T) *DeviceClient {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = url
+	return NewDeviceClient(cfg)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statusProbe returns a probe for a device whose /api/v1/status answers 200
+// while up is true and 503 otherwise, counting requests.
+func statusProbe(t *testing.T, tolerance time.Duration) (*ReadinessProbe, *atomic.Bool, *atomic.Int32) {
+	t.Helper()
+	var up atomic.Bool
+	var calls atomic.Int32
+	up.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.ReadyzStaleTolerance = tolerance
+	return &ReadinessProbe{Client: NewDeviceClient(cfg)}, &up, &calls
+}
+
+func getReadyz(t *testing.T, p *ReadinessProbe) (int, Readiness) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	readyzHandler(p)(w, httptest.NewRequest("GET", "/readyz", nil))
+	var result Readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("/readyz: %v: %s", err, w.Body.String())
+	}
+	return w.Code, result
+}
+
+func TestReadyzServesRecentSuccessWithinTolerance(t *testing.T) {
+	probe, up, calls := statusProbe(t, time.Minute)
+	code, first := getReadyz(t, probe)
+	if code != http.StatusOK || first.Cached || first.LastCheck == nil {
+		t.Fatalf("first /readyz: %d %+v, want a fresh ready check", code, first)
+	}
+
+	up.Store(false)
+	code, second := getReadyz(t, probe)
+	if code != http.StatusOK || !second.Cached || second.LastCheck == nil || !second.LastCheck.Equal(*first.LastCheck) {
+		t.Fatalf("second /readyz: %d %+v, want the cached success from %v", code, second, first.LastCheck)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("device probed %d times, want the cached result to skip it", n)
+	}
+
+	// Once the last success is older than the tolerance the device is probed again
+	probe.mu.Lock()
+	probe.lastOK = time.Now().Add(-2 * time.Minute)
+	probe.mu.Unlock()
+	code, third := getReadyz(t, probe)
+	if code != http.StatusServiceUnavailable || third.Status != "unready" || third.Error == "" {
+		t.Fatalf("stale /readyz: %d %+v, want 503 unready with the device error", code, third)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("device probed %d times, want 2", n)
+	}
+}
+
+func TestReadyzWithoutToleranceProbesEveryTime(t *testing.T) {
+	probe, up, calls := statusProbe(t, 0)
+	if code, _ := getReadyz(t, probe); code != http.StatusOK {
+		t.Fatalf("device up: status %d, want 200", code)
+	}
+	up.Store(false)
+	code, result := getReadyz(t, probe)
+	if code != http.StatusServiceUnavailable || result.Cached {
+		t.Fatalf("device down: %d %+v, want 503 from a fresh probe", code, result)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("device probed %d times, want 2", n)
+	}
+}
+
+func TestValidateConfigReadyzStaleTolerance(t *testing.T) {
+	for _, c := range []struct {
+		tolerance time.Duration
+		ok        bool
+	}{{0, true}, {30 * time.Second, true}, {-time.Second, false}} {
+		cfg := loadConfig()
+		cfg.ReadyzStaleTolerance = c.tolerance
+		if err := ValidateConfig(cfg); (err == nil) != c.ok {
+			t.Errorf("READYZ_STALE_TOLERANCE_S=%v: %v", c.tolerance, err)
+		}
+	}
+}
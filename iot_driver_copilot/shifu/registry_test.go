@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// namedDevice serves {"device": name} on every path.
+func namedDevice(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"device":%q}`, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// fleet returns a registry loaded from a DEVICE_REGISTRY_FILE listing the
+// given devices by name and API base.
+func fleet(t *testing.T, devices map[string]string) *DeviceRegistry {
+	t.Helper()
+	var entries []RegistryEntry
+	for name, base := range devices {
+		entries = append(entries, RegistryEntry{Name: name, APIBase: base})
+	}
+	data, _ := json.Marshal(entries)
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg := NewDeviceRegistry(loadConfig())
+	if err := reg.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// echoDevice answers with the device it was routed to.
+func echoDevice(dev DeviceAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Get(r.Context(), "/api/v1/status")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}
+}
+
+func getFleet(h http.HandlerFunc, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/status"+query, nil))
+	return w
+}
+
+func TestFleetRoutesAndBroadcasts(t *testing.T) {
+	reg := fleet(t, map[string]string{"cam-a": namedDevice(t, "a"), "cam-b": namedDevice(t, "b")})
+	single := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "single") }
+	h := fleetHandler(reg, "/api/v1/status", single, echoDevice)
+
+	if w := getFleet(h, "?device=cam-b"); w.Body.String() != `{"device":"b"}` {
+		t.Fatalf("?device=cam-b: %q", w.Body.String())
+	}
+	if w := getFleet(h, "?device=cam-z"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown device: status %d, want 404", w.Code)
+	}
+
+	w := getFleet(h, "")
+	var got struct{ Devices map[string]DeviceResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(got.Devices) != 2 {
+		t.Fatalf("broadcast: %d %s", w.Code, w.Body.String())
+	}
+	if body := got.Devices["cam-a"].Body.(map[string]interface{}); body["device"] != "a" {
+		t.Fatalf("cam-a answered %v", body)
+	}
+
+	names := reg.Names()
+	if len(names) != 2 || names[0] != "cam-a" || reg.List()[1].Source != "file" {
+		t.Fatalf("registry = %v", reg.List())
+	}
+}
+
+func TestFleetBroadcastAllOffline(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	down := srv.URL
+	srv.Close()
+	reg := fleet(t, map[string]string{"cam-a": down})
+	w := getFleet(fleetHandler(reg, "/api/v1/status", nil, echoDevice), "")
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502 with every device offline", w.Code)
+	}
+}
+
+func TestFleetEmptyRegistryUsesSingleDevice(t *testing.T) {
+	reg := NewDeviceRegistry(loadConfig())
+	single := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "single") }
+	if w := getFleet(fleetHandler(reg, "/api/v1/status", single, echoDevice), ""); w.Body.String() != "single" {
+		t.Fatalf("empty registry answered %q", w.Body.String())
+	}
+}
+
+func TestRegistryFileRejectsIncompleteEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	os.WriteFile(path, []byte(`[{"name": "cam-a"}]`), 0o644)
+	if err := NewDeviceRegistry(loadConfig()).LoadFile(path); err == nil {
+		t.Fatal("entry without ip or api_base accepted")
+	}
+}
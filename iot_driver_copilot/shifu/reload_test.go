@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reloadEnv clears the configuration sources so a reload only sees the
+// environment set by the test.
+func reloadEnv(t *testing.T) {
+	t.Helper()
+	useConfigSources(t, map[string]string{}, map[string]string{})
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("CONFIGMAP_NAME", "")
+}
+
+// deviceAt serves name on every path.
+func deviceAt(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func askDevice(t *testing.T, dev *DeviceClient) string {
+	t.Helper()
+	resp, err := dev.Get(context.Background(), "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestSIGHUPSwitchesDeviceAddress(t *testing.T) {
+	reloadEnv(t)
+	t.Setenv("SHIFU_API_BASE", deviceAt(t, "old"))
+	dev := NewDeviceClient(loadConfig())
+	if got := askDevice(t, dev); got != "old" {
+		t.Fatalf("before reload the device answered %q", got)
+	}
+
+	// Keep SIGHUP from terminating the test binary before Watch has
+	// registered for it.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&ConfigReloader{Client: dev}).Watch(ctx)
+
+	t.Setenv("SHIFU_API_BASE", deviceAt(t, "new"))
+	deadline := time.Now().Add(2 * time.Second)
+	for askDevice(t, dev) != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("requests still reach the old device after SIGHUP")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestConfigReloadAppliesChanges(t *testing.T) {
+	reloadEnv(t)
+	dev := NewDeviceClient(loadConfig())
+	var applied *Config
+	reloader := &ConfigReloader{Client: dev, Apply: func(cfg *Config) { applied = cfg }}
+
+	t.Setenv("CAMERA_SNAPSHOT_MAX_FILES", "7")
+	t.Setenv("SERVER_PORT", "9999")
+	w := httptest.NewRecorder()
+	configReloadHandler(reloader)(w, httptest.NewRequest("POST", "/config/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if dev.Config().SnapshotMaxFiles != 7 || applied == nil || applied.SnapshotMaxFiles != 7 {
+		t.Fatalf("CAMERA_SNAPSHOT_MAX_FILES not applied: client %d", dev.Config().SnapshotMaxFiles)
+	}
+	var status ReloadStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.LastSuccess.IsZero() || status.Error != "" {
+		t.Fatalf("status = %+v", status)
+	}
+	if !slices.Contains(status.RestartRequired, "SERVER_PORT") || slices.Contains(status.RestartRequired, "CAMERA_SNAPSHOT_MAX_FILES") {
+		t.Fatalf("restart_required = %v, want SERVER_PORT only among the changes", status.RestartRequired)
+	}
+	if dev.Config().ServerPort != "8081" {
+		t.Fatalf("SERVER_PORT = %q, want the startup value kept", dev.Config().ServerPort)
+	}
+}
+
+func TestConfigReloadKeepsMockMode(t *testing.T) {
+	reloadEnv(t)
+	dev := NewDeviceClient(loadConfig())
+	reloader := &ConfigReloader{Client: dev}
+
+	responses := filepath.Join(t.TempDir(), "responses.json")
+	if err := os.WriteFile(responses, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DEVICE_MOCK_MODE", "true")
+	t.Setenv("MOCK_RESPONSES_FILE", responses)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Config().MockMode {
+		t.Fatal("DEVICE_MOCK_MODE applied to the running client")
+	}
+	if st := reloader.Status(); !slices.Contains(st.RestartRequired, "DEVICE_MOCK_MODE") {
+		t.Fatalf("restart_required = %v, want DEVICE_MOCK_MODE", st.RestartRequired)
+	}
+}
+
+func TestConfigReloadKeepsConfigOnError(t *testing.T) {
+	reloadEnv(t)
+	dev := NewDeviceClient(loadConfig())
+	before := dev.Config()
+	reloader := &ConfigReloader{Client: dev}
+
+	t.Setenv("CAMERA_PTZ_PATH", "camera/ptz")
+	w := httptest.NewRecorder()
+	configReloadHandler(reloader)(w, httptest.NewRequest("POST", "/config/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", w.Code)
+	}
+	if dev.Config().CameraPTZ != before.CameraPTZ {
+		t.Fatalf("invalid configuration applied: %q", dev.Config().CameraPTZ)
+	}
+	if st := reloader.Status(); st.Error == "" || !st.LastSuccess.IsZero() {
+		t.Fatalf("status = %+v, want the error recorded", st)
+	}
+}
+
+func TestConfigRequiresAdminToken(t *testing.T) {
+	reloadEnv(t)
+	for _, c := range []struct {
+		token, auth string
+		want        int
+	}{
+		{"", "Bearer anything", http.StatusForbidden},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"s3cret", "Bearer s3cret", http.StatusOK},
+	} {
+		t.Setenv("ADMIN_TOKEN", c.token)
+		dev := NewDeviceClient(loadConfig())
+		reloader := &ConfigReloader{Client: dev}
+		for _, route := range []struct {
+			method, path string
+			h            http.HandlerFunc
+		}{
+			{"GET", "/config", configHandler(dev, reloader)},
+			{"POST", "/config/reload", configReloadHandler(reloader)},
+		} {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			if c.auth != "" {
+				r.Header.Set("Authorization", c.auth)
+			}
+			w := httptest.NewRecorder()
+			requireAdminToken(dev, route.h)(w, r)
+			if w.Code != c.want {
+				t.Errorf("%s %s with ADMIN_TOKEN=%q, %q: status %d, want %d", route.method, route.path, c.token, c.auth, w.Code, c.want)
+			}
+		}
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	useConfigSources(t, map[string]string{"SHIFU_PORT": "9000"}, map[string]string{"SHIFU_API_BASE": "http://file", "CAMERA_SNAPSHOT_MAX_FILES": "9"})
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("CONFIGMAP_NAME", "")
+	t.Setenv("SHIFU_IP", "10.0.0.5")
+	t.Setenv("HEARTBEAT_WEBHOOK_URL", "https://hooks.example/token")
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	dev := NewDeviceClient(loadConfig())
+
+	w := httptest.NewRecorder()
+	configHandler(dev, &ConfigReloader{Client: dev})(w, httptest.NewRequest("GET", "/config", nil))
+	var body struct {
+		Config map[string]ConfigValue `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]ConfigValue{
+		"ShifuIP":          {"10.0.0.5", "SHIFU_IP", "env"},
+		"ShifuPort":        {"9000", "SHIFU_PORT", "configmap"},
+		"ShifuAPIBase":     {"http://file", "SHIFU_API_BASE", "file"},
+		"ServerPort":       {"8081", "SERVER_PORT", "default"},
+		"HeartbeatWebhook": {redactedValue, "HEARTBEAT_WEBHOOK_URL", "env"},
+		"AdminToken":       {redactedValue, "ADMIN_TOKEN", "env"},
+		"SnapshotMaxFiles": {9.0, "CAMERA_SNAPSHOT_MAX_FILES", "file"},
+		"Discovery":        {false, "", "derived"},
+	} {
+		if got := body.Config[field]; got != want {
+			t.Errorf("%s = %+v, want %+v", field, got, want)
+		}
+	}
+}
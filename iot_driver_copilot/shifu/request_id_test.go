@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// deviceIDProbe serves a handler that makes one device GET and reports the
+// X-Request-ID the device returned.
+func deviceIDProbe(dev DeviceAPI) http.Handler {
+	return withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := dev.Get(r.Context(), "/api/v1/status")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		w.Header().Set("X-Device-Request-ID", resp.Header.Get(requestIDHeader))
+	}))
+}
+
+func TestRequestIDForwardedToDevice(t *testing.T) {
+	var seen string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(requestIDHeader)
+	}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	h := deviceIDProbe(NewDeviceClient(cfg))
+
+	for _, c := range []struct {
+		name, sent string
+		keep       bool
+	}{
+		{"custom", "trace-42", true},
+		{"missing", "", false},
+		{"invalid", "bad id\r\nX-Evil: 1", false},
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if c.sent != "" {
+			r.Header.Set(requestIDHeader, c.sent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		echoed := w.Header().Get(requestIDHeader)
+		if c.keep && echoed != c.sent {
+			t.Errorf("%s: echoed %q, want %q", c.name, echoed, c.sent)
+		}
+		if !c.keep && (echoed == "" || echoed == c.sent) {
+			t.Errorf("%s: echoed %q, want a generated ID", c.name, echoed)
+		}
+		if seen != echoed {
+			t.Errorf("%s: device got %q, client got %q", c.name, seen, echoed)
+		}
+	}
+}
+
+func TestMockDeviceEchoesRequestID(t *testing.T) {
+	h := deviceIDProbe(mockDevice(t, `{"/api/v1/status": {"body": {"state": "ok"}}}`))
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.Header.Set(requestIDHeader, "trace-42")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("X-Device-Request-ID"); got != "trace-42" {
+		t.Fatalf("mock device saw request ID %q, want trace-42", got)
+	}
+}
+
+func TestMockDeviceLatencyStopsWithContext(t *testing.T) {
+	mock := mockDevice(t, `{"/api/v1/status": {"latency_ms": 3600000}}`)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := mock.Get(ctx, "/api/v1/status"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// retryDevice returns a DeviceClient for a device that answers 503 to the
+// first failures requests and 200 afterwards, and the request counter.
+func retryDevice(t *testing.T, failures int32, base time.Duration) (*DeviceClient, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "warming up", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	t.Cleanup(srv.Close)
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.RetryMax, cfg.RetryBaseDelay = 3, base
+	return NewDeviceClient(cfg), &calls
+}
+
+func TestDeviceClientRetriesTransientFailures(t *testing.T) {
+	dev, calls := retryDevice(t, 2, time.Millisecond)
+	resp, err := dev.Get(context.Background(), "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 3 {
+		t.Fatalf("status %d after %d calls, want 200 after 3", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestDeviceClientGivesUpAfterRetryMax(t *testing.T) {
+	dev, calls := retryDevice(t, 10, time.Millisecond)
+	resp, err := dev.Get(context.Background(), "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 4 {
+		t.Fatalf("status %d after %d calls, want 503 after 4", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestDeviceClientBackoffStopsWithContext(t *testing.T) {
+	dev, calls := retryDevice(t, 10, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dev.Get(ctx, "/api/v1/status")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second || calls.Load() != 1 {
+		t.Fatalf("returned after %v and %d calls", elapsed, calls.Load())
+	}
+}
+
+func TestDeviceClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = srv.URL
+	cfg.RetryMax, cfg.RetryBaseDelay = 3, time.Millisecond
+	resp, err := NewDeviceClient(cfg).Get(context.Background(), "/api/v1/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || calls.Load() != 1 {
+		t.Fatalf("status %d after %d calls, want 404 after 1", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestDeviceClientRetriesRefusedConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cfg := loadConfig()
+	cfg.ShifuAPIBase = "http://" + addr
+	cfg.RetryMax, cfg.RetryBaseDelay = 3, 100*time.Millisecond
+
+	// The device comes up while the first attempt's backoff is running. A
+	// POST is only resent when the connection was refused, so the 200 below
+	// means the refusal was retried.
+	up := make(chan net.Listener, 1)
+	time.AfterFunc(20*time.Millisecond, func() {
+		l, err := net.Listen("tcp", addr)
+		up <- l
+		if err == nil {
+			http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"ok":true}`)
+			}))
+		}
+	})
+	resp, err := NewDeviceClient(cfg).Post(context.Background(), "/api/v1/control", "application/json", []byte(`{}`))
+	l := <-up
+	if l == nil {
+		t.Skipf("could not listen on %s again", addr)
+	}
+	defer l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200 once the device is up", resp.StatusCode)
+	}
+}
+
+func TestRetryDelayIsCapped(t *testing.T) {
+	for _, c := range []struct {
+		base time.Duration
+		n    int
+		want time.Duration
+	}{
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+		{100 * time.Millisecond, 3, 800 * time.Millisecond},
+		{100 * time.Millisecond, 20, maxRetryDelay},
+		{100 * time.Millisecond, 100, maxRetryDelay}, // would overflow as a shift
+		{time.Hour, 0, maxRetryDelay},
+	} {
+		if got := retryDelay(c.base, c.n); got != c.want {
+			t.Errorf("retryDelay(%v, %d) = %v, want %v", c.base, c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSchedulerActionRequiresAdminToken(t *testing.T) {
+	reloadEnv(t)
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	dev := NewDeviceClient(loadConfig())
+	s := &Scheduler{}
+	s.Add("poll", time.Hour, func(ctx context.Context) error { return nil })
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /scheduler/jobs/{name}/{action}", requireAdminToken(dev, schedulerJobActionHandler(s)))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/scheduler/jobs/poll/pause", nil))
+	if w.Code != http.StatusUnauthorized || s.Job("poll").Paused() {
+		t.Fatalf("without a token: status %d, paused %v", w.Code, s.Job("poll").Paused())
+	}
+
+	r := httptest.NewRequest("POST", "/scheduler/jobs/poll/pause", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted || !s.Job("poll").Paused() {
+		t.Fatalf("with the token: status %d, paused %v", w.Code, s.Job("poll").Paused())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cameraDevice returns a DeviceClient for a camera whose snapshot endpoint
+// serves a fixed JPEG and whose inference endpoint answers with inferStatus.
+// The last inference request body is stored in *inferred.
+func cameraDevice(t *testing.T, inferStatus int, inferred *string) *DeviceClient {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/camera/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\xff\xd8jpeg\xff\xd9"))
+	})
+	mux.HandleFunc("/api/v1/infer", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if inferred != nil {
+			*inferred = string(b)
+		}
+		w.WriteHeader(inferStatus)
+		io.WriteString(w, `{"label":"person"}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	cfg := loadConfig()
+	cfg.ShifuAPIBase, cfg.CameraSnapshot = srv.URL, "/api/v1/camera/snapshot"
+	cfg.RetryMax = 0
+	return NewDeviceClient(cfg)
+}
+
+// stepClock returns a clock that advances one second per call.
+func stepClock() func() time.Time {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		at = at.Add(time.Second)
+		return at
+	}
+}
+
+func TestSnapshotStoreKeepsNewest(t *testing.T) {
+	store := &SnapshotStore{Dir: t.TempDir(), MaxFiles: 2, Client: cameraDevice(t, http.StatusOK, nil), Now: stepClock()}
+	for i := 0; i < 3; i++ {
+		if err := store.Capture(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "20240501_100002.jpg" || list[1].Name != "20240501_100003.jpg" {
+		t.Fatalf("stored %+v, want the two newest", list)
+	}
+	if list[1].Size != 8 || list[1].Analysis != "" {
+		t.Fatalf("entry = %+v", list[1])
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(store.Dir, ".snapshot-*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestSnapshotHandlers(t *testing.T) {
+	store := &SnapshotStore{Dir: t.TempDir(), MaxFiles: 5, Client: cameraDevice(t, http.StatusOK, nil), Now: stepClock()}
+	if err := store.Capture(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /camera/snapshots", snapshotsHandler(store))
+	mux.HandleFunc("GET /camera/snapshots/{filename}", snapshotFileHandler(store))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/camera/snapshots", nil))
+	var list []StoredSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 {
+		t.Fatalf("list: %v %s", err, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/camera/snapshots/"+list[0].Name, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || w.Body.String() != "\xff\xd8jpeg\xff\xd9" {
+		t.Fatalf("file: status %d type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	os.WriteFile(filepath.Join(store.Dir, "notes.txt"), []byte("x"), 0o644)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/camera/snapshots/notes.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("non-snapshot file: status %d, want 404", w.Code)
+	}
+}
+
+func TestSnapshotStoreEmptyDir(t *testing.T) {
+	store := &SnapshotStore{Dir: filepath.Join(t.TempDir(), "missing")}
+	list, err := store.List()
+	if err != nil || len(list) != 0 {
+		t.Fatalf("List = %v, %v; want empty", list, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigHostnameRefresh(t *testing.T) {
+	t.Setenv("DEVICE_HOSTNAME", "camera-01.local")
+	for _, c := range []struct {
+		refresh string
+		wantErr bool
+	}{{"30", false}, {"1", false}, {"0", true}, {"-5", true}} {
+		t.Setenv("DEVICE_HOSTNAME_REFRESH_S", c.refresh)
+		err := ValidateConfig(loadConfig())
+		got := err != nil && strings.Contains(err.Error(), "DEVICE_HOSTNAME_REFRESH_S")
+		if got != c.wantErr {
+			t.Errorf("DEVICE_HOSTNAME_REFRESH_S=%s: %v", c.refresh, err)
+		}
+	}
+	// The interval doesn't matter while no hostname is watched
+	t.Setenv("DEVICE_HOSTNAME", "")
+	t.Setenv("DEVICE_HOSTNAME_REFRESH_S", "0")
+	if err := ValidateConfig(loadConfig()); err != nil {
+		t.Errorf("without DEVICE_HOSTNAME: %v", err)
+	}
+}
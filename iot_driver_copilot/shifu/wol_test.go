@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMagicPacket(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	packet := magicPacket(mac)
+	if len(packet) != 102 {
+		t.Fatalf("packet is %d bytes, want 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Fatalf("sync stream = % x, want six 0xff bytes", packet[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if got := packet[6+6*i : 12+6*i]; !bytes.Equal(got, mac) {
+			t.Fatalf("repetition %d = % x, want % x", i+1, got, mac)
+		}
+	}
+}
+
+func TestParseWakeMAC(t *testing.T) {
+	for _, c := range []struct {
+		in string
+		ok bool
+	}{
+		{"AA:BB:CC:DD:EE:FF", true},
+		{"aa-bb-cc-dd-ee-ff", true},
+		{"aabb.ccdd.eeff", true},
+		{"AA:BB:CC:DD:EE:FF:00:11", false}, // EUI-64
+		{"AA:BB:CC:DD:EE", false},
+		{"not-a-mac", false},
+	} {
+		mac, err := parseWakeMAC(c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("parseWakeMAC(%q) = %v, %v", c.in, mac, err)
+		}
+		if c.ok && mac.String() != "aa:bb:cc:dd:ee:ff" {
+			t.Errorf("parseWakeMAC(%q) = %v", c.in, mac)
+		}
+	}
+}
+
+func TestWakeRejectsBadRequests(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		configMAC string
+		body      string
+		want      string
+	}{
+		{"no MAC anywhere", "", "", "DEVICE_MAC_ADDRESS"},
+		{"empty body field", "", `{"mac_address":""}`, "DEVICE_MAC_ADDRESS"},
+		{"invalid MAC", "", `{"mac_address":"zz:zz"}`, "Invalid MAC address"},
+		{"EUI-64 MAC", "AA:BB:CC:DD:EE:FF", `{"mac_address":"AA:BB:CC:DD:EE:FF:00:11"}`, "needs 6 bytes"},
+		{"invalid JSON", "AA:BB:CC:DD:EE:FF", `{"mac_address":`, "Invalid JSON"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := loadConfig()
+			cfg.DeviceMAC = c.configMAC
+			w := httptest.NewRecorder()
+			wolHandler(NewDeviceClient(cfg))(w, httptest.NewRequest("POST", "/device/wol", strings.NewReader(c.body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), c.want) {
+				t.Fatalf("status %d %q, want 400 mentioning %q", w.Code, w.Body.String(), c.want)
+			}
+		})
+	}
+}
+
+func TestWakeRequiresAdminToken(t *testing.T) {
+	for _, token := range []string{"", "s3cret"} {
+		cfg := loadConfig()
+		cfg.DeviceMAC, cfg.AdminToken = "AA:BB:CC:DD:EE:FF", token
+		dev := NewDeviceClient(cfg)
+		w := httptest.NewRecorder()
+		requireAdminToken(dev, wolHandler(dev))(w, httptest.NewRequest("POST", "/device/wol", nil))
+		if w.Code != http.StatusForbidden && w.Code != http.StatusUnauthorized {
+			t.Errorf("ADMIN_TOKEN=%q without Authorization: status %d, want 403 or 401", token, w.Code)
+		}
+	}
+}
+
+func TestValidateConfigDeviceMAC(t *testing.T) {
+	for _, c := range []struct {
+		mac string
+		ok  bool
+	}{{"", true}, {"AA:BB:CC:DD:EE:FF", true}, {"AA:BB:CC:DD:EE:FF:00:11", false}, {"nope", false}} {
+		cfg := loadConfig()
+		cfg.DeviceMAC = c.mac
+		if err := ValidateConfig(cfg); (err == nil) != c.ok {
+			t.Errorf("DEVICE_MAC_ADDRESS=%q: %v", c.mac, err)
+		}
+	}
+}
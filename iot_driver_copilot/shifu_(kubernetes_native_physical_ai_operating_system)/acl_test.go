@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useControlACL(t *testing.T, entries string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(entries), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := loadControlACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := controlACL
+	controlACL = acl
+	t.Cleanup(func() { controlACL = prev })
+}
+
+func TestControlACL(t *testing.T) {
+	useControlACL(t, `[{"identity":"operator","allow":["start","stop"]},{"identity":"admin","allow":["*"]}]`)
+	var forwarded []string
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ControlRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		forwarded = append(forwarded, req.Command)
+		w.Write([]byte(`{"ok":true}`))
+	})
+	// Identities come from the API key prefix
+	h := requireToken(parseTokens("operator_k1,admin_k2,guest_k3"), nil, http.HandlerFunc(handleControl))
+
+	for _, c := range []struct {
+		name    string
+		token   string
+		command string
+		want    int
+	}{
+		{"allowed", "operator_k1", "start", http.StatusOK},
+		{"allowed case-insensitively", "operator_k1", "STOP", http.StatusOK},
+		{"denied", "operator_k1", "reboot", http.StatusForbidden},
+		{"admin wildcard", "admin_k2", "reboot", http.StatusOK},
+		{"identity without an entry", "guest_k3", "start", http.StatusForbidden},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			forwarded = nil
+			r := httptest.NewRequest("POST", "/control", strings.NewReader(`{"command":"`+c.command+`"}`))
+			r.Header.Set("Authorization", "Bearer "+c.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.want, w.Body.String())
+			}
+			if c.want == http.StatusOK {
+				if len(forwarded) != 1 || forwarded[0] != c.command {
+					t.Fatalf("device got %v, want %q", forwarded, c.command)
+				}
+				return
+			}
+			var body map[string]string
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body["error"] != "command not permitted" || body["command"] != c.command {
+				t.Errorf("body %v, want the command not permitted error for %q", body, c.command)
+			}
+			if len(forwarded) != 0 {
+				t.Errorf("denied command reached the device: %v", forwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useAuditLog opens the audit file at path as auditLog, closing it when the
+// test ends.
+func useAuditLog(t *testing.T, path string) *auditLogger {
+	t.Helper()
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := auditLog
+	auditLog = audit
+	t.Cleanup(func() {
+		audit.file.Close()
+		auditLog = prev
+	})
+	return audit
+}
+
+func sendControlAs(identity, command string) int {
+	r := httptest.NewRequest("POST", "/control", strings.NewReader(`{"command":"`+command+`"}`))
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+	w := httptest.NewRecorder()
+	handleControl(w, r)
+	return w.Code
+}
+
+func TestAuditLogSurvivesRestart(t *testing.T) {
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+	path := filepath.Join(t.TempDir(), "shifu", "audit.jsonl")
+
+	first := useAuditLog(t, path)
+	sendControlAs("operator", "start")
+	sendControlAs("operator", "stop")
+	// Simulate a driver restart: close the file and open it again
+	if err := first.file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	useAuditLog(t, path)
+	sendControlAs("admin", "reboot")
+
+	w := httptest.NewRecorder()
+	getControlAudit(w, httptest.NewRequest("GET", "/control/audit", nil))
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("GET /control/audit: %d %s", w.Code, w.Body.String())
+	}
+	want := []struct{ identity, command string }{{"operator", "start"}, {"operator", "stop"}, {"admin", "reboot"}}
+	if len(entries) != len(want) {
+		t.Fatalf("%d audit entries after restart, want %d: %s", len(entries), len(want), w.Body.String())
+	}
+	for i, e := range entries {
+		if e.Identity != want[i].identity || e.Command != want[i].command || e.Result != JobDone || e.StatusCode != http.StatusOK {
+			t.Errorf("entry %d = %+v, want %s by %s done with 200", i, e, want[i].command, want[i].identity)
+		}
+		if e.SourceIP == "" || e.Timestamp.IsZero() {
+			t.Errorf("entry %d has no source IP or timestamp: %+v", i, e)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// useFailingDevice points CONTROL_API at a device that answers the k-th
+// command (1-based) with 500 and every other one with 200. k = 0 never fails.
+func useFailingDevice(t *testing.T, k int) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		if int(calls.Add(1)) == k {
+			http.Error(w, `{"error":"jammed"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+	return &calls
+}
+
+func TestControlBatch(t *testing.T) {
+	commands := []string{"home", "grip", "lift"}
+	for _, c := range []struct {
+		name        string
+		failAt      int
+		stopOnError string
+		want        []string
+	}{
+		{"success-all", 0, "false", []string{JobDone, JobDone, JobDone}},
+		{"partial-failure-continue", 2, "false", []string{JobDone, JobFailed, JobDone}},
+		{"partial-failure-abort", 2, "true", []string{JobDone, JobFailed, "skipped"}},
+		{"first-failure-abort", 1, "true", []string{JobFailed, "skipped", "skipped"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(EnvControlBatchStopOnError, c.stopOnError)
+			calls := useFailingDevice(t, c.failAt)
+			w := httptest.NewRecorder()
+			handleControlBatch(w, httptest.NewRequest("POST", "/control/batch",
+				strings.NewReader(`[{"command":"home"},{"command":"grip"},{"command":"lift"}]`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			var results []BatchItemResult
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(c.want) {
+				t.Fatalf("%d results, want %d", len(results), len(c.want))
+			}
+			sent := 0
+			for i, res := range results {
+				if res.Command != commands[i] || res.Status != c.want[i] {
+					t.Errorf("result %d = %s %s, want %s", i, res.Command, res.Status, c.want[i])
+				}
+				if res.Status != "skipped" {
+					sent++
+				}
+			}
+			if int(calls.Load()) != sent {
+				t.Errorf("device got %d command(s), want %d", calls.Load(), sent)
+			}
+		})
+	}
+}
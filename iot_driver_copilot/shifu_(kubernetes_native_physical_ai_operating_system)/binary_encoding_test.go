@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeForEncoding(t *testing.T, doc string) interface{} {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// Expected encodings are from RFC 8949 appendix A and the MessagePack spec.
+func TestBinaryEncodings(t *testing.T) {
+	for _, c := range []struct {
+		json, cbor, msgpack string
+	}{
+		{`0`, "00", "00"},
+		{`23`, "17", "17"},
+		{`24`, "1818", "18"},
+		{`127`, "187f", "7f"},
+		{`128`, "1880", "cf0000000000000080"},
+		{`1000`, "1903e8", "cf00000000000003e8"},
+		{`1000000`, "1a000f4240", "cf00000000000f4240"},
+		{`-1`, "20", "ff"},
+		{`-32`, "381f", "e0"},
+		{`-1000`, "3903e7", "d3fffffffffffffc18"},
+		{`1.5`, "fb3ff8000000000000", "cb3ff8000000000000"},
+		{`true`, "f5", "c3"},
+		{`false`, "f4", "c2"},
+		{`null`, "f6", "c0"},
+		{`"a"`, "6161", "a161"},
+		{`[1,2]`, "820102", "920102"},
+		{`{"b":[2],"a":1}`, "a261610161628102", "82a16101a1629102"},
+	} {
+		v := decodeForEncoding(t, c.json)
+		if got := hex.EncodeToString(appendCBOR(nil, v)); got != c.cbor {
+			t.Errorf("CBOR %s = %s, want %s", c.json, got, c.cbor)
+		}
+		if got := hex.EncodeToString(appendMsgpack(nil, v)); got != c.msgpack {
+			t.Errorf("MessagePack %s = %s, want %s", c.json, got, c.msgpack)
+		}
+	}
+}
+
+func TestBinaryEncodingLongString(t *testing.T) {
+	s := strings.Repeat("x", 32)
+	v := decodeForEncoding(t, `"`+s+`"`)
+	if got := appendCBOR(nil, v); !bytes.Equal(got[:2], []byte{0x78, 32}) {
+		t.Errorf("CBOR header %x, want 7820", got[:2])
+	}
+	if got := appendMsgpack(nil, v); !bytes.Equal(got[:2], []byte{0xd9, 32}) {
+		t.Errorf("MessagePack header %x, want d920", got[:2])
+	}
+}
+
+func TestWriteNegotiated(t *testing.T) {
+	for _, c := range []struct {
+		accept, contentType, body, wantType, wantHex string
+	}{
+		{"application/cbor", "application/json", `{"a":1}`, contentTypeCBOR, "a1616101"},
+		{"text/html, application/x-msgpack;q=0.9", "application/json", `{"a":1}`, contentTypeMsgpack, "81a16101"},
+		{"", "application/json", `{"a":1}`, "application/json", hex.EncodeToString([]byte(`{"a":1}`))},
+		{"application/cbor", "text/plain", `not json`, "text/plain", hex.EncodeToString([]byte(`not json`))},
+	} {
+		r := httptest.NewRequest("GET", "/telemetry", nil)
+		r.Header.Set("Accept", c.accept)
+		w := httptest.NewRecorder()
+		writeNegotiated(w, r, http.StatusOK, c.contentType, []byte(c.body))
+		if w.Header().Get("Content-Type") != c.wantType || hex.EncodeToString(w.Body.Bytes()) != c.wantHex {
+			t.Errorf("Accept %q: %s %x, want %s %s", c.accept, w.Header().Get("Content-Type"), w.Body.Bytes(), c.wantType, c.wantHex)
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: missing Vary: Accept", c.accept)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postJSON(h http.HandlerFunc, path, body string) (int, string) {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r)
+	var envelope map[string]string
+	json.Unmarshal(w.Body.Bytes(), &envelope)
+	return w.Code, envelope["error"]
+}
+
+func TestBodyLimits(t *testing.T) {
+	t.Setenv(EnvControlMaxBody, "64")
+	t.Setenv(EnvOTAMaxBody, "128")
+	t.Setenv(EnvOTAApi, "http://127.0.0.1:1/ota")
+	big := `{"command":"start","params":{"pad":"` + strings.Repeat("x", 200) + `"}}`
+
+	for _, c := range []struct {
+		name  string
+		h     http.HandlerFunc
+		path  string
+		limit string
+	}{
+		{"control", handleControl, "/control", "64"},
+		{"batch", handleControlBatch, "/control/batch", "64"},
+		{"ota", handleOTA, "/ota", "128"},
+	} {
+		code, msg := postJSON(c.h, c.path, big)
+		if code != http.StatusRequestEntityTooLarge || msg != "request body exceeds "+c.limit+" bytes" {
+			t.Errorf("%s: %d %q, want 413 naming the %s-byte limit", c.name, code, msg, c.limit)
+		}
+	}
+}
+
+func TestDecodeJSONBodyErrors(t *testing.T) {
+	t.Setenv(EnvStrictJSON, "true")
+	for _, c := range []struct {
+		body, msg string
+	}{
+		{"", "request body is empty"},
+		{`{"comand":"start"}`, `unknown field "comand"`},
+	} {
+		code, msg := postJSON(handleControl, "/control", c.body)
+		if code != http.StatusBadRequest || msg != c.msg {
+			t.Errorf("%q: %d %q, want 400 %q", c.body, code, msg, c.msg)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getConfigBody(t *testing.T) (string, map[string]map[string]ConfigValue) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getConfig(w, httptest.NewRequest("GET", "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /config: status %d", w.Code)
+	}
+	var cfg map[string]map[string]ConfigValue
+	if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+		t.Fatalf("GET /config: %v: %s", err, w.Body.String())
+	}
+	return w.Body.String(), cfg
+}
+
+func TestConfigSources(t *testing.T) {
+	t.Setenv(EnvServerPort, "9090")
+	t.Setenv(EnvLogFormat, "")
+	t.Setenv(EnvDeviceIP, "10.0.0.5")
+	t.Setenv(EnvDeviceSSHHost, "")
+	t.Setenv(EnvAPIToken, "")
+	_, cfg := getConfigBody(t)
+
+	for _, c := range []struct {
+		group, env string
+		want       ConfigValue
+	}{
+		{"http", EnvServerPort, ConfigValue{"9090", "env"}},
+		{"logging", EnvLogFormat, ConfigValue{"text", "default"}},
+		{"device", EnvDeviceIP, ConfigValue{"10.0.0.5", "env"}},
+		// DEVICE_SSH_HOST falls back to DEVICE_IP
+		{"ssh", EnvDeviceSSHHost, ConfigValue{"10.0.0.5", "default"}},
+		// An unset secret is reported empty rather than masked
+		{"auth", EnvAPIToken, ConfigValue{"", "default"}},
+	} {
+		if got, ok := cfg[c.group][c.env]; !ok || got != c.want {
+			t.Errorf("%s.%s = %+v, want %+v", c.group, c.env, got, c.want)
+		}
+	}
+}
+
+func TestConfigMasksSecrets(t *testing.T) {
+	for _, s := range configSettings {
+		if s.Secret {
+			t.Setenv(s.Env, "leaked-"+strings.ToLower(s.Env))
+		}
+	}
+	body, cfg := getConfigBody(t)
+	if strings.Contains(body, "leaked-") {
+		t.Fatalf("GET /config exposes a secret: %s", body)
+	}
+	for _, s := range configSettings {
+		if !s.Secret {
+			continue
+		}
+		if got := cfg[s.Group][s.Env]; got != (ConfigValue{redactedValue, "env"}) {
+			t.Errorf("%s.%s = %+v, want it masked", s.Group, s.Env, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useParamsDevice points CONTROL_API at a device that records the params of
+// every command it receives.
+func useParamsDevice(t *testing.T) *[]map[string]interface{} {
+	t.Helper()
+	var got []map[string]interface{}
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ControlRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		got = append(got, req.Params)
+		w.Write([]byte(`{"ok":true}`))
+	})
+	return &got
+}
+
+func TestEncryptedControlParams(t *testing.T) {
+	seal := useSealedParams(t)
+	for _, c := range []struct {
+		name string
+		body string
+		want int
+	}{
+		{"sealed params", `{"command":"move","params_encrypted":"` + seal("move", `{"pin":"1234"}`) + `"}`, http.StatusOK},
+		{"no params", `{"command":"move"}`, http.StatusOK},
+		{"sealed for another command", `{"command":"move","params_encrypted":"` + seal("stop", `{"pin":"1234"}`) + `"}`, http.StatusBadRequest},
+		{"plaintext params", `{"command":"move","params":{"pin":"1234"}}`, http.StatusBadRequest},
+		{"not base64", `{"command":"move","params_encrypted":"%%%"}`, http.StatusBadRequest},
+		{"too short", `{"command":"move","params_encrypted":"AAAA"}`, http.StatusBadRequest},
+		{"not a JSON object", `{"command":"move","params_encrypted":"` + seal("move", `[1,2]`) + `"}`, http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			forwarded := useParamsDevice(t)
+			w := httptest.NewRecorder()
+			handleControl(w, httptest.NewRequest("POST", "/control", strings.NewReader(c.body)))
+			if w.Code != c.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.want, w.Body.String())
+			}
+			if c.want != http.StatusOK {
+				if len(*forwarded) != 0 {
+					t.Fatalf("rejected command reached the device: %v", *forwarded)
+				}
+				return
+			}
+			if len(*forwarded) != 1 {
+				t.Fatalf("device got %d command(s), want 1", len(*forwarded))
+			}
+			if c.name == "sealed params" && (*forwarded)[0]["pin"] != "1234" {
+				t.Fatalf("device got params %v, want the decrypted pin", (*forwarded)[0])
+			}
+		})
+	}
+}
+
+func TestSealedParamsRefusedWhenEncryptionOff(t *testing.T) {
+	prev := controlPayloadAEAD
+	controlPayloadAEAD = nil
+	t.Cleanup(func() { controlPayloadAEAD = prev })
+	forwarded := useParamsDevice(t)
+
+	w := httptest.NewRecorder()
+	handleControl(w, httptest.NewRequest("POST", "/control", strings.NewReader(`{"command":"move","params_encrypted":"AAAA"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), EnvControlEncryptPayload) {
+		t.Fatalf("status %d %s, want 400 naming %s", w.Code, w.Body.String(), EnvControlEncryptPayload)
+	}
+	if len(*forwarded) != 0 {
+		t.Fatalf("rejected command reached the device: %v", *forwarded)
+	}
+}
+
+func TestSealedBatchParamsStayOutOfAuditLog(t *testing.T) {
+	seal := useSealedParams(t)
+	forwarded := useParamsDevice(t)
+	useAuditLog(t, filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	body := `[{"command":"move","params_encrypted":"` + seal("move", `{"pin":"1234"}`) + `"},` +
+		`{"command":"grip","params_encrypted":"` + seal("grip", `{"force":7}`) + `"}]`
+	w := httptest.NewRecorder()
+	handleControlBatch(w, httptest.NewRequest("POST", "/control/batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if len(*forwarded) != 2 || (*forwarded)[0]["pin"] != "1234" || (*forwarded)[1]["force"] != float64(7) {
+		t.Fatalf("device got %v, want both commands' decrypted params", *forwarded)
+	}
+
+	w = httptest.NewRecorder()
+	getControlAudit(w, httptest.NewRequest("GET", "/control/audit", nil))
+	if strings.Contains(w.Body.String(), "1234") || strings.Contains(w.Body.String(), `"force"`) {
+		t.Fatalf("audit log holds decrypted params: %s", w.Body.String())
+	}
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 2 {
+		t.Fatalf("GET /control/audit: %v %s, want 2 entries", err, w.Body.String())
+	}
+}
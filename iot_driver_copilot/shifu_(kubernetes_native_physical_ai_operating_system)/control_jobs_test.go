@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useControlDevice points CONTROL_API at h.
+func useControlDevice(t *testing.T, h http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	t.Setenv(EnvControlAPI, srv.URL)
+}
+
+// useBlockingDevice points CONTROL_API at a device that holds every command
+// until release is called. started receives one value per command received.
+func useBlockingDevice(t *testing.T) (started <-chan string, release func()) {
+	t.Helper()
+	got := make(chan string, 16)
+	done := make(chan struct{})
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ControlRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		got <- req.Command
+		<-done
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true,"command":"` + req.Command + `"}`))
+	})
+	var once sync.Once
+	release = func() { once.Do(func() { close(done) }) }
+	// Runs before the server is closed, so a failed test doesn't hang on it
+	t.Cleanup(release)
+	return got, release
+}
+
+// useJobState gives the test its own job store and device gate.
+func useJobState(t *testing.T) {
+	t.Helper()
+	prevJobs, prevGate := controlJobs, deviceGate
+	controlJobs, deviceGate = newJobStore(50), &drainGate{}
+	t.Cleanup(func() { controlJobs, deviceGate = prevJobs, prevGate })
+}
+
+func pollJob(t *testing.T, id, want string) ControlJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := httptest.NewRequest("GET", "/control/jobs/"+id, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		getControlJob(w, r)
+		var job ControlJob
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("GET /control/jobs/%s: %d %s", id, w.Code, w.Body.String())
+		}
+		if job.Status == want {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %q, want %q", id, job.Status, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func postAsync(h http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", path+"?async=true", strings.NewReader(body)))
+	return w
+}
+
+func TestAsyncControlJobTransitions(t *testing.T) {
+	useJobState(t)
+	started, release := useBlockingDevice(t)
+
+	w := postAsync(handleControl, "/control", `{"command":"burn"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var accepted map[string]string
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+	if accepted["status"] != JobPending || accepted["job_id"] == "" {
+		t.Fatalf("accepted %v, want a pending job", accepted)
+	}
+	id := accepted["job_id"]
+
+	<-started
+	pollJob(t, id, JobRunning)
+	release()
+	job := pollJob(t, id, JobDone)
+	if result, _ := job.Result.(map[string]interface{}); result["command"] != "burn" {
+		t.Fatalf("result %v, want the device reply", job.Result)
+	}
+}
+
+func TestOTADrainWaitsForAsyncJobs(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		h    http.HandlerFunc
+		path string
+		body string
+	}{
+		{"control", handleControl, "/control", `{"command":"burn"}`},
+		{"batch", handleControlBatch, "/control/batch", `[{"command":"burn"}]`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			useJobState(t)
+			started, release := useBlockingDevice(t)
+
+			if w := postAsync(c.h, c.path, c.body); w.Code != http.StatusAccepted {
+				t.Fatalf("status %d, want 202: %s", w.Code, w.Body.String())
+			}
+			<-started
+			drained := make(chan struct{})
+			go func() {
+				deviceGate.drain(5 * time.Second)
+				close(drained)
+			}()
+			select {
+			case <-drained:
+				t.Fatal("drain returned while the async job was still talking to the device")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if w := postAsync(c.h, c.path, c.body); w.Code != http.StatusServiceUnavailable {
+				t.Errorf("submit during drain: status %d, want 503", w.Code)
+			}
+
+			release()
+			select {
+			case <-drained:
+			case <-time.After(2 * time.Second):
+				t.Fatal("drain did not return after the async job finished")
+			}
+			deviceGate.resume()
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRelay returns a relay whose upstream connection is driven by the
+// test through stream, rather than by a background run loop.
+func newTestRelay(rawURL string, size int) *eventRelay {
+	return &eventRelay{
+		URL:     rawURL,
+		Client:  &http.Client{},
+		Size:    size,
+		started: true,
+		subs:    make(map[chan sseEvent]struct{}),
+	}
+}
+
+func useDeviceEvents(t *testing.T, rl *eventRelay) {
+	t.Helper()
+	prev := deviceEvents
+	deviceEvents = rl
+	t.Cleanup(func() { deviceEvents = prev })
+}
+
+func eventIDs(events []sseEvent) []string {
+	out := []string{}
+	for _, ev := range events {
+		out = append(out, ev.ID)
+	}
+	return out
+}
+
+func TestDeviceEventStreamNotConfigured(t *testing.T) {
+	useDeviceEvents(t, nil)
+	w := httptest.NewRecorder()
+	handleDeviceEventStream(w, httptest.NewRequest("GET", "/device/events/stream", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", w.Code)
+	}
+}
+
+func TestEventRelayResumesFromLastID(t *testing.T) {
+	var attempts atomic.Int32
+	var resumedFrom atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if attempts.Add(1) == 1 {
+			writeSSE(w, sseEvent{ID: "1", Data: "a"})
+			writeSSE(w, sseEvent{ID: "2", Name: "status", Data: "b"})
+			return // drop the connection
+		}
+		resumedFrom.Store(r.Header.Get("Last-Event-ID"))
+		writeSSE(w, sseEvent{ID: "3", Data: "c"})
+	}))
+	defer srv.Close()
+	rl := newTestRelay(srv.URL, 2)
+	ch, _ := rl.subscribe("")
+
+	for i := 0; i < 2; i++ {
+		if received, _ := rl.stream(context.Background()); !received {
+			t.Fatalf("connection %d received no events", i+1)
+		}
+	}
+	if got, _ := resumedFrom.Load().(string); got != "2" {
+		t.Errorf("reconnect sent Last-Event-ID %q, want 2", got)
+	}
+	var relayed []sseEvent
+	for len(ch) > 0 {
+		relayed = append(relayed, <-ch)
+	}
+	if got := eventIDs(relayed); len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("subscriber got %v, want [1 2 3]", got)
+	}
+	if relayed[1].Name != "status" || relayed[1].Data != "b" {
+		t.Errorf("event 2 = %+v, want the status event", relayed[1])
+	}
+	// Size is 2, so the oldest event has been dropped from the buffer
+	if got := eventIDs(rl.buf); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Errorf("buffer holds %v, want [2 3]", got)
+	}
+}
+
+func TestDeviceEventStreamReplaysMissedEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleDeviceEventStream))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		name   string
+		query  string
+		lastID string
+		want   []string
+	}{
+		{"Last-Event-ID header", "", "1", []string{"2", "3", "live"}},
+		{"last_event_id query", "?last_event_id=2", "", []string{"3", "live"}},
+		{"unknown ID", "", "99", []string{"live"}},
+		{"no ID", "", "", []string{"live"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rl := newTestRelay("http://device.local:8080/events", 10)
+			for _, id := range []string{"1", "2", "3"} {
+				rl.publish(sseEvent{ID: id, Data: "reading " + id})
+			}
+			useDeviceEvents(t, rl)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+c.query, nil)
+			if c.lastID != "" {
+				req.Header.Set("Last-Event-ID", c.lastID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if host := resp.Header.Get("X-Device-Host"); host != "device.local:8080" {
+				t.Errorf("X-Device-Host %q, want device.local:8080", host)
+			}
+			events := make(chan sseEvent, 16)
+			go readSSE(resp.Body, func(ev sseEvent) { events <- ev })
+
+			var got []string
+			timeout := time.After(5 * time.Second)
+			for len(got) < len(c.want) {
+				select {
+				case ev := <-events:
+					got = append(got, ev.ID)
+				case <-timeout:
+					t.Fatalf("got %v, want %v", got, c.want)
+				case <-time.After(50 * time.Millisecond):
+					// The replay has been written, so the client is subscribed
+					// and sees what the device sends next
+					rl.publish(sseEvent{ID: "live", Data: "now"})
+				}
+			}
+			for i := range c.want {
+				if got[i] != c.want[i] {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
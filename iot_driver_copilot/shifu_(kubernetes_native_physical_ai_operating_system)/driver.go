@@ -1,34 +1,125 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Environment variable names
 const (
-	EnvServerHost     = "SERVER_HOST"
-	EnvServerPort     = "SERVER_PORT"
-	EnvDeviceIP       = "DEVICE_IP"
-	EnvMqttHost       = "MQTT_HOST"
-	EnvMqttPort       = "MQTT_PORT"
-	EnvModbusPort     = "MODBUS_PORT"
-	EnvS7Port         = "S7_PORT"
-	EnvVideoAPIUrl    = "VIDEO_API_URL"
-	EnvVideoAPIKey    = "VIDEO_API_KEY"
-	EnvTelemetryAPI   = "TELEMETRY_API"
-	EnvStatusAPI      = "STATUS_API"
-	EnvControlAPI     = "CONTROL_API"
-	EnvOTAApi         = "OTA_API"
+	EnvServerHost              = "SERVER_HOST"
+	EnvServerPort              = "SERVER_PORT"
+	EnvDeviceIP                = "DEVICE_IP"
+	EnvMqttHost                = "MQTT_HOST"
+	EnvMqttPort                = "MQTT_PORT"
+	EnvModbusPort              = "MODBUS_PORT"
+	EnvS7Port                  = "S7_PORT"
+	EnvVideoAPIUrl             = "VIDEO_API_URL"
+	EnvVideoAPIKey             = "VIDEO_API_KEY"
+	EnvTelemetryAPI            = "TELEMETRY_API"
+	EnvStatusAPI               = "STATUS_API"
+	EnvControlAPI              = "CONTROL_API"
+	EnvOTAApi                  = "OTA_API"
+	EnvOTADrainTimeout         = "OTA_DRAIN_TIMEOUT_S"
+	EnvOTAOnlineTimeout        = "OTA_ONLINE_TIMEOUT_S"
+	EnvWebhookURL              = "WEBHOOK_URL"
+	EnvWebhookSecret           = "WEBHOOK_SECRET"
+	EnvStatusWebhookURL        = "STATUS_WEBHOOK_URL"
+	EnvStatusWebhookSecret     = "STATUS_WEBHOOK_SECRET"
+	EnvStatusWebhookRetries    = "STATUS_WEBHOOK_RETRIES"
+	EnvAPIToken                = "API_TOKEN"
+	EnvControlAsync            = "CONTROL_ASYNC"
+	EnvControlJobHistoryMax    = "CONTROL_JOB_HISTORY_MAX"
+	EnvLogFormat               = "LOG_FORMAT"
+	EnvAccessLogExclude        = "ACCESS_LOG_EXCLUDE_PATHS"
+	EnvJWTSecret               = "JWT_SECRET"
+	EnvControlACLFile          = "CONTROL_ACL_FILE"
+	EnvAuditLogFile            = "AUDIT_LOG_FILE"
+	EnvControlBatchStopOnError = "CONTROL_BATCH_STOP_ON_ERROR"
+	EnvScheduleFile            = "SCHEDULE_FILE"
+	EnvDeviceIDs               = "DEVICE_IDS"
+	EnvJobHistoryTTL           = "COMMAND_HISTORY_TTL_HOURS"
+	EnvJobHistorySweep         = "COMMAND_HISTORY_SWEEP_INTERVAL_S"
+	EnvDeviceEventsPath        = "DEVICE_EVENTS_PATH"
+	EnvDeviceEventsSSEPath     = "DEVICE_EVENTS_SSE_PATH"
+	EnvDeviceEventsBuffer      = "DEVICE_EVENTS_BUFFER"
+	EnvAccessLogFile           = "ACCESS_LOG_FILE"
+	EnvLogMaxSizeMB            = "LOG_MAX_SIZE_MB"
+	EnvLogMaxBackups           = "LOG_MAX_BACKUPS"
+	EnvMaxVideoClients         = "MAX_VIDEO_CLIENTS"
+	EnvTrustedProxies          = "TRUSTED_PROXIES"
+	EnvEnablePprof             = "ENABLE_PPROF"
+	EnvPprofHost               = "PPROF_HOST"
+	EnvPprofPort               = "PPROF_PORT"
+	EnvControlMaxBody          = "CONTROL_MAX_BODY_BYTES"
+	EnvOTAMaxBody              = "OTA_MAX_BODY_BYTES"
+	EnvStrictJSON              = "STRICT_JSON"
+	EnvTelemetryMode           = "TELEMETRY_MODE"
+	EnvOTAStateFile            = "OTA_STATE_FILE"
+	EnvOTACacheDir             = "OTA_CACHE_DIR"
+	EnvOTACacheMaxImages       = "OTA_CACHE_MAX_IMAGES"
+	EnvOTAFirmwareBaseURL      = "OTA_FIRMWARE_BASE_URL"
+	EnvH2CEnabled              = "H2C_ENABLED"
+	EnvOTAMaxFirmwareMB        = "OTA_MAX_FIRMWARE_MB"
+	EnvOTAPublicKeyFile        = "OTA_SIGNING_PUBLIC_KEY_FILE"
+	EnvSSHProxyEnabled         = "SSH_PROXY_ENABLED"
+	EnvDeviceSSHHost           = "DEVICE_SSH_HOST"
+	EnvDeviceSSHPort           = "DEVICE_SSH_PORT"
+	EnvDeviceSSHUser           = "DEVICE_SSH_USER"
+	EnvDeviceSSHKeyFile        = "DEVICE_SSH_KEY_FILE"
+	EnvDeviceSSHKnownHosts     = "DEVICE_SSH_KNOWN_HOSTS_FILE"
+	EnvSSHAllowedOrigins       = "SSH_ALLOWED_ORIGINS"
+	EnvControlEncryptPayload   = "CONTROL_ENCRYPT_PAYLOAD"
+	EnvControlPayloadKey       = "CONTROL_PAYLOAD_KEY"
+	EnvEventLogSize            = "EVENT_LOG_SIZE"
+)
+
+// Build information, stamped at build time:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 // Helper: Required environment variable
@@ -49,6 +140,28 @@ func getEnv(key, def string) string {
 	return v
 }
 
+// Helper: Optional integer with default
+func getEnvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("invalid value for %s: %q, using default %d", key, v, def)
+	}
+	return def
+}
+
+// Helper: Optional duration in seconds with default
+func getEnvSeconds(key string, def int) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second
+		}
+		log.Printf("invalid value for %s: %q, using default %ds", key, v, def)
+	}
+	return time.Duration(def) * time.Second
+}
+
 // ========== Data Structures ==========
 
 type StatusResponse struct {
@@ -68,179 +181,4347 @@ type TelemetryResponse struct {
 type OTARequest struct {
 	FirmwareURL string `json:"firmware_url"`
 	Version     string `json:"version"`
+	Checksum    string `json:"checksum,omitempty"`  // sha256 hex, optionally "sha256:"-prefixed
+	Signature   string `json:"signature,omitempty"` // base64 Ed25519ph signature of the image
+	DryRun      bool   `json:"dry_run,omitempty"`
 }
 
 type ControlRequest struct {
-	Command string                 `json:"command"`
-	Params  map[string]interface{} `json:"params,omitempty"`
+	Command  string                 `json:"command"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Sealed   string                 `json:"params_encrypted,omitempty"` // see CONTROL_PAYLOAD_ENCRYPTION.md
+	DeviceID string                 `json:"-"`                          // target unit, empty for the default device
+	secret   bool                   // params arrived encrypted; kept out of events, jobs and the audit log
 }
 
-// ========== Video Stream Proxy ==========
+// ========== Multi-Device Support ==========
 
-func streamVideo(w http.ResponseWriter, r *http.Request) {
-	videoAPI := mustEnv(EnvVideoAPIUrl)
-	apiKey := os.Getenv(EnvVideoAPIKey)
+// deviceIDs lists the units served by this driver (DEVICE_IDS). The device API
+// variables may contain a {device_id} placeholder that is filled in per
+// request. Without DEVICE_IDS the driver serves a single device as before.
+var deviceIDs []string
 
-	// For demonstration, we expect the video API to respond with an MJPEG stream
-	client := &http.Client{
-		Timeout: 0, // no timeout for streaming
+func parseDeviceIDs(v string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(v, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
 	}
-	req, err := http.NewRequest("GET", videoAPI, nil)
-	if err != nil {
-		http.Error(w, "Error preparing video stream request", http.StatusInternalServerError)
-		return
+	return ids
+}
+
+// resolveDevice maps the empty ID used by the unprefixed routes to the first
+// configured device.
+func resolveDevice(id string) string {
+	if id == "" && len(deviceIDs) > 0 {
+		return deviceIDs[0]
 	}
-	if apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+apiKey)
+	return id
+}
+
+// deviceAPI returns the URL in env var key with {device_id} filled in.
+func deviceAPI(key, deviceID string) string {
+	return strings.ReplaceAll(mustEnv(key), "{device_id}", url.PathEscape(resolveDevice(deviceID)))
+}
+
+// forDevice guards a /devices/{device_id}/... route, answering 404 with the
+// known IDs when the device is not configured.
+func forDevice(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("device_id")
+		for _, known := range deviceIDs {
+			if id == known {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "unknown device",
+			"details": map[string]interface{}{
+				"device_id": id,
+				"known_ids": append([]string{}, deviceIDs...),
+			},
+		})
 	}
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Unable to reach video source", http.StatusBadGateway)
-		return
+// ========== Authentication ==========
+
+// publicPaths are served without a bearer token.
+var publicPaths = map[string]bool{
+	"/healthz": true,
+}
+
+// writeJSONError writes the driver's JSON error envelope.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// parseTokens splits the comma-separated API_TOKEN value. Several tokens may
+// be active at once so they can be rotated without downtime.
+func parseTokens(v string) [][]byte {
+	var tokens [][]byte
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, []byte(t))
+		}
 	}
-	defer resp.Body.Close()
+	return tokens
+}
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "Video source returned: "+resp.Status, http.StatusBadGateway)
-		return
+// requireToken rejects requests without a valid "Authorization: Bearer"
+// credential: one of the static API tokens, or an HS256 JWT signed with
+// JWT_SECRET. The caller's identity is stored in the request context. With no
+// tokens and no JWT secret configured every request is let through.
+func requireToken(tokens [][]byte, jwtSecret []byte, next http.Handler) http.Handler {
+	if len(tokens) == 0 && len(jwtSecret) == 0 {
+		return next
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Cached firmware is fetched by the device itself; only images in the
+		// OTA state or being installed are served
+		if publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, otaFirmwarePrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		identity := ""
+		if ok {
+			identity = authenticate(tokens, jwtSecret, presented)
+		}
+		if identity == "" {
+			log.Printf("authentication failed for %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="shifu"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
 
-	ct := resp.Header.Get("Content-Type")
-	if !strings.HasPrefix(ct, "multipart/") && !strings.HasPrefix(ct, "video/") {
-		http.Error(w, "Upstream video is not a compatible stream", http.StatusBadGateway)
-		return
+// authenticate returns the identity behind a bearer credential, or "" if it
+// is not valid.
+func authenticate(tokens [][]byte, jwtSecret []byte, presented string) string {
+	if validToken(tokens, []byte(presented)) {
+		return tokenIdentity(presented)
 	}
-	w.Header().Set("Content-Type", ct)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, resp.Body)
+	if len(jwtSecret) > 0 && strings.Count(presented, ".") == 2 {
+		sub, err := verifyJWT(jwtSecret, presented)
+		if err == nil {
+			return sub
+		}
+		log.Printf("rejected JWT: %v", err)
+	}
+	return ""
 }
 
-// ========== Telemetry Proxy ==========
+// validToken compares against every configured token in constant time.
+func validToken(tokens [][]byte, presented []byte) bool {
+	match := 0
+	for _, t := range tokens {
+		match |= subtle.ConstantTimeCompare(t, presented)
+	}
+	return match == 1
+}
 
-func fetchTelemetry(w http.ResponseWriter, r *http.Request) {
-	telemetryAPI := mustEnv(EnvTelemetryAPI)
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("GET", telemetryAPI, nil)
+// tokenIdentity derives the identity of a static API token from its prefix:
+// "operator_3f9a..." belongs to "operator". Tokens without a prefix are
+// anonymous.
+func tokenIdentity(token string) string {
+	if prefix, _, ok := strings.Cut(token, "_"); ok && prefix != "" {
+		return prefix
+	}
+	return "anonymous"
+}
+
+// verifyJWT checks an HS256 JWT's signature and expiry and returns its sub claim.
+func verifyJWT(secret []byte, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "HS256" {
+		return "", errors.New("unsupported algorithm " + header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
 	if err != nil {
-		http.Error(w, "Failed to prepare telemetry request", http.StatusInternalServerError)
-		return
+		return "", errors.New("malformed signature")
 	}
-	resp, err := client.Do(req)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("invalid signature")
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Exp != 0 && time.Now().Unix() >= claims.Exp {
+		return "", errors.New("token expired")
+	}
+	if claims.Sub == "" {
+		return "", errors.New("missing sub claim")
+	}
+	return claims.Sub, nil
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
 	if err != nil {
-		http.Error(w, "Failed to fetch telemetry data", http.StatusBadGateway)
-		return
+		return errors.New("malformed token")
 	}
-	defer resp.Body.Close()
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
 }
 
-// ========== Status Proxy ==========
+type identityKey struct{}
 
-func fetchStatus(w http.ResponseWriter, r *http.Request) {
-	statusAPI := mustEnv(EnvStatusAPI)
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("GET", statusAPI, nil)
-	if err != nil {
-		http.Error(w, "Failed to prepare status request", http.StatusInternalServerError)
-		return
+// requestIdentity returns the authenticated identity of the caller, or
+// "anonymous" when authentication is disabled.
+func requestIdentity(r *http.Request) string {
+	if id, ok := r.Context().Value(identityKey{}).(string); ok {
+		return id
 	}
-	resp, err := client.Do(req)
+	return "anonymous"
+}
+
+// ========== Control ACL ==========
+
+// ControlACLEntry lists the control commands an identity may send. "*"
+// allows every command.
+type ControlACLEntry struct {
+	Identity string   `json:"identity"`
+	Allow    []string `json:"allow"`
+}
+
+// ControlACL maps identities to their permitted commands. A nil ACL permits
+// everything.
+type ControlACL map[string]map[string]bool
+
+var controlACL ControlACL
+
+// loadControlACL reads CONTROL_ACL_FILE; an empty path disables the ACL.
+func loadControlACL(path string) (ControlACL, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		http.Error(w, "Failed to fetch status data", http.StatusBadGateway)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	var entries []ControlACLEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	acl := ControlACL{}
+	for _, e := range entries {
+		if acl[e.Identity] == nil {
+			acl[e.Identity] = map[string]bool{}
+		}
+		for _, cmd := range e.Allow {
+			acl[e.Identity][strings.ToLower(cmd)] = true
+		}
+	}
+	return acl, nil
 }
 
-// ========== OTA Upgrade Proxy ==========
+// permits reports whether identity may send command.
+func (acl ControlACL) permits(identity, command string) bool {
+	if acl == nil {
+		return true
+	}
+	allowed := acl[identity]
+	return allowed["*"] || allowed[strings.ToLower(command)]
+}
 
-func handleOTA(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// writeCommandDenied writes the 403 response for a command outside the ACL.
+func writeCommandDenied(w http.ResponseWriter, command string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": "command not permitted", "command": command})
+}
+
+// ========== OTA Connection Draining ==========
+
+// drainGate tracks in-flight device requests so an OTA upgrade can stop
+// new ones and let the running ones finish before the device restarts.
+type drainGate struct {
+	mu       sync.Mutex
+	draining bool
+	inflight int
+	idle     chan struct{} // closed when inflight drops to zero during a drain
+}
+
+var deviceGate = &drainGate{}
+
+// track wraps a device-proxying handler so it is counted as in-flight and
+// rejected with 503 while an OTA upgrade is draining the device.
+func (g *drainGate) track(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.enter() {
+			writeUpgrading(w)
+			return
+		}
+		defer g.leave()
+		h(w, r)
 	}
-	otaAPI := mustEnv(EnvOTAApi)
-	var otaReq OTARequest
-	if err := json.NewDecoder(r.Body).Decode(&otaReq); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+}
+
+// writeUpgrading writes the 503 returned while an OTA upgrade drains the device.
+func writeUpgrading(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, "Device is being upgraded, try again later", http.StatusServiceUnavailable)
+}
+
+func (g *drainGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return false
+	}
+	g.inflight++
+	return true
+}
+
+func (g *drainGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight--
+	if g.inflight == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// drain stops new requests and waits up to timeout for in-flight ones to
+// finish. It returns false without draining if a drain is already active.
+func (g *drainGate) drain(timeout time.Duration) bool {
+	g.mu.Lock()
+	if g.draining {
+		g.mu.Unlock()
+		return false
+	}
+	g.draining = true
+	if g.inflight == 0 {
+		g.mu.Unlock()
+		return true
+	}
+	g.idle = make(chan struct{})
+	idle, remaining := g.idle, g.inflight
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+		log.Printf("OTA drain timed out after %s with %d request(s) still in flight", timeout, remaining)
+	}
+	return true
+}
+
+func (g *drainGate) resume() {
+	g.mu.Lock()
+	g.draining = false
+	g.mu.Unlock()
+}
+
+// waitForDevice polls the status API until the device answers again after an
+// upgrade, then reopens the gate. The gate is reopened on timeout as well so a
+// device that never comes back doesn't wedge the driver. It reports whether the
+// device came back.
+func waitForDevice(statusAPI string, timeout time.Duration) bool {
+	defer deviceGate.resume()
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		resp, err := client.Get(statusAPI)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			log.Printf("Device is back online after OTA upgrade, accepting requests")
+			return true
+		}
+	}
+	log.Printf("Device did not come back online within %s after OTA upgrade, accepting requests anyway", timeout)
+	return false
+}
+
+// ========== Webhook Events ==========
+
+// Event types delivered to WEBHOOK_URL
+const (
+	EventOTAComplete     = "ota.complete"
+	EventControlExecuted = "control.executed"
+	EventStatusChanged   = "status.changed"
+	EventTelemetryPushed = "telemetry.pushed"
+	EventOTARollback     = "ota.rollback"
+)
+
+// Event is a significant device event delivered to external systems.
+type Event struct {
+	ID        string      `json:"event_id"`
+	Type      string      `json:"type"`
+	Payload   interface{} `json:"payload"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// EventBus posts events to a webhook, signed with HMAC-SHA256 when a secret
+// is configured. A bus without a URL drops events.
+type EventBus struct {
+	URL     string
+	Secret  string
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+var events = &EventBus{
+	URL:     os.Getenv(EnvWebhookURL),
+	Secret:  os.Getenv(EnvWebhookSecret),
+	Client:  &http.Client{Timeout: 5 * time.Second},
+	Retries: 3,
+	Backoff: time.Second,
+}
+
+// statusWebhook receives only status transitions, in a flat payload that
+// alerting tools can consume without unwrapping the Event envelope.
+var statusWebhook = &EventBus{
+	URL:     os.Getenv(EnvStatusWebhookURL),
+	Secret:  os.Getenv(EnvStatusWebhookSecret),
+	Client:  &http.Client{Timeout: 5 * time.Second},
+	Retries: getEnvInt(EnvStatusWebhookRetries, 3),
+	Backoff: time.Second,
+}
+
+// StatusTransition is the body posted to STATUS_WEBHOOK_URL.
+type StatusTransition struct {
+	Device    string          `json:"device"`
+	OldStatus string          `json:"old_status"`
+	NewStatus string          `json:"new_status"`
+	Timestamp time.Time       `json:"ts"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// statusQueueSize bounds the transitions waiting for STATUS_WEBHOOK_URL.
+const statusQueueSize = 256
+
+// statusQueue delivers status transitions one at a time from a single
+// worker, so the receiver sees them in the order they happened even when a
+// delivery is retried. Transitions arriving while the queue is full are
+// dropped and counted as failures.
+type statusQueue struct {
+	bus  *EventBus
+	once sync.Once
+	ch   chan statusDelivery
+}
+
+type statusDelivery struct {
+	event Event
+	body  []byte
+}
+
+var statusTransitions = &statusQueue{bus: statusWebhook}
+
+// enqueue queues a delivery without blocking, starting the worker on first
+// use.
+func (q *statusQueue) enqueue(event Event, body []byte) {
+	q.once.Do(func() {
+		q.ch = make(chan statusDelivery, statusQueueSize)
+		go q.run()
+	})
+	select {
+	case q.ch <- statusDelivery{event, body}:
+	default:
+		log.Printf("status webhook: queue full, dropping transition %s", event.ID)
+		metrics.statusWebhookFailures.Add(1)
+	}
+}
+
+func (q *statusQueue) run() {
+	for d := range q.ch {
+		if err := q.bus.deliver(d.event, d.body); err != nil {
+			metrics.statusWebhookFailures.Add(1)
+		}
+	}
+}
+
+// notifyStatusWebhook queues a status transition for STATUS_WEBHOOK_URL, so
+// a slow receiver never holds up status processing. Deliveries that fail
+// after every retry are counted in
+// shifu_driver_status_webhook_failures_total.
+func notifyStatusWebhook(deviceID, previous, current string, status []byte) {
+	if statusWebhook.URL == "" {
 		return
 	}
-	payload, _ := json.Marshal(otaReq)
-	client := &http.Client{Timeout: 15 * time.Second}
-	req, err := http.NewRequest("POST", otaAPI, bytes.NewReader(payload))
+	body, err := json.Marshal(StatusTransition{
+		Device:    deviceID,
+		OldStatus: previous,
+		NewStatus: current,
+		Timestamp: time.Now().UTC(),
+		Payload:   json.RawMessage(status),
+	})
 	if err != nil {
-		http.Error(w, "Failed to prepare OTA request", http.StatusInternalServerError)
+		log.Printf("status webhook: failed to encode transition: %v", err)
 		return
 	}
+	statusTransitions.enqueue(Event{ID: newUUID(), Type: EventStatusChanged}, body)
+}
+
+// Dispatch assigns the event a unique ID and delivers it in the background so
+// request handlers never wait on the webhook receiver. It returns the event ID.
+func (b *EventBus) Dispatch(event Event) string {
+	if b.URL == "" {
+		return ""
+	}
+	if event.ID == "" {
+		event.ID = newUUID()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("webhook: failed to encode %s event: %v", event.Type, err)
+		return ""
+	}
+	go b.deliver(event, body)
+	return event.ID
+}
+
+// deliver posts body to the webhook, retrying failed attempts with exponential
+// backoff. Every attempt carries the same X-Shifu-Event-ID so the receiver can
+// deduplicate; a 409 Conflict means it already has the event.
+func (b *EventBus) deliver(event Event, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= b.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(b.Backoff << (attempt - 1))
+		}
+		if err = b.post(event.ID, body); err == nil {
+			return nil
+		}
+		log.Printf("webhook: delivery of %s event %s failed (attempt %d/%d): %v", event.Type, event.ID, attempt+1, b.Retries+1, err)
+	}
+	return err
+}
+
+func (b *EventBus) post(eventID string, body []byte) error {
+	req, err := http.NewRequest("POST", b.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	req.Header.Set("X-Shifu-Event-ID", eventID)
+	if b.Secret != "" {
+		req.Header.Set("X-Shifu-Signature", signPayload(b.Secret, body))
+	}
+	resp, err := b.Client.Do(req)
 	if err != nil {
-		http.Error(w, "OTA upgrade failed", http.StatusBadGateway)
-		return
+		return err
 	}
 	defer resp.Body.Close()
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		// Already processed by the receiver
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		return errors.New("receiver returned " + resp.Status)
+	}
+	return nil
 }
 
-// ========== Device Control Proxy ==========
+// newUUID returns a random (version 4) UUID, used for event and job IDs.
+func newUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		log.Printf("failed to generate UUID: %v", err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
 
-func handleControl(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// signPayload returns the X-Shifu-Signature value for body: "sha256=" followed
+// by the hex HMAC-SHA256 of the body keyed with secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ========== Lifecycle Events ==========
+
+// LifecycleType classifies an entry of GET /events.
+type LifecycleType string
+
+// Lifecycle event types; GET /events?type= accepts exactly these.
+const (
+	LifecycleOTA     LifecycleType = "ota"
+	LifecycleControl LifecycleType = "control"
+	LifecycleStatus  LifecycleType = "status"
+)
+
+var lifecycleTypes = map[LifecycleType]bool{
+	LifecycleOTA:     true,
+	LifecycleControl: true,
+	LifecycleStatus:  true,
+}
+
+// LifecycleEvent is one entry of GET /events. Seq increases by one per event
+// and doubles as the pagination cursor.
+type LifecycleEvent struct {
+	Seq       uint64        `json:"seq"`
+	Timestamp time.Time     `json:"ts"`
+	Type      LifecycleType `json:"type"`
+	Summary   string        `json:"summary"`
+	Details   interface{}   `json:"details,omitempty"`
+}
+
+// lifecycleRecorder keeps the most recent EVENT_LOG_SIZE lifecycle events in
+// memory, dropping the oldest first. It is safe for concurrent use.
+type lifecycleRecorder struct {
+	mu     sync.Mutex
+	size   int
+	seq    uint64
+	events []LifecycleEvent // oldest first
+}
+
+var lifecycle = newLifecycleRecorder(getEnvInt(EnvEventLogSize, 500))
+
+func newLifecycleRecorder(size int) *lifecycleRecorder {
+	if size < 1 {
+		size = 1
 	}
-	controlAPI := mustEnv(EnvControlAPI)
-	var ctrlReq ControlRequest
-	if err := json.NewDecoder(r.Body).Decode(&ctrlReq); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	return &lifecycleRecorder{size: size}
+}
+
+// record adds an event. Details must not be modified afterwards.
+func (l *lifecycleRecorder) record(typ LifecycleType, summary string, details interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	if len(l.events) == l.size {
+		copy(l.events, l.events[1:])
+		l.events = l.events[:len(l.events)-1]
 	}
-	payload, _ := json.Marshal(ctrlReq)
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("POST", controlAPI, bytes.NewReader(payload))
-	if err != nil {
-		http.Error(w, "Failed to prepare control command", http.StatusInternalServerError)
-		return
+	l.events = append(l.events, LifecycleEvent{
+		Seq:       l.seq,
+		Timestamp: time.Now().UTC(),
+		Type:      typ,
+		Summary:   summary,
+		Details:   details,
+	})
+}
+
+// query returns up to limit events, newest first, that match typ (any when
+// empty), happened at or after since, and have a Seq below before (no bound
+// when zero). more reports whether older matching events remain.
+func (l *lifecycleRecorder) query(typ LifecycleType, since time.Time, before uint64, limit int) (page []LifecycleEvent, more bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	page = []LifecycleEvent{}
+	for i := len(l.events) - 1; i >= 0; i-- {
+		e := l.events[i]
+		if before != 0 && e.Seq >= before {
+			continue
+		}
+		if e.Timestamp.Before(since) {
+			break
+		}
+		if typ != "" && e.Type != typ {
+			continue
+		}
+		if len(page) == limit {
+			return page, true
+		}
+		page = append(page, e)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Failed to send control command", http.StatusBadGateway)
+	return page, false
+}
+
+// getEvents handles GET /events?type=&since=&limit=&cursor=. Events are
+// returned newest first; when more remain, next_cursor is passed as ?cursor=
+// to fetch the next (older) page with the same filters.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	typ := LifecycleType(q.Get("type"))
+	if typ != "" && !lifecycleTypes[typ] {
+		writeJSONError(w, http.StatusBadRequest, "unknown event type "+strconv.Quote(string(typ))+"; use ota, control or status")
 		return
 	}
-	defer resp.Body.Close()
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "since must be an RFC3339 timestamp")
+			return
+		}
+		since = t
+	}
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	var before uint64
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		before = n
+	}
+	page, more := lifecycle.query(typ, since, before, limit)
+	resp := map[string]interface{}{"events": page}
+	if more {
+		resp["next_cursor"] = strconv.FormatUint(page[len(page)-1].Seq, 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
-// ========== Main and Routing ==========
+// ========== Driver Metrics ==========
 
-func main() {
-	// Required env vars
-	host := getEnv(EnvServerHost, "0.0.0.0")
-	port := getEnv(EnvServerPort, "8080")
+// driverMetrics holds the driver's own Prometheus metrics, exposed on /metrics
+// in the text exposition format.
+type driverMetrics struct {
+	mu            sync.Mutex
+	httpRequests  map[httpRequestKey]uint64
+	otaJobs       map[string]uint64
+	videoClients  atomic.Int64
+	lastTelemetry atomic.Int64 // unix nanoseconds of the last successful telemetry fetch
 
-	// Non-protocol ports are not used here, but can be enforced if needed
-	// (MQTT, Modbus, S7, etc.) - not implemented as HTTP endpoints
+	statusWebhookFailures atomic.Uint64
+}
+
+type httpRequestKey struct {
+	route string
+	code  int
+}
 
-	http.HandleFunc("/status", fetchStatus)
-	http.HandleFunc("/telemetry", fetchTelemetry)
-	http.HandleFunc("/video", streamVideo)
-	http.HandleFunc("/ota", handleOTA)
-	http.HandleFunc("/control", handleControl)
+var metrics = &driverMetrics{
+	httpRequests: map[httpRequestKey]uint64{},
+	otaJobs:      map[string]uint64{},
+}
 
-	addr := host + ":" + port
-	log.Printf("Shifu PAIOS HTTP Driver starting at %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("HTTP server failed: %v", err)
+func (m *driverMetrics) observeRequest(route string, code int) {
+	m.mu.Lock()
+	m.httpRequests[httpRequestKey{route, code}]++
+	m.mu.Unlock()
+}
+
+// observeOTA counts an OTA job by outcome: accepted, rejected or failed.
+func (m *driverMetrics) observeOTA(outcome string) {
+	m.mu.Lock()
+	m.otaJobs[outcome]++
+	m.mu.Unlock()
+}
+
+func (m *driverMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	requests := make([]httpRequestKey, 0, len(m.httpRequests))
+	for k := range m.httpRequests {
+		requests = append(requests, k)
 	}
-}
\ No newline at end of file
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].route != requests[j].route {
+			return requests[i].route < requests[j].route
+		}
+		return requests[i].code < requests[j].code
+	})
+	fmt.Fprintln(w, "# HELP shifu_driver_http_requests_total HTTP requests served by the driver, by route and status code.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_http_requests_total counter")
+	for _, k := range requests {
+		fmt.Fprintf(w, "shifu_driver_http_requests_total{route=\"%s\",code=\"%d\"} %d\n", escapeLabel(k.route), k.code, m.httpRequests[k])
+	}
+
+	outcomes := make([]string, 0, len(m.otaJobs))
+	for k := range m.otaJobs {
+		outcomes = append(outcomes, k)
+	}
+	sort.Strings(outcomes)
+	fmt.Fprintln(w, "# HELP shifu_driver_ota_jobs_total OTA upgrade jobs forwarded to the device, by outcome.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_ota_jobs_total counter")
+	for _, k := range outcomes {
+		fmt.Fprintf(w, "shifu_driver_ota_jobs_total{outcome=\"%s\"} %d\n", escapeLabel(k), m.otaJobs[k])
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP shifu_driver_video_clients_active Video stream clients currently connected.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_video_clients_active gauge")
+	fmt.Fprintf(w, "shifu_driver_video_clients_active %d\n", m.videoClients.Load())
+
+	fmt.Fprintln(w, "# HELP shifu_driver_video_clients_max Limit on concurrent video stream clients, 0 if unlimited.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_video_clients_max gauge")
+	fmt.Fprintf(w, "shifu_driver_video_clients_max %d\n", maxVideoClients)
+
+	fmt.Fprintln(w, "# HELP shifu_driver_status_webhook_failures_total Status transitions that could not be delivered to STATUS_WEBHOOK_URL.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_status_webhook_failures_total counter")
+	fmt.Fprintf(w, "shifu_driver_status_webhook_failures_total %d\n", m.statusWebhookFailures.Load())
+
+	fmt.Fprintln(w, "# HELP shifu_driver_telemetry_age_seconds Seconds since telemetry was last fetched from the device.")
+	fmt.Fprintln(w, "# TYPE shifu_driver_telemetry_age_seconds gauge")
+	if last := m.lastTelemetry.Load(); last != 0 {
+		fmt.Fprintf(w, "shifu_driver_telemetry_age_seconds %g\n", time.Since(time.Unix(0, last)).Seconds())
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeTo(w)
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// instrument counts every request by the mux pattern that served it, so new
+// routes are picked up without touching the metrics code.
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			// Rejected before reaching the mux (e.g. by authentication)
+			_, route = mux.Handler(r)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metrics.observeRequest(route, rec.status)
+	})
+}
+
+// ========== Trusted Proxies ==========
+
+// forwardedProtoKey holds the scheme the client used, as reported by a
+// trusted proxy.
+type forwardedProtoKey struct{}
+
+func parseTrustedProxies(v string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrusted(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the client address from X-Forwarded-For, walking
+// the hops right to left past trusted proxies. If every hop is trusted the
+// leftmost one is the client.
+func forwardedClient(trusted []netip.Prefix, xff []string) (netip.Addr, bool) {
+	var hops []string
+	for _, h := range xff {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			if ap, perr := netip.ParseAddrPort(hops[i]); perr == nil {
+				addr = ap.Addr()
+			} else {
+				break
+			}
+		}
+		client = addr
+		if !isTrusted(trusted, addr) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// trustProxies rewrites RemoteAddr to the real client address and records
+// X-Forwarded-Proto, but only for requests whose peer is in TRUSTED_PROXIES.
+// Headers from anyone else are ignored so they cannot spoof their address.
+func trustProxies(trusted []netip.Prefix, next http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !isTrusted(trusted, peer.Addr()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		if client, ok := forwardedClient(trusted, r.Header.Values("X-Forwarded-For")); ok {
+			r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		}
+		if proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])); proto == "http" || proto == "https" {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedProtoKey{}, proto))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestScheme returns the scheme the client used to reach the driver.
+func requestScheme(r *http.Request) string {
+	if proto, ok := r.Context().Value(forwardedProtoKey{}).(string); ok {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// absoluteURL builds a client-facing URL for path on this driver.
+func absoluteURL(r *http.Request, path string) string {
+	return requestScheme(r) + "://" + r.Host + path
+}
+
+// ========== Access Logging ==========
+
+// accessLogEntry is one line of the access log.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// accessLog writes one line per request once the handler returns, so
+// streaming endpoints are logged when the client disconnects, with the total
+// bytes sent. LOG_FORMAT=json switches to structured lines, and paths listed
+// in ACCESS_LOG_EXCLUDE_PATHS (e.g. /healthz) are not logged. With
+// ACCESS_LOG_FILE set, lines go to that file instead, rotated by size.
+func accessLog(next http.Handler) http.Handler {
+	jsonFormat := getEnv(EnvLogFormat, "text") == "json"
+	exclude := map[string]bool{}
+	for _, p := range strings.Split(os.Getenv(EnvAccessLogExclude), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			exclude[p] = true
+		}
+	}
+	out := log.New(os.Stdout, "", 0)
+	textOut := log.Default()
+	if path := os.Getenv(EnvAccessLogFile); path != "" {
+		maxSize := int64(getEnvInt(EnvLogMaxSizeMB, 100)) << 20
+		rw, err := newRollingWriter(path, maxSize, getEnvInt(EnvLogMaxBackups, 5))
+		if err != nil {
+			log.Printf("access log file disabled: %v", err)
+		} else {
+			out = log.New(rw, "", 0)
+			textOut = log.New(rw, "", log.LstdFlags)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exclude[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		entry := accessLogEntry{
+			Time:       start.UTC(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			RemoteAddr: r.RemoteAddr,
+		}
+		if jsonFormat {
+			line, _ := json.Marshal(entry)
+			out.Println(string(line))
+			return
+		}
+		textOut.Printf("%s %s %d %dB %.1fms %s", entry.Method, entry.Path, entry.Status, entry.Bytes, entry.DurationMS, entry.RemoteAddr)
+	})
+}
+
+// rollingWriter is a log file that is rotated once it would grow past
+// maxSize: app.log becomes app.1.log, app.1.log becomes app.2.log, and so on,
+// keeping at most maxBackups old files.
+type rollingWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRollingWriter(path string, maxSize int64, maxBackups int) (*rollingWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	w := &rollingWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rollingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+// backupName returns the name of the n-th rotated file.
+func (w *rollingWriter) backupName(n int) string {
+	ext := filepath.Ext(w.path)
+	if ext == "" {
+		return fmt.Sprintf("%s.%d", w.path, n)
+	}
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(w.path, ext), n, ext)
+}
+
+func (w *rollingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			log.Printf("access log rotation failed: %v", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rollingWriter) rotate() error {
+	w.file.Close()
+	if w.maxBackups > 0 {
+		os.Remove(w.backupName(w.maxBackups))
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			os.Rename(w.backupName(i), w.backupName(i+1))
+		}
+		if err := os.Rename(w.path, w.backupName(1)); err != nil {
+			w.open()
+			return err
+		}
+	} else if err := os.Truncate(w.path, 0); err != nil {
+		w.open()
+		return err
+	}
+	return w.open()
+}
+
+// ========== Video Stream Proxy ==========
+
+// maxVideoClients caps concurrent /video streams; 0 means unlimited.
+var maxVideoClients = int64(getEnvInt(EnvMaxVideoClients, 10))
+
+func streamVideo(w http.ResponseWriter, r *http.Request) {
+	videoAPI := deviceAPI(EnvVideoAPIUrl, "")
+	apiKey := os.Getenv(EnvVideoAPIKey)
+	// The deferred decrement also runs if the handler panics.
+	active := metrics.videoClients.Add(1)
+	defer metrics.videoClients.Add(-1)
+	if maxVideoClients > 0 && active > maxVideoClients {
+		w.Header().Set("Retry-After", "10")
+		writeJSONError(w, http.StatusServiceUnavailable, "too many video clients")
+		return
+	}
+
+	// For demonstration, we expect the video API to respond with an MJPEG stream
+	client := &http.Client{
+		Timeout: 0, // no timeout for streaming
+	}
+	req, err := http.NewRequest("GET", videoAPI, nil)
+	if err != nil {
+		http.Error(w, "Error preparing video stream request", http.StatusInternalServerError)
+		return
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Unable to reach video source", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Video source returned: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "multipart/") && !strings.HasPrefix(ct, "video/") {
+		http.Error(w, "Upstream video is not a compatible stream", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, resp.Body)
+}
+
+// ========== Binary Encodings ==========
+
+// Constrained clients can ask /telemetry and /status for CBOR (RFC 8949) or
+// MessagePack instead of JSON. The device's JSON document is decoded once and
+// re-encoded; anything that isn't valid JSON is passed through untouched.
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeCBOR    = "application/cbor"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// negotiateFormat returns the first of the supported content types listed in
+// the Accept header, defaulting to JSON.
+func negotiateFormat(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		media, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.ToLower(strings.TrimSpace(media)) {
+		case contentTypeCBOR:
+			return contentTypeCBOR
+		case contentTypeMsgpack, "application/x-msgpack":
+			return contentTypeMsgpack
+		case contentTypeJSON:
+			return contentTypeJSON
+		}
+	}
+	return contentTypeJSON
+}
+
+// writeNegotiated writes a device JSON body in the format the client asked
+// for. The Content-Type always reflects what is actually sent.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	w.Header().Add("Vary", "Accept")
+	if format := negotiateFormat(r); format != contentTypeJSON {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err == nil {
+			var out []byte
+			if format == contentTypeCBOR {
+				out = appendCBOR(nil, v)
+			} else {
+				out = appendMsgpack(nil, v)
+			}
+			w.Header().Set("Content-Type", format)
+			w.WriteHeader(status)
+			w.Write(out)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// sortedKeys returns m's keys in order so binary encodings are deterministic.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonNumber splits a decoded JSON number into an integer or a float.
+func jsonNumber(n json.Number) (int64, float64, bool) {
+	if i, err := n.Int64(); err == nil {
+		return i, 0, true
+	}
+	f, _ := n.Float64()
+	return 0, f, false
+}
+
+// cborHead appends a CBOR initial byte and argument for the major type.
+func cborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+}
+
+// appendCBOR encodes a value produced by JSON decoding (with UseNumber).
+func appendCBOR(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xf6)
+	case bool:
+		if x {
+			return append(b, 0xf5)
+		}
+		return append(b, 0xf4)
+	case json.Number:
+		i, f, isInt := jsonNumber(x)
+		if !isInt {
+			return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(f))
+		}
+		if i < 0 {
+			return cborHead(b, 1, uint64(-(i + 1)))
+		}
+		return cborHead(b, 0, uint64(i))
+	case string:
+		return append(cborHead(b, 3, uint64(len(x))), x...)
+	case []interface{}:
+		b = cborHead(b, 4, uint64(len(x)))
+		for _, e := range x {
+			b = appendCBOR(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		b = cborHead(b, 5, uint64(len(x)))
+		for _, k := range sortedKeys(x) {
+			b = appendCBOR(b, k)
+			b = appendCBOR(b, x[k])
+		}
+		return b
+	}
+	return appendCBOR(b, fmt.Sprint(v))
+}
+
+// msgpackLen appends a str, array or map header using the smallest form.
+func msgpackLen(b []byte, fix, fixMax, code16 byte, n int) []byte {
+	switch {
+	case n <= int(fixMax):
+		return append(b, fix|byte(n))
+	case fix == 0xa0 && n <= 0xff:
+		return append(b, 0xd9, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, code16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, code16+1), uint32(n))
+}
+
+// appendMsgpack encodes a value produced by JSON decoding (with UseNumber).
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if x {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		i, f, isInt := jsonNumber(x)
+		switch {
+		case !isInt:
+			return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+		case i >= 0 && i < 128:
+			return append(b, byte(i))
+		case i < 0 && i >= -32:
+			return append(b, byte(int8(i)))
+		case i >= 0:
+			return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(i))
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+	case string:
+		return append(msgpackLen(b, 0xa0, 31, 0xda, len(x)), x...)
+	case []interface{}:
+		b = msgpackLen(b, 0x90, 15, 0xdc, len(x))
+		for _, e := range x {
+			b = appendMsgpack(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		b = msgpackLen(b, 0x80, 15, 0xde, len(x))
+		for _, k := range sortedKeys(x) {
+			b = appendMsgpack(b, k)
+			b = appendMsgpack(b, x[k])
+		}
+		return b
+	}
+	return appendMsgpack(b, fmt.Sprint(v))
+}
+
+// ========== Telemetry Proxy ==========
+
+func fetchTelemetry(w http.ResponseWriter, r *http.Request) {
+	if getEnv(EnvTelemetryMode, "poll") == "push" {
+		servePushedTelemetry(w, r, resolveDevice(r.PathValue("device_id")))
+		return
+	}
+	telemetryAPI := deviceAPI(EnvTelemetryAPI, r.PathValue("device_id"))
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", telemetryAPI, nil)
+	if err != nil {
+		http.Error(w, "Failed to prepare telemetry request", http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Failed to fetch telemetry data", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Failed to read telemetry data", http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode < 300 {
+		metrics.lastTelemetry.Store(time.Now().UnixNano())
+	}
+	writeNegotiated(w, r, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+}
+
+// ========== Status Proxy ==========
+
+func fetchStatus(w http.ResponseWriter, r *http.Request) {
+	deviceID := resolveDevice(r.PathValue("device_id"))
+	statusAPI := deviceAPI(EnvStatusAPI, deviceID)
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", statusAPI, nil)
+	if err != nil {
+		http.Error(w, "Failed to prepare status request", http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, "Failed to fetch status data", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Failed to read status data", http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode < 300 {
+		trackStatus(deviceID, body)
+	}
+	writeNegotiated(w, r, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+}
+
+var (
+	lastStatusMu sync.Mutex
+	lastStatus   = map[string]string{} // device ID -> last reported status
+)
+
+// trackStatus dispatches a status.changed event when a device's reported
+// status differs from the last one seen for that device.
+func trackStatus(deviceID string, body []byte) {
+	var st StatusResponse
+	if err := json.Unmarshal(body, &st); err != nil || st.Status == "" {
+		return
+	}
+	lastStatusMu.Lock()
+	previous := lastStatus[deviceID]
+	lastStatus[deviceID] = st.Status
+	if previous != st.Status {
+		// Queued under the lock so concurrent updates reach the webhook in order
+		notifyStatusWebhook(deviceID, previous, st.Status, body)
+	}
+	lastStatusMu.Unlock()
+	if previous != st.Status {
+		payload := map[string]interface{}{
+			"previous": previous,
+			"current":  st.Status,
+			"status":   st,
+		}
+		if deviceID != "" {
+			payload["device_id"] = deviceID
+		}
+		events.Dispatch(Event{Type: EventStatusChanged, Payload: payload})
+		summary := fmt.Sprintf("status changed from %q to %q", previous, st.Status)
+		if deviceID != "" {
+			summary = "device " + deviceID + " " + summary
+		}
+		lifecycle.record(LifecycleStatus, summary, payload)
+	}
+}
+
+// ========== Request Bodies ==========
+
+// Default body limits; a control command or OTA descriptor is a few hundred
+// bytes, so anything near these is a misbehaving client.
+const (
+	defaultControlMaxBody = 64 << 10
+	defaultOTAMaxBody     = 64 << 10
+)
+
+// decodeJSONBody decodes at most limit bytes of the request body into v. On
+// failure it writes the JSON error envelope (413 for oversized bodies, 400
+// otherwise) and returns false. With STRICT_JSON=true unknown fields are
+// rejected so typos such as "comand" are not silently ignored.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if getEnv(EnvStrictJSON, "false") == "true" {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+	case errors.Is(err, io.EOF):
+		writeJSONError(w, http.StatusBadRequest, "request body is empty")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		writeJSONError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+	}
+	return false
+}
+
+// ========== OTA Upgrade Proxy ==========
+
+// handleOTA serves GET /ota (firmware info) and POST /ota (upgrade).
+func handleOTA(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		getFirmwareInfo(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); rawFirmwareTypes[mediaType] {
+		uploadFirmware(w, r)
+		return
+	}
+	var otaReq OTARequest
+	if !decodeJSONBody(w, r, &otaReq, int64(getEnvInt(EnvOTAMaxBody, defaultOTAMaxBody))) {
+		return
+	}
+	if otaReq.DryRun || r.URL.Query().Get("dry_run") == "true" {
+		dryRunOTA(w, otaReq)
+		return
+	}
+	info := FirmwareInfo{Version: otaReq.Version, URL: otaReq.FirmwareURL}
+	if verify := firmwareVerifier(otaReq); verify != nil {
+		check, err := verify(otaReq)
+		if err != nil {
+			log.Printf("failed to verify firmware %s: %v", otaReq.FirmwareURL, err)
+			if isFirmwareStorageError(err) {
+				writeJSONError(w, http.StatusInternalServerError, "failed to store firmware for verification: "+err.Error())
+				return
+			}
+			writeJSONError(w, http.StatusBadGateway, "failed to download firmware for verification: "+err.Error())
+			return
+		}
+		if len(check.Problems) > 0 {
+			writeJSONError(w, http.StatusUnprocessableEntity, "firmware failed verification: "+strings.Join(check.Problems, "; "))
+			return
+		}
+		info.Digest = check.Digest
+	}
+	applyFirmware(w, otaReq, func() {
+		if err := firmware.install(info); err != nil {
+			log.Printf("failed to save OTA state: %v", err)
+		}
+	})
+}
+
+// firmwareVerifier returns how POST /ota fetches the image before forwarding
+// the upgrade: into OTA_CACHE_DIR when caching is on, or into a discarded temp
+// file when there is a checksum or signature to check. It returns nil when
+// there is nothing to check, and the device downloads the image itself.
+func firmwareVerifier(otaReq OTARequest) func(OTARequest) (firmwareCheck, error) {
+	switch {
+	case firmware.cacheDir != "":
+		return firmware.cache
+	case otaReq.Checksum != "", otaReq.Signature != "" && os.Getenv(EnvOTAPublicKeyFile) != "":
+		return verifyDiscarding
+	}
+	return nil
+}
+
+// rawFirmwareTypes are the POST /ota content types whose body is the firmware
+// image itself rather than a JSON OTARequest.
+var rawFirmwareTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/zip":          true,
+	"application/gzip":         true,
+	"application/x-gzip":       true,
+	"application/x-tar":        true,
+}
+
+// uploadFirmware handles POST /ota with the image as the body, as sent by
+// curl --data-binary. The image goes through the same size, checksum and
+// signature checks as a downloaded one and is kept in OTA_CACHE_DIR, from
+// where the device fetches it via GET /ota/firmware/{digest}. The optional
+// X-Firmware-Name, X-Firmware-Version, X-Firmware-SHA256 and
+// X-Firmware-Signature headers stand in for the JSON fields.
+func uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get("X-Firmware-Name")
+	if name != "" {
+		name = filepath.Base(name)
+	}
+	otaReq := OTARequest{
+		Version:   r.Header.Get("X-Firmware-Version"),
+		Checksum:  r.Header.Get("X-Firmware-SHA256"),
+		Signature: r.Header.Get("X-Firmware-Signature"),
+	}
+	if otaReq.Version == "" {
+		otaReq.Version = name
+	}
+	upload := func(dst io.Writer) (firmwareCheck, error) {
+		return checkFirmware(otaReq, r.Body, r.ContentLength, dst)
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		tmp, err := os.CreateTemp("", "ota-dry-run-*")
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to create temp file: "+err.Error())
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		check, err := upload(tmp)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "dry run failed to read firmware upload: "+err.Error())
+			return
+		}
+		writeDryRun(w, otaReq, check)
+		return
+	}
+	if firmware.cacheDir == "" || os.Getenv(EnvOTAFirmwareBaseURL) == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "firmware uploads are not configured: set "+EnvOTACacheDir+" and "+EnvOTAFirmwareBaseURL+" so the device can download the image from the driver")
+		return
+	}
+	check, err := firmware.keep(upload)
+	if err != nil {
+		log.Printf("failed to store uploaded firmware: %v", err)
+		if isFirmwareStorageError(err) {
+			writeJSONError(w, http.StatusInternalServerError, "failed to store firmware upload: "+err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "failed to read firmware upload: "+err.Error())
+		return
+	}
+	if check.SizeBytes > maxFirmwareBytes() {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "firmware failed verification: "+strings.Join(check.Problems, "; "))
+		return
+	}
+	if len(check.Problems) > 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "firmware failed verification: "+strings.Join(check.Problems, "; "))
+		return
+	}
+	if otaReq.Version == "" {
+		otaReq.Version = check.Digest
+	}
+	otaReq.FirmwareURL, _ = cachedFirmwareURL(check.Digest)
+	info := FirmwareInfo{Version: otaReq.Version, Name: name, URL: otaReq.FirmwareURL, Digest: check.Digest}
+	defer firmware.hold(check.Digest)()
+	applyFirmware(w, otaReq, func() {
+		if err := firmware.install(info); err != nil {
+			log.Printf("failed to save OTA state: %v", err)
+		}
+	})
+}
+
+// applyFirmware forwards an upgrade to the device, draining in-flight
+// requests first, and relays the device's answer. onAccepted runs when the
+// device accepts the upgrade.
+func applyFirmware(w http.ResponseWriter, otaReq OTARequest, onAccepted func()) {
+	otaAPI := deviceAPI(EnvOTAApi, "")
+	payload, _ := json.Marshal(otaReq)
+	client := &http.Client{Timeout: 15 * time.Second}
+	req, err := http.NewRequest("POST", otaAPI, bytes.NewReader(payload))
+	if err != nil {
+		http.Error(w, "Failed to prepare OTA request", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Let in-flight device requests finish before the device restarts
+	if !deviceGate.drain(getEnvSeconds(EnvOTADrainTimeout, 30)) {
+		http.Error(w, "OTA upgrade already in progress", http.StatusConflict)
+		return
+	}
+	details := map[string]interface{}{"firmware_url": otaReq.FirmwareURL, "version": otaReq.Version}
+	resp, err := client.Do(req)
+	if err != nil {
+		deviceGate.resume()
+		metrics.observeOTA("failed")
+		lifecycle.record(LifecycleOTA, "OTA upgrade to "+otaReq.Version+" failed: "+err.Error(), details)
+		http.Error(w, "OTA upgrade failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		metrics.observeOTA("accepted")
+		lifecycle.record(LifecycleOTA, "OTA upgrade to "+otaReq.Version+" accepted by device", details)
+		onAccepted()
+		go func() {
+			online := waitForDevice(deviceAPI(EnvStatusAPI, ""), getEnvSeconds(EnvOTAOnlineTimeout, 300))
+			complete := map[string]interface{}{
+				"firmware_url": otaReq.FirmwareURL,
+				"version":      otaReq.Version,
+				"online":       online,
+			}
+			events.Dispatch(Event{Type: EventOTAComplete, Payload: complete})
+			summary := "OTA upgrade to " + otaReq.Version + " complete, device back online"
+			if !online {
+				summary = "OTA upgrade to " + otaReq.Version + " complete, device did not come back online"
+			}
+			lifecycle.record(LifecycleOTA, summary, complete)
+		}()
+	} else {
+		metrics.observeOTA("rejected")
+		deviceGate.resume()
+		lifecycle.record(LifecycleOTA, "OTA upgrade to "+otaReq.Version+" rejected by device: "+resp.Status, details)
+	}
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// ========== Firmware State ==========
+
+// FirmwareInfo describes a firmware image installed through /ota.
+type FirmwareInfo struct {
+	Version     string    `json:"version"`
+	Name        string    `json:"name,omitempty"` // X-Firmware-Name of an uploaded image
+	URL         string    `json:"firmware_url"`
+	Digest      string    `json:"digest,omitempty"` // sha256:<hex>, known when the image was cached or verified
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// FirmwareState is the body of GET /ota and the content of OTA_STATE_FILE.
+type FirmwareState struct {
+	Current  *FirmwareInfo `json:"current"`
+	Previous *FirmwareInfo `json:"previous"`
+}
+
+const otaFirmwarePrefix = "/ota/firmware/"
+
+// cachedFirmwareURL is where the device downloads a kept image: under
+// OTA_FIRMWARE_BASE_URL, the driver's address as seen from the device. The
+// request's Host header is not used, since any client can set it.
+func cachedFirmwareURL(digest string) (string, bool) {
+	base := strings.TrimSuffix(os.Getenv(EnvOTAFirmwareBaseURL), "/")
+	if base == "" {
+		return "", false
+	}
+	return base + otaFirmwarePrefix + strings.TrimPrefix(digest, "sha256:"), true
+}
+
+// firmwareStore persists the current and previous firmware so a bad flash
+// can be rolled back. With a cache directory, images are also kept locally,
+// named by digest, so a rollback doesn't depend on the original URL still
+// being available. The cache holds at most OTA_CACHE_MAX_IMAGES images
+// besides the current and previous ones.
+type firmwareStore struct {
+	path     string
+	cacheDir string
+
+	mu    sync.Mutex
+	state FirmwareState
+	held  map[string]int // digests of images the device may be downloading
+}
+
+var firmware = &firmwareStore{}
+
+func loadFirmwareState(path, cacheDir string) (*firmwareStore, error) {
+	f := &firmwareStore{path: path, cacheDir: cacheDir}
+	if path == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (f *firmwareStore) get() FirmwareState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// install records info as the running firmware; the one it replaces becomes
+// the rollback target.
+func (f *firmwareStore) install(info FirmwareInfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info.InstalledAt = time.Now().UTC()
+	f.state = FirmwareState{Current: &info, Previous: f.state.Current}
+	return f.save()
+}
+
+// rolledBack swaps current and previous after a successful rollback.
+func (f *firmwareStore) rolledBack() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	restored := *f.state.Previous
+	restored.InstalledAt = time.Now().UTC()
+	f.state = FirmwareState{Current: &restored, Previous: f.state.Current}
+	return f.save()
+}
+
+func (f *firmwareStore) save() error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(f.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// hold marks an image as being installed, so it is served and kept in the
+// cache until the returned release is called.
+func (f *firmwareStore) hold(digest string) (release func()) {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.held == nil {
+		f.held = map[string]int{}
+	}
+	f.held[digest]++
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.held[digest]--; f.held[digest] <= 0 {
+			delete(f.held, digest)
+		}
+	}
+}
+
+// referenced reports whether the image with the given hex digest is the
+// current or previous firmware, or is being installed.
+func (f *firmwareStore) referenced(digest string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.referencedLocked(digest)
+}
+
+func (f *firmwareStore) referencedLocked(digest string) bool {
+	for _, info := range []*FirmwareInfo{f.state.Current, f.state.Previous} {
+		if info != nil && strings.TrimPrefix(info.Digest, "sha256:") == digest {
+			return true
+		}
+	}
+	return f.held[digest] > 0
+}
+
+// prune deletes the oldest cached images beyond OTA_CACHE_MAX_IMAGES.
+// Referenced images and keep (a hex digest) are never deleted and count
+// towards the limit.
+func (f *firmwareStore) prune(keep string) {
+	paths, err := filepath.Glob(filepath.Join(f.cacheDir, "*.bin"))
+	if err != nil {
+		return
+	}
+	type image struct {
+		path    string
+		modTime time.Time
+	}
+	var images []image
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			images = append(images, image{path, fi.ModTime()})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].modTime.After(images[j].modTime) })
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kept := 0
+	limit := getEnvInt(EnvOTACacheMaxImages, 5)
+	for _, img := range images {
+		digest := strings.TrimSuffix(filepath.Base(img.path), ".bin")
+		if digest == keep || f.referencedLocked(digest) {
+			kept++
+		}
+	}
+	for _, img := range images {
+		digest := strings.TrimSuffix(filepath.Base(img.path), ".bin")
+		if digest == keep || f.referencedLocked(digest) {
+			continue
+		}
+		if kept < limit {
+			kept++
+			continue
+		}
+		if err := os.Remove(img.path); err != nil {
+			log.Printf("failed to prune cached firmware %s: %v", img.path, err)
+		}
+	}
+}
+
+// cachedPath returns where an image with the given digest is kept.
+func (f *firmwareStore) cachedPath(digest string) string {
+	return filepath.Join(f.cacheDir, strings.TrimPrefix(digest, "sha256:")+".bin")
+}
+
+// cache downloads and verifies the image into the cache directory. Images
+// that fail verification are not kept.
+func (f *firmwareStore) cache(otaReq OTARequest) (firmwareCheck, error) {
+	return f.keep(func(dst io.Writer) (firmwareCheck, error) {
+		return verifyFirmware(otaReq, dst)
+	})
+}
+
+// keep streams an image through fetch into a temp file in the cache
+// directory and renames it after its digest if it passed verification.
+// Failures to write the cache directory are returned as
+// *firmwareStorageError, so callers can tell them from a bad download or
+// upload.
+func (f *firmwareStore) keep(fetch func(dst io.Writer) (firmwareCheck, error)) (firmwareCheck, error) {
+	if err := os.MkdirAll(f.cacheDir, 0o755); err != nil {
+		return firmwareCheck{}, &firmwareStorageError{err}
+	}
+	tmp, err := os.CreateTemp(f.cacheDir, "download-*")
+	if err != nil {
+		return firmwareCheck{}, &firmwareStorageError{err}
+	}
+	defer os.Remove(tmp.Name())
+	check, err := fetch(storageWriter{tmp})
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = &firmwareStorageError{cerr}
+	}
+	if err != nil || len(check.Problems) > 0 {
+		return check, err
+	}
+	if err := os.Rename(tmp.Name(), f.cachedPath(check.Digest)); err != nil {
+		return check, &firmwareStorageError{err}
+	}
+	f.prune(strings.TrimPrefix(check.Digest, "sha256:"))
+	return check, nil
+}
+
+// firmwareStorageError is a failure to write an image to OTA_CACHE_DIR.
+type firmwareStorageError struct{ err error }
+
+func (e *firmwareStorageError) Error() string { return e.err.Error() }
+func (e *firmwareStorageError) Unwrap() error { return e.err }
+
+func isFirmwareStorageError(err error) bool {
+	var storage *firmwareStorageError
+	return errors.As(err, &storage)
+}
+
+// storageWriter marks write errors of the cache temp file as storage errors.
+type storageWriter struct{ w io.Writer }
+
+func (s storageWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		err = &firmwareStorageError{err}
+	}
+	return n, err
+}
+
+// firmwareCheck is the outcome of downloading and verifying an image.
+type firmwareCheck struct {
+	Digest        string   `json:"digest"`
+	SizeBytes     int64    `json:"size_bytes"`
+	ChecksumMatch *bool    `json:"checksum_match,omitempty"` // nil when no checksum was given
+	Signature     string   `json:"signature"`                // verified, invalid, unsigned, no_key or not_checked
+	Problems      []string `json:"problems,omitempty"`
+}
+
+// verifyFirmware downloads otaReq.FirmwareURL into dst and checks its size
+// against OTA_MAX_FIRMWARE_MB, its sha256 against the request checksum and
+// its Ed25519ph signature against OTA_SIGNING_PUBLIC_KEY_FILE. Download
+// failures are returned as errors; failed checks are listed in Problems.
+func verifyFirmware(otaReq OTARequest, dst io.Writer) (firmwareCheck, error) {
+	if otaReq.FirmwareURL == "" {
+		return firmwareCheck{}, errors.New("firmware_url is required")
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(otaReq.FirmwareURL)
+	if err != nil {
+		return firmwareCheck{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return firmwareCheck{}, fmt.Errorf("firmware server returned %s", resp.Status)
+	}
+	return checkFirmware(otaReq, resp.Body, resp.ContentLength, dst)
+}
+
+// maxFirmwareBytes is the OTA_MAX_FIRMWARE_MB limit in bytes.
+func maxFirmwareBytes() int64 {
+	return int64(getEnvInt(EnvOTAMaxFirmwareMB, 1024)) << 20
+}
+
+// checkFirmware copies an image of the given length (-1 if unknown) from
+// body into dst and verifies it as described for verifyFirmware.
+func checkFirmware(otaReq OTARequest, body io.Reader, length int64, dst io.Writer) (firmwareCheck, error) {
+	var check firmwareCheck
+	maxSize := maxFirmwareBytes()
+	if length > maxSize {
+		check.SizeBytes = length
+		check.Signature = "not_checked"
+		check.Problems = append(check.Problems, fmt.Sprintf("image is %d bytes, over the %d byte limit", length, maxSize))
+		return check, nil
+	}
+	sum256, sum512 := sha256.New(), sha512.New()
+	n, err := io.Copy(io.MultiWriter(dst, sum256, sum512), io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return check, err
+	}
+	check.SizeBytes = n
+	check.Digest = "sha256:" + hex.EncodeToString(sum256.Sum(nil))
+	if n > maxSize {
+		check.Problems = append(check.Problems, fmt.Sprintf("image is over the %d byte limit", maxSize))
+	}
+	if otaReq.Checksum != "" {
+		match := strings.EqualFold(strings.TrimPrefix(otaReq.Checksum, "sha256:"), strings.TrimPrefix(check.Digest, "sha256:"))
+		check.ChecksumMatch = &match
+		if !match {
+			check.Problems = append(check.Problems, "checksum does not match the image")
+		}
+	}
+	check.Signature = verifySignature(otaReq.Signature, sum512.Sum(nil))
+	if check.Signature == "invalid" {
+		check.Problems = append(check.Problems, "signature does not verify against OTA_SIGNING_PUBLIC_KEY_FILE")
+	}
+	return check, nil
+}
+
+// verifySignature checks a base64 Ed25519ph signature over the image's
+// SHA-512 digest.
+func verifySignature(signature string, digest []byte) string {
+	keyFile := os.Getenv(EnvOTAPublicKeyFile)
+	switch {
+	case signature == "":
+		return "unsigned"
+	case keyFile == "":
+		return "no_key"
+	}
+	pub, err := loadEd25519PublicKey(keyFile)
+	if err != nil {
+		log.Printf("failed to load %s: %v", EnvOTAPublicKeyFile, err)
+		return "no_key"
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || ed25519.VerifyWithOptions(pub, digest, sig, &ed25519.Options{Hash: crypto.SHA512}) != nil {
+		return "invalid"
+	}
+	return "verified"
+}
+
+// loadEd25519PublicKey reads a PEM-encoded PKIX Ed25519 public key.
+func loadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is %T, not Ed25519", key)
+	}
+	return pub, nil
+}
+
+// dryRunOTA handles /ota?dry_run=true: the image is downloaded into the temp
+// directory, verified and deleted. The device is not contacted, no state or
+// events change, and it runs even while a real upgrade is draining the device.
+func dryRunOTA(w http.ResponseWriter, otaReq OTARequest) {
+	if otaReq.FirmwareURL == "" {
+		writeJSONError(w, http.StatusBadRequest, "firmware_url is required")
+		return
+	}
+	check, err := verifyDiscarding(otaReq)
+	if isFirmwareStorageError(err) {
+		writeJSONError(w, http.StatusInternalServerError, "dry run failed to write temp file: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "dry run failed to download firmware: "+err.Error())
+		return
+	}
+	writeDryRun(w, otaReq, check)
+}
+
+// writeDryRun reports the verification of a dry-run image.
+func writeDryRun(w http.ResponseWriter, otaReq OTARequest, check firmwareCheck) {
+	status, message := http.StatusOK, "dry run: firmware verified, nothing was applied"
+	if len(check.Problems) > 0 {
+		status, message = http.StatusUnprocessableEntity, "dry run: firmware failed verification, nothing was applied"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":      true,
+		"applied":      false,
+		"message":      message,
+		"version":      otaReq.Version,
+		"firmware_url": otaReq.FirmwareURL,
+		"verification": check,
+	})
+}
+
+// verifyDiscarding downloads and verifies the image into a temp file that is
+// deleted afterwards. Failures to write the temp file are returned as
+// *firmwareStorageError.
+func verifyDiscarding(otaReq OTARequest) (firmwareCheck, error) {
+	tmp, err := os.CreateTemp("", "ota-verify-*")
+	if err != nil {
+		return firmwareCheck{}, &firmwareStorageError{err}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	return verifyFirmware(otaReq, storageWriter{tmp})
+}
+
+// getFirmwareInfo handles GET /ota.
+func getFirmwareInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(firmware.get())
+}
+
+// handleOTARollback handles POST /ota/rollback by re-applying the previous
+// firmware, from the local cache when a copy was kept and
+// OTA_FIRMWARE_BASE_URL is set, otherwise from its original URL.
+func handleOTARollback(w http.ResponseWriter, r *http.Request) {
+	state := firmware.get()
+	if state.Previous == nil {
+		writeJSONError(w, http.StatusConflict, "no previous firmware recorded; rollback is available after a second successful OTA upgrade")
+		return
+	}
+	prev := *state.Previous
+	otaReq := OTARequest{FirmwareURL: prev.URL, Version: prev.Version}
+	source := "url"
+	if firmware.cacheDir != "" && prev.Digest != "" {
+		url, ok := cachedFirmwareURL(prev.Digest)
+		if _, err := os.Stat(firmware.cachedPath(prev.Digest)); ok && err == nil {
+			otaReq.FirmwareURL = url
+			source = "cache"
+		}
+	}
+	log.Printf("rolling back firmware to %s from %s", prev.Version, source)
+	applyFirmware(w, otaReq, func() {
+		if err := firmware.rolledBack(); err != nil {
+			log.Printf("failed to save OTA state: %v", err)
+		}
+		from := ""
+		if state.Current != nil {
+			from = state.Current.Version
+		}
+		rollback := map[string]interface{}{
+			"from_version": from,
+			"to_version":   prev.Version,
+			"source":       source,
+		}
+		events.Dispatch(Event{Type: EventOTARollback, Payload: rollback})
+		lifecycle.record(LifecycleOTA, "firmware rolled back from "+from+" to "+prev.Version, rollback)
+	})
+}
+
+// serveCachedFirmware handles GET /ota/firmware/{digest} so the device can
+// download a kept image during an upload or rollback. The route is public,
+// so only images in the OTA state or being installed are served.
+func serveCachedFirmware(w http.ResponseWriter, r *http.Request) {
+	digest := r.PathValue("digest")
+	if firmware.cacheDir == "" || len(digest) != sha256.Size*2 || strings.Trim(digest, "0123456789abcdef") != "" || !firmware.referenced(digest) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, firmware.cachedPath(digest))
+}
+
+// ========== Device Control Proxy ==========
+
+func handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ctrlReq ControlRequest
+	if !decodeJSONBody(w, r, &ctrlReq, int64(getEnvInt(EnvControlMaxBody, defaultControlMaxBody))) {
+		return
+	}
+	if err := openParams(&ctrlReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctrlReq.DeviceID = resolveDevice(r.PathValue("device_id"))
+	caller := controlCaller{Identity: requestIdentity(r), SourceIP: sourceIP(r)}
+	if !controlACL.permits(caller.Identity, ctrlReq.Command) {
+		log.Printf("control command %q denied for %s", ctrlReq.Command, caller.Identity)
+		writeCommandDenied(w, ctrlReq.Command)
+		return
+	}
+	if controlAsync(r) {
+		job, ok := submitControlJob(ctrlReq, caller)
+		if !ok {
+			writeUpgrading(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", absoluteURL(r, "/control/jobs/"+job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID, "status": job.Status})
+		return
+	}
+	res, err := executeControl(ctrlReq)
+	auditLog.record(ctrlReq, caller, "", res, err)
+	if err != nil {
+		http.Error(w, "Failed to send control command", http.StatusBadGateway)
+		return
+	}
+	if res.EventID != "" {
+		w.Header().Set("X-Shifu-Event-ID", res.EventID)
+	}
+	w.Header().Set("Content-Type", res.ContentType)
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+// controlCaller identifies who sent a control command, for the audit log.
+type controlCaller struct {
+	Identity string
+	SourceIP string
+}
+
+// sourceIP returns the client address of the request without the port.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// controlResult is the device's answer to a control command.
+type controlResult struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	EventID     string
+}
+
+// executeControl forwards a control command to the device and reads its reply.
+func executeControl(ctrlReq ControlRequest) (*controlResult, error) {
+	ctrlReq.DeviceID = resolveDevice(ctrlReq.DeviceID)
+	controlAPI := deviceAPI(EnvControlAPI, ctrlReq.DeviceID)
+	payload, _ := json.Marshal(ctrlReq)
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("POST", controlAPI, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		lifecycle.record(LifecycleControl, "control command "+ctrlReq.Command+" failed: "+err.Error(), map[string]interface{}{
+			"command":   ctrlReq.Command,
+			"device_id": ctrlReq.DeviceID,
+		})
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]interface{}{
+		"command":     ctrlReq.Command,
+		"params":      ctrlReq.loggedParams(),
+		"status_code": resp.StatusCode,
+	}
+	if ctrlReq.secret {
+		details["params_encrypted"] = true
+	}
+	if ctrlReq.DeviceID != "" {
+		details["device_id"] = ctrlReq.DeviceID
+	}
+	eventID := events.Dispatch(Event{Type: EventControlExecuted, Payload: details})
+	lifecycle.record(LifecycleControl, "control command "+ctrlReq.Command+" returned "+resp.Status, details)
+	return &controlResult{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+		EventID:     eventID,
+	}, nil
+}
+
+// ========== Control Payload Encryption ==========
+
+// controlParamsInfo is the HKDF info string for the params key. Changing the
+// scheme means a new version here and in CONTROL_PAYLOAD_ENCRYPTION.md.
+const controlParamsInfo = "shifu control params v1"
+
+// controlPayloadAEAD decrypts params_encrypted when CONTROL_ENCRYPT_PAYLOAD is
+// on; nil otherwise.
+var controlPayloadAEAD cipher.AEAD
+
+// newControlPayloadAEAD derives the AES-256-GCM key from CONTROL_PAYLOAD_KEY
+// with HKDF-SHA256 (no salt).
+func newControlPayloadAEAD(secret string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, controlParamsInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// openParams replaces params_encrypted with the decrypted params. The
+// ciphertext is base64(nonce || sealed) and the command name is the
+// additional data, so params can't be replayed under another command. With
+// encryption on, plaintext params are refused.
+func openParams(ctrlReq *ControlRequest) error {
+	if controlPayloadAEAD == nil {
+		if ctrlReq.Sealed != "" {
+			return fmt.Errorf("params_encrypted is not accepted unless %s=true", EnvControlEncryptPayload)
+		}
+		return nil
+	}
+	if len(ctrlReq.Params) > 0 {
+		return errors.New("params must be sent encrypted in params_encrypted")
+	}
+	if ctrlReq.Sealed == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(ctrlReq.Sealed)
+	if err != nil {
+		return errors.New("params_encrypted is not valid base64")
+	}
+	size := controlPayloadAEAD.NonceSize()
+	if len(data) < size+controlPayloadAEAD.Overhead() {
+		return errors.New("params_encrypted is too short")
+	}
+	plain, err := controlPayloadAEAD.Open(nil, data[:size], data[size:], []byte(ctrlReq.Command))
+	if err != nil {
+		return errors.New("params_encrypted could not be decrypted")
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal(plain, &params); err != nil {
+		return errors.New("decrypted params are not a JSON object")
+	}
+	ctrlReq.Params, ctrlReq.Sealed, ctrlReq.secret = params, "", true
+	return nil
+}
+
+// loggedParams returns the params to show in events, jobs and the audit log:
+// none when they arrived encrypted.
+func (c ControlRequest) loggedParams() map[string]interface{} {
+	if c.secret {
+		return nil
+	}
+	return c.Params
+}
+
+// ========== Batch Control ==========
+
+// BatchItemResult is the outcome of one command in a batch: done, failed, or
+// skipped after an earlier failure.
+type BatchItemResult struct {
+	Command    string      `json:"command"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// handleControlBatch handles POST /control/batch. The commands run one after
+// another and the results come back in the same order. With
+// CONTROL_BATCH_STOP_ON_ERROR=true the first failure skips the rest.
+func handleControlBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var batch []ControlRequest
+	if !decodeJSONBody(w, r, &batch, int64(getEnvInt(EnvControlMaxBody, defaultControlMaxBody))) {
+		return
+	}
+	if len(batch) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "batch is empty")
+		return
+	}
+	for i := range batch {
+		if err := openParams(&batch[i]); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("command %d: %v", i, err))
+			return
+		}
+	}
+	caller := controlCaller{Identity: requestIdentity(r), SourceIP: sourceIP(r)}
+	for _, ctrlReq := range batch {
+		if !controlACL.permits(caller.Identity, ctrlReq.Command) {
+			log.Printf("control command %q denied for %s", ctrlReq.Command, caller.Identity)
+			writeCommandDenied(w, ctrlReq.Command)
+			return
+		}
+	}
+	if controlAsync(r) {
+		job, ok := submitBatchJob(batch, caller)
+		if !ok {
+			writeUpgrading(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", absoluteURL(r, "/control/jobs/"+job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID, "status": job.Status})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runBatch(batch, caller, ""))
+}
+
+func runBatch(batch []ControlRequest, caller controlCaller, jobID string) []BatchItemResult {
+	stopOnError := getEnv(EnvControlBatchStopOnError, "false") == "true"
+	results := make([]BatchItemResult, len(batch))
+	failed := false
+	for i, ctrlReq := range batch {
+		results[i].Command = ctrlReq.Command
+		if failed && stopOnError {
+			results[i].Status = "skipped"
+			continue
+		}
+		res, err := executeControl(ctrlReq)
+		auditLog.record(ctrlReq, caller, jobID, res, err)
+		switch {
+		case err != nil:
+			results[i].Status = JobFailed
+			results[i].Error = err.Error()
+		case res.StatusCode >= 300:
+			results[i].Status = JobFailed
+			results[i].StatusCode = res.StatusCode
+			results[i].Result = decodeResult(res.Body)
+		default:
+			results[i].Status = JobDone
+			results[i].StatusCode = res.StatusCode
+			results[i].Result = decodeResult(res.Body)
+		}
+		if results[i].Status == JobFailed {
+			failed = true
+		}
+	}
+	return results
+}
+
+// submitBatchJob runs a whole batch in the background under a single job.
+// The job holds the device gate until it finishes, so an OTA drain waits for
+// it; ok is false when the gate is already closed for an upgrade.
+func submitBatchJob(batch []ControlRequest, caller controlCaller) (ControlJob, bool) {
+	if !deviceGate.enter() {
+		return ControlJob{}, false
+	}
+	now := time.Now().UTC()
+	pending := &ControlJob{
+		ID:        newUUID(),
+		Command:   "batch",
+		Status:    JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	snapshot := *pending
+	controlJobs.add(pending)
+	go func() {
+		defer deviceGate.leave()
+		controlJobs.update(snapshot.ID, func(j *ControlJob) { j.Status = JobRunning })
+		results := runBatch(batch, caller, snapshot.ID)
+		controlJobs.update(snapshot.ID, func(j *ControlJob) {
+			j.Status = JobDone
+			for _, res := range results {
+				if res.Status == JobFailed {
+					j.Status = JobFailed
+					j.Error = "one or more commands failed"
+					break
+				}
+			}
+			j.Result = results
+		})
+	}()
+	return snapshot, true
+}
+
+// ========== Control Jobs ==========
+
+// Control job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// ControlJob tracks a control command executed in the background.
+type ControlJob struct {
+	ID        string                 `json:"job_id"`
+	DeviceID  string                 `json:"device_id,omitempty"`
+	Command   string                 `json:"command"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Status    string                 `json:"status"`
+	Result    interface{}            `json:"result,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// jobStore keeps the most recent jobs in memory, evicting the oldest first.
+type jobStore struct {
+	mu    sync.Mutex
+	max   int
+	order []string // job IDs, oldest first
+	jobs  map[string]*ControlJob
+}
+
+var controlJobs = newJobStore(getEnvInt(EnvControlJobHistoryMax, 50))
+
+func newJobStore(max int) *jobStore {
+	if max < 1 {
+		max = 1
+	}
+	return &jobStore{max: max, jobs: map[string]*ControlJob{}}
+}
+
+func (s *jobStore) add(job *ControlJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	for len(s.order) > s.max {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// update applies fn to the job under the store lock.
+func (s *jobStore) update(id string, fn func(*ControlJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+		job.UpdatedAt = time.Now().UTC()
+	}
+}
+
+func (s *jobStore) get(id string) (ControlJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ControlJob{}, false
+	}
+	return *job, true
+}
+
+// sweep drops finished jobs last updated before cutoff and returns how many
+// were removed. Pending and running jobs are kept regardless of age.
+func (s *jobStore) sweep(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.order[:0]
+	removed := 0
+	for _, id := range s.order {
+		job := s.jobs[id]
+		if (job.Status == JobDone || job.Status == JobFailed) && job.UpdatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+			removed++
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+	return removed
+}
+
+// expireJobs sweeps the store every interval, removing jobs older than ttl.
+func (s *jobStore) expireJobs(ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := s.sweep(time.Now().Add(-ttl)); n > 0 {
+			log.Printf("expired %d control job(s) older than %v", n, ttl)
+		}
+	}
+}
+
+// list returns copies of the stored jobs, newest first.
+func (s *jobStore) list() []ControlJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]ControlJob, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[s.order[i]])
+	}
+	return jobs
+}
+
+// controlAsync reports whether a control request should run as a job. The
+// CONTROL_ASYNC default can be overridden per request with ?async=true|false.
+func controlAsync(r *http.Request) bool {
+	if v := r.URL.Query().Get("async"); v != "" {
+		return v == "true"
+	}
+	return getEnv(EnvControlAsync, "false") == "true"
+}
+
+// submitControlJob records a pending job and runs the command in the
+// background. Like submitBatchJob, the job holds the device gate until the
+// command finishes; ok is false when an upgrade has closed the gate.
+func submitControlJob(ctrlReq ControlRequest, caller controlCaller) (ControlJob, bool) {
+	if !deviceGate.enter() {
+		return ControlJob{}, false
+	}
+	now := time.Now().UTC()
+	pending := &ControlJob{
+		ID:        newUUID(),
+		DeviceID:  ctrlReq.DeviceID,
+		Command:   ctrlReq.Command,
+		Params:    ctrlReq.loggedParams(),
+		Status:    JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	snapshot := *pending
+	controlJobs.add(pending)
+	go runControlJob(snapshot.ID, ctrlReq, caller)
+	return snapshot, true
+}
+
+// runControlJob executes a submitted job and releases the device gate entry
+// taken by submitControlJob.
+func runControlJob(id string, ctrlReq ControlRequest, caller controlCaller) {
+	defer deviceGate.leave()
+	controlJobs.update(id, func(job *ControlJob) { job.Status = JobRunning })
+	res, err := executeControl(ctrlReq)
+	auditLog.record(ctrlReq, caller, id, res, err)
+	controlJobs.update(id, func(job *ControlJob) {
+		switch {
+		case err != nil:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		case res.StatusCode >= 300:
+			job.Status = JobFailed
+			job.Error = "device returned status " + strconv.Itoa(res.StatusCode)
+			job.Result = decodeResult(res.Body)
+		default:
+			job.Status = JobDone
+			job.Result = decodeResult(res.Body)
+		}
+	})
+}
+
+// decodeResult returns the device reply as JSON when it parses, else as text.
+func decodeResult(body []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		return v
+	}
+	return string(body)
+}
+
+func listControlJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controlJobs.list())
+}
+
+func getControlJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := controlJobs.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// ========== Control Schedules ==========
+
+// cronSpec is a parsed cron expression. It accepts the standard five fields
+// (minute hour day-of-month month day-of-week), an optional leading seconds
+// field, and the @yearly/@monthly/@weekly/@daily/@hourly and "@every <duration>"
+// shorthands.
+type cronSpec struct {
+	second, minute, hour, dom, month, dow uint64
+	domStar, dowStar                      bool
+	every                                 time.Duration
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid interval in %q", expr)
+		}
+		return &cronSpec{every: d}, nil
+	}
+	if d, ok := cronDescriptors[expr]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("expected 5 or 6 fields in %q", expr)
+	}
+	bounds := [6][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var masks [6]uint64
+	for i, f := range fields {
+		m, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", f, err)
+		}
+		masks[i] = m
+	}
+	// Sunday may be written as 0 or 7
+	if masks[5]&(1<<7) != 0 {
+		masks[5] |= 1
+	}
+	return &cronSpec{
+		second: masks[0], minute: masks[1], hour: masks[2],
+		dom: masks[3], month: masks[4], dow: masks[5],
+		domStar: fields[3] == "*" || fields[3] == "?",
+		dowStar: fields[5] == "*" || fields[5] == "?",
+	}, nil
+}
+
+// parseCronField turns a comma-separated list of *, n, a-b and */step forms
+// into a bitmask of the allowed values.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi, err2 = strconv.Atoi(b)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", rng, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron(8), a restricted day-of-month and day-of-week match either.
+	if !c.domStar && !c.dowStar {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
+
+// Next returns the first activation strictly after t, or the zero time if the
+// expression never fires within the next five years (e.g. "0 0 31 2 *").
+func (c *cronSpec) Next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every).Truncate(time.Second)
+	}
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		h, mi, s := t.Clock()
+		loc := t.Location()
+		switch {
+		case c.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(h)) == 0:
+			t = time.Date(y, mo, d, h+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(mi)) == 0:
+			t = time.Date(y, mo, d, h, mi+1, 0, 0, loc)
+		case c.second&(1<<uint(s)) == 0:
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Schedule is a recurring control command. It runs with the identity of the
+// caller that created it, so the control ACL applies as if they sent it. With
+// CONTROL_ENCRYPT_PAYLOAD=true only the sealed params are kept; they are opened
+// on each run.
+type Schedule struct {
+	ID         string                 `json:"id"`
+	Cron       string                 `json:"cron"`
+	Command    string                 `json:"command"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Sealed     string                 `json:"params_encrypted,omitempty"`
+	Identity   string                 `json:"identity"`
+	CreatedAt  time.Time              `json:"created_at"`
+	NextRun    time.Time              `json:"next_run,omitempty"`
+	LastRun    *time.Time             `json:"last_run,omitempty"`
+	LastResult string                 `json:"last_result,omitempty"`
+}
+
+type scheduleEntry struct {
+	Schedule
+	spec *cronSpec
+	stop chan struct{}
+}
+
+// scheduler runs schedules in memory and, when SCHEDULE_FILE is set, saves
+// them there after every change so they survive a restart.
+type scheduler struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*scheduleEntry
+}
+
+var schedules = &scheduler{entries: map[string]*scheduleEntry{}}
+
+// loadSchedules restores and starts the schedules saved in path. A missing
+// file is not an error.
+func loadSchedules(path string) (*scheduler, error) {
+	s := &scheduler{path: path, entries: map[string]*scheduleEntry{}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []Schedule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, sched := range saved {
+		spec, err := parseCron(sched.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %w", sched.ID, err)
+		}
+		s.start(sched, spec)
+	}
+	return s, nil
+}
+
+// start registers the schedule and launches its timer goroutine. The caller
+// must not hold s.mu.
+func (s *scheduler) start(sched Schedule, spec *cronSpec) {
+	e := &scheduleEntry{Schedule: sched, spec: spec, stop: make(chan struct{})}
+	s.mu.Lock()
+	e.NextRun = spec.Next(time.Now())
+	s.entries[sched.ID] = e
+	s.mu.Unlock()
+	go s.run(e)
+}
+
+func (s *scheduler) run(e *scheduleEntry) {
+	for {
+		s.mu.Lock()
+		next := e.NextRun
+		s.mu.Unlock()
+		if next.IsZero() {
+			log.Printf("schedule %s (%q) has no future activation", e.ID, e.Cron)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-e.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		result := runScheduledCommand(e.Schedule)
+		now := time.Now().UTC()
+		s.mu.Lock()
+		e.LastRun = &now
+		e.LastResult = result
+		e.NextRun = e.spec.Next(next)
+		s.mu.Unlock()
+	}
+}
+
+// runScheduledCommand executes a schedule's command the same way POST
+// /control does: ACL check, device call and audit entry.
+func runScheduledCommand(sched Schedule) string {
+	ctrlReq := ControlRequest{Command: sched.Command, Params: sched.Params, Sealed: sched.Sealed}
+	caller := controlCaller{Identity: sched.Identity, SourceIP: "schedule:" + sched.ID}
+	if err := openParams(&ctrlReq); err != nil {
+		log.Printf("scheduled command %q not run: %v", ctrlReq.Command, err)
+		return JobFailed
+	}
+	if !controlACL.permits(caller.Identity, ctrlReq.Command) {
+		log.Printf("scheduled command %q denied for %s", ctrlReq.Command, caller.Identity)
+		return "denied"
+	}
+	if !deviceGate.enter() {
+		log.Printf("scheduled command %q skipped: device is being upgraded", ctrlReq.Command)
+		return "skipped"
+	}
+	defer deviceGate.leave()
+	res, err := executeControl(ctrlReq)
+	auditLog.record(ctrlReq, caller, "", res, err)
+	switch {
+	case err != nil:
+		log.Printf("scheduled command %q failed: %v", ctrlReq.Command, err)
+		return JobFailed
+	case res.StatusCode >= 300:
+		return JobFailed
+	}
+	return JobDone
+}
+
+func (s *scheduler) add(sched Schedule, spec *cronSpec) error {
+	s.start(sched, spec)
+	return s.save()
+}
+
+// remove stops and deletes a schedule, reporting whether it existed.
+func (s *scheduler) remove(id string) (bool, error) {
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	if ok {
+		close(e.stop)
+		delete(s.entries, id)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// list returns copies of the active schedules, oldest first.
+func (s *scheduler) list() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Schedule, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e.Schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// save writes all schedules to the schedule file via a temp file and rename.
+func (s *scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// createSchedule handles POST /schedule.
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Cron    string                 `json:"cron"`
+		Command string                 `json:"command"`
+		Params  map[string]interface{} `json:"params"`
+		Sealed  string                 `json:"params_encrypted"`
+	}
+	if !decodeJSONBody(w, r, &body, int64(getEnvInt(EnvControlMaxBody, defaultControlMaxBody))) {
+		return
+	}
+	if body.Command == "" {
+		writeJSONError(w, http.StatusBadRequest, "command is required")
+		return
+	}
+	// Open the params once to reject a bad payload now rather than at the
+	// first run; the schedule itself keeps only what the caller sent.
+	check := ControlRequest{Command: body.Command, Params: body.Params, Sealed: body.Sealed}
+	if err := openParams(&check); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	spec, err := parseCron(body.Cron)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid cron expression: "+err.Error())
+		return
+	}
+	identity := requestIdentity(r)
+	if !controlACL.permits(identity, body.Command) {
+		log.Printf("control command %q denied for %s", body.Command, identity)
+		writeCommandDenied(w, body.Command)
+		return
+	}
+	sched := Schedule{
+		ID:        newUUID(),
+		Cron:      body.Cron,
+		Command:   body.Command,
+		Params:    body.Params,
+		Sealed:    body.Sealed,
+		Identity:  identity,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := schedules.add(sched, spec); err != nil {
+		log.Printf("failed to persist schedules: %v", err)
+	}
+	sched.NextRun = spec.Next(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", absoluteURL(r, "/schedule/"+sched.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sched)
+}
+
+// listSchedules handles GET /schedule.
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules.list())
+}
+
+// deleteSchedule handles DELETE /schedule/{id}.
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	ok, err := schedules.remove(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "schedule not found")
+		return
+	}
+	if err != nil {
+		log.Printf("failed to persist schedules: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== Control Audit Log ==========
+
+// AuditEntry is one executed control command, stored as a JSON line.
+type AuditEntry struct {
+	Timestamp  time.Time              `json:"timestamp"`
+	DeviceID   string                 `json:"device_id,omitempty"`
+	Command    string                 `json:"command"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Identity   string                 `json:"identity"`
+	SourceIP   string                 `json:"source_ip"`
+	JobID      string                 `json:"job_id,omitempty"`
+	Result     string                 `json:"result"`
+	StatusCode int                    `json:"status_code,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// auditLogger appends control commands to AUDIT_LOG_FILE. The file is opened
+// with O_SYNC so entries survive a crash. A logger without a file is a no-op.
+type auditLogger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var auditLog = &auditLogger{}
+
+// openAuditLog opens (creating if needed) the audit file in append mode.
+func openAuditLog(path string) (*auditLogger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{path: path, file: f}, nil
+}
+
+func (a *auditLogger) record(ctrlReq ControlRequest, caller controlCaller, jobID string, res *controlResult, err error) {
+	if a.file == nil {
+		return
+	}
+	entry := AuditEntry{
+		Timestamp: time.Now().UTC(),
+		DeviceID:  resolveDevice(ctrlReq.DeviceID),
+		Command:   ctrlReq.Command,
+		Params:    ctrlReq.loggedParams(),
+		Identity:  caller.Identity,
+		SourceIP:  caller.SourceIP,
+		JobID:     jobID,
+	}
+	switch {
+	case err != nil:
+		entry.Result = JobFailed
+		entry.Error = err.Error()
+	case res.StatusCode >= 300:
+		entry.Result = JobFailed
+		entry.StatusCode = res.StatusCode
+	default:
+		entry.Result = JobDone
+		entry.StatusCode = res.StatusCode
+	}
+	line, _ := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
+
+// tail returns the last n lines of the audit file.
+func (a *auditLogger) tail(n int) ([]json.RawMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]json.RawMessage, 0, n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+	}
+	return lines, scanner.Err()
+}
+
+// getControlAudit handles GET /control/audit, returning the last 100 audit
+// entries as a JSON array.
+func getControlAudit(w http.ResponseWriter, r *http.Request) {
+	if auditLog.file == nil {
+		writeJSONError(w, http.StatusNotFound, "audit log is not enabled")
+		return
+	}
+	lines, err := auditLog.tail(100)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+// ========== Device Push (SSE) ==========
+
+// sseEvent is one event read from a text/event-stream.
+type sseEvent struct {
+	ID   string
+	Name string
+	Data string
+}
+
+// DeviceSSESubscriber keeps a connection open to the device's event stream
+// (DEVICE_EVENTS_PATH) and routes what it receives: "telemetry" events update
+// the pushed-telemetry cache, "status" events feed status change tracking, and
+// anything else is forwarded to the event bus as device.<name>.
+type DeviceSSESubscriber struct {
+	URL        string
+	Client     *http.Client
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu            sync.Mutex
+	connected     bool
+	connectedAt   time.Time
+	lastEventAt   time.Time
+	lastEventID   string
+	lastError     string
+	reconnects    int
+	received      int64
+	lastTelemetry json.RawMessage
+}
+
+// PushStatus is the body of GET /device/push-status.
+type PushStatus struct {
+	Enabled        bool            `json:"enabled"`
+	URL            string          `json:"url,omitempty"`
+	Connected      bool            `json:"connected"`
+	ConnectedAt    *time.Time      `json:"connected_at,omitempty"`
+	LastEventAt    *time.Time      `json:"last_event_at,omitempty"`
+	LastEventID    string          `json:"last_event_id,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	Reconnects     int             `json:"reconnects"`
+	EventsReceived int64           `json:"events_received"`
+	LastTelemetry  json.RawMessage `json:"last_telemetry,omitempty"`
+}
+
+var devicePush *DeviceSSESubscriber
+
+// eventsURL resolves DEVICE_EVENTS_PATH against the telemetry API's origin
+// unless it is already an absolute URL.
+func eventsURL(path string) (string, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	if ref.IsAbs() {
+		return ref.String(), nil
+	}
+	base, err := url.Parse(deviceAPI(EnvTelemetryAPI, ""))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// Run connects to the device and reconnects with exponential backoff until
+// ctx is cancelled.
+func (s *DeviceSSESubscriber) Run(ctx context.Context) {
+	backoff := s.MinBackoff
+	for {
+		received, err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connected = false
+		s.reconnects++
+		if err != nil {
+			s.lastError = err.Error()
+		}
+		s.mu.Unlock()
+		if received {
+			backoff = s.MinBackoff
+		}
+		log.Printf("device push: stream ended (%v), reconnecting in %v", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+// stream reads one connection until it fails, reporting whether any event
+// arrived on it.
+func (s *DeviceSSESubscriber) stream(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	s.mu.Lock()
+	if s.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", s.lastEventID)
+	}
+	s.mu.Unlock()
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("device returned status %d", resp.StatusCode)
+	}
+	s.mu.Lock()
+	s.connected = true
+	s.connectedAt = time.Now().UTC()
+	s.lastError = ""
+	s.mu.Unlock()
+	log.Printf("device push: connected to %s", s.URL)
+
+	received := false
+	err = readSSE(resp.Body, func(ev sseEvent) {
+		received = true
+		s.route(ev)
+	})
+	if err == nil {
+		err = io.EOF
+	}
+	return received, err
+}
+
+// readSSE parses an event stream, calling fn for every complete event.
+func readSSE(r io.Reader, fn func(sseEvent)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var ev sseEvent
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				ev.Data = strings.Join(data, "\n")
+				if ev.Name == "" {
+					ev.Name = "message"
+				}
+				fn(ev)
+			}
+			ev, data = sseEvent{ID: ev.ID}, nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Name = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			ev.ID = value
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *DeviceSSESubscriber) route(ev sseEvent) {
+	s.mu.Lock()
+	s.received++
+	s.lastEventAt = time.Now().UTC()
+	if ev.ID != "" {
+		s.lastEventID = ev.ID
+	}
+	if ev.Name == "telemetry" && json.Valid([]byte(ev.Data)) {
+		s.lastTelemetry = json.RawMessage(ev.Data)
+	}
+	s.mu.Unlock()
+
+	switch ev.Name {
+	case "telemetry":
+		if json.Valid([]byte(ev.Data)) {
+			storePushedTelemetry(resolveDevice(""), json.RawMessage(ev.Data))
+		}
+	case "status":
+		trackStatus(resolveDevice(""), []byte(ev.Data))
+	default:
+		var payload interface{}
+		if err := json.Unmarshal([]byte(ev.Data), &payload); err != nil {
+			payload = ev.Data
+		}
+		events.Dispatch(Event{Type: "device." + ev.Name, Payload: payload})
+	}
+}
+
+func (s *DeviceSSESubscriber) status() PushStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := PushStatus{
+		Enabled:        true,
+		URL:            s.URL,
+		Connected:      s.connected,
+		LastEventID:    s.lastEventID,
+		LastError:      s.lastError,
+		Reconnects:     s.reconnects,
+		EventsReceived: s.received,
+		LastTelemetry:  s.lastTelemetry,
+	}
+	if !s.connectedAt.IsZero() {
+		t := s.connectedAt
+		st.ConnectedAt = &t
+	}
+	if !s.lastEventAt.IsZero() {
+		t := s.lastEventAt
+		st.LastEventAt = &t
+	}
+	return st
+}
+
+// getPushStatus handles GET /device/push-status.
+func getPushStatus(w http.ResponseWriter, r *http.Request) {
+	st := PushStatus{}
+	if devicePush != nil {
+		st = devicePush.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// ========== Device Event Pass-through ==========
+
+// GET /device/events/stream relays the device's native event stream
+// (DEVICE_EVENTS_SSE_PATH) to clients as is, without the routing done by
+// DeviceSSESubscriber. One upstream connection is shared by all clients and
+// the last DEVICE_EVENTS_BUFFER events are kept, so a client that reconnects
+// with Last-Event-ID gets what it missed. The upstream connection resumes
+// from the last event ID it saw after a drop.
+
+// eventRelay fans one device event stream out to many clients.
+type eventRelay struct {
+	URL    string
+	Client *http.Client
+	Size   int
+
+	mu      sync.Mutex
+	started bool
+	buf     []sseEvent
+	subs    map[chan sseEvent]struct{}
+	lastID  string
+}
+
+var deviceEvents *eventRelay
+
+// subscribe registers a client, starting the upstream connection on first
+// use, and returns the buffered events after lastID (none if lastID is
+// unknown or empty).
+func (rl *eventRelay) subscribe(lastID string) (chan sseEvent, []sseEvent) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.started {
+		rl.started = true
+		rl.subs = make(map[chan sseEvent]struct{})
+		go rl.run(context.Background())
+	}
+	ch := make(chan sseEvent, 64)
+	rl.subs[ch] = struct{}{}
+	var missed []sseEvent
+	if lastID != "" {
+		for i := len(rl.buf) - 1; i >= 0; i-- {
+			if rl.buf[i].ID == lastID {
+				missed = append(missed, rl.buf[i+1:]...)
+				break
+			}
+		}
+	}
+	return ch, missed
+}
+
+func (rl *eventRelay) unsubscribe(ch chan sseEvent) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.subs[ch]; ok {
+		delete(rl.subs, ch)
+		close(ch)
+	}
+}
+
+// publish buffers an event and hands it to every client. A client too slow
+// to keep up is disconnected so it reconnects and replays from the buffer.
+func (rl *eventRelay) publish(ev sseEvent) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.buf = append(rl.buf, ev)
+	if len(rl.buf) > rl.Size {
+		rl.buf = rl.buf[len(rl.buf)-rl.Size:]
+	}
+	if ev.ID != "" {
+		rl.lastID = ev.ID
+	}
+	for ch := range rl.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(rl.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// run keeps the upstream connection open, reconnecting with backoff.
+func (rl *eventRelay) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		received, err := rl.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = time.Second
+		}
+		log.Printf("device events: stream ended (%v), reconnecting in %v", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func (rl *eventRelay) stream(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rl.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	rl.mu.Lock()
+	if rl.lastID != "" {
+		req.Header.Set("Last-Event-ID", rl.lastID)
+	}
+	rl.mu.Unlock()
+	resp, err := rl.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("device returned status %d", resp.StatusCode)
+	}
+	received := false
+	err = readSSE(resp.Body, func(ev sseEvent) {
+		received = true
+		rl.publish(ev)
+	})
+	if err == nil {
+		err = io.EOF
+	}
+	return received, err
+}
+
+// writeSSE writes ev in text/event-stream format.
+func writeSSE(w io.Writer, ev sseEvent) error {
+	var b strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Name != "" && ev.Name != "message" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Name)
+	}
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// handleDeviceEventStream handles GET /device/events/stream.
+func handleDeviceEventStream(w http.ResponseWriter, r *http.Request) {
+	if deviceEvents == nil {
+		writeJSONError(w, http.StatusNotFound, EnvDeviceEventsSSEPath+" is not set")
+		return
+	}
+	rc := http.NewResponseController(w)
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	ch, missed := deviceEvents.subscribe(lastID)
+	defer deviceEvents.unsubscribe(ch)
+
+	if u, err := url.Parse(deviceEvents.URL); err == nil {
+		w.Header().Set("X-Device-Host", u.Host)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range missed {
+		writeSSE(w, ev)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if writeSSE(w, ev) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// ========== Device Metrics Push ==========
+
+// Devices that sleep between readings can't be polled, so they POST their
+// metrics to /device/metrics/push instead. Pushed readings are cached per
+// device; with TELEMETRY_MODE=push, /telemetry serves the cache and never
+// contacts the device.
+
+const pushMaxBody = 1 << 20
+
+// pushedEntry is the latest telemetry a device pushed.
+type pushedEntry struct {
+	Telemetry  json.RawMessage
+	ReceivedAt time.Time
+}
+
+var (
+	pushedMu        sync.Mutex
+	pushedTelemetry = map[string]pushedEntry{} // device ID -> latest push
+)
+
+// storePushedTelemetry caches a device's telemetry document.
+func storePushedTelemetry(deviceID string, data json.RawMessage) {
+	pushedMu.Lock()
+	pushedTelemetry[deviceID] = pushedEntry{Telemetry: data, ReceivedAt: time.Now().UTC()}
+	pushedMu.Unlock()
+	metrics.lastTelemetry.Store(time.Now().UnixNano())
+}
+
+// servePushedTelemetry writes the cached telemetry for deviceID, or 503 if
+// the device hasn't pushed anything yet.
+func servePushedTelemetry(w http.ResponseWriter, r *http.Request, deviceID string) {
+	pushedMu.Lock()
+	entry, ok := pushedTelemetry[deviceID]
+	pushedMu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, "no telemetry pushed by the device yet")
+		return
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.ReceivedAt).Seconds())))
+	writeNegotiated(w, r, http.StatusOK, contentTypeJSON, entry.Telemetry)
+}
+
+// handleMetricsPush handles POST /device/metrics/push. The body is either the
+// driver's telemetry document ({"timestamp": ..., "data": {...}}) or, with a
+// text/plain Content-Type, Prometheus text exposition whose samples become
+// the data map keyed by series.
+func handleMetricsPush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := resolveDevice(r.PathValue("device_id"))
+	var telemetry TelemetryResponse
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		samples, err := parsePrometheusText(http.MaxBytesReader(w, r.Body, pushMaxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid Prometheus text: "+err.Error())
+			return
+		}
+		telemetry.Data = make(map[string]interface{}, len(samples))
+		for k, v := range samples {
+			telemetry.Data[k] = v
+		}
+	} else if !decodeJSONBody(w, r, &telemetry, pushMaxBody) {
+		return
+	}
+	if telemetry.Data == nil {
+		writeJSONError(w, http.StatusBadRequest, "data is required")
+		return
+	}
+	if telemetry.Timestamp == 0 {
+		telemetry.Timestamp = time.Now().Unix()
+	}
+	data, _ := json.Marshal(telemetry)
+	storePushedTelemetry(deviceID, data)
+	payload := map[string]interface{}{"telemetry": telemetry}
+	if deviceID != "" {
+		payload["device_id"] = deviceID
+	}
+	events.Dispatch(Event{Type: EventTelemetryPushed, Payload: payload})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parsePrometheusText reads Prometheus text exposition format and returns
+// each sample's value keyed by its series, e.g. `temp_c{sensor="a"}`.
+// Comments, HELP/TYPE lines and sample timestamps are ignored.
+func parsePrometheusText(r io.Reader) (map[string]float64, error) {
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, rest := line, ""
+		if i := strings.LastIndex(line, "}"); i >= 0 && strings.Contains(line[:i], "{") {
+			series, rest = line[:i+1], line[i+1:]
+		} else if i := strings.IndexAny(line, " \t"); i >= 0 {
+			series, rest = line[:i], line[i:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing value", n)
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", n, fields[0])
+		}
+		samples[series] = v
+	}
+	return samples, scanner.Err()
+}
+
+// ========== Driver Info ==========
+
+var startTime = time.Now()
+
+// InfoResponse is the body of GET /info.
+type InfoResponse struct {
+	Version   string        `json:"version"`
+	Commit    string        `json:"commit"`
+	BuildDate string        `json:"build_date"`
+	GoVersion string        `json:"go_version"`
+	StartedAt time.Time     `json:"started_at"`
+	UptimeS   int64         `json:"uptime_s"`
+	Device    DeviceInfo    `json:"device"`
+	Video     VideoInfo     `json:"video"`
+	Profiling ProfilingInfo `json:"profiling"`
+}
+
+// VideoInfo reports /video stream usage.
+type VideoInfo struct {
+	Clients    int64 `json:"clients"`
+	MaxClients int64 `json:"max_clients"`
+}
+
+// DeviceInfo identifies the device(s) this driver instance serves.
+type DeviceInfo struct {
+	DeviceIP  string   `json:"device_ip,omitempty"`
+	DeviceIDs []string `json:"device_ids,omitempty"`
+}
+
+func getInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InfoResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		StartedAt: startTime.UTC(),
+		UptimeS:   int64(time.Since(startTime).Seconds()),
+		Device: DeviceInfo{
+			DeviceIP:  os.Getenv(EnvDeviceIP),
+			DeviceIDs: deviceIDs,
+		},
+		Video: VideoInfo{
+			Clients:    metrics.videoClients.Load(),
+			MaxClients: maxVideoClients,
+		},
+		Profiling: profiling,
+	})
+}
+
+// versionHeader stamps the driver version on every response.
+func versionHeader(next http.Handler) http.Handler {
+	server := "shifu-paios-driver/" + version
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", server)
+		w.Header().Set("X-Driver-Version", version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ========== Effective Configuration ==========
+
+// configSetting describes one environment variable for GET /config.
+type configSetting struct {
+	Group    string
+	Env      string
+	Default  string
+	Fallback string // environment variable used when Env is unset
+	Secret   bool
+}
+
+// configSettings lists every environment variable the driver reads, with the
+// default it falls back to. Keep it in step with the Env constants.
+var configSettings = []configSetting{
+	{Group: "http", Env: EnvServerHost, Default: "0.0.0.0"},
+	{Group: "http", Env: EnvServerPort, Default: "8080"},
+	{Group: "http", Env: EnvH2CEnabled, Default: "false"},
+	{Group: "http", Env: EnvTrustedProxies},
+	{Group: "http", Env: EnvStrictJSON, Default: "false"},
+	{Group: "http", Env: EnvControlMaxBody, Default: strconv.Itoa(defaultControlMaxBody)},
+	{Group: "http", Env: EnvOTAMaxBody, Default: strconv.Itoa(defaultOTAMaxBody)},
+	{Group: "http", Env: EnvMaxVideoClients, Default: "10"},
+	{Group: "http", Env: EnvEnablePprof, Default: "false"},
+	{Group: "http", Env: EnvPprofHost, Default: "127.0.0.1"},
+	{Group: "http", Env: EnvPprofPort},
+	{Group: "auth", Env: EnvAPIToken, Secret: true},
+	{Group: "auth", Env: EnvJWTSecret, Secret: true},
+	{Group: "auth", Env: EnvControlACLFile},
+	{Group: "device", Env: EnvDeviceIP},
+	{Group: "device", Env: EnvDeviceIDs},
+	{Group: "device", Env: EnvStatusAPI},
+	{Group: "device", Env: EnvTelemetryAPI},
+	{Group: "device", Env: EnvTelemetryMode, Default: "poll"},
+	{Group: "device", Env: EnvControlAPI},
+	{Group: "device", Env: EnvVideoAPIUrl},
+	{Group: "device", Env: EnvVideoAPIKey, Secret: true},
+	{Group: "device", Env: EnvDeviceEventsPath},
+	{Group: "device", Env: EnvDeviceEventsSSEPath},
+	{Group: "device", Env: EnvDeviceEventsBuffer, Default: "100"},
+	{Group: "broker", Env: EnvMqttHost},
+	{Group: "broker", Env: EnvMqttPort},
+	{Group: "broker", Env: EnvModbusPort},
+	{Group: "broker", Env: EnvS7Port},
+	{Group: "ota", Env: EnvOTAApi},
+	{Group: "ota", Env: EnvOTADrainTimeout, Default: "30"},
+	{Group: "ota", Env: EnvOTAOnlineTimeout, Default: "300"},
+	{Group: "ota", Env: EnvOTAStateFile, Default: "/var/lib/shifu/ota-state.json"},
+	{Group: "ota", Env: EnvOTACacheDir},
+	{Group: "ota", Env: EnvOTACacheMaxImages, Default: "5"},
+	{Group: "ota", Env: EnvOTAFirmwareBaseURL},
+	{Group: "ota", Env: EnvOTAMaxFirmwareMB, Default: "1024"},
+	{Group: "ota", Env: EnvOTAPublicKeyFile},
+	{Group: "control", Env: EnvControlAsync, Default: "false"},
+	{Group: "control", Env: EnvControlJobHistoryMax, Default: "50"},
+	{Group: "control", Env: EnvControlBatchStopOnError, Default: "false"},
+	{Group: "control", Env: EnvJobHistoryTTL, Default: "0"},
+	{Group: "control", Env: EnvJobHistorySweep, Default: "60"},
+	{Group: "control", Env: EnvScheduleFile},
+	{Group: "control", Env: EnvAuditLogFile, Default: "/var/log/shifu/audit.jsonl"},
+	{Group: "control", Env: EnvControlEncryptPayload, Default: "false"},
+	{Group: "control", Env: EnvControlPayloadKey, Secret: true},
+	// Webhook URLs often carry a token in the path or query
+	{Group: "webhooks", Env: EnvWebhookURL, Secret: true},
+	{Group: "webhooks", Env: EnvWebhookSecret, Secret: true},
+	{Group: "webhooks", Env: EnvStatusWebhookURL, Secret: true},
+	{Group: "webhooks", Env: EnvStatusWebhookSecret, Secret: true},
+	{Group: "webhooks", Env: EnvStatusWebhookRetries, Default: "3"},
+	{Group: "logging", Env: EnvLogFormat, Default: "text"},
+	{Group: "logging", Env: EnvAccessLogExclude},
+	{Group: "logging", Env: EnvAccessLogFile},
+	{Group: "logging", Env: EnvLogMaxSizeMB, Default: "100"},
+	{Group: "logging", Env: EnvLogMaxBackups, Default: "5"},
+	{Group: "logging", Env: EnvEventLogSize, Default: "500"},
+	{Group: "ssh", Env: EnvSSHProxyEnabled, Default: "false"},
+	{Group: "ssh", Env: EnvDeviceSSHHost, Fallback: EnvDeviceIP},
+	{Group: "ssh", Env: EnvDeviceSSHPort, Default: "22"},
+	{Group: "ssh", Env: EnvDeviceSSHUser},
+	{Group: "ssh", Env: EnvDeviceSSHKeyFile},
+	{Group: "ssh", Env: EnvDeviceSSHKnownHosts},
+	{Group: "ssh", Env: EnvSSHAllowedOrigins},
+}
+
+// redactedValue replaces secrets that are set in GET /config.
+const redactedValue = "***"
+
+// ConfigValue is one setting in GET /config. Source is "env" when the
+// variable is set, "default" otherwise; this driver reads no config file.
+type ConfigValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig resolves every setting in configSettings, by group.
+func effectiveConfig() map[string]map[string]ConfigValue {
+	out := map[string]map[string]ConfigValue{}
+	for _, s := range configSettings {
+		v := ConfigValue{Value: os.Getenv(s.Env), Source: "env"}
+		if v.Value == "" {
+			v.Source = "default"
+			v.Value = s.Default
+			if s.Fallback != "" {
+				v.Value = os.Getenv(s.Fallback)
+			}
+		}
+		if s.Secret && v.Value != "" {
+			v.Value = redactedValue
+		}
+		if out[s.Group] == nil {
+			out[s.Group] = map[string]ConfigValue{}
+		}
+		out[s.Group][s.Env] = v
+	}
+	return out
+}
+
+// getConfig handles GET /config. Like every route other than /healthz it
+// requires a bearer token when API_TOKEN or JWT_SECRET is set.
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectiveConfig())
+}
+
+// ========== SSH Proxy ==========
+
+// /device/ssh gives operators a shell on the device over a WebSocket. Each
+// session runs the system ssh client against DEVICE_SSH_HOST with a remote
+// tty; WebSocket messages are fed to its stdin and its output is sent back
+// as binary messages.
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFrameSize = 1 << 20
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// wsConn is the server side of an RFC 6455 WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	wmu  sync.Mutex
+}
+
+// checkWebSocketUpgrade returns the status and reason to refuse r with: it
+// is not a WebSocket handshake (400), or it was sent by a browser page whose
+// Origin is neither this host nor listed in SSH_ALLOWED_ORIGINS (403).
+// Clients that send no Origin, such as websocat, are not browsers and pass.
+func checkWebSocketUpgrade(r *http.Request) (int, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || r.Header.Get("Sec-WebSocket-Key") == "" {
+		return http.StatusBadRequest, errors.New("not a WebSocket upgrade request")
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return 0, nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return 0, nil
+	}
+	for _, allowed := range strings.Split(os.Getenv(EnvSSHAllowedOrigins), ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), origin) {
+			return 0, nil
+		}
+	}
+	return http.StatusForbidden, fmt.Errorf("origin %s is not allowed; add it to %s", origin, EnvSSHAllowedOrigins)
+}
+
+// upgradeWebSocket completes the WebSocket handshake of a request that
+// passed checkWebSocketUpgrade and takes over the connection. Unless the
+// error matches http.ErrNotSupported, the connection has already been
+// hijacked and w must not be written to.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// readFrame returns the next frame's opcode and unmasked payload.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("client frame is not masked")
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds %d", n, wsMaxFrameSize)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// writeFrame sends a single unmasked, final frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	head := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = binary.BigEndian.AppendUint16(append(head, 126), uint16(n))
+	default:
+		head = binary.BigEndian.AppendUint64(append(head, 127), uint64(n))
+	}
+	if _, err := c.rw.Write(head); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// Write sends p as a binary message so the connection can be ssh's stdout.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.conn.Close()
+}
+
+// sshCommand builds the ssh invocation for the configured device.
+func sshCommand(ctx context.Context) (*exec.Cmd, error) {
+	host := getEnv(EnvDeviceSSHHost, getEnv(EnvDeviceIP, ""))
+	user := os.Getenv(EnvDeviceSSHUser)
+	keyFile := os.Getenv(EnvDeviceSSHKeyFile)
+	if host == "" || user == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s, %s and %s must be set", EnvDeviceSSHHost, EnvDeviceSSHUser, EnvDeviceSSHKeyFile)
+	}
+	args := []string{
+		"-tt",
+		"-p", getEnv(EnvDeviceSSHPort, "22"),
+		"-i", keyFile,
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "ServerAliveInterval=30",
+	}
+	if knownHosts := os.Getenv(EnvDeviceSSHKnownHosts); knownHosts != "" {
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHosts)
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	args = append(args, "--", user+"@"+host)
+	return exec.CommandContext(ctx, "ssh", args...), nil
+}
+
+// handleSSHProxy handles GET /device/ssh (WebSocket). A session holds the
+// device gate until it ends, so an OTA upgrade waits for open shells the way
+// it waits for other device requests, and no session starts during a drain.
+func handleSSHProxy(w http.ResponseWriter, r *http.Request) {
+	identity, client := requestIdentity(r), sourceIP(r)
+	if status, err := checkWebSocketUpgrade(r); err != nil {
+		log.Printf("ssh session for %s from %s refused: %v", identity, client, err)
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	if !deviceGate.enter() {
+		writeUpgrading(w)
+		return
+	}
+	defer deviceGate.leave()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd, err := sshCommand(ctx)
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "ssh proxy is not configured: "+err.Error())
+		return
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("ssh session for %s from %s failed to upgrade: %v", identity, client, err)
+		if errors.Is(err, http.ErrNotSupported) {
+			writeJSONError(w, http.StatusInternalServerError, "connection cannot be upgraded to a WebSocket")
+		}
+		return
+	}
+	defer ws.Close()
+	cmd.Stdout = ws
+	cmd.Stderr = ws
+	if err := cmd.Start(); err != nil {
+		log.Printf("ssh session for %s from %s failed to start: %v", identity, client, err)
+		ws.writeFrame(wsOpText, []byte("failed to start ssh: "+err.Error()+"\r\n"))
+		return
+	}
+	started := time.Now()
+	log.Printf("ssh session started for %s from %s", identity, client)
+
+	go func() {
+		defer stdin.Close()
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				cancel()
+				return
+			}
+			switch opcode {
+			case wsOpText, wsOpBinary, wsOpContinuation:
+				if _, err := stdin.Write(payload); err != nil {
+					return
+				}
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			case wsOpClose:
+				cancel()
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	log.Printf("ssh session ended for %s from %s after %s (%v)", identity, client, time.Since(started).Round(time.Second), err)
+}
+
+// ========== Profiling ==========
+
+// ProfilingInfo reports in /info whether pprof is enabled and where. An empty
+// listener means the profiling routes share the main, authenticated port.
+type ProfilingInfo struct {
+	Enabled  bool   `json:"enabled"`
+	Listener string `json:"listener,omitempty"`
+}
+
+var profiling ProfilingInfo
+
+// registerPprof adds the net/http/pprof handlers under /debug/pprof/.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// ========== HTTP/2 ==========
+
+// enableH2C makes server accept HTTP/2 with prior knowledge on its plaintext
+// listener, alongside HTTP/1.1, for in-cluster clients that skip TLS.
+func enableH2C(server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+}
+
+// ========== Main and Routing ==========
+
+func main() {
+	// Required env vars
+	host := getEnv(EnvServerHost, "0.0.0.0")
+	port := getEnv(EnvServerPort, "8080")
+
+	// Non-protocol ports are not used here, but can be enforced if needed
+	// (MQTT, Modbus, S7, etc.) - not implemented as HTTP endpoints
+
+	// Routes live on a private mux: net/http/pprof registers itself on
+	// http.DefaultServeMux and must only be exposed when enabled.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", deviceGate.track(fetchStatus))
+	mux.HandleFunc("/telemetry", deviceGate.track(fetchTelemetry))
+	mux.HandleFunc("/video", deviceGate.track(streamVideo))
+	mux.HandleFunc("/ota", handleOTA)
+	mux.HandleFunc("POST /ota/rollback", handleOTARollback)
+	mux.HandleFunc("GET /ota/firmware/{digest}", serveCachedFirmware)
+	mux.HandleFunc("/control", deviceGate.track(handleControl))
+	mux.HandleFunc("/control/batch", deviceGate.track(handleControlBatch))
+	mux.HandleFunc("GET /control/jobs", listControlJobs)
+	mux.HandleFunc("GET /control/jobs/{id}", getControlJob)
+	mux.HandleFunc("GET /control/audit", getControlAudit)
+	mux.HandleFunc("POST /schedule", createSchedule)
+	mux.HandleFunc("GET /schedule", listSchedules)
+	mux.HandleFunc("DELETE /schedule/{id}", deleteSchedule)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("GET /info", getInfo)
+	mux.HandleFunc("GET /config", getConfig)
+	mux.HandleFunc("GET /events", getEvents)
+	if getEnv(EnvSSHProxyEnabled, "false") == "true" {
+		// Without authentication the proxy would hand a device shell to
+		// anyone who can reach the port
+		if os.Getenv(EnvAPIToken) == "" && os.Getenv(EnvJWTSecret) == "" {
+			log.Fatalf("%s=true requires %s or %s", EnvSSHProxyEnabled, EnvAPIToken, EnvJWTSecret)
+		}
+		mux.HandleFunc("GET /device/ssh", handleSSHProxy)
+		log.Printf("ssh proxy enabled at /device/ssh")
+	}
+	mux.HandleFunc("GET /device/push-status", getPushStatus)
+	mux.HandleFunc("GET /device/events/stream", handleDeviceEventStream)
+	mux.HandleFunc("/device/metrics/push", handleMetricsPush)
+	mux.HandleFunc("/devices/{device_id}/metrics/push", forDevice(handleMetricsPush))
+	mux.HandleFunc("/devices/{device_id}/status", forDevice(deviceGate.track(fetchStatus)))
+	mux.HandleFunc("/devices/{device_id}/telemetry", forDevice(deviceGate.track(fetchTelemetry)))
+	mux.HandleFunc("/devices/{device_id}/control", forDevice(deviceGate.track(handleControl)))
+
+	addr := host + ":" + port
+	log.Printf("Shifu PAIOS HTTP Driver %s (%s) starting at %s", version, commit, addr)
+	acl, err := loadControlACL(os.Getenv(EnvControlACLFile))
+	if err != nil {
+		log.Fatalf("failed to load control ACL: %v", err)
+	}
+	controlACL = acl
+
+	if getEnv(EnvControlEncryptPayload, "false") == "true" {
+		secret := os.Getenv(EnvControlPayloadKey)
+		if secret == "" {
+			log.Fatalf("%s=true requires %s", EnvControlEncryptPayload, EnvControlPayloadKey)
+		}
+		aead, err := newControlPayloadAEAD(secret)
+		if err != nil {
+			log.Fatalf("failed to set up control payload encryption: %v", err)
+		}
+		controlPayloadAEAD = aead
+		log.Printf("control params must be sent encrypted")
+	}
+
+	auditPath := getEnv(EnvAuditLogFile, "/var/log/shifu/audit.jsonl")
+	if audit, err := openAuditLog(auditPath); err != nil {
+		log.Printf("control audit log disabled: %v", err)
+	} else {
+		auditLog = audit
+	}
+
+	deviceIDs = parseDeviceIDs(os.Getenv(EnvDeviceIDs))
+	if len(deviceIDs) > 1 && !strings.Contains(os.Getenv(EnvTelemetryAPI)+os.Getenv(EnvStatusAPI)+os.Getenv(EnvControlAPI), "{device_id}") {
+		log.Printf("warning: %s lists %d devices but no device API URL contains {device_id}", EnvDeviceIDs, len(deviceIDs))
+	}
+
+	if ttl := getEnvInt(EnvJobHistoryTTL, 0); ttl > 0 {
+		interval := getEnvSeconds(EnvJobHistorySweep, 60)
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go controlJobs.expireJobs(time.Duration(ttl)*time.Hour, interval)
+	}
+
+	if path := os.Getenv(EnvDeviceEventsPath); path != "" {
+		target, err := eventsURL(path)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", EnvDeviceEventsPath, err)
+		}
+		devicePush = &DeviceSSESubscriber{
+			URL:        target,
+			Client:     &http.Client{},
+			MinBackoff: time.Second,
+			MaxBackoff: time.Minute,
+		}
+		go devicePush.Run(context.Background())
+	}
+	if path := os.Getenv(EnvDeviceEventsSSEPath); path != "" {
+		target, err := eventsURL(path)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", EnvDeviceEventsSSEPath, err)
+		}
+		deviceEvents = &eventRelay{
+			URL:    target,
+			Client: &http.Client{},
+			Size:   max(getEnvInt(EnvDeviceEventsBuffer, 100), 1),
+		}
+	}
+
+	sched, err := loadSchedules(os.Getenv(EnvScheduleFile))
+	if err != nil {
+		log.Fatalf("failed to load schedules: %v", err)
+	}
+	schedules = sched
+
+	fw, err := loadFirmwareState(getEnv(EnvOTAStateFile, "/var/lib/shifu/ota-state.json"), os.Getenv(EnvOTACacheDir))
+	if err != nil {
+		log.Fatalf("failed to load OTA state: %v", err)
+	}
+	firmware = fw
+
+	trusted, err := parseTrustedProxies(os.Getenv(EnvTrustedProxies))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", EnvTrustedProxies, err)
+	}
+	if getEnv(EnvEnablePprof, "false") == "true" {
+		pprofMux := mux
+		if pprofPort := os.Getenv(EnvPprofPort); pprofPort != "" {
+			pprofMux = http.NewServeMux()
+			profiling.Listener = net.JoinHostPort(getEnv(EnvPprofHost, "127.0.0.1"), pprofPort)
+			go func() {
+				if err := http.ListenAndServe(profiling.Listener, pprofMux); err != nil {
+					log.Printf("pprof listener failed: %v", err)
+				}
+			}()
+		}
+		registerPprof(pprofMux)
+		profiling.Enabled = true
+		log.Printf("pprof enabled at %s/debug/pprof/", profiling.Listener)
+	}
+
+	handler := requireToken(parseTokens(os.Getenv(EnvAPIToken)), []byte(os.Getenv(EnvJWTSecret)), mux)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: trustProxies(trusted, accessLog(instrument(mux, versionHeader(handler)))),
+	}
+	if getEnv(EnvH2CEnabled, "false") == "true" {
+		enableH2C(server)
+		log.Printf("h2c enabled on %s", addr)
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+}
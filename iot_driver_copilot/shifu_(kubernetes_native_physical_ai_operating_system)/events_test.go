@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useLifecycle replaces the event log with an empty one of the given size.
+func useLifecycle(t *testing.T, size int) {
+	t.Helper()
+	prev := lifecycle
+	lifecycle = newLifecycleRecorder(size)
+	t.Cleanup(func() { lifecycle = prev })
+}
+
+type eventsPage struct {
+	Events     []LifecycleEvent `json:"events"`
+	NextCursor string           `json:"next_cursor"`
+}
+
+func getEventsPage(t *testing.T, query string) (int, eventsPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getEvents(w, httptest.NewRequest("GET", "/events"+query, nil))
+	var page eventsPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	return w.Code, page
+}
+
+func seqs(events []LifecycleEvent) []uint64 {
+	out := []uint64{}
+	for _, e := range events {
+		out = append(out, e.Seq)
+	}
+	return out
+}
+
+func TestEventsPaginateNewestFirst(t *testing.T) {
+	useLifecycle(t, 100)
+	for i := 1; i <= 5; i++ {
+		typ := LifecycleControl
+		if i%2 == 0 {
+			typ = LifecycleOTA
+		}
+		lifecycle.record(typ, fmt.Sprintf("event %d", i), nil)
+	}
+
+	_, page := getEventsPage(t, "?limit=2")
+	if fmt.Sprint(seqs(page.Events)) != "[5 4]" || page.NextCursor != "4" {
+		t.Fatalf("first page %v cursor %q", seqs(page.Events), page.NextCursor)
+	}
+	_, page = getEventsPage(t, "?limit=2&cursor=4")
+	if fmt.Sprint(seqs(page.Events)) != "[3 2]" || page.NextCursor != "2" {
+		t.Fatalf("second page %v cursor %q", seqs(page.Events), page.NextCursor)
+	}
+	_, page = getEventsPage(t, "?limit=2&cursor=2")
+	if fmt.Sprint(seqs(page.Events)) != "[1]" || page.NextCursor != "" {
+		t.Fatalf("last page %v cursor %q", seqs(page.Events), page.NextCursor)
+	}
+
+	_, page = getEventsPage(t, "?type=ota")
+	if fmt.Sprint(seqs(page.Events)) != "[4 2]" {
+		t.Fatalf("type=ota: %v", seqs(page.Events))
+	}
+	_, page = getEventsPage(t, "?since=2999-01-01T00:00:00Z")
+	if len(page.Events) != 0 {
+		t.Fatalf("since in the future: %v", seqs(page.Events))
+	}
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	useLifecycle(t, 3)
+	for i := 0; i < 5; i++ {
+		lifecycle.record(LifecycleStatus, "status", nil)
+	}
+	_, page := getEventsPage(t, "")
+	if fmt.Sprint(seqs(page.Events)) != "[5 4 3]" {
+		t.Fatalf("events %v, want the newest 3", seqs(page.Events))
+	}
+}
+
+func TestEventsRejectBadQuery(t *testing.T) {
+	useLifecycle(t, 10)
+	for _, q := range []string{"?type=reboot", "?since=yesterday", "?limit=0", "?limit=501", "?cursor=0", "?cursor=x"} {
+		if code, _ := getEventsPage(t, q); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, code)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// protoServer serves the negotiated protocol of each request.
+func protoServer(t *testing.T, h2c bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	if h2c {
+		enableH2C(srv.Config)
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getProto(t *testing.T, url string, protocols *http.Protocols) (string, error) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	var h2 http.Protocols
+	h2.SetUnencryptedHTTP2(true)
+	var h1 http.Protocols
+	h1.SetHTTP1(true)
+
+	srv := protoServer(t, true)
+	if proto, err := getProto(t, srv.URL, &h2); err != nil || proto != "HTTP/2.0" {
+		t.Fatalf("h2c client: %q, %v; want HTTP/2.0", proto, err)
+	}
+	if proto, err := getProto(t, srv.URL, &h1); err != nil || proto != "HTTP/1.1" {
+		t.Fatalf("HTTP/1.1 client: %q, %v; want HTTP/1.1 alongside h2c", proto, err)
+	}
+
+	if _, err := getProto(t, protoServer(t, false).URL, &h2); err == nil {
+		t.Fatal("h2c accepted without H2C_ENABLED")
+	}
+}
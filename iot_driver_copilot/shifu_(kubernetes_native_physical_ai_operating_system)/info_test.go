@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestInfoReportsBuildAndDevice(t *testing.T) {
+	t.Setenv(EnvDeviceIP, "10.0.0.5")
+	prevIDs := deviceIDs
+	deviceIDs = []string{"cam-1", "cam-2"}
+	t.Cleanup(func() { deviceIDs = prevIDs })
+	metrics.videoClients.Add(2)
+	t.Cleanup(func() { metrics.videoClients.Add(-2) })
+
+	w := httptest.NewRecorder()
+	versionHeader(http.HandlerFunc(getInfo)).ServeHTTP(w, httptest.NewRequest("GET", "/info", nil))
+	var info InfoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.GoVersion != runtime.Version() || info.StartedAt.IsZero() || info.UptimeS < 0 {
+		t.Errorf("build info = %+v", info)
+	}
+	if info.Device.DeviceIP != "10.0.0.5" || len(info.Device.DeviceIDs) != 2 {
+		t.Errorf("device = %+v", info.Device)
+	}
+	if info.Video.Clients != 2 || info.Video.MaxClients != maxVideoClients {
+		t.Errorf("video = %+v", info.Video)
+	}
+	if got := w.Header().Get("X-Driver-Version"); got != version {
+		t.Errorf("X-Driver-Version = %q, want %q", got, version)
+	}
+	if got := w.Header().Get("Server"); got != "shifu-paios-driver/"+version {
+		t.Errorf("Server = %q", got)
+	}
+}
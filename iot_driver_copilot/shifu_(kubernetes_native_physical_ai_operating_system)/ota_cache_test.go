@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useFirmwareCache(t *testing.T, dir string) {
+	t.Helper()
+	prev := firmware
+	firmware = &firmwareStore{cacheDir: dir}
+	t.Cleanup(func() { firmware = prev })
+	t.Setenv(EnvOTAFirmwareBaseURL, "http://driver.svc:8080")
+}
+
+// useOTADevice points OTA_API at a device that records the upgrade request
+// and refuses it, so no post-upgrade watcher is started.
+func useOTADevice(t *testing.T) *[]OTARequest {
+	t.Helper()
+	var got []OTARequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OTARequest
+		json.NewDecoder(r.Body).Decode(&req)
+		got = append(got, req)
+		http.Error(w, "busy", http.StatusConflict)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv(EnvOTAApi, srv.URL)
+	return &got
+}
+
+// cacheImage downloads image into the firmware cache and returns its hex
+// digest.
+func cacheImage(t *testing.T, image string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, image)
+	}))
+	defer srv.Close()
+	check, err := firmware.cache(OTARequest{FirmwareURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(check.Digest, "sha256:")
+}
+
+func getCachedFirmware(digest string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", otaFirmwarePrefix+digest, nil)
+	r.SetPathValue("digest", digest)
+	w := httptest.NewRecorder()
+	serveCachedFirmware(w, r)
+	return w
+}
+
+func TestServeCachedFirmwareOnlyReferenced(t *testing.T) {
+	useFirmwareCache(t, t.TempDir())
+	current, other := cacheImage(t, "firmware v1"), cacheImage(t, "firmware v2")
+	firmware.state.Current = &FirmwareInfo{Version: "v1", Digest: "sha256:" + current}
+
+	if w := getCachedFirmware(current); w.Code != http.StatusOK || w.Body.String() != "firmware v1" {
+		t.Fatalf("current image: %d %q", w.Code, w.Body.String())
+	}
+	if w := getCachedFirmware(other); w.Code != http.StatusNotFound {
+		t.Fatalf("unreferenced image: status %d, want 404", w.Code)
+	}
+	release := firmware.hold("sha256:" + other)
+	if w := getCachedFirmware(other); w.Code != http.StatusOK {
+		t.Fatalf("image being installed: status %d, want 200", w.Code)
+	}
+	release()
+	if w := getCachedFirmware(other); w.Code != http.StatusNotFound {
+		t.Fatalf("released image: status %d, want 404", w.Code)
+	}
+}
+
+func TestFirmwareCacheLimit(t *testing.T) {
+	dir := t.TempDir()
+	useFirmwareCache(t, dir)
+	t.Setenv(EnvOTACacheMaxImages, "2")
+	current := cacheImage(t, "firmware v1")
+	firmware.state.Current = &FirmwareInfo{Version: "v1", Digest: "sha256:" + current}
+	var newest string
+	for _, image := range []string{"firmware v2", "firmware v3", "firmware v4"} {
+		newest = cacheImage(t, image)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("cache keeps %d images, want 2", len(entries))
+	}
+	for _, digest := range []string{current, newest} {
+		if _, err := os.Stat(filepath.Join(dir, digest+".bin")); err != nil {
+			t.Errorf("image %s pruned: %v", digest, err)
+		}
+	}
+}
+
+func TestRollbackFirmwareURL(t *testing.T) {
+	useFirmwareCache(t, t.TempDir())
+	digest := cacheImage(t, "firmware v1")
+	firmware.state = FirmwareState{
+		Current:  &FirmwareInfo{Version: "v2", URL: "https://images.example/v2.bin"},
+		Previous: &FirmwareInfo{Version: "v1", URL: "https://images.example/v1.bin", Digest: "sha256:" + digest},
+	}
+	sent := useOTADevice(t)
+	rollback := func() {
+		r := httptest.NewRequest("POST", "/ota/rollback", bytes.NewReader(nil))
+		r.Host = "attacker.example"
+		handleOTARollback(httptest.NewRecorder(), r)
+	}
+
+	rollback()
+	if got, want := (*sent)[0].FirmwareURL, "http://driver.svc:8080"+otaFirmwarePrefix+digest; got != want {
+		t.Fatalf("firmware_url %q, want %q from %s", got, want, EnvOTAFirmwareBaseURL)
+	}
+	t.Setenv(EnvOTAFirmwareBaseURL, "")
+	rollback()
+	if got := (*sent)[1].FirmwareURL; got != "https://images.example/v1.bin" {
+		t.Fatalf("firmware_url %q, want the original URL without %s", got, EnvOTAFirmwareBaseURL)
+	}
+}
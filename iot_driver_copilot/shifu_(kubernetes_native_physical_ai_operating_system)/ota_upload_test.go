@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func postFirmware(body []byte, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "http://driver.local/ota", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handleOTA(w, r)
+	return w
+}
+
+func TestUploadFirmwareRaw(t *testing.T) {
+	dir := t.TempDir()
+	useFirmwareCache(t, dir)
+	sent := useOTADevice(t)
+	image := []byte("firmware image v2")
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+
+	w := postFirmware(image, map[string]string{"X-Firmware-Name": "../fw-2.bin", "X-Firmware-SHA256": digest})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want the device's 409: %s", w.Code, w.Body.String())
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("device got %d upgrade requests, want 1", len(*sent))
+	}
+	req := (*sent)[0]
+	if !strings.HasSuffix(req.FirmwareURL, otaFirmwarePrefix+digest) || req.Version != "fw-2.bin" {
+		t.Fatalf("device got url=%q version=%q", req.FirmwareURL, req.Version)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, digest+".bin")); err != nil || !bytes.Equal(data, image) {
+		t.Fatalf("cached image: %q, %v", data, err)
+	}
+}
+
+func TestUploadFirmwareChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	useFirmwareCache(t, dir)
+	sent := useOTADevice(t)
+	w := postFirmware([]byte("firmware image v2"), map[string]string{"X-Firmware-SHA256": strings.Repeat("0", 64)})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", w.Code, w.Body.String())
+	}
+	if len(*sent) != 0 {
+		t.Fatal("a mismatched image was sent to the device")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("cache dir keeps %d file(s) of a rejected image", len(entries))
+	}
+}
+
+func TestUploadFirmwareTooLarge(t *testing.T) {
+	useFirmwareCache(t, t.TempDir())
+	sent := useOTADevice(t)
+	t.Setenv(EnvOTAMaxFirmwareMB, "1")
+	w := postFirmware(make([]byte, 1<<20+1), nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413: %s", w.Code, w.Body.String())
+	}
+	if len(*sent) != 0 {
+		t.Fatal("an oversized image was sent to the device")
+	}
+}
+
+func TestUploadFirmwareStorageError(t *testing.T) {
+	// A cache dir below a regular file can't be created
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useFirmwareCache(t, filepath.Join(blocker, "cache"))
+	useOTADevice(t)
+	w := postFirmware([]byte("firmware image v2"), nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// serveImage serves image as a firmware download and counts the downloads.
+func serveImage(t *testing.T, image string) (string, *atomic.Int32) {
+	t.Helper()
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Write([]byte(image))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/fw.bin", &downloads
+}
+
+func TestOTAVerifiesWithoutCache(t *testing.T) {
+	useFirmwareCache(t, "")
+	url, _ := serveImage(t, "firmware image v2")
+	sum := sha256.Sum256([]byte("firmware image v2"))
+
+	for _, c := range []struct {
+		checksum string
+		want     int
+		sent     int
+	}{
+		{strings.Repeat("0", 64), http.StatusUnprocessableEntity, 0},
+		{hex.EncodeToString(sum[:]), http.StatusConflict, 1}, // the device's answer
+	} {
+		sent := useOTADevice(t)
+		code, msg := postJSON(handleOTA, "/ota", `{"firmware_url":"`+url+`","version":"v2","checksum":"`+c.checksum+`"}`)
+		if code != c.want || len(*sent) != c.sent {
+			t.Errorf("checksum %s: %d %q, device got %d request(s); want %d and %d", c.checksum[:8], code, msg, len(*sent), c.want, c.sent)
+		}
+	}
+}
+
+func TestOTAForwardsWithoutVerification(t *testing.T) {
+	useFirmwareCache(t, "")
+	url, downloads := serveImage(t, "firmware image v2")
+
+	for _, body := range []string{
+		`{"firmware_url":"` + url + `","version":"v2"}`,
+		`{"version":"v2"}`, // the device decides what a missing URL means
+	} {
+		sent := useOTADevice(t)
+		if code, msg := postJSON(handleOTA, "/ota", body); code != http.StatusConflict || len(*sent) != 1 {
+			t.Errorf("%s: %d %q, device got %d request(s); want the device's 409", body, code, msg, len(*sent))
+		}
+	}
+	if n := downloads.Load(); n != 0 {
+		t.Fatalf("driver downloaded the image %d time(s) with nothing to verify", n)
+	}
+}
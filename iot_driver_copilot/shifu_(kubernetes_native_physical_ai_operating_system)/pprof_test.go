@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getPprof(h http.Handler, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPprofOnlyWhenRegistered(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info", getInfo)
+	if w := getPprof(mux, "/debug/pprof/", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("pprof served without ENABLE_PPROF: status %d", w.Code)
+	}
+
+	registerPprof(mux)
+	w := getPprof(mux, "/debug/pprof/", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatalf("index: status %d", w.Code)
+	}
+	if w := getPprof(mux, "/debug/pprof/cmdline", ""); w.Code != http.StatusOK {
+		t.Fatalf("cmdline: status %d", w.Code)
+	}
+}
+
+func TestPprofOnMainPortRequiresToken(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	h := requireToken(parseTokens("secret-token"), nil, mux)
+	if w := getPprof(h, "/debug/pprof/", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("without a token: status %d, want 401", w.Code)
+	}
+	if w := getPprof(h, "/debug/pprof/", "secret-token"); w.Code != http.StatusOK {
+		t.Fatalf("with a token: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// seenBehindProxy sends a request from peer with the given forwarding
+// headers through trustProxies and returns the RemoteAddr and scheme the
+// handler saw.
+func seenBehindProxy(t *testing.T, trusted, peer, xff, proto string) (string, string) {
+	t.Helper()
+	prefixes, err := parseTrustedProxies(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr, scheme string
+	h := trustProxies(prefixes, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, scheme = r.RemoteAddr, requestScheme(r)
+	}))
+	r := httptest.NewRequest("GET", "/status", nil)
+	r.RemoteAddr = peer
+	if xff != "" {
+		r.Header.Set("X-Forwarded-For", xff)
+	}
+	if proto != "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return addr, scheme
+}
+
+func TestTrustProxies(t *testing.T) {
+	for _, c := range []struct {
+		name, trusted, peer, xff, proto string
+		addr, scheme                    string
+	}{
+		{"trusted peer", "10.0.0.0/8", "10.0.0.2:5000", "203.0.113.7", "https", "203.0.113.7:0", "https"},
+		{"skips trusted hops", "10.0.0.0/8", "10.0.0.2:5000", "198.51.100.1, 203.0.113.7, 10.0.0.9", "", "203.0.113.7:0", "http"},
+		{"all hops trusted", "10.0.0.0/8", "10.0.0.2:5000", "10.0.0.5, 10.0.0.9", "", "10.0.0.5:0", "http"},
+		{"untrusted peer", "10.0.0.0/8", "192.0.2.1:5000", "203.0.113.7", "https", "192.0.2.1:5000", "http"},
+		{"no trusted proxies", "", "10.0.0.2:5000", "203.0.113.7", "https", "10.0.0.2:5000", "http"},
+		{"single address", "10.0.0.2", "10.0.0.2:5000", "203.0.113.7", "", "203.0.113.7:0", "http"},
+		{"bogus proto", "10.0.0.0/8", "10.0.0.2:5000", "", "gopher", "10.0.0.2:5000", "http"},
+	} {
+		addr, scheme := seenBehindProxy(t, c.trusted, c.peer, c.xff, c.proto)
+		if addr != c.addr || scheme != c.scheme {
+			t.Errorf("%s: saw %s %s, want %s %s", c.name, addr, scheme, c.addr, c.scheme)
+		}
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalid(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/2"} {
+		if _, err := parseTrustedProxies(v); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
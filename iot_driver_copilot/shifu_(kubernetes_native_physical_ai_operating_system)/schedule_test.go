@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSealedParams turns on CONTROL_ENCRYPT_PAYLOAD for the test and returns a
+// function that seals params for a command the way a client would.
+func useSealedParams(t *testing.T) func(command, params string) string {
+	t.Helper()
+	aead, err := newControlPayloadAEAD("schedule-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := controlPayloadAEAD
+	controlPayloadAEAD = aead
+	t.Cleanup(func() { controlPayloadAEAD = prev })
+	return func(command, params string) string {
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(params), []byte(command)))
+	}
+}
+
+func useScheduleFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	prev := schedules
+	schedules = &scheduler{path: path, entries: map[string]*scheduleEntry{}}
+	t.Cleanup(func() {
+		for _, s := range schedules.list() {
+			schedules.remove(s.ID)
+		}
+		schedules = prev
+	})
+	return path
+}
+
+func postSchedule(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	createSchedule(w, httptest.NewRequest("POST", "/schedule", strings.NewReader(body)))
+	return w
+}
+
+func TestCreateScheduleRejectsPlainParamsWhenEncrypted(t *testing.T) {
+	useSealedParams(t)
+	useScheduleFile(t)
+	w := postSchedule(`{"cron":"@every 1h","command":"move","params":{"pin":"1234"}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body.String())
+	}
+	if n := len(schedules.list()); n != 0 {
+		t.Fatalf("%d schedules stored, want 0", n)
+	}
+}
+
+func TestCreateScheduleKeepsOnlySealedParams(t *testing.T) {
+	seal := useSealedParams(t)
+	path := useScheduleFile(t)
+	sealed := seal("move", `{"pin":"1234"}`)
+	w := postSchedule(`{"cron":"@every 1h","command":"move","params_encrypted":"` + sealed + `"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	var got Schedule
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Params != nil || got.Sealed != sealed {
+		t.Fatalf("response params=%v sealed=%q, want only the sealed value", got.Params, got.Sealed)
+	}
+	list := httptest.NewRecorder()
+	listSchedules(list, httptest.NewRequest("GET", "/schedule", nil))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, out := range map[string]string{"GET /schedule": list.Body.String(), "schedule file": string(data)} {
+		if strings.Contains(out, "1234") {
+			t.Errorf("%s exposes the plaintext params: %s", name, out)
+		}
+	}
+}
+
+func TestCreateScheduleRejectsBadSeal(t *testing.T) {
+	seal := useSealedParams(t)
+	useScheduleFile(t)
+	// sealed for a different command, so authentication fails
+	w := postSchedule(`{"cron":"@every 1h","command":"move","params_encrypted":"` + seal("stop", `{}`) + `"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body.String())
+	}
+}
+
+// bits returns the cron field mask with the given values set.
+func bits(values ...int) uint64 {
+	var m uint64
+	for _, v := range values {
+		m |= 1 << uint(v)
+	}
+	return m
+}
+
+func TestParseCronField(t *testing.T) {
+	for _, c := range []struct {
+		field string
+		want  uint64
+	}{
+		{"5", bits(5)},
+		{"1-3", bits(1, 2, 3)},
+		{"1,3,5", bits(1, 3, 5)},
+		{"*/15", bits(0, 15, 30, 45)},
+		{"10-20/5", bits(10, 15, 20)},
+		{"5/20", bits(5, 25, 45)},
+		{"1-2,50-59/3", bits(1, 2, 50, 53, 56, 59)},
+	} {
+		got, err := parseCronField(c.field, 0, 59)
+		if err != nil || got != c.want {
+			t.Errorf("parseCronField(%q) = %b, %v; want %b", c.field, got, err, c.want)
+		}
+	}
+	if got, err := parseCronField("*", 0, 59); err != nil || got != 1<<60-1 {
+		t.Errorf("parseCronField(\"*\") = %b, %v; want 0-59", got, err)
+	}
+	for _, field := range []string{"", "60", "x", "1-", "5-1", "*/0", "*/x", "1,,2"} {
+		if _, err := parseCronField(field, 0, 59); err == nil {
+			t.Errorf("parseCronField(%q) accepted", field)
+		}
+	}
+}
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * * *", "* * 32 * *", "* * * 13 *", "* * * * 8", "@every 500ms", "@every soon", "@often"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 10, 15, 10, 7, 30, 0, time.UTC) // a Thursday
+	for _, c := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2026, 10, 16, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 15, 10, 15, 0, 0, time.UTC)},
+		{"30 * * * * *", time.Date(2026, 10, 15, 10, 8, 30, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 15, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2026, 10, 15, 10, 9, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)}, // Sunday as 7
+		{"0 0 1 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)}, // 1st of the month or Monday
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)}, // next leap day
+		{"0 0 31 2 *", time.Time{}},
+	} {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", c.expr, err)
+			continue
+		}
+		if got := spec.Next(from); !got.Equal(c.want) {
+			t.Errorf("%q: next run %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestScheduleFiresWithinTwoSeconds(t *testing.T) {
+	useScheduleFile(t)
+	fired := make(chan string, 4)
+	useControlDevice(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ControlRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		select {
+		case fired <- req.Command:
+		default:
+		}
+	})
+	if w := postSchedule(`{"cron":"* * * * * *","command":"ping"}`); w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201: %s", w.Code, w.Body.String())
+	}
+	select {
+	case cmd := <-fired:
+		if cmd != "ping" {
+			t.Fatalf("device got %q, want ping", cmd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a once-a-second schedule did not fire within 2s")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCheckWebSocketUpgrade(t *testing.T) {
+	t.Setenv(EnvSSHAllowedOrigins, "https://console.example.com")
+	for _, c := range []struct {
+		name    string
+		upgrade bool
+		origin  string
+		want    int
+	}{
+		{"plain GET", false, "", http.StatusBadRequest},
+		{"no origin", true, "", 0},
+		{"same origin", true, "https://driver.local:8080", 0},
+		{"allowed origin", true, "https://console.example.com", 0},
+		{"foreign origin", true, "https://evil.example.com", http.StatusForbidden},
+		{"null origin", true, "null", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "http://driver.local:8080/device/ssh", nil)
+		if c.upgrade {
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		}
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got, _ := checkWebSocketUpgrade(r); got != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSSHProxyRefusesForeignOriginBeforeUpgrade(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://driver.local/device/ssh", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	handleSSHProxy(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want 403: %s", w.Code, w.Body.String())
+	}
+}
+
+// useStubSSH puts an ssh on PATH that idles until it is killed, and
+// configures the device it would connect to.
+func useStubSSH(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ssh is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\nexec sleep 60\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv(EnvDeviceSSHHost, "device.local")
+	t.Setenv(EnvDeviceSSHUser, "root")
+	t.Setenv(EnvDeviceSSHKeyFile, filepath.Join(dir, "id_ed25519"))
+}
+
+// dialSSHProxy opens a WebSocket session on srv's /device/ssh.
+func dialSSHProxy(t *testing.T, srv *httptest.Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /device/ssh HTTP/1.1\r\nHost: driver.local\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d, want 101", resp.StatusCode)
+	}
+	return conn
+}
+
+func TestSSHSessionHoldsDeviceGate(t *testing.T) {
+	useStubSSH(t)
+	prevGate := deviceGate
+	deviceGate = &drainGate{}
+	t.Cleanup(func() { deviceGate = prevGate })
+	srv := httptest.NewServer(http.HandlerFunc(handleSSHProxy))
+	defer srv.Close()
+
+	conn := dialSSHProxy(t, srv)
+	drained := make(chan struct{})
+	go func() {
+		deviceGate.drain(5 * time.Second)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("OTA drain finished while an ssh session was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// No new session while the drain is in progress
+	r := httptest.NewRequest("GET", "http://driver.local/device/ssh", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w := httptest.NewRecorder()
+	handleSSHProxy(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade during drain: status %d, want 503", w.Code)
+	}
+
+	conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(3 * time.Second):
+		t.Fatal("OTA drain still waiting after the ssh session closed")
+	}
+}
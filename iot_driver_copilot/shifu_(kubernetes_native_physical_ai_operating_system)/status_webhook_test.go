@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useStatusWebhook points STATUS_WEBHOOK_URL at a receiver that fails its
+// first request and returns the new_status of each delivered transition.
+func useStatusWebhook(t *testing.T) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var got []string
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		var tr StatusTransition
+		json.NewDecoder(r.Body).Decode(&tr)
+		got = append(got, tr.NewStatus)
+	}))
+	t.Cleanup(srv.Close)
+
+	prevBus, prevQueue, prevLast := statusWebhook, statusTransitions, lastStatus
+	statusWebhook = &EventBus{URL: srv.URL, Client: srv.Client(), Retries: 3, Backoff: 10 * time.Millisecond}
+	statusTransitions = &statusQueue{bus: statusWebhook}
+	lastStatus = map[string]string{}
+	t.Cleanup(func() { statusWebhook, statusTransitions, lastStatus = prevBus, prevQueue, prevLast })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), got...)
+	}
+}
+
+func TestStatusWebhookOrder(t *testing.T) {
+	delivered := useStatusWebhook(t)
+	want := []string{"booting", "running", "error", "running"}
+	for _, status := range want {
+		trackStatus("arm-1", []byte(`{"status":"`+status+`"}`))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(delivered()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := delivered()
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v in order despite the retried first delivery", got, want)
+		}
+	}
+}
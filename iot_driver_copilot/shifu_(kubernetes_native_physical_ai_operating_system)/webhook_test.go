@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookAttempt is one POST seen by the receiver.
+type webhookAttempt struct {
+	eventID   string
+	signature string
+	body      string
+}
+
+// useWebhookReceiver starts a receiver that answers the first failures
+// attempts with 500 and the rest with 200, and returns a bus pointed at it.
+func useWebhookReceiver(t *testing.T, failures int) (*EventBus, func() []webhookAttempt) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []webhookAttempt
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, webhookAttempt{r.Header.Get("X-Shifu-Event-ID"), r.Header.Get("X-Shifu-Signature"), string(body)})
+		if len(got) <= failures {
+			http.Error(w, "try again", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	bus := &EventBus{URL: srv.URL, Secret: "webhook-secret", Client: srv.Client(), Retries: 3, Backoff: time.Millisecond}
+	return bus, func() []webhookAttempt {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookAttempt(nil), got...)
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// python3 -c 'import hmac,hashlib; print(hmac.new(b"webhook-secret", b"{\"type\":\"control.executed\"}", hashlib.sha256).hexdigest())'
+	want := "sha256=25b131f7c4edf1938c8217e77f8fcbbc9a9c22f242a303cc479ec3bd0d5bba40"
+	if got := signPayload("webhook-secret", []byte(`{"type":"control.executed"}`)); got != want {
+		t.Fatalf("signPayload = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, c := range []struct {
+		failures int
+		attempts int
+		ok       bool
+	}{
+		{0, 1, true},
+		{2, 3, true},
+		{3, 4, true},
+		{4, 4, false}, // Retries is 3, so the fourth failure is final
+	} {
+		bus, attempts := useWebhookReceiver(t, c.failures)
+		body := []byte(`{"type":"control.executed"}`)
+		err := bus.deliver(Event{ID: "evt-1", Type: EventControlExecuted}, body)
+		if (err == nil) != c.ok {
+			t.Errorf("%d failure(s): deliver error %v, want ok=%v", c.failures, err, c.ok)
+		}
+		got := attempts()
+		if len(got) != c.attempts {
+			t.Errorf("%d failure(s): %d attempt(s), want %d", c.failures, len(got), c.attempts)
+		}
+		for i, a := range got {
+			if a.signature != signPayload("webhook-secret", body) || a.body != string(body) {
+				t.Errorf("%d failure(s), attempt %d: signature %q over %q", c.failures, i+1, a.signature, a.body)
+			}
+		}
+	}
+}
+
+func TestWebhookRetriesReuseEventID(t *testing.T) {
+	bus, attempts := useWebhookReceiver(t, 2)
+	id := bus.Dispatch(Event{Type: EventControlExecuted, Payload: map[string]string{"command": "start"}})
+	if id == "" {
+		t.Fatal("Dispatch returned no event ID")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(attempts()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := attempts()
+	if len(got) != 3 {
+		t.Fatalf("%d attempt(s), want 2 failures and a success", len(got))
+	}
+	for i, a := range got {
+		if a.eventID != id {
+			t.Errorf("attempt %d sent X-Shifu-Event-ID %q, want %q on every retry", i+1, a.eventID, id)
+		}
+	}
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
 	"log"
-	"mime"
+	"math"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -59,8 +70,51 @@ var (
 	videoPath    = getEnv("VIDEO_PATH", "/video")
 	controlPath  = getEnv("CONTROL_PATH", "/control")
 	deployPath   = getEnv("DEPLOY_PATH", "/deploy")
+	metricsPath  = getEnv("METRICS_PATH", "/metrics")
+	// Frames queued per video client; when full, VIDEO_BUFFER_STRATEGY decides
+	// whether the incoming frame (drop_newest) or the oldest queued frame
+	// (drop_oldest) is discarded.
+	frameBufferSize = getEnvInt("VIDEO_FRAME_BUFFER_SIZE", 5)
+	bufferStrategy  = getEnv("VIDEO_BUFFER_STRATEGY", "drop_oldest")
+	// Concurrent VIDEO_PATH streams; further clients get 503.
+	maxVideoClients = getEnvInt("VIDEO_MAX_CLIENTS", 10)
+	// RTSP_URL switches the video source from UDP to an RTSP camera, which is
+	// transcoded to MJPEG by ffmpeg.
+	rtspURL     = getEnv("RTSP_URL", "")
+	ffmpegPath  = getEnv("FFMPEG_PATH", "ffmpeg")
+	rtspTimeout = time.Duration(getEnvInt("RTSP_TIMEOUT_S", 10)) * time.Second
+	// HLS output under VIDEO_PATH/hls/, segmented by ffmpeg and kept to a
+	// sliding window of HLS_MAX_SEGMENTS.
+	hlsSegmentDuration = getEnvInt("HLS_SEGMENT_DURATION", 2)
+	hlsMaxSegments     = getEnvInt("HLS_MAX_SEGMENTS", 5)
+	// VIDEO_PATH/snapshot serves the hub's last frame while it is younger
+	// than this, and waits for a new one otherwise.
+	snapshotMaxAge = time.Duration(getEnvInt("SNAPSHOT_CACHE_MAX_AGE_MS", 200)) * time.Millisecond
+	// MODEL_DEPLOY_PATH forwards deployments to the device's MODEL_DEPLOY_URL
+	// and smoke-tests the new model against MODEL_INFER_URL; it is only
+	// served when both URLs are set.
+	modelDeployPath = getEnv("MODEL_DEPLOY_PATH", "/model/deploy")
+	modelDeployURL  = getEnv("MODEL_DEPLOY_URL", "")
+	modelInferURL   = getEnv("MODEL_INFER_URL", "")
+	modelTimeout    = time.Duration(getEnvInt("MODEL_TIMEOUT_S", 10)) * time.Second
 )
 
+// Video frame counters, exposed on METRICS_PATH
+var (
+	framesReceived atomic.Uint64
+	framesDropped  atomic.Uint64
+)
+
+// videoClients counts open VIDEO_PATH streams for VIDEO_PATH/info, the
+// video_clients_active gauge and the VIDEO_MAX_CLIENTS limit. Rejected
+// clients are counted briefly too, so read it through activeVideoClients.
+var videoClients atomic.Int64
+
+// activeVideoClients returns the number of streams being served.
+func activeVideoClients() int64 {
+	return min(videoClients.Load(), int64(maxVideoClients))
+}
+
 // Helper: get env var with fallback
 func getEnv(key, fallback string) string {
 	if val, ok := os.LookupEnv(key); ok && val != "" {
@@ -69,67 +123,706 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// Video stream proxy over HTTP (UDP MJPEG -> HTTP multipart/x-mixed-replace)
+// envErrors collects integer settings that did not parse; validateSettings
+// reports them so a typo stops the driver instead of running on the default.
+var envErrors []error
+
+// Helper: get integer env var with fallback. The value is returned as set,
+// so range checks belong in validateSettings.
+func getEnvInt(key string, fallback int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("invalid %s=%q, expected an integer", key, val))
+		return fallback
+	}
+	return n
+}
+
+// frameSource yields one JPEG frame per call to ReadFrame.
+type frameSource interface {
+	ReadFrame() ([]byte, error)
+	Close() error
+}
+
+// udpSource reads one JPEG per datagram from VIDEO_STREAM_PORT.
+type udpSource struct {
+	conn net.PacketConn
+	buf  []byte
+}
+
+func (u *udpSource) ReadFrame() ([]byte, error) {
+	n, _, err := u.conn.ReadFrom(u.buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, u.buf[:n]...), nil
+}
+
+func (u *udpSource) Close() error { return u.conn.Close() }
+
+// rtspSource runs ffmpeg to pull RTSP_URL and transcode it to a stream of
+// JPEGs on stdout. ffmpeg is killed when the client goes away or when no
+// frame arrives within RTSP_TIMEOUT_S, so a hung camera can't leak processes.
+type rtspSource struct {
+	cmd      *exec.Cmd
+	cancel   context.CancelFunc
+	scanner  *bufio.Scanner
+	watchdog *time.Timer
+}
+
+func openRTSP(ctx context.Context) (*rtspSource, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-loglevel", "error",
+		"-rtsp_transport", "tcp",
+		"-i", rtspURL,
+		"-an",
+		"-f", "mjpeg",
+		"-q:v", "5",
+		"pipe:1",
+	)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Close our end of the pipe on cancel too, so a read blocked on a
+	// child that inherited it returns immediately.
+	cmd.Cancel = func() error {
+		stdout.Close()
+		return cmd.Process.Kill()
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 1<<20), 16<<20)
+	scanner.Split(splitJPEG)
+	return &rtspSource{
+		cmd:      cmd,
+		cancel:   cancel,
+		scanner:  scanner,
+		watchdog: time.AfterFunc(rtspTimeout, cancel),
+	}, nil
+}
+
+func (s *rtspSource) ReadFrame() ([]byte, error) {
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	s.watchdog.Reset(rtspTimeout)
+	return append([]byte{}, s.scanner.Bytes()...), nil
+}
+
+func (s *rtspSource) Close() error {
+	s.watchdog.Stop()
+	s.cancel()
+	return s.cmd.Wait()
+}
+
+// splitJPEG is a bufio.SplitFunc that cuts a concatenated MJPEG stream at
+// the JPEG start (FFD8) and end (FFD9) markers.
+func splitJPEG(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.Index(data, []byte{0xff, 0xd8})
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return max(len(data)-1, 0), nil, nil
+	}
+	end := bytes.Index(data[start+2:], []byte{0xff, 0xd9})
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+	end += start + 4
+	return end, data[start:end], nil
+}
+
+// openVideoSource opens the configured upstream: RTSP when RTSP_URL is set,
+// UDP MJPEG otherwise.
+func openVideoSource() (frameSource, error) {
+	if rtspURL != "" {
+		rtsp, err := openRTSP(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to start RTSP client: %w", err)
+		}
+		return rtsp, nil
+	}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(serverHost, videoPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP port: %w", err)
+	}
+	return &udpSource{conn: conn, buf: make([]byte, 65536)}, nil
+}
+
+// videoFrame is one JPEG from the source. Seq counts frames read by the hub,
+// so a client that has frames dropped sees a gap; At is when it arrived.
+type videoFrame struct {
+	Data []byte
+	Seq  uint64
+	At   time.Time
+}
+
+// setFrameHeaders adds the frame's X-Frame-Timestamp and X-Frame-Sequence.
+func setFrameHeaders(h textproto.MIMEHeader, frame videoFrame) {
+	h.Set("X-Frame-Timestamp", frame.At.UTC().Format(time.RFC3339Nano))
+	h.Set("X-Frame-Sequence", strconv.FormatUint(frame.Seq, 10))
+}
+
+// videoConsumer is one downstream client of a VideoHub. Frames are queued in
+// a bounded buffer; when the client can't keep up the buffer fills and frames
+// are dropped according to VIDEO_BUFFER_STRATEGY instead of piling up.
+type videoConsumer struct {
+	frames  chan videoFrame
+	dropped atomic.Uint64
+}
+
+// offer queues frame for the consumer. Only the hub's reader calls it.
+func (c *videoConsumer) offer(frame videoFrame) {
+	select {
+	case c.frames <- frame:
+		return
+	default:
+	}
+	c.dropped.Add(1)
+	framesDropped.Add(1)
+	if bufferStrategy == "drop_newest" {
+		return
+	}
+	select {
+	case <-c.frames:
+	default:
+	}
+	select {
+	case c.frames <- frame:
+	default:
+	}
+}
+
+// VideoHub shares one upstream video source between all clients. The source
+// is opened when the first consumer registers and closed when the last one
+// leaves; a single reader goroutine broadcasts every frame to all consumers.
+type VideoHub struct {
+	mu        sync.Mutex
+	open      func() (frameSource, error)
+	src       frameSource
+	consumers map[*videoConsumer]struct{}
+	last      videoFrame
+	seq       uint64
+	info      VideoInfo
+}
+
+// VideoInfo describes the stream, as served by VIDEO_PATH/info. Width and
+// height come from the first frame's JPEG header and fps is a moving
+// average of the frame interval, so all three are 0 until frames arrive.
+type VideoInfo struct {
+	Codec     string  `json:"codec"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FPS       float64 `json:"fps"`
+	Source    string  `json:"source"`
+	Streaming bool    `json:"streaming"`
+}
+
+func NewVideoHub(open func() (frameSource, error)) *VideoHub {
+	return &VideoHub{open: open, consumers: make(map[*videoConsumer]struct{})}
+}
+
+var videoHub = NewVideoHub(openVideoSource)
+
+// Register adds a consumer, opening the upstream source if needed. The
+// consumer's channel is closed if the source ends.
+func (h *VideoHub) Register() (*videoConsumer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.src == nil {
+		src, err := h.open()
+		if err != nil {
+			return nil, err
+		}
+		h.src = src
+		h.info = VideoInfo{Codec: "mjpeg", Source: videoSourceName()}
+		go h.run(src)
+	}
+	c := &videoConsumer{frames: make(chan videoFrame, frameBufferSize)}
+	h.consumers[c] = struct{}{}
+	return c, nil
+}
+
+// Deregister removes a consumer and closes the source once nobody is left.
+func (h *VideoHub) Deregister(c *videoConsumer) {
+	h.mu.Lock()
+	delete(h.consumers, c)
+	var idle frameSource
+	if len(h.consumers) == 0 && h.src != nil {
+		idle, h.src = h.src, nil
+	}
+	h.mu.Unlock()
+	if idle != nil {
+		idle.Close()
+	}
+}
+
+// Info returns the stream parameters seen so far.
+func (h *VideoHub) Info() VideoInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info := h.info
+	if info.Source == "" {
+		info = VideoInfo{Codec: "mjpeg", Source: videoSourceName()}
+	}
+	info.FPS = math.Round(info.FPS*10) / 10
+	return info
+}
+
+func videoSourceName() string {
+	if rtspURL != "" {
+		return "rtsp"
+	}
+	return "udp"
+}
+
+// jpegSize reads the frame dimensions from a JPEG's start-of-frame marker,
+// returning zeros if there is none.
+func jpegSize(frame []byte) (int, int) {
+	for i := 2; i+9 < len(frame); {
+		if frame[i] != 0xff {
+			i++
+			continue
+		}
+		marker := frame[i+1]
+		switch {
+		case marker == 0xff || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			// Fill byte or a marker without a length
+			i += 2
+			continue
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			height := int(frame[i+5])<<8 | int(frame[i+6])
+			width := int(frame[i+7])<<8 | int(frame[i+8])
+			return width, height
+		}
+		i += 2 + (int(frame[i+2])<<8 | int(frame[i+3]))
+	}
+	return 0, 0
+}
+
+// Last returns the most recent frame; its Data is nil before the first one.
+func (h *VideoHub) Last() videoFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// run reads frames from src and broadcasts them until src fails or is closed.
+func (h *VideoHub) run(src frameSource) {
+	var prev time.Time
+	for {
+		frame, err := src.ReadFrame()
+		if err != nil {
+			break
+		}
+		framesReceived.Add(1)
+		now := time.Now()
+		h.mu.Lock()
+		if h.info.Width == 0 {
+			h.info.Width, h.info.Height = jpegSize(frame)
+		}
+		if !prev.IsZero() {
+			if fps := 1 / now.Sub(prev).Seconds(); h.info.FPS == 0 {
+				h.info.FPS = fps
+			} else {
+				h.info.FPS += (fps - h.info.FPS) / 10
+			}
+		}
+		h.seq++
+		h.last = videoFrame{Data: frame, Seq: h.seq, At: now}
+		prev = now
+		for c := range h.consumers {
+			c.offer(h.last)
+		}
+		h.mu.Unlock()
+	}
+	// If the source ended on its own, end every stream reading from it so
+	// the clients reconnect and a fresh source is opened.
+	h.mu.Lock()
+	failed := h.src == src
+	if failed {
+		h.src = nil
+		for c := range h.consumers {
+			close(c.frames)
+			delete(h.consumers, c)
+		}
+	}
+	h.mu.Unlock()
+	if failed {
+		src.Close()
+	}
+}
+
+// Video stream proxy over HTTP (UDP or RTSP -> HTTP multipart/x-mixed-replace).
+// All clients share one upstream source through videoHub.
 func videoHandler(w http.ResponseWriter, r *http.Request) {
-	if videoProto != "udp" || videoAddr == "" || videoPort == "" || videoCodec != "mjpeg" {
+	if rtspURL == "" && (videoProto != "udp" || videoAddr == "" || videoPort == "" || videoCodec != "mjpeg") {
 		http.Error(w, "Video stream not configured or unsupported protocol/codec", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
-	ctx := r.Context()
-	conn, err := net.ListenPacket("udp", net.JoinHostPort(serverHost, videoPort))
+	// Reserve a slot before touching the hub; the deferred release also
+	// runs if the handler panics.
+	defer videoClients.Add(-1)
+	if videoClients.Add(1) > int64(maxVideoClients) {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many video clients", http.StatusServiceUnavailable)
+		return
+	}
+	consumer, err := videoHub.Register()
 	if err != nil {
-		http.Error(w, "Failed to bind UDP port: "+err.Error(), http.StatusBadGateway)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer videoHub.Deregister(consumer)
+	// Parts are framed per RFC 2046 by multipart.Writer, with the boundary
+	// declared in Content-Type matching the one written.
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary("frame"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close()
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
 
-	var mu sync.Mutex
-	var lastFrame []byte
-	go func() {
-		buf := make([]byte, 65536)
-		for {
-			n, _, err := conn.ReadFrom(buf)
-			if err != nil {
-				break
-			}
-			mu.Lock()
-			lastFrame = append([]byte{}, buf[:n]...)
-			mu.Unlock()
-		}
+	// Dropped frames are reported in the X-Frames-Dropped trailer when the
+	// stream ends.
+	defer func() {
+		w.Header().Set(http.TrailerPrefix+"X-Frames-Dropped", strconv.FormatUint(consumer.dropped.Load(), 10))
 	}()
+	// Terminate the multipart body with the closing boundary when the stream ends
+	defer mw.Close()
 
-	ticker := time.NewTicker(40 * time.Millisecond) // ~25fps
-	defer ticker.Stop()
-	boundary := "--frame"
+	ctx := r.Context()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			mu.Lock()
-			frame := lastFrame
-			mu.Unlock()
-			if len(frame) == 0 {
+		case frame, ok := <-consumer.frames:
+			if !ok {
+				return
+			}
+			if len(frame.Data) == 0 {
 				continue
 			}
 			// Assume frame is a JPEG image over UDP (MJPEG streaming)
-			_, _ = w.Write([]byte(boundary + "\r\n"))
-			_, _ = w.Write([]byte("Content-Type: image/jpeg\r\n"))
-			_, _ = w.Write([]byte("Content-Length: " + strconv.Itoa(len(frame)) + "\r\n\r\n"))
-			_, _ = w.Write(frame)
-			_, _ = w.Write([]byte("\r\n"))
+			header := textproto.MIMEHeader{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {strconv.Itoa(len(frame.Data))},
+			}
+			setFrameHeaders(header, frame)
+			part, err := mw.CreatePart(header)
+			if err != nil {
+				return
+			}
+			if _, err := part.Write(frame.Data); err != nil {
+				return
+			}
 			flusher.Flush()
 		}
 	}
 }
 
+// Video stream parameters as JSON
+func videoInfoHandler(w http.ResponseWriter, r *http.Request) {
+	info := videoHub.Info()
+	info.Streaming = activeVideoClients() > 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Single JPEG from the video source. A frame cached by videoHub within
+// SNAPSHOT_CACHE_MAX_AGE_MS is returned straight away; otherwise the handler
+// registers with the hub and waits for the next one.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if rtspURL == "" && (videoProto != "udp" || videoAddr == "" || videoPort == "" || videoCodec != "mjpeg") {
+		http.Error(w, "Video stream not configured or unsupported protocol/codec", http.StatusBadRequest)
+		return
+	}
+	frame := videoHub.Last()
+	if frame.Data == nil || time.Since(frame.At) > snapshotMaxAge {
+		consumer, err := videoHub.Register()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer videoHub.Deregister(consumer)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(rtspTimeout):
+			http.Error(w, "Timed out waiting for a video frame", http.StatusGatewayTimeout)
+			return
+		case f, ok := <-consumer.frames:
+			if !ok {
+				http.Error(w, "Video source ended", http.StatusBadGateway)
+				return
+			}
+			frame = f
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(frame.Data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Last-Modified", frame.At.UTC().Format(http.TimeFormat))
+	setFrameHeaders(textproto.MIMEHeader(w.Header()), frame)
+	w.Write(frame.Data)
+}
+
+// hlsIdleTimeout stops the HLS transcoder once nobody has fetched the
+// playlist or a segment for this long.
+const hlsIdleTimeout = 60 * time.Second
+
+// hlsStream runs a single ffmpeg process that segments the video source into
+// an HLS playlist in a temp directory. It is started by the first request
+// and shared by every HLS client.
+type hlsStream struct {
+	mu   sync.Mutex
+	dir  string
+	stop context.CancelFunc
+	idle *time.Timer
+}
+
+var hls = &hlsStream{}
+
+// ensure starts the transcoder if it isn't running, pushes back the idle
+// timeout and returns the segments directory.
+func (h *hlsStream) ensure() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		h.idle.Reset(hlsIdleTimeout)
+		return h.dir, nil
+	}
+	dir, err := os.MkdirTemp("", "hls-")
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := h.start(ctx, dir); err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		return "", err
+	}
+	h.dir = dir
+	h.stop = cancel
+	h.idle = time.AfterFunc(hlsIdleTimeout, cancel)
+	log.Printf("HLS transcoder started in %s", dir)
+	return dir, nil
+}
+
+// start launches ffmpeg writing HLS into dir. RTSP is read by ffmpeg
+// directly; UDP JPEG datagrams are piped into its stdin.
+func (h *hlsStream) start(ctx context.Context, dir string) error {
+	// UDP frames come from videoHub so /video and HLS share the port.
+	var input []string
+	var consumer *videoConsumer
+	if rtspURL != "" {
+		input = []string{"-rtsp_transport", "tcp", "-i", rtspURL}
+	} else {
+		var err error
+		if consumer, err = videoHub.Register(); err != nil {
+			return err
+		}
+		input = []string{"-f", "mjpeg", "-use_wallclock_as_timestamps", "1", "-i", "pipe:0"}
+	}
+	args := append([]string{"-loglevel", "error"}, input...)
+	args = append(args,
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentDuration),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentDuration),
+		"-hls_list_size", strconv.Itoa(hlsMaxSegments),
+		"-hls_flags", "omit_endlist",
+		"-hls_segment_filename", filepath.Join(dir, "segment%06d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stderr = os.Stderr
+	var stdin io.WriteCloser
+	if consumer != nil {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			videoHub.Deregister(consumer)
+			return err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		if consumer != nil {
+			videoHub.Deregister(consumer)
+		}
+		return err
+	}
+	if consumer != nil {
+		go func() {
+			defer videoHub.Deregister(consumer)
+			defer stdin.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case frame, ok := <-consumer.frames:
+					if !ok {
+						return
+					}
+					if _, err := stdin.Write(frame.Data); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+	// Prune with the settings ffmpeg was started with
+	segmentDuration, maxSegments := hlsSegmentDuration, hlsMaxSegments
+	go func() {
+		ticker := time.NewTicker(time.Duration(segmentDuration) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pruneSegments(dir, maxSegments)
+			}
+		}
+	}()
+	go func() {
+		err := cmd.Wait()
+		log.Printf("HLS transcoder stopped: %v", err)
+		h.mu.Lock()
+		if h.dir == dir {
+			h.idle.Stop()
+			h.stop()
+			h.dir, h.stop, h.idle = "", nil, nil
+		}
+		h.mu.Unlock()
+		os.RemoveAll(dir)
+	}()
+	return nil
+}
+
+// pruneSegments deletes all but the newest keep segments in dir. ffmpeg
+// only lists the window in the playlist; this keeps the disk in step.
+func pruneSegments(dir string, keep int) {
+	segments, err := filepath.Glob(filepath.Join(dir, "segment*.ts"))
+	if err != nil || len(segments) <= keep {
+		return
+	}
+	// Segment names are zero-padded sequence numbers, so lexical order is
+	// creation order.
+	sort.Strings(segments)
+	for _, seg := range segments[:len(segments)-keep] {
+		if err := os.Remove(seg); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove HLS segment %s: %v", seg, err)
+		}
+	}
+}
+
+// HLS output: VIDEO_PATH/hls redirects to the playlist, and
+// VIDEO_PATH/hls/index.m3u8 and VIDEO_PATH/hls/segmentNNNNNN.ts are served
+// from the transcoder's directory.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if rtspURL == "" && (videoProto != "udp" || videoPort == "") {
+		http.Error(w, "Video stream not configured or unsupported protocol", http.StatusBadRequest)
+		return
+	}
+	prefix := videoPath + "/hls/"
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if r.URL.Path == videoPath+"/hls" || name == "" {
+		http.Redirect(w, r, prefix+"index.m3u8", http.StatusFound)
+		return
+	}
+	if name != path.Base(name) || (name != "index.m3u8" && !strings.HasSuffix(name, ".ts")) {
+		http.NotFound(w, r)
+		return
+	}
+	dir, err := hls.ensure()
+	if err != nil {
+		http.Error(w, "Failed to start HLS transcoder: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	file := filepath.Join(dir, name)
+	if name == "index.m3u8" {
+		// The playlist appears once ffmpeg has written the first segment.
+		deadline := time.Now().Add(rtspTimeout + time.Duration(hlsSegmentDuration)*time.Second)
+		for {
+			if _, err := os.Stat(file); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				w.Header().Set("Retry-After", strconv.Itoa(hlsSegmentDuration))
+				http.Error(w, "HLS playlist not ready", http.StatusServiceUnavailable)
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeFile(w, r, file)
+}
+
+// Prometheus metrics for the video proxy
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP video_frames_received_total Video frames received from the device.")
+	fmt.Fprintln(w, "# TYPE video_frames_received_total counter")
+	fmt.Fprintf(w, "video_frames_received_total %d\n", framesReceived.Load())
+	fmt.Fprintln(w, "# HELP video_frames_dropped_total Video frames dropped because a client's frame buffer was full.")
+	fmt.Fprintln(w, "# TYPE video_frames_dropped_total counter")
+	fmt.Fprintf(w, "video_frames_dropped_total{strategy=\"%s\"} %d\n", escapeLabel(bufferStrategy), framesDropped.Load())
+	fmt.Fprintln(w, "# HELP video_clients_active Video stream clients currently connected.")
+	fmt.Fprintln(w, "# TYPE video_clients_active gauge")
+	fmt.Fprintf(w, "video_clients_active %d\n", activeVideoClients())
+}
+
+// escapeLabel escapes a Prometheus label value. %q is not a substitute: Go
+// escapes non-ASCII and control characters that the exposition format takes
+// literally.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
 // Simulated AI model deployment
 func deployHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -149,6 +842,162 @@ func deployHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// SmokeTestResult reports whether a freshly deployed model answered an
+// inference request.
+type SmokeTestResult struct {
+	Passed     bool   `json:"passed"`
+	StatusCode int    `json:"status_code,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// RollbackResult reports the redeploy of the previous model after a failed
+// smoke test.
+type RollbackResult struct {
+	Attempted bool   `json:"attempted"`
+	Version   string `json:"version,omitempty"`
+	Status    string `json:"status"` // "rolled_back", "failed" or "no_previous_model"
+	Error     string `json:"error,omitempty"`
+}
+
+// ModelDeployResponse is the body returned by MODEL_DEPLOY_PATH.
+type ModelDeployResponse struct {
+	Status    string          `json:"status"` // "deployed", "rolled_back" or "failed"
+	ModelName string          `json:"model_name"`
+	Version   string          `json:"version"`
+	SmokeTest SmokeTestResult `json:"smoke_test"`
+	Rollback  *RollbackResult `json:"rollback,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// modelDeployer remembers the last model that passed its smoke test so a
+// failed deployment can be rolled back. Deployments are serialized.
+type modelDeployer struct {
+	mu      sync.Mutex
+	client  *http.Client
+	current *DeployRequest
+}
+
+var models = &modelDeployer{client: &http.Client{Timeout: modelTimeout}}
+
+// smokeTestImage is a small grey JPEG sent to the model after deployment.
+var smokeTestImage = func() []byte {
+	var buf bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+// deploy sends the request to the device's MODEL_DEPLOY_URL.
+func (m *modelDeployer) deploy(req DeployRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Post(modelDeployURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("device returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smokeTest posts smokeTestImage as {"image_b64": ...} to MODEL_INFER_URL.
+// The model passes if it answers 200 with a JSON body.
+func (m *modelDeployer) smokeTest() SmokeTestResult {
+	var result SmokeTestResult
+	body, _ := json.Marshal(map[string]string{"image_b64": base64.StdEncoding.EncodeToString(smokeTestImage)})
+	start := time.Now()
+	resp, err := m.client.Post(modelInferURL, "application/json", bytes.NewReader(body))
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	out, err := io.ReadAll(resp.Body)
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case resp.StatusCode != http.StatusOK:
+		result.Error = "inference returned " + resp.Status
+	case !json.Valid(out):
+		result.Error = "inference returned invalid JSON"
+	default:
+		result.Passed = true
+	}
+	return result
+}
+
+// Deploy rolls out req, smoke-tests it and, if the test fails, redeploys the
+// previous model.
+func (m *modelDeployer) Deploy(req DeployRequest) ModelDeployResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := ModelDeployResponse{ModelName: req.ModelName, Version: req.Version}
+	if err := m.deploy(req); err != nil {
+		resp.Status = "failed"
+		resp.Error = "deploy: " + err.Error()
+		return resp
+	}
+	resp.SmokeTest = m.smokeTest()
+	if resp.SmokeTest.Passed {
+		m.current = &req
+		resp.Status = "deployed"
+		log.Printf("Deployed model %s version %s", req.ModelName, req.Version)
+		return resp
+	}
+
+	log.Printf("Model %s version %s failed its smoke test: %s", req.ModelName, req.Version, resp.SmokeTest.Error)
+	resp.Status = "failed"
+	resp.Rollback = &RollbackResult{Status: "no_previous_model"}
+	if m.current == nil {
+		return resp
+	}
+	resp.Rollback.Attempted = true
+	resp.Rollback.Version = m.current.Version
+	if err := m.deploy(*m.current); err != nil {
+		resp.Rollback.Status = "failed"
+		resp.Rollback.Error = err.Error()
+		log.Printf("Rollback to model %s version %s failed: %v", m.current.ModelName, m.current.Version, err)
+		return resp
+	}
+	resp.Status = "rolled_back"
+	resp.Rollback.Status = "rolled_back"
+	log.Printf("Rolled back to model %s version %s", m.current.ModelName, m.current.Version)
+	return resp
+}
+
+// Hot-swap the device's AI model without an OTA restart
+func modelDeployHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req DeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ModelName == "" || req.Version == "" {
+		http.Error(w, "model_name and version are required", http.StatusBadRequest)
+		return
+	}
+	resp := models.Deploy(req)
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "deployed" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
 // Simulated device control
 func controlHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -209,11 +1058,57 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 
 var startTime = time.Now()
 
+// validateSettings rejects settings the driver can't run with: integers that
+// don't parse and values out of range, such as a zero HLS_SEGMENT_DURATION,
+// which would panic the segment pruner's ticker and be passed to ffmpeg as
+// -hls_time 0.
+func validateSettings() error {
+	if err := errors.Join(envErrors...); err != nil {
+		return err
+	}
+	if frameBufferSize < 1 {
+		return fmt.Errorf("invalid VIDEO_FRAME_BUFFER_SIZE=%d, expected at least 1", frameBufferSize)
+	}
+	if rtspTimeout < time.Second {
+		return fmt.Errorf("invalid RTSP_TIMEOUT_S=%d, expected at least 1 second", rtspTimeout/time.Second)
+	}
+	if snapshotMaxAge < 0 {
+		return fmt.Errorf("invalid SNAPSHOT_CACHE_MAX_AGE_MS=%d, expected 0 or more", snapshotMaxAge/time.Millisecond)
+	}
+	if modelTimeout < time.Second {
+		return fmt.Errorf("invalid MODEL_TIMEOUT_S=%d, expected at least 1 second", modelTimeout/time.Second)
+	}
+	if bufferStrategy != "drop_newest" && bufferStrategy != "drop_oldest" {
+		return fmt.Errorf("invalid VIDEO_BUFFER_STRATEGY=%q, expected drop_newest or drop_oldest", bufferStrategy)
+	}
+	if hlsSegmentDuration < 1 {
+		return fmt.Errorf("invalid HLS_SEGMENT_DURATION=%d, expected at least 1 second", hlsSegmentDuration)
+	}
+	if hlsMaxSegments < 1 {
+		return fmt.Errorf("invalid HLS_MAX_SEGMENTS=%d, expected at least 1", hlsMaxSegments)
+	}
+	if maxVideoClients < 1 {
+		return fmt.Errorf("invalid VIDEO_MAX_CLIENTS=%d, expected at least 1", maxVideoClients)
+	}
+	return nil
+}
+
 func main() {
+	if err := validateSettings(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 	http.HandleFunc(videoPath, videoHandler)
+	http.HandleFunc(videoPath+"/snapshot", snapshotHandler)
+	http.HandleFunc(videoPath+"/info", videoInfoHandler)
+	http.HandleFunc(videoPath+"/hls", hlsHandler)
+	http.HandleFunc(videoPath+"/hls/", hlsHandler)
 	http.HandleFunc(deployPath, deployHandler)
 	http.HandleFunc(controlPath, controlHandler)
 	http.HandleFunc(statusPath, statusHandler)
+	http.HandleFunc(metricsPath, metricsHandler)
+	if modelDeployURL != "" && modelInferURL != "" {
+		http.HandleFunc(modelDeployPath, modelDeployHandler)
+	}
 	addr := net.JoinHostPort(serverHost, serverPort)
 	log.Printf("Starting driver HTTP server on %s\n", addr)
 	log.Fatal(http.ListenAndServe(addr, nil))
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVideoPartsCarryFrameHeaders(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	srv := httptest.NewServer(http.HandlerFunc(videoHandler))
+	defer srv.Close()
+
+	start := time.Now()
+	feedWhenConsumers(src, 1, []byte("\xff\xd8one\xff\xd9"), []byte("\xff\xd8two\xff\xd9"))
+	_, mr := openVideoStream(t, srv)
+
+	var prevSeq uint64
+	var prevAt time.Time
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		seq, err := strconv.ParseUint(part.Header.Get("X-Frame-Sequence"), 10, 64)
+		if err != nil || seq <= prevSeq {
+			t.Fatalf("part %d X-Frame-Sequence %q after %d", i, part.Header.Get("X-Frame-Sequence"), prevSeq)
+		}
+		at, err := time.Parse(time.RFC3339Nano, part.Header.Get("X-Frame-Timestamp"))
+		if err != nil || at.Before(start) || at.Before(prevAt) || at.Location() != time.UTC {
+			t.Fatalf("part %d X-Frame-Timestamp %q: %v", i, part.Header.Get("X-Frame-Timestamp"), err)
+		}
+		prevSeq, prevAt = seq, at
+	}
+}
+
+func TestSnapshotCarriesFrameHeaders(t *testing.T) {
+	useFakeVideo(t, newFakeSource())
+	at := time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.FixedZone("CEST", 2*3600))
+	videoHub.last = videoFrame{Data: []byte("\xff\xd8x\xff\xd9"), Seq: 42, At: at}
+	prevAge := snapshotMaxAge
+	snapshotMaxAge = 100 * 365 * 24 * time.Hour
+	t.Cleanup(func() { snapshotMaxAge = prevAge })
+
+	w := getSnapshot()
+	if got := w.Header().Get("X-Frame-Sequence"); got != "42" {
+		t.Errorf("X-Frame-Sequence = %q, want 42", got)
+	}
+	if got := w.Header().Get("X-Frame-Timestamp"); got != "2024-05-01T08:00:00.123456789Z" {
+		t.Errorf("X-Frame-Timestamp = %q", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubFFmpeg writes a new segment and rewrites the playlist every 200ms,
+// like ffmpeg's HLS muxer with a sliding window.
+const stubFFmpeg = `#!/bin/sh
+for playlist; do :; done
+dir=$(dirname "$playlist")
+n=0
+while :; do
+	seg=$(printf 'segment%06d.ts' $n)
+	printf 'ts' > "$dir/$seg"
+	printf '#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXTINF:1.0,\n%s\n' $n $seg > "$playlist.tmp"
+	mv "$playlist.tmp" "$playlist"
+	n=$((n+1))
+	sleep 0.2
+done
+`
+
+var mediaSequence = regexp.MustCompile(`#EXT-X-MEDIA-SEQUENCE:(\d+)`)
+
+func fetchPlaylistSequence(t *testing.T) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	hlsHandler(w, httptest.NewRequest("GET", "/video/hls/index.m3u8", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("playlist: %d %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("playlist Content-Type = %q", ct)
+	}
+	m := mediaSequence.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("no media sequence in %q", w.Body.String())
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+func TestHLSPlaylistAdvances(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+	stub := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(stub, []byte(stubFFmpeg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	oldFFmpeg, oldRTSP, oldDuration, oldMax := ffmpegPath, rtspURL, hlsSegmentDuration, hlsMaxSegments
+	ffmpegPath, rtspURL, hlsSegmentDuration, hlsMaxSegments = stub, "rtsp://camera.local/stream", 1, 2
+	t.Cleanup(func() {
+		hls.mu.Lock()
+		if hls.stop != nil {
+			hls.stop()
+		}
+		hls.mu.Unlock()
+		ffmpegPath, rtspURL, hlsSegmentDuration, hlsMaxSegments = oldFFmpeg, oldRTSP, oldDuration, oldMax
+	})
+
+	first := fetchPlaylistSequence(t)
+	time.Sleep(1500 * time.Millisecond)
+	second := fetchPlaylistSequence(t)
+	if second <= first {
+		t.Fatalf("media sequence went from %d to %d, want it to advance", first, second)
+	}
+
+	hls.mu.Lock()
+	dir := hls.dir
+	hls.mu.Unlock()
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment*.ts"))
+	if len(segments) == 0 {
+		t.Fatal("no segments on disk")
+	}
+	w := httptest.NewRecorder()
+	hlsHandler(w, httptest.NewRequest("GET", "/video/hls/"+filepath.Base(segments[len(segments)-1]), nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "video/mp2t" {
+		t.Errorf("segment: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, p := range []string{"/video/hls/../driver.go", "/video/hls/sub/segment000000.ts", "/video/hls/notes.txt"} {
+		w := httptest.NewRecorder()
+		hlsHandler(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", p, w.Code)
+		}
+	}
+}
+
+func TestPruneSegmentsKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 6; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("segment%06d.ts", i)), []byte("ts"), 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte("#EXTM3U"), 0o644)
+	pruneSegments(dir, 2)
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	want := []string{"index.m3u8", "segment000004.ts", "segment000005.ts"}
+	if len(left) != len(want) {
+		t.Fatalf("left %v, want %v", left, want)
+	}
+	for i, f := range left {
+		if filepath.Base(f) != want[i] {
+			t.Errorf("left %v, want %v", left, want)
+		}
+	}
+}
+
+func TestValidateSettingsHLS(t *testing.T) {
+	oldDuration, oldMax := hlsSegmentDuration, hlsMaxSegments
+	t.Cleanup(func() { hlsSegmentDuration, hlsMaxSegments = oldDuration, oldMax })
+	for _, c := range []struct {
+		duration, max int
+		ok            bool
+	}{{2, 5, true}, {1, 1, true}, {0, 5, false}, {-1, 5, false}, {2, 0, false}} {
+		hlsSegmentDuration, hlsMaxSegments = c.duration, c.max
+		if err := validateSettings(); (err == nil) != c.ok {
+			t.Errorf("HLS_SEGMENT_DURATION=%d HLS_MAX_SEGMENTS=%d: %v", c.duration, c.max, err)
+		}
+	}
+}
+
+func TestValidateSettingsHLSFromEnv(t *testing.T) {
+	for _, c := range []struct {
+		key string
+		v   *int
+	}{
+		{"HLS_SEGMENT_DURATION", &hlsSegmentDuration},
+		{"HLS_MAX_SEGMENTS", &hlsMaxSegments},
+	} {
+		for _, val := range []string{"0", "-1", "2s"} {
+			t.Run(c.key+"="+val, func(t *testing.T) {
+				setEnvInt(t, c.v, c.key, val)
+				if err := validateSettings(); err == nil || !strings.Contains(err.Error(), c.key) {
+					t.Fatalf("error %v, want startup to fail naming %s", err, c.key)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sofJPEG is a minimal JPEG whose start-of-frame marker declares 640x480.
+var sofJPEG = []byte{
+	0xff, 0xd8,
+	0xff, 0xe0, 0x00, 0x04, 0x00, 0x00,
+	0xff, 0xc0, 0x00, 0x0b, 0x08, 0x01, 0xe0, 0x02, 0x80, 0x01, 0x01, 0x11, 0x00,
+	0xff, 0xd9,
+}
+
+func getVideoInfo(t *testing.T) VideoInfo {
+	t.Helper()
+	w := httptest.NewRecorder()
+	videoInfoHandler(w, httptest.NewRequest("GET", "/video/info", nil))
+	var info VideoInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	return info
+}
+
+func TestJPEGSize(t *testing.T) {
+	if w, h := jpegSize(sofJPEG); w != 640 || h != 480 {
+		t.Fatalf("jpegSize = %dx%d, want 640x480", w, h)
+	}
+	if w, h := jpegSize([]byte{0xff, 0xd8, 0xff, 0xd9}); w != 0 || h != 0 {
+		t.Fatalf("jpegSize without SOF = %dx%d, want 0x0", w, h)
+	}
+}
+
+func TestVideoInfoBeforeStreaming(t *testing.T) {
+	useFakeVideo(t, newFakeSource())
+	info := getVideoInfo(t)
+	if info.Codec != "mjpeg" || info.Source != "udp" || info.Streaming || info.Width != 0 {
+		t.Fatalf("info = %+v, want idle udp mjpeg with no dimensions", info)
+	}
+}
+
+func TestVideoInfoFromFrames(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	consumer, err := videoHub.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer videoHub.Deregister(consumer)
+	for i := 0; i < 3; i++ {
+		src.frames <- sofJPEG
+		<-consumer.frames
+		time.Sleep(20 * time.Millisecond)
+	}
+	videoClients.Add(1)
+	defer videoClients.Add(-1)
+
+	info := getVideoInfo(t)
+	if info.Width != 640 || info.Height != 480 {
+		t.Errorf("size = %dx%d, want 640x480", info.Width, info.Height)
+	}
+	if info.FPS <= 0 || info.FPS > 50 {
+		t.Errorf("fps = %v, want a rate from the frame spacing", info.FPS)
+	}
+	if !info.Streaming {
+		t.Error("streaming = false with a client connected")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// modelDevice is a device whose inference endpoint fails while a model
+// version listed in broken is loaded.
+type modelDevice struct {
+	mu       sync.Mutex
+	loaded   string
+	deployed []string
+	broken   map[string]bool
+}
+
+// useModelDevice points MODEL_DEPLOY_URL and MODEL_INFER_URL at a fake
+// device for the duration of the test.
+func useModelDevice(t *testing.T, broken ...string) *modelDevice {
+	t.Helper()
+	dev := &modelDevice{broken: map[string]bool{}}
+	for _, v := range broken {
+		dev.broken[v] = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deploy", func(w http.ResponseWriter, r *http.Request) {
+		var req DeployRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		dev.loaded = req.Version
+		dev.deployed = append(dev.deployed, req.Version)
+	})
+	mux.HandleFunc("/infer", func(w http.ResponseWriter, r *http.Request) {
+		dev.mu.Lock()
+		defer dev.mu.Unlock()
+		if dev.broken[dev.loaded] {
+			http.Error(w, "model crashed", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, `{"label":"ok"}`)
+	})
+	srv := httptest.NewServer(mux)
+	prevDeploy, prevInfer, prevModels := modelDeployURL, modelInferURL, models
+	modelDeployURL, modelInferURL = srv.URL+"/deploy", srv.URL+"/infer"
+	models = &modelDeployer{client: srv.Client()}
+	t.Cleanup(func() {
+		srv.Close()
+		modelDeployURL, modelInferURL, models = prevDeploy, prevInfer, prevModels
+	})
+	return dev
+}
+
+func postDeploy(t *testing.T, body string) (int, ModelDeployResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	modelDeployHandler(w, httptest.NewRequest("POST", "/model/deploy", strings.NewReader(body)))
+	var resp ModelDeployResponse
+	if w.Code == http.StatusOK || w.Code == http.StatusBadGateway {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+	}
+	return w.Code, resp
+}
+
+func TestModelDeployPassesSmokeTest(t *testing.T) {
+	useModelDevice(t)
+	code, resp := postDeploy(t, `{"model_name":"yolo","version":"1"}`)
+	if code != http.StatusOK || resp.Status != "deployed" || !resp.SmokeTest.Passed || resp.Rollback != nil {
+		t.Fatalf("%d %+v, want deployed", code, resp)
+	}
+}
+
+func TestModelDeployRollsBack(t *testing.T) {
+	dev := useModelDevice(t, "2")
+	postDeploy(t, `{"model_name":"yolo","version":"1"}`)
+	code, resp := postDeploy(t, `{"model_name":"yolo","version":"2"}`)
+	if code != http.StatusBadGateway || resp.Status != "rolled_back" || resp.SmokeTest.Passed {
+		t.Fatalf("%d %+v, want rolled_back", code, resp)
+	}
+	if resp.Rollback == nil || resp.Rollback.Version != "1" || resp.Rollback.Status != "rolled_back" {
+		t.Fatalf("rollback = %+v", resp.Rollback)
+	}
+	if strings.Join(dev.deployed, ",") != "1,2,1" || dev.loaded != "1" {
+		t.Fatalf("device saw deployments %v, loaded %q", dev.deployed, dev.loaded)
+	}
+}
+
+func TestModelDeployFailsWithoutPrevious(t *testing.T) {
+	useModelDevice(t, "1")
+	code, resp := postDeploy(t, `{"model_name":"yolo","version":"1"}`)
+	if code != http.StatusBadGateway || resp.Status != "failed" || resp.Rollback == nil || resp.Rollback.Status != "no_previous_model" {
+		t.Fatalf("%d %+v, want failed with no_previous_model", code, resp)
+	}
+}
+
+func TestModelDeployRejectsBadRequest(t *testing.T) {
+	useModelDevice(t)
+	for _, body := range []string{`{"model_name":"yolo"}`, `not json`} {
+		if code, _ := postDeploy(t, body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, code)
+		}
+	}
+}
+
+func TestValidateSettingsModelTimeout(t *testing.T) {
+	prev := modelTimeout
+	t.Cleanup(func() { modelTimeout = prev })
+	for _, c := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{{10 * time.Second, true}, {time.Second, true}, {0, false}, {-time.Second, false}} {
+		modelTimeout = c.timeout
+		if err := validateSettings(); (err == nil) != c.ok {
+			t.Errorf("MODEL_TIMEOUT_S=%d: %v", c.timeout/time.Second, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// useStubFFmpeg installs script as FFMPEG_PATH and points RTSP_URL at a
+// camera for the duration of the test.
+func useStubFFmpeg(t *testing.T, script string, timeout time.Duration) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub ffmpeg is a shell script")
+	}
+	stub := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	oldFFmpeg, oldRTSP, oldTimeout := ffmpegPath, rtspURL, rtspTimeout
+	ffmpegPath, rtspURL, rtspTimeout = stub, "rtsp://camera.local/stream", timeout
+	t.Cleanup(func() { ffmpegPath, rtspURL, rtspTimeout = oldFFmpeg, oldRTSP, oldTimeout })
+}
+
+func TestSplitJPEG(t *testing.T) {
+	stream := "junk\xff\xd8one\xff\xd9\x00\x00\xff\xd8two\xff\xd9trailing\xff\xd8cut"
+	scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(stream)))
+	scanner.Split(splitJPEG)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[0] != "\xff\xd8one\xff\xd9" || frames[1] != "\xff\xd8two\xff\xd9" {
+		t.Fatalf("frames = %q, want the two complete JPEGs", frames)
+	}
+}
+
+func TestRTSPSourceReadsFrames(t *testing.T) {
+	// Only emits frames when invoked with the expected input URL
+	useStubFFmpeg(t, `#!/bin/sh
+case "$*" in *"-i rtsp://camera.local/stream"*) ;; *) exit 1;; esac
+printf 'noise\377\330one\377\331\377\330two\377\331'
+`, 5*time.Second)
+	src, err := openRTSP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, want := range []string{"\xff\xd8one\xff\xd9", "\xff\xd8two\xff\xd9"} {
+		frame, err := src.ReadFrame()
+		if err != nil || !bytes.Equal(frame, []byte(want)) {
+			t.Fatalf("ReadFrame = %q, %v; want %q", frame, err, want)
+		}
+	}
+	if _, err := src.ReadFrame(); err != io.EOF {
+		t.Fatalf("after ffmpeg exited: %v, want io.EOF", err)
+	}
+}
+
+func TestRTSPSourceWatchdog(t *testing.T) {
+	useStubFFmpeg(t, "#!/bin/sh\nexec sleep 60\n", 100*time.Millisecond)
+	src, err := openRTSP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := src.ReadFrame()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("ReadFrame returned a frame from a silent camera")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrame still blocked after RTSP_TIMEOUT_S")
+	}
+}
+
+func TestOpenVideoSourceMissingFFmpeg(t *testing.T) {
+	useStubFFmpeg(t, "", time.Second)
+	ffmpegPath = filepath.Join(t.TempDir(), "no-such-ffmpeg")
+	if _, err := openVideoSource(); err == nil || !strings.Contains(err.Error(), "RTSP") {
+		t.Fatalf("err = %v, want an RTSP start error", err)
+	}
+}
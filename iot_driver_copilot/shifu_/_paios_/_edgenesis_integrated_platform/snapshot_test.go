@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getSnapshot() *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	snapshotHandler(w, httptest.NewRequest("GET", "/video/snapshot", nil))
+	return w
+}
+
+func TestSnapshotServesCachedFrame(t *testing.T) {
+	useFakeVideo(t, newFakeSource())
+	videoHub.open = func() (frameSource, error) {
+		t.Fatal("source opened for a fresh cached frame")
+		return nil, nil
+	}
+	videoHub.last = videoFrame{Data: []byte("\xff\xd8cached\xff\xd9"), Seq: 7, At: time.Now()}
+
+	w := getSnapshot()
+	if w.Code != http.StatusOK || w.Body.String() != "\xff\xd8cached\xff\xd9" {
+		t.Fatalf("status %d body %q", w.Code, w.Body.String())
+	}
+	for header, want := range map[string]string{
+		"Content-Type":     "image/jpeg",
+		"Cache-Control":    "no-store",
+		"X-Frame-Sequence": "7",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSnapshotWaitsForFreshFrame(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	videoHub.last = videoFrame{Data: []byte("\xff\xd8old\xff\xd9"), At: time.Now().Add(-time.Hour)}
+	feedWhenConsumers(src, 1, []byte("\xff\xd8new\xff\xd9"))
+
+	w := getSnapshot()
+	if w.Code != http.StatusOK || w.Body.String() != "\xff\xd8new\xff\xd9" {
+		t.Fatalf("status %d body %q, want the new frame", w.Code, w.Body.String())
+	}
+}
+
+func TestSnapshotSourceEnded(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	feedWhenConsumers(src, 1)
+	if w := getSnapshot(); w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", w.Code)
+	}
+}
+
+func TestSnapshotRejectsPost(t *testing.T) {
+	useFakeVideo(t, newFakeSource())
+	w := httptest.NewRecorder()
+	snapshotHandler(w, httptest.NewRequest("POST", "/video/snapshot", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status %d, want 405", w.Code)
+	}
+}
+
+func TestValidateSettingsSnapshotMaxAge(t *testing.T) {
+	prev := snapshotMaxAge
+	t.Cleanup(func() { snapshotMaxAge = prev })
+	for _, c := range []struct {
+		age time.Duration
+		ok  bool
+	}{{200 * time.Millisecond, true}, {0, true}, {-time.Millisecond, false}} {
+		snapshotMaxAge = c.age
+		if err := validateSettings(); (err == nil) != c.ok {
+			t.Errorf("SNAPSHOT_CACHE_MAX_AGE_MS=%d: %v", c.age/time.Millisecond, err)
+		}
+	}
+}
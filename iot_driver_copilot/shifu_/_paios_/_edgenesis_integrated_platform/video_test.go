@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setEnvInt sets key for the test and reads it into v through getEnvInt, as
+// package initialisation would.
+func setEnvInt(t *testing.T, v *int, key, val string) {
+	t.Helper()
+	prev, prevErrs := *v, envErrors
+	t.Cleanup(func() { *v, envErrors = prev, prevErrs })
+	t.Setenv(key, val)
+	envErrors = nil
+	*v = getEnvInt(key, prev)
+}
+
+func TestValidateSettingsFrameBufferFromEnv(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		want string
+	}{
+		{"3", ""},
+		{"0", "VIDEO_FRAME_BUFFER_SIZE=0"},
+		{"-1", "VIDEO_FRAME_BUFFER_SIZE=-1"},
+		{"five", `VIDEO_FRAME_BUFFER_SIZE="five"`},
+	} {
+		t.Run(c.val, func(t *testing.T) {
+			setEnvInt(t, &frameBufferSize, "VIDEO_FRAME_BUFFER_SIZE", c.val)
+			err := validateSettings()
+			switch {
+			case c.want == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Fatalf("error %v, want one naming %s", err, c.want)
+			}
+		})
+	}
+}
+
+func TestMetricsEscapesStrategyLabel(t *testing.T) {
+	prev := bufferStrategy
+	bufferStrategy = "drop\\\"é\n"
+	t.Cleanup(func() { bufferStrategy = prev })
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `video_frames_dropped_total{strategy="drop\\\"é\n"}`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("metrics missing %s:\n%s", want, w.Body.String())
+	}
+}
+
+// fakeSource is a frameSource fed by the test. ReadFrame returns io.EOF once
+// end is called, as a camera that goes away would.
+type fakeSource struct {
+	frames chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{frames: make(chan []byte), done: make(chan struct{})}
+}
+
+func (s *fakeSource) ReadFrame() ([]byte, error) {
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeSource) Close() error {
+	s.end()
+	return nil
+}
+
+func (s *fakeSource) end() { s.once.Do(func() { close(s.done) }) }
+
+// useFakeVideo points the video handlers at src for the duration of the test.
+func useFakeVideo(t *testing.T, src *fakeSource) {
+	t.Helper()
+	oldHub, oldAddr, oldPort := videoHub, videoAddr, videoPort
+	videoHub = NewVideoHub(func() (frameSource, error) { return src, nil })
+	videoAddr, videoPort = "127.0.0.1", "5000"
+	t.Cleanup(func() { videoHub, videoAddr, videoPort = oldHub, oldAddr, oldPort })
+}
+
+// feedWhenConsumers sends frames to src once n clients are registered with
+// the hub, then ends the source. Clients only see their response headers
+// with the first frame, so this runs alongside the requests.
+func feedWhenConsumers(src *fakeSource, n int, frames ...[]byte) {
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			videoHub.mu.Lock()
+			got := len(videoHub.consumers)
+			videoHub.mu.Unlock()
+			if got >= n {
+				break
+			}
+		}
+		for _, f := range frames {
+			src.frames <- f
+		}
+		src.end()
+	}()
+}
+
+// openVideoStream starts a VIDEO_PATH request and returns a reader over its
+// multipart body.
+func openVideoStream(t *testing.T, srv *httptest.Server) (*http.Response, *multipart.Reader) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Content-Type %q: %v", resp.Header.Get("Content-Type"), err)
+	}
+	return resp, multipart.NewReader(resp.Body, params["boundary"])
+}
+
+func TestVideoStreamIsValidMultipart(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	srv := httptest.NewServer(http.HandlerFunc(videoHandler))
+	defer srv.Close()
+
+	frames := [][]byte{[]byte("\xff\xd8one\xff\xd9"), []byte("\xff\xd8two\xff\xd9"), []byte("\xff\xd8three\xff\xd9")}
+	feedWhenConsumers(src, 1, frames...)
+	_, mr := openVideoStream(t, srv)
+
+	for i, want := range frames {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("part %d Content-Type = %q", i, ct)
+		}
+		if cl := part.Header.Get("Content-Length"); cl != strconv.Itoa(len(want)) {
+			t.Errorf("part %d Content-Length = %q, want %d", i, cl, len(want))
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if string(body) != string(want) {
+			t.Errorf("part %d = %q, want %q", i, body, want)
+		}
+	}
+	// The source ended, so the stream must finish with the closing boundary
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("after the last frame: %v, want io.EOF", err)
+	}
+}
+
+func TestVideoHubFansOutToClients(t *testing.T) {
+	src := newFakeSource()
+	useFakeVideo(t, src)
+	var opens atomic.Int32
+	videoHub.open = func() (frameSource, error) {
+		opens.Add(1)
+		return src, nil
+	}
+	srv := httptest.NewServer(http.HandlerFunc(videoHandler))
+	defer srv.Close()
+
+	const clients = 3
+	frames := [][]byte{[]byte("\xff\xd8one\xff\xd9"), []byte("\xff\xd8two\xff\xd9")}
+	feedWhenConsumers(src, clients, frames...)
+	var wg sync.WaitGroup
+	got := make([][]string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/video")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			mr := multipart.NewReader(resp.Body, params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					return
+				}
+				body, _ := io.ReadAll(part)
+				got[i] = append(got[i], string(body))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, frames := range got {
+		if len(frames) != 2 || frames[0] != "\xff\xd8one\xff\xd9" || frames[1] != "\xff\xd8two\xff\xd9" {
+			t.Errorf("client %d got %q, want both frames in order", i, frames)
+		}
+	}
+	if n := opens.Load(); n != 1 {
+		t.Errorf("source opened %d times for %d clients, want 1", n, clients)
+	}
+	videoHub.mu.Lock()
+	left := len(videoHub.consumers)
+	videoHub.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d consumers still registered after the stream ended", left)
+	}
+}
+
+func TestVideoClientLimit(t *testing.T) {
+	useFakeVideo(t, newFakeSource())
+	oldMax := maxVideoClients
+	maxVideoClients = 1
+	t.Cleanup(func() { maxVideoClients = oldMax })
+	videoClients.Add(1)
+	defer videoClients.Add(-1)
+
+	w := httptest.NewRecorder()
+	videoHandler(w, httptest.NewRequest("GET", "/video", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("status %d Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := videoClients.Load(); n != 1 {
+		t.Fatalf("%d clients counted after a rejection, want 1", n)
+	}
+}
+
+func TestValidateSettingsMaxClients(t *testing.T) {
+	oldMax := maxVideoClients
+	t.Cleanup(func() { maxVideoClients = oldMax })
+	for _, c := range []struct {
+		max int
+		ok  bool
+	}{{1, true}, {10, true}, {0, false}, {-1, false}} {
+		maxVideoClients = c.max
+		if err := validateSettings(); (err == nil) != c.ok {
+			t.Errorf("VIDEO_MAX_CLIENTS=%d: %v", c.max, err)
+		}
+	}
+}
+
+func TestValidateSettingsMaxClientsFromEnv(t *testing.T) {
+	setEnvInt(t, &maxVideoClients, "VIDEO_MAX_CLIENTS", "0")
+	if maxVideoClients != 0 {
+		t.Fatalf("VIDEO_MAX_CLIENTS=0 read as %d", maxVideoClients)
+	}
+	if err := validateSettings(); err == nil || !strings.Contains(err.Error(), "VIDEO_MAX_CLIENTS=0") {
+		t.Fatalf("error %v, want startup to fail naming VIDEO_MAX_CLIENTS=0", err)
+	}
+}
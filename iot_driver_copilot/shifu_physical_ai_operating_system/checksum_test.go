@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// recordHistory replaces the telemetry history with readings recorded in order.
+func recordHistory(t *testing.T, readings ...TelemetryData) {
+	t.Helper()
+	prev := history
+	history = newTelemetryHistory(len(readings) + 1)
+	t.Cleanup(func() { history = prev })
+	for _, reading := range readings {
+		if _, err := history.record(reading); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func getChecksum(t *testing.T, query string) (int, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getTelemetryChecksum(w, httptest.NewRequest("GET", "/telemetry/checksum"+query, nil))
+	var body map[string]interface{}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, body
+}
+
+func TestTelemetryChecksumIgnoresRecordingOrder(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	reading := func(ts time.Time, v float64) TelemetryData {
+		return TelemetryData{Timestamp: ts, SensorData: map[string]interface{}{"v": v}}
+	}
+	a, b, c := reading(t0, 1), reading(t0, 2), reading(t0.Add(time.Second), 3)
+	outside := reading(t0.Add(time.Hour), 4)
+	const query = "?from=2026-01-01T00:00:00Z&to=2026-01-01T00:00:01Z"
+
+	var sums []interface{}
+	for _, order := range [][]TelemetryData{{a, b, c, outside}, {b, a, outside, c}, {c, outside, b, a}} {
+		recordHistory(t, order...)
+		code, body := getChecksum(t, query)
+		if code != http.StatusOK || body["count"] != 3.0 {
+			t.Fatalf("status %d, body %v; want 3 readings in range", code, body)
+		}
+		sums = append(sums, body["checksum"])
+	}
+	if sums[0] != sums[1] || sums[0] != sums[2] {
+		t.Fatalf("checksums %v differ with recording order", sums)
+	}
+
+	recordHistory(t, a, c)
+	if _, body := getChecksum(t, query); body["checksum"] == sums[0] {
+		t.Fatal("checksum unchanged with a reading missing")
+	}
+}
+
+func TestTelemetryChecksumBadRange(t *testing.T) {
+	recordHistory(t)
+	for _, query := range []string{
+		"",
+		"?from=yesterday&to=2026-01-01T00:00:00Z",
+		"?from=2026-01-02T00:00:00Z&to=2026-01-01T00:00:00Z",
+	} {
+		if code, _ := getChecksum(t, query); code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, code)
+		}
+	}
+}
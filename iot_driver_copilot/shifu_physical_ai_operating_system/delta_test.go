@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useHistory gives the test an empty snapshot ring of the given size, with
+// the poller off so GET /telemetry collects a reading on every request.
+func useHistory(t *testing.T, size int) {
+	t.Helper()
+	prevHist, prevPoll := history, pollInterval
+	history, pollInterval = newTelemetryHistory(size), 0
+	t.Cleanup(func() { history, pollInterval = prevHist, prevPoll })
+}
+
+type deltaBody struct {
+	ETag    string                 `json:"etag"`
+	Since   string                 `json:"since"`
+	Changed map[string]interface{} `json:"changed"`
+	Removed []string               `json:"removed"`
+}
+
+func getDelta(t *testing.T, since string) (int, deltaBody) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getTelemetryDelta(w, httptest.NewRequest("GET", "/telemetry/delta?since="+since, nil))
+	var body deltaBody
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, body
+}
+
+func TestTelemetryDeltaPollingKeepsBaseSnapshot(t *testing.T) {
+	useHistory(t, 2)
+	w := httptest.NewRecorder()
+	getTelemetry(w, httptest.NewRequest("GET", "/telemetry", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /telemetry sent no ETag")
+	}
+	// Far more polls than the ring holds; the device reading doesn't change
+	for i := 0; i < 5; i++ {
+		code, body := getDelta(t, etag)
+		if code != http.StatusOK {
+			t.Fatalf("poll %d: status %d, want the base snapshot still available", i+1, code)
+		}
+		if body.ETag != etag || body.Since != etag {
+			t.Fatalf("poll %d: etag %s since %s, want both %s", i+1, body.ETag, body.Since, etag)
+		}
+		for k := range body.Changed {
+			if k != "timestamp" {
+				t.Fatalf("poll %d: %s reported as changed: %v", i+1, k, body.Changed)
+			}
+		}
+	}
+}
+
+func TestTelemetryDeltaReportsChangedFields(t *testing.T) {
+	useHistory(t, 4)
+	base, err := history.record(TelemetryData{
+		Timestamp:  time.Now(),
+		SensorData: map[string]interface{}{"temperature": 30.0, "humidity": 40.0, "pressure": 1013.0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := getDelta(t, base.ETag)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	sensor, _ := body.Changed["sensor_data"].(map[string]interface{})
+	if len(sensor) != 1 || sensor["temperature"] != 25.1 {
+		t.Fatalf("sensor_data changes %v, want only temperature 25.1", sensor)
+	}
+	if len(body.Removed) != 1 || body.Removed[0] != "sensor_data.pressure" {
+		t.Fatalf("removed %v, want sensor_data.pressure", body.Removed)
+	}
+	if body.ETag == base.ETag {
+		t.Fatal("a changed reading kept the old ETag")
+	}
+}
+
+func TestTelemetryDeltaGone(t *testing.T) {
+	useHistory(t, 1)
+	old, err := history.record(TelemetryData{SensorData: map[string]interface{}{"temperature": 30.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The current reading differs, so it takes the only slot
+	w := httptest.NewRecorder()
+	getTelemetry(w, httptest.NewRequest("GET", "/telemetry", nil))
+
+	if code, _ := getDelta(t, old.ETag); code != http.StatusGone {
+		t.Fatalf("evicted base: status %d, want 410", code)
+	}
+	if code, _ := getDelta(t, `"unknown"`); code != http.StatusGone {
+		t.Fatalf("unknown ETag: status %d, want 410", code)
+	}
+	w = httptest.NewRecorder()
+	getTelemetryDelta(w, httptest.NewRequest("GET", "/telemetry/delta", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("missing since: status %d, want 400", w.Code)
+	}
+}
@@ -1,14 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -41,8 +58,46 @@ var (
 	serverPort       = os.Getenv("SERVER_PORT")
 	telemetryTimeout = getenvInt("TELEMETRY_TIMEOUT", 5) // seconds
 	videoMJPEGPort   = os.Getenv("VIDEO_MJPEG_PORT")
+	schemaFile       = os.Getenv("TELEMETRY_SCHEMA_FILE")
+	historySize      = getenvInt("TELEMETRY_HISTORY_SIZE", 32)
+	pollInterval     = getenvInt("TELEMETRY_POLL_INTERVAL", 1) // seconds, 0 disables polling
+	clientBuffer     = getenvInt("TELEMETRY_CLIENT_BUFFER", 16)
+	simulation       = os.Getenv("SIMULATION") == "true"
+	simInterval      = getenvInt("SIMULATION_INTERVAL", 1) // seconds
+	simProfileFile   = os.Getenv("SIMULATION_PROFILE_FILE")
+	coerceFile       = os.Getenv("TELEMETRY_TYPE_COERCE_FILE")
+	telemetryMaxAge  = getenvInt("TELEMETRY_MAX_AGE", 0) // seconds, 0 disables the staleness check
+	rejectedSize     = getenvInt("TELEMETRY_REJECTED_SIZE", 10)
+	unitsMapEnv      = os.Getenv("TELEMETRY_UNITS_MAP")
+	replicationPeers = os.Getenv("REPLICATION_PEERS")
+	deviceName       = os.Getenv("DEVICE_NAME") // device label of ?format=prometheus, defaults to DEVICE_IP
+
+	// syncSecret is the bearer token peers send to /sync/receive; when empty,
+	// only REPLICATION_PEERS hosts may post readings.
+	syncSecret = os.Getenv("REPLICATION_SECRET")
 )
 
+// coercions fix up field types from TELEMETRY_TYPE_COERCE_FILE; empty disables.
+var coercions []coercionRule
+
+// unitsMap gives the metric unit of each telemetry field for ?units=imperial.
+var unitsMap = defaultUnitsMap
+
+// sim generates sensor values when SIMULATION=true; nil otherwise.
+var sim *simulator
+
+// telemetrySchema is loaded from TELEMETRY_SCHEMA_FILE at startup; nil disables validation.
+var telemetrySchema *jsonSchema
+
+// history keeps the most recent telemetry snapshots served, keyed by ETag.
+var history = newTelemetryHistory(historySize)
+
+// rejections keeps the most recent readings that failed schema validation.
+var rejections = newRejectedTelemetry(rejectedSize)
+
+// replication pushes local telemetry to REPLICATION_PEERS; nil when no peers are configured.
+var replication *replicator
+
 func getenvInt(env string, def int) int {
 	if v := os.Getenv(env); v != "" {
 		if i, err := strconv.Atoi(v); err == nil {
@@ -59,24 +114,396 @@ func main() {
 	if serverPort == "" {
 		serverPort = "8080"
 	}
+	if schemaFile != "" {
+		schema, err := loadJSONSchema(schemaFile)
+		if err != nil {
+			log.Fatalf("Failed to load telemetry schema: %v", err)
+		}
+		telemetrySchema = schema
+		log.Printf("Validating telemetry against schema %s", schemaFile)
+	}
+	if coerceFile != "" {
+		rules, err := loadCoercions(coerceFile)
+		if err != nil {
+			log.Fatalf("Failed to load telemetry coercion rules: %v", err)
+		}
+		coercions = rules
+		log.Printf("Loaded %d telemetry coercion rule(s) from %s", len(rules), coerceFile)
+	}
+
+	if unitsMapEnv != "" {
+		m, err := loadUnitsMap(unitsMapEnv)
+		if err != nil {
+			log.Fatalf("Failed to load telemetry units map: %v", err)
+		}
+		unitsMap = m
+		log.Printf("Loaded %d telemetry unit mapping(s)", len(m))
+	}
 
 	http.HandleFunc("/telemetry", getTelemetry)
+	http.HandleFunc("/telemetry/delta", getTelemetryDelta)
+	http.HandleFunc("/telemetry/tail", tailTelemetry)
+	http.HandleFunc("/telemetry/rejected", getRejectedTelemetry)
+	http.HandleFunc("/telemetry/checksum", getTelemetryChecksum)
+	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/ota", otaHandler)
 	http.HandleFunc("/control", controlHandler)
 	if videoMJPEGPort != "" {
 		http.HandleFunc("/telemetry/video", mjpegProxyHandler)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if simulation {
+		profile := defaultSimProfile
+		if simProfileFile != "" {
+			p, err := loadSimProfile(simProfileFile)
+			if err != nil {
+				log.Fatalf("Failed to load simulation profile: %v", err)
+			}
+			profile = p
+		}
+		sim = newSimulator(profile, time.Duration(simInterval)*time.Second)
+		go sim.run(ctx)
+		log.Printf("Simulation mode enabled with %d field(s)", len(profile.Fields))
+	}
+	if peers := splitPeers(replicationPeers); len(peers) > 0 {
+		replication = newReplicator(peers, time.Duration(telemetryTimeout)*time.Second)
+		go replication.run(ctx)
+		http.HandleFunc("/sync/receive", syncReceiveHandler)
+		log.Printf("Replicating telemetry to %d peer(s)", len(peers))
+	}
+	if pollInterval > 0 {
+		go pollTelemetry(ctx, time.Duration(pollInterval)*time.Second)
+	}
+
 	addr := net.JoinHostPort(serverHost, serverPort)
+	server := &http.Server{Addr: addr}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
 	log.Printf("Shifu PAIO driver HTTP server listening at %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
-// getTelemetry handles GET /telemetry. Returns sensor, AI, and (optionally) video data.
+// getTelemetry handles GET /telemetry. Returns sensor, AI, and (optionally) video data,
+// as protobuf (proto/telemetry.proto) when the client accepts application/x-protobuf.
+// While the poller is running the latest polled snapshot is served; if it is older
+// than TELEMETRY_MAX_AGE the request fails with 503 unless ?allow_stale=true.
+// ?units=imperial converts the fields listed in TELEMETRY_UNITS_MAP.
 func getTelemetry(w http.ResponseWriter, r *http.Request) {
+	units := r.URL.Query().Get("units")
+	if units != "" && units != "metric" && units != "imperial" {
+		http.Error(w, "Invalid units parameter, expected metric or imperial", http.StatusBadRequest)
+		return
+	}
+	var snap *telemetrySnapshot
+	if pollInterval > 0 {
+		if recent := history.recent(1); len(recent) == 1 {
+			snap = recent[0]
+		}
+	}
+	if snap == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(telemetryTimeout)*time.Second)
+		defer cancel()
+		var err error
+		if snap, err = recordTelemetry(collectTelemetry(ctx)); err != nil {
+			writeRecordError(w, err)
+			return
+		}
+	}
+
+	age := time.Since(snap.Data.Timestamp)
+	// Scrapers get the age gauge even when the reading is stale
+	if r.URL.Query().Get("format") == "prometheus" {
+		doc := snap.Doc
+		if units == "imperial" {
+			_, body, err := toImperial(snap.Doc)
+			if err == nil {
+				err = json.Unmarshal(body, &doc)
+			}
+			if err != nil {
+				http.Error(w, "Failed to convert telemetry units", http.StatusInternalServerError)
+				return
+			}
+		}
+		device := deviceName
+		if device == "" {
+			device = deviceIP
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeTelemetryPrometheus(w, doc, age, device)
+		return
+	}
+	if telemetryMaxAge > 0 && age > time.Duration(telemetryMaxAge)*time.Second && r.URL.Query().Get("allow_stale") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     "telemetry is stale",
+			"age_s":     int(age.Seconds()),
+			"max_age_s": telemetryMaxAge,
+			"timestamp": snap.Data.Timestamp.UTC().Format(time.RFC3339Nano),
+		})
+		return
+	}
+
+	w.Header().Set("ETag", snap.ETag)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("X-Telemetry-Timestamp", snap.Data.Timestamp.UTC().Format(time.RFC3339Nano))
+	w.Header().Add("Vary", "Accept")
+	data, body := snap.Data, snap.JSON
+	if units == "imperial" {
+		var err error
+		if data, body, err = toImperial(snap.Doc); err != nil {
+			http.Error(w, "Failed to convert telemetry units", http.StatusInternalServerError)
+			return
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), protobufContentType) {
+		w.Header().Set("Content-Type", protobufContentType)
+		w.Write(encodeTelemetryProto(data))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// writeTelemetryPrometheus writes every numeric leaf of the telemetry document
+// as a paios_telemetry_<flattened_path> gauge, plus paios_telemetry_age_seconds.
+// Paths are joined with underscores and sanitized to valid metric names.
+// Gauges are sorted by name; when two paths sanitize to the same name only the
+// first path in sorted order is written, and a path that sanitizes to
+// age_seconds is skipped since that name is reserved for the age gauge.
+func writeTelemetryPrometheus(w io.Writer, doc map[string]interface{}, age time.Duration, device string) {
+	const ageMetric = "paios_telemetry_age_seconds"
+	labels := `{device="` + promLabelValue(device) + `"}`
+	fmt.Fprintln(w, "# HELP "+ageMetric+" Seconds since the latest telemetry reading was taken.")
+	fmt.Fprintln(w, "# TYPE "+ageMetric+" gauge")
+	fmt.Fprintf(w, "%s%s %g\n", ageMetric, labels, age.Seconds())
+
+	values := map[string]float64{}
+	flattenNumeric("", doc, values)
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ni, nj := promName(paths[i]), promName(paths[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return paths[i] < paths[j]
+	})
+	last := ""
+	for _, path := range paths {
+		name := "paios_telemetry_" + promName(path)
+		if name == last || name == ageMetric {
+			continue
+		}
+		last = name
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(values[path], 'g', -1, 64))
+	}
+}
+
+// flattenNumeric collects the numeric leaves under v keyed by their path,
+// with map keys and array indexes joined by underscores.
+func flattenNumeric(prefix string, v interface{}, out map[string]float64) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "_" + key
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			flattenNumeric(join(k), child, out)
+		}
+	case []interface{}:
+		for i, child := range val {
+			flattenNumeric(join(strconv.Itoa(i)), child, out)
+		}
+	default:
+		if f, ok := toFloat(val); ok && prefix != "" {
+			out[prefix] = f
+		}
+	}
+}
+
+// promName replaces every character that is not valid in a Prometheus metric
+// name with an underscore.
+func promName(path string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, path)
+}
+
+// getTelemetryDelta handles GET /telemetry/delta?since=<etag>. Returns only the
+// fields that changed since the snapshot with that ETag, or 410 Gone when the
+// snapshot has already left the history and a full fetch is needed.
+func getTelemetryDelta(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		http.Error(w, "Missing since parameter", http.StatusBadRequest)
+		return
+	}
+	base, ok := history.find(since)
+	if !ok {
+		http.Error(w, "Snapshot no longer available, fetch /telemetry", http.StatusGone)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(telemetryTimeout)*time.Second)
 	defer cancel()
+	snap, err := recordTelemetry(collectTelemetry(ctx))
+	if err != nil {
+		writeRecordError(w, err)
+		return
+	}
+
+	changed, removed := diffFields(base.Doc, snap.Doc, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", snap.ETag)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"etag":    snap.ETag,
+		"since":   base.ETag,
+		"changed": changed,
+		"removed": removed,
+	})
+}
+
+// getTelemetryChecksum handles GET /telemetry/checksum?from=<RFC3339>&to=<RFC3339>.
+// The checksum is a SHA-256 over the snapshots in the history whose timestamp
+// lies in [from, to], each serialized as canonical JSON (object keys sorted,
+// no insignificant whitespace) and followed by a newline. Snapshots are
+// sorted by timestamp, then by their canonical JSON, so the checksum does not
+// depend on recording order. Only snapshots still in the
+// TELEMETRY_HISTORY_SIZE ring are covered.
+func getTelemetryChecksum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid or missing from parameter, expected RFC3339", http.StatusBadRequest)
+		return
+	}
+	to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid or missing to parameter, expected RFC3339", http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	snaps := history.between(from, to)
+	type entry struct {
+		ts   time.Time
+		data []byte
+	}
+	entries := make([]entry, len(snaps))
+	for i, snap := range snaps {
+		// Marshaling the decoded document sorts keys at every level
+		data, err := json.Marshal(snap.Doc)
+		if err != nil {
+			http.Error(w, "Failed to encode telemetry", http.StatusInternalServerError)
+			return
+		}
+		entries[i] = entry{snap.Data.Timestamp, data}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ts.Equal(entries[j].ts) {
+			return entries[i].ts.Before(entries[j].ts)
+		}
+		return bytes.Compare(entries[i].data, entries[j].data) < 0
+	})
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write(e.data)
+		h.Write([]byte{'\n'})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(snaps),
+		"from":     from.UTC().Format(time.RFC3339Nano),
+		"to":       to.UTC().Format(time.RFC3339Nano),
+		"checksum": hex.EncodeToString(h.Sum(nil)),
+	})
+}
+
+// tailTelemetry handles GET /telemetry/tail. Streams every new telemetry
+// snapshot as one JSON object per line (NDJSON), optionally starting with the
+// last ?backlog=N snapshots from the history.
+func tailTelemetry(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	backlog, _ := strconv.Atoi(r.URL.Query().Get("backlog"))
+
+	// Subscribe before replaying the backlog so nothing recorded in between is missed
+	sub := history.subscribe(clientBuffer)
+	defer history.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, snap := range history.recent(backlog) {
+		w.Write(snap.JSON)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			if n := sub.dropped.Load(); n > 0 {
+				log.Printf("telemetry tail client %s dropped %d snapshot(s)", r.RemoteAddr, n)
+			}
+			return
+		case snap := <-sub.ch:
+			if _, err := w.Write(snap.JSON); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// pollTelemetry records a telemetry snapshot on every tick so streaming
+// clients receive updates without polling themselves.
+func pollTelemetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(telemetryTimeout)*time.Second)
+		if _, err := recordTelemetry(collectTelemetry(fetchCtx)); err != nil && !errors.Is(err, errTelemetryRejected) {
+			log.Printf("Failed to record telemetry: %v", err)
+		}
+		cancel()
+	}
+}
 
+// collectTelemetry gathers one telemetry reading from the device.
+func collectTelemetry(ctx context.Context) TelemetryData {
 	telemetry := TelemetryData{
 		Timestamp: time.Now(),
 	}
@@ -85,14 +512,546 @@ func getTelemetry(w http.ResponseWriter, r *http.Request) {
 	telemetry.SensorData = fetchSensorData(ctx)
 	telemetry.AIResults = fetchAIResults(ctx)
 	telemetry.CustomData = fetchCustomDeviceData(ctx)
+	applyCoercions(&telemetry)
 
 	// If MJPEG video configured, provide video endpoint link
 	if videoMJPEGPort != "" {
 		telemetry.VideoStreamMJPEG = getVideoHTTPURL()
 	}
+	return telemetry
+}
+
+// errTelemetryRejected is returned by recordTelemetry when a reading fails
+// schema validation and there is no earlier good snapshot to serve instead.
+var errTelemetryRejected = errors.New("telemetry failed schema validation")
+
+// recordTelemetry validates a reading against TELEMETRY_SCHEMA_FILE and records
+// it. A reading that fails validation never reaches the history: it is kept in
+// rejections and the last good snapshot is returned in its place.
+func recordTelemetry(t TelemetryData) (*telemetrySnapshot, error) {
+	if telemetrySchema != nil {
+		if errs := telemetrySchema.validate("", t.SensorData); len(errs) > 0 {
+			rejections.add(t, errs)
+			log.Printf("Rejected telemetry with %d schema error(s), first: %s", len(errs), errs[0])
+			if recent := history.recent(1); len(recent) == 1 {
+				return recent[0], nil
+			}
+			return nil, errTelemetryRejected
+		}
+	}
+	snap, err := history.record(t)
+	if err == nil && replication != nil {
+		replication.replicate(t)
+	}
+	return snap, err
+}
+
+// writeRecordError reports a recordTelemetry failure to the client.
+func writeRecordError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTelemetryRejected) {
+		http.Error(w, "Telemetry failed schema validation, see /telemetry/rejected", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, "Failed to encode telemetry", http.StatusInternalServerError)
+}
+
+// telemetrySnapshot is one encoded telemetry document and its decoded form.
+type telemetrySnapshot struct {
+	ETag string
+	JSON []byte
+	Doc  map[string]interface{}
+	Data TelemetryData
+}
+
+// telemetryHistory is a fixed-size ring of recent snapshots. Streaming
+// clients subscribe to it to receive each new snapshot.
+type telemetryHistory struct {
+	mu          sync.Mutex
+	entries     []*telemetrySnapshot
+	next        int
+	subscribers map[*telemetrySubscriber]struct{}
+}
+
+// telemetrySubscriber is one streaming client's bounded queue. Snapshots that
+// arrive while the queue is full are dropped for that client only, so a
+// stalled consumer never holds up telemetry ingest.
+type telemetrySubscriber struct {
+	ch      chan *telemetrySnapshot
+	dropped atomic.Int64
+}
+
+func newTelemetryHistory(size int) *telemetryHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &telemetryHistory{
+		entries:     make([]*telemetrySnapshot, size),
+		subscribers: map[*telemetrySubscriber]struct{}{},
+	}
+}
+
+func (h *telemetryHistory) subscribe(buffer int) *telemetrySubscriber {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &telemetrySubscriber{ch: make(chan *telemetrySnapshot, buffer)}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *telemetryHistory) unsubscribe(sub *telemetrySubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// recent returns up to n of the newest snapshots, oldest first.
+func (h *telemetryHistory) recent(n int) []*telemetrySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []*telemetrySnapshot
+	for i := 1; i <= len(h.entries) && len(out) < n; i++ {
+		snap := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if snap == nil {
+			break
+		}
+		out = append(out, snap)
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// between returns the snapshots with a timestamp in [from, to], sorted by
+// timestamp. Snapshots with equal timestamps keep their recording order.
+func (h *telemetryHistory) between(from, to time.Time) []*telemetrySnapshot {
+	var out []*telemetrySnapshot
+	for _, snap := range h.recent(len(h.entries)) {
+		if ts := snap.Data.Timestamp; !ts.Before(from) && !ts.After(to) {
+			out = append(out, snap)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Data.Timestamp.Before(out[j].Data.Timestamp)
+	})
+	return out
+}
+
+// record encodes the telemetry and returns its snapshot. The ETag covers
+// everything but the timestamp, and a reading that matches the latest
+// snapshot replaces it rather than taking a new slot, so clients polling an
+// unchanged device don't push each other's base snapshots out of the ring.
+func (h *telemetryHistory) record(t TelemetryData) (*telemetrySnapshot, error) {
+	snap, _, err := h.recordIf(t, nil)
+	return snap, err
+}
+
+// recordIf is record guarded by a conflict strategy: the reading is stored only
+// if strategy accepts it over the newest snapshot. When it is refused the
+// newest snapshot is returned with applied set to false.
+func (h *telemetryHistory) recordIf(t TelemetryData, strategy ConflictStrategy) (snap *telemetrySnapshot, applied bool, err error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, false, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	content := t
+	content.Timestamp = time.Time{}
+	key, err := json.Marshal(content)
+	if err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(key)
+	snap = &telemetrySnapshot{
+		ETag: `"` + hex.EncodeToString(sum[:8]) + `"`,
+		JSON: append(data, '\n'),
+		Doc:  doc,
+		Data: t,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest := (h.next - 1 + len(h.entries)) % len(h.entries)
+	current := h.entries[latest]
+	if strategy != nil && current != nil && !strategy.Accept(current.Data, t) {
+		return current, false, nil
+	}
+	if current != nil && current.ETag == snap.ETag {
+		h.entries[latest] = snap
+	} else {
+		h.entries[h.next] = snap
+		h.next = (h.next + 1) % len(h.entries)
+	}
+	for sub := range h.subscribers {
+		select {
+		case sub.ch <- snap:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+	return snap, true, nil
+}
+
+// find looks up a snapshot by ETag; the surrounding quotes are optional.
+func (h *telemetryHistory) find(etag string) (*telemetrySnapshot, bool) {
+	etag = `"` + strings.Trim(etag, `"`) + `"`
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, snap := range h.entries {
+		if snap != nil && snap.ETag == etag {
+			return snap, true
+		}
+	}
+	return nil, false
+}
+
+// rejectedReading is a telemetry reading that failed schema validation.
+type rejectedReading struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Payload   map[string]interface{} `json:"payload"`
+	Errors    []string               `json:"errors"`
+}
+
+// rejectedTelemetry is a fixed-size ring of the latest rejected readings.
+type rejectedTelemetry struct {
+	mu      sync.Mutex
+	entries []*rejectedReading
+	next    int
+	total   uint64
+}
+
+func newRejectedTelemetry(size int) *rejectedTelemetry {
+	if size < 1 {
+		size = 1
+	}
+	return &rejectedTelemetry{entries: make([]*rejectedReading, size)}
+}
+
+func (r *rejectedTelemetry) add(t TelemetryData, errs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = &rejectedReading{Timestamp: t.Timestamp, Payload: t.SensorData, Errors: errs}
+	r.next = (r.next + 1) % len(r.entries)
+	r.total++
+}
+
+// list returns the rejected readings newest first and the total ever rejected.
+func (r *rejectedTelemetry) list() ([]*rejectedReading, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []*rejectedReading{}
+	for i := 1; i <= len(r.entries); i++ {
+		entry := r.entries[(r.next-i+len(r.entries))%len(r.entries)]
+		if entry == nil {
+			break
+		}
+		out = append(out, entry)
+	}
+	return out, r.total
+}
+
+// getRejectedTelemetry handles GET /telemetry/rejected. Returns the last
+// TELEMETRY_REJECTED_SIZE readings that failed schema validation, newest first,
+// with their validation errors.
+func getRejectedTelemetry(w http.ResponseWriter, r *http.Request) {
+	rejected, total := rejections.list()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rejected_total": total,
+		"rejected":       rejected,
+	})
+}
+
+// ConflictStrategy decides whether a reading received from a peer replaces
+// the newest local snapshot.
+type ConflictStrategy interface {
+	Accept(current, incoming TelemetryData) bool
+}
+
+// LastWriteWins keeps whichever reading has the later Timestamp. On a tie the
+// local reading is kept, so replicas settle instead of overwriting each other.
+type LastWriteWins struct{}
+
+func (LastWriteWins) Accept(current, incoming TelemetryData) bool {
+	return incoming.Timestamp.After(current.Timestamp)
+}
+
+// replicator pushes every locally recorded reading to the REPLICATION_PEERS.
+type replicator struct {
+	client *http.Client
+	peers  []*replicationPeer
+}
+
+// replicationPeer holds only the newest unsent reading for one peer, so a slow
+// or unreachable peer skips intermediate readings instead of queueing them.
+type replicationPeer struct {
+	url    string
+	host   string // host part of url, matched against /sync/receive callers
+	wake   chan struct{}
+	mu     sync.Mutex
+	next   *TelemetryData
+	behind time.Time // timestamp of the oldest reading the peer has not acknowledged
+	failed bool
+}
+
+// splitPeers parses the comma-separated REPLICATION_PEERS list.
+func splitPeers(value string) []string {
+	var peers []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimRight(strings.TrimSpace(p), "/"); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func newReplicator(urls []string, timeout time.Duration) *replicator {
+	r := &replicator{client: &http.Client{Timeout: timeout}}
+	for _, u := range urls {
+		p := &replicationPeer{url: u, wake: make(chan struct{}, 1)}
+		if pu, err := url.Parse(u); err == nil {
+			p.host = pu.Hostname()
+		}
+		r.peers = append(r.peers, p)
+	}
+	return r
+}
+
+func (r *replicator) run(ctx context.Context) {
+	for _, p := range r.peers {
+		go r.sendLoop(ctx, p)
+	}
+}
+
+// replicate queues a reading for every peer without waiting on the network.
+func (r *replicator) replicate(t TelemetryData) {
+	for _, p := range r.peers {
+		p.mu.Lock()
+		p.next = &t
+		if p.behind.IsZero() {
+			p.behind = t.Timestamp
+		}
+		p.mu.Unlock()
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *replicator) sendLoop(ctx context.Context, p *replicationPeer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		}
+		p.mu.Lock()
+		t := p.next
+		p.next = nil
+		p.mu.Unlock()
+		if t == nil {
+			continue
+		}
+		err := r.send(ctx, p.url, *t)
+
+		p.mu.Lock()
+		if err == nil {
+			p.behind = time.Time{}
+			if p.next != nil {
+				p.behind = p.next.Timestamp
+			}
+		}
+		wasFailed := p.failed
+		p.failed = err != nil
+		p.mu.Unlock()
+		// Log only transitions so a down peer doesn't flood the log on every poll
+		if err != nil && !wasFailed {
+			log.Printf("Replication to %s failing: %v", p.url, err)
+		} else if err == nil && wasFailed {
+			log.Printf("Replication to %s recovered", p.url)
+		}
+	}
+}
+
+func (r *replicator) send(ctx context.Context, peer string, t TelemetryData) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", peer+"/sync/receive", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if syncSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+syncSecret)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	return nil
+}
+
+// lag reports how long each peer has been behind the local telemetry; zero
+// when it has acknowledged everything recorded so far.
+func (r *replicator) lag(now time.Time) map[string]time.Duration {
+	out := make(map[string]time.Duration, len(r.peers))
+	for _, p := range r.peers {
+		p.mu.Lock()
+		if !p.behind.IsZero() {
+			out[p.url] = now.Sub(p.behind)
+		} else {
+			out[p.url] = 0
+		}
+		p.mu.Unlock()
+	}
+	return out
+}
 
+// syncMaxBody caps the size of a reading accepted on /sync/receive.
+const syncMaxBody = 1 << 20
+
+// isPeer reports whether a /sync/receive request may write to the history.
+// With REPLICATION_SECRET set the caller must present it as a bearer token;
+// otherwise its address must resolve from one of the REPLICATION_PEERS hosts.
+func (r *replicator) isPeer(req *http.Request) bool {
+	if syncSecret != "" {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(syncSecret)) == 1
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, p := range r.peers {
+		if p.host == "" {
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), p.host)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// syncReceiveHandler handles POST /sync/receive from replication peers. It is
+// registered only when REPLICATION_PEERS is set. The reading goes through the
+// same schema check as local telemetry, is stored only if LastWriteWins
+// prefers it over the newest local snapshot, and is not replicated onwards.
+func syncReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if replication == nil || !replication.isPeer(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var t TelemetryData
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, syncMaxBody)).Decode(&t); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if t.Timestamp.IsZero() {
+		http.Error(w, "Missing timestamp", http.StatusBadRequest)
+		return
+	}
+	if telemetrySchema != nil {
+		if errs := telemetrySchema.validate("", t.SensorData); len(errs) > 0 {
+			rejections.add(t, errs)
+			http.Error(w, "Telemetry failed schema validation: "+errs[0], http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	snap, applied, err := history.recordIf(t, LastWriteWins{})
+	if err != nil {
+		http.Error(w, "Failed to encode telemetry", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(telemetry)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applied": applied,
+		"etag":    snap.ETag,
+	})
+}
+
+// metricsHandler handles GET /metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP shifu_replication_lag_seconds Time since the oldest reading a replication peer has not acknowledged.")
+	fmt.Fprintln(w, "# TYPE shifu_replication_lag_seconds gauge")
+	if replication == nil {
+		return
+	}
+	lag := replication.lag(time.Now())
+	for _, p := range replication.peers {
+		fmt.Fprintf(w, "shifu_replication_lag_seconds{peer=\"%s\"} %g\n", promLabelValue(p.url), lag[p.url].Seconds())
+	}
+}
+
+// promLabelValue escapes a label value for the Prometheus text format, which
+// only knows \\, \" and \n.
+func promLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// diffFields returns the fields of cur that differ from prev, nesting into
+// objects so only changed leaves are included, plus the dotted paths of fields
+// that no longer exist.
+func diffFields(prev, cur map[string]interface{}, prefix string) (map[string]interface{}, []string) {
+	changed := map[string]interface{}{}
+	removed := []string{}
+	for k, v := range cur {
+		old, ok := prev[k]
+		if !ok {
+			changed[k] = v
+			continue
+		}
+		oldMap, oldIsMap := old.(map[string]interface{})
+		newMap, newIsMap := v.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			sub, subRemoved := diffFields(oldMap, newMap, prefix+k+".")
+			if len(sub) > 0 {
+				changed[k] = sub
+			}
+			removed = append(removed, subRemoved...)
+			continue
+		}
+		if !reflect.DeepEqual(old, v) {
+			changed[k] = v
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			removed = append(removed, prefix+k)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
 }
 
 // otaHandler handles POST /ota for OTA firmware/software upgrades.
@@ -172,6 +1131,9 @@ func getVideoHTTPURL() string {
 
 // Mocked Telemetry Functions (replace with real device communication as needed)
 func fetchSensorData(ctx context.Context) map[string]interface{} {
+	if sim != nil {
+		return sim.sensorData()
+	}
 	return map[string]interface{}{
 		"temperature": 25.1,
 		"humidity":    40.0,
@@ -205,4 +1167,595 @@ func performDeviceControl(req ControlCommandRequest) map[string]interface{} {
 		"status":  "Command executed",
 		"command": req.Command,
 	}
-}
\ No newline at end of file
+}
+
+// jsonSchema is the subset of JSON Schema used to check device telemetry:
+// type, required, properties, additionalProperties, items, enum, minimum and maximum.
+type jsonSchema struct {
+	Type                 string                 `json:"type,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// loadJSONSchema reads and parses a JSON Schema document from path.
+func loadJSONSchema(path string) (*jsonSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &schema, nil
+}
+
+// validate checks value against the schema and returns one message per violation.
+// path is the JSON pointer of value within the document ("" for the root).
+func (s *jsonSchema) validate(path string, value interface{}) []string {
+	where := path
+	if where == "" {
+		where = "/"
+	}
+	if s.Type != "" && !schemaTypeMatches(s.Type, value) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", where, s.Type, schemaTypeOf(value))}
+	}
+	var errs []string
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: value %v is not one of %v", where, value, s.Enum))
+		}
+	}
+	if n, ok := toFloat(value); ok {
+		if s.Minimum != nil && n < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than minimum %v", where, n, *s.Minimum))
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: %v is greater than maximum %v", where, n, *s.Maximum))
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required field %q", where, name))
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if prop, ok := s.Properties[k]; ok {
+				errs = append(errs, prop.validate(path+"/"+k, v[k])...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, fmt.Sprintf("%s: unexpected field %q", where, k))
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(path+"/"+strconv.Itoa(i), item)...)
+			}
+		}
+	}
+	return errs
+}
+
+// jsonEqual reports whether two decoded JSON values are equal. Numbers compare
+// by value whatever their Go type; everything else must match in JSON type
+// too, so the string "1" is not equal to the number 1.
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case nil, bool, string:
+		return a == b
+	}
+	return false
+}
+
+func schemaTypeMatches(want string, value interface{}) bool {
+	got := schemaTypeOf(value)
+	if want == "number" && got == "integer" {
+		return true
+	}
+	return want == got
+}
+
+func schemaTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}, []map[string]interface{}:
+		return "array"
+	default:
+		if n, ok := toFloat(v); ok {
+			if n == float64(int64(n)) {
+				return "integer"
+			}
+			return "number"
+		}
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// toFloat converts the numeric types produced by JSON decoding or Go literals to float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// unitConversion converts a metric value to its imperial equivalent.
+type unitConversion struct {
+	To      string
+	Convert func(float64) float64
+}
+
+// unitConversions is keyed by the metric unit named in TELEMETRY_UNITS_MAP.
+var unitConversions = map[string]unitConversion{
+	"C":   {"F", func(v float64) float64 { return v*9/5 + 32 }},
+	"m/s": {"mph", func(v float64) float64 { return v * 2.2369362920544 }},
+	"kPa": {"psi", func(v float64) float64 { return v * 0.1450377377 }},
+}
+
+var defaultUnitsMap = map[string]string{
+	"temperature": "C",
+	"speed":       "m/s",
+	"pressure":    "kPa",
+}
+
+// loadUnitsMap parses TELEMETRY_UNITS_MAP, which is either an inline JSON
+// object or the path of a file holding one, mapping field names to units.
+// A field is matched by its name at any depth or by its dotted path from
+// the document root, e.g. "sensor_data.engine.temperature".
+func loadUnitsMap(value string) (map[string]string, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse units map: %w", err)
+	}
+	for field, unit := range m {
+		if _, ok := unitConversions[unit]; !ok {
+			return nil, fmt.Errorf("field %s: unsupported unit %q", field, unit)
+		}
+	}
+	return m, nil
+}
+
+// toImperial returns a converted copy of a decoded telemetry document as
+// both TelemetryData and JSON. doc itself is left untouched.
+func toImperial(doc map[string]interface{}) (TelemetryData, []byte, error) {
+	var t TelemetryData
+	data, err := json.Marshal(convertUnits(doc, ""))
+	if err != nil {
+		return t, nil, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, nil, err
+	}
+	return t, append(data, '\n'), nil
+}
+
+// convertUnits copies m, converting numeric fields found in unitsMap and
+// adding a <field>_unit sibling for each one. Other values are copied as is.
+func convertUnits(m map[string]interface{}, prefix string) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	for k, v := range m {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			out[k] = convertUnits(nested, path)
+			continue
+		}
+		unit, ok := unitsMap[path]
+		if !ok {
+			unit, ok = unitsMap[k]
+		}
+		n, isNum := toFloat(v)
+		if !ok || !isNum {
+			continue
+		}
+		conv := unitConversions[unit]
+		out[k] = conv.Convert(n)
+		out[k+"_unit"] = conv.To
+	}
+	return out
+}
+
+// protobufContentType is negotiated by GET /telemetry for binary telemetry.
+const protobufContentType = "application/x-protobuf"
+
+// Protobuf wire types used by the telemetry encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// encodeTelemetryProto encodes t as the TelemetryData message in
+// proto/telemetry.proto. Map entries are written in key order so the output
+// is deterministic.
+func encodeTelemetryProto(t TelemetryData) []byte {
+	var b []byte
+	if !t.Timestamp.IsZero() {
+		var ts []byte
+		if sec := t.Timestamp.Unix(); sec != 0 {
+			ts = protoVarint(ts, 1, uint64(sec))
+		}
+		if nanos := t.Timestamp.Nanosecond(); nanos != 0 {
+			ts = protoVarint(ts, 2, uint64(nanos))
+		}
+		b = protoBytes(b, 1, ts)
+	}
+	b = protoMap(b, 2, t.SensorData)
+	if t.VideoStreamMJPEG != "" {
+		b = protoBytes(b, 3, []byte(t.VideoStreamMJPEG))
+	}
+	b = protoMap(b, 4, t.AIResults)
+	b = protoMap(b, 5, t.CustomData)
+	return b
+}
+
+// protoMap appends m as a map<string, Value> field.
+func protoMap(b []byte, field int, m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := protoBytes(nil, 1, []byte(k))
+		entry = protoBytes(entry, 2, protoValue(m[k]))
+		b = protoBytes(b, field, entry)
+	}
+	return b
+}
+
+// protoValue encodes v as a Value message. Types other than those produced by
+// JSON decoding are normalised through a JSON round trip first.
+func protoValue(v interface{}) []byte {
+	if n, ok := toFloat(v); ok {
+		return binary.LittleEndian.AppendUint64(protoTag(nil, 2, wireFixed64), math.Float64bits(n))
+	}
+	switch x := v.(type) {
+	case nil:
+		return protoVarint(nil, 1, 0)
+	case string:
+		return protoBytes(nil, 3, []byte(x))
+	case bool:
+		var n uint64
+		if x {
+			n = 1
+		}
+		return protoVarint(nil, 4, n)
+	case map[string]interface{}:
+		return protoBytes(nil, 5, protoMap(nil, 1, x))
+	case []interface{}:
+		var list []byte
+		for _, e := range x {
+			list = protoBytes(list, 1, protoValue(e))
+		}
+		return protoBytes(nil, 6, list)
+	}
+	data, err := json.Marshal(v)
+	var normalised interface{}
+	if err != nil || json.Unmarshal(data, &normalised) != nil {
+		return protoBytes(nil, 3, []byte(fmt.Sprint(v)))
+	}
+	return protoValue(normalised)
+}
+
+func protoTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(protoTag(b, field, wireVarint), v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(protoTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// coercionRule converts a telemetry field that the firmware reports with the
+// wrong JSON type, e.g. {"field": "temperature", "from_type": "string",
+// "to_type": "float64"}. Field may be a dotted path into nested objects, and
+// Section selects sensor_data (the default), ai_results or custom_data.
+type coercionRule struct {
+	Field    string `json:"field"`
+	FromType string `json:"from_type"`
+	ToType   string `json:"to_type"`
+	Section  string `json:"section,omitempty"`
+}
+
+func loadCoercions(path string) ([]coercionRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []coercionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, r := range rules {
+		if r.Field == "" {
+			return nil, fmt.Errorf("%s: rule %d has no field", path, i)
+		}
+		switch r.ToType {
+		case "string", "float64", "int64", "bool":
+		default:
+			return nil, fmt.Errorf("%s: rule %d: unsupported to_type %q", path, i, r.ToType)
+		}
+		switch r.Section {
+		case "", "sensor_data", "ai_results", "custom_data":
+		default:
+			return nil, fmt.Errorf("%s: rule %d: unknown section %q", path, i, r.Section)
+		}
+	}
+	return rules, nil
+}
+
+// applyCoercions rewrites the fields named by the coercion rules in place.
+// Values that cannot be converted are logged and left unchanged.
+func applyCoercions(t *TelemetryData) {
+	for _, rule := range coercions {
+		section := t.SensorData
+		switch rule.Section {
+		case "ai_results":
+			section = t.AIResults
+		case "custom_data":
+			section = t.CustomData
+		}
+		parent, key := section, rule.Field
+		for parent != nil && strings.Contains(key, ".") {
+			var head string
+			head, key, _ = strings.Cut(key, ".")
+			parent, _ = parent[head].(map[string]interface{})
+		}
+		value, ok := parent[key]
+		if !ok || (rule.FromType != "" && coercionTypeOf(value) != rule.FromType) {
+			continue
+		}
+		converted, err := coerceValue(value, rule.ToType)
+		if err != nil {
+			log.Printf("WARNING: cannot coerce telemetry field %s to %s: %v", rule.Field, rule.ToType, err)
+			continue
+		}
+		parent[key] = converted
+	}
+}
+
+// coercionTypeOf names a decoded JSON value the way coercion rules do.
+func coercionTypeOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "float64"
+	case int, int64:
+		return "int64"
+	case bool:
+		return "bool"
+	case nil:
+		return "null"
+	}
+	return schemaTypeOf(v)
+}
+
+func coerceValue(v interface{}, to string) (interface{}, error) {
+	switch to {
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case "float64":
+		switch v := v.(type) {
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+	case "int64":
+		switch v := v.(type) {
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("%v is not a whole number", v)
+			}
+			return int64(v), nil
+		case int:
+			return int64(v), nil
+		}
+	case "bool":
+		switch v := v.(type) {
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		case float64:
+			return v != 0, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported conversion from %s", coercionTypeOf(v))
+}
+
+// simField describes one simulated sensor value, which does a bounded random
+// walk between Min and Max, moving at most Step per update.
+type simField struct {
+	Name    string  `json:"name"`
+	Initial float64 `json:"initial"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Step    float64 `json:"step"`
+	PeriodS int     `json:"period_s,omitempty"` // seconds between updates, defaults to SIMULATION_INTERVAL
+}
+
+// simProfile is the SIMULATION_PROFILE_FILE document.
+type simProfile struct {
+	Fields []simField `json:"fields"`
+}
+
+var defaultSimProfile = simProfile{Fields: []simField{
+	{Name: "temperature", Initial: 25.1, Min: 15, Max: 35, Step: 0.3},
+	{Name: "humidity", Initial: 40, Min: 20, Max: 80, Step: 1},
+}}
+
+func loadSimProfile(path string) (simProfile, error) {
+	var profile simProfile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profile, err
+	}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return profile, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, f := range profile.Fields {
+		if f.Name == "" || f.Min > f.Max {
+			return profile, fmt.Errorf("invalid field %q in %s: name is required and min must not exceed max", f.Name, path)
+		}
+	}
+	return profile, nil
+}
+
+// simulator produces plausibly varying sensor readings plus an uptime counter.
+type simulator struct {
+	mu       sync.Mutex
+	fields   []simField
+	values   map[string]float64
+	due      map[string]time.Time
+	interval time.Duration
+	started  time.Time
+}
+
+func newSimulator(profile simProfile, interval time.Duration) *simulator {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	s := &simulator{
+		fields:   profile.Fields,
+		values:   map[string]float64{},
+		due:      map[string]time.Time{},
+		interval: interval,
+		started:  time.Now(),
+	}
+	for _, f := range profile.Fields {
+		s.values[f.Name] = math.Max(f.Min, math.Min(f.Max, f.Initial))
+	}
+	return s
+}
+
+// run updates the values until ctx is cancelled.
+func (s *simulator) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Simulation stopped")
+			return
+		case now := <-ticker.C:
+			s.step(now)
+		}
+	}
+}
+
+func (s *simulator) step(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.fields {
+		if now.Before(s.due[f.Name]) {
+			continue
+		}
+		v := s.values[f.Name] + (rand.Float64()*2-1)*f.Step
+		s.values[f.Name] = math.Round(math.Max(f.Min, math.Min(f.Max, v))*100) / 100
+		if f.PeriodS > 0 {
+			s.due[f.Name] = now.Add(time.Duration(f.PeriodS) * time.Second)
+		}
+	}
+}
+
+// sensorData returns a copy of the current values.
+func (s *simulator) sensorData() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := make(map[string]interface{}, len(s.values)+1)
+	for k, v := range s.values {
+		data[k] = v
+	}
+	data["uptime_s"] = int(time.Since(s.started).Seconds())
+	return data
+}
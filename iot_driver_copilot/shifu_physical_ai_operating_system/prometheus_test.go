@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTelemetryPrometheus(t *testing.T) {
+	doc := map[string]interface{}{
+		"age_seconds": 99.0,
+		"engine":      map[string]interface{}{"rpm": 900.0, "mode": "eco"},
+		"temp-c":      21.5,
+	}
+	var b strings.Builder
+	writeTelemetryPrometheus(&b, doc, 2*time.Second, "arm \"1\"\\\n\tleft")
+
+	labels := `{device="arm \"1\"\\\n` + "\t" + `left"}`
+	want := strings.Join([]string{
+		"# HELP paios_telemetry_age_seconds Seconds since the latest telemetry reading was taken.",
+		"# TYPE paios_telemetry_age_seconds gauge",
+		"paios_telemetry_age_seconds" + labels + " 2",
+		"# TYPE paios_telemetry_engine_rpm gauge",
+		"paios_telemetry_engine_rpm" + labels + " 900",
+		"# TYPE paios_telemetry_temp_c gauge",
+		"paios_telemetry_temp_c" + labels + " 21.5",
+		"",
+	}, "\n")
+	if got := b.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPromLabelValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":     "plain",
+		`a"b`:       `a\"b`,
+		`a\b`:       `a\\b`,
+		"a\nb":      `a\nb`,
+		"tab\there": "tab\there",
+		"ünïcödé ✓": "ünïcödé ✓",
+	} {
+		if got := promLabelValue(in); got != want {
+			t.Errorf("promLabelValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
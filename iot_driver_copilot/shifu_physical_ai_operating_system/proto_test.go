@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// protoField is one decoded field of a protobuf message: the varint or
+// fixed64 value, or the bytes of a length-delimited field.
+type protoField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodeProto splits a message into its fields, failing the test on
+// malformed input.
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag in %x", b)
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint in %x", b)
+			}
+			b = b[n:]
+		case wireFixed64:
+			f.value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatalf("bad length in %x", b)
+			}
+			f.bytes, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// protoMapKeys returns the keys of a map field, in encoded order, and the
+// encoded Value of each.
+func protoMapKeys(t *testing.T, fields []protoField, num int) ([]string, map[string][]byte) {
+	t.Helper()
+	var keys []string
+	values := map[string][]byte{}
+	for _, f := range fields {
+		if f.num != num {
+			continue
+		}
+		entry := decodeProto(t, f.bytes)
+		if len(entry) != 2 || entry[0].num != 1 || entry[1].num != 2 {
+			t.Fatalf("malformed map entry %x", f.bytes)
+		}
+		keys = append(keys, string(entry[0].bytes))
+		values[string(entry[0].bytes)] = entry[1].bytes
+	}
+	return keys, values
+}
+
+func TestEncodeTelemetryProtoWireFormat(t *testing.T) {
+	got := encodeTelemetryProto(TelemetryData{SensorData: map[string]interface{}{"t": 1.5}})
+	want := []byte{0x12, 0x0e, 0x0a, 0x01, 't', 0x12, 0x09, 0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encoded %x, want %x", got, want)
+	}
+}
+
+func TestEncodeTelemetryProtoValues(t *testing.T) {
+	reading := TelemetryData{
+		Timestamp: time.Unix(1700000000, 250),
+		SensorData: map[string]interface{}{
+			"temperature": 21.5,
+			"status":      "ok",
+			"armed":       true,
+			"fault":       nil,
+			"engine":      map[string]interface{}{"rpm": 900.0},
+			"history":     []interface{}{1.0, "x"},
+		},
+		VideoStreamMJPEG: "http://cam/stream",
+	}
+	fields := decodeProto(t, encodeTelemetryProto(reading))
+
+	ts := decodeProto(t, fields[0].bytes)
+	if fields[0].num != 1 || ts[0].value != 1700000000 || ts[1].value != 250 {
+		t.Fatalf("timestamp = %+v", ts)
+	}
+	keys, values := protoMapKeys(t, fields, 2)
+	if want := []string{"armed", "engine", "fault", "history", "status", "temperature"}; !slices.Equal(keys, want) {
+		t.Fatalf("keys %v, want %v in sorted order", keys, want)
+	}
+	value := func(key string) protoField { return decodeProto(t, values[key])[0] }
+	if v := value("temperature"); v.num != 2 || math.Float64frombits(v.value) != 21.5 {
+		t.Errorf("temperature = %+v", v)
+	}
+	if v := value("status"); v.num != 3 || string(v.bytes) != "ok" {
+		t.Errorf("status = %+v", v)
+	}
+	if v := value("armed"); v.num != 4 || v.value != 1 {
+		t.Errorf("armed = %+v", v)
+	}
+	if v := value("fault"); v.num != 1 || v.value != 0 {
+		t.Errorf("fault = %+v", v)
+	}
+	if v := value("engine"); v.num != 5 {
+		t.Errorf("engine = %+v, want a struct", v)
+	} else if keys, _ := protoMapKeys(t, decodeProto(t, v.bytes), 1); len(keys) != 1 || keys[0] != "rpm" {
+		t.Errorf("engine keys = %v", keys)
+	}
+	if v := value("history"); v.num != 6 || len(decodeProto(t, v.bytes)) != 2 {
+		t.Errorf("history = %+v, want a two-element list", v)
+	}
+	for _, f := range fields {
+		if f.num == 3 && string(f.bytes) != "http://cam/stream" {
+			t.Errorf("video_stream_mjpeg = %q", f.bytes)
+		}
+	}
+}
+
+func TestTelemetryNegotiatesProtobuf(t *testing.T) {
+	useReading(t, unitsReading)
+	r := httptest.NewRequest("GET", "/telemetry", nil)
+	r.Header.Set("Accept", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	getTelemetry(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != protobufContentType || w.Header().Get("Vary") != "Accept" {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	if keys, _ := protoMapKeys(t, decodeProto(t, w.Body.Bytes()), 2); len(keys) != len(unitsReading.SensorData) {
+		t.Fatalf("sensor_data keys %v", keys)
+	}
+}
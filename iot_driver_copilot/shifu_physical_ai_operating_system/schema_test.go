@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustSchema(t *testing.T, doc string) *jsonSchema {
+	t.Helper()
+	var s jsonSchema
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+// validateJSON decodes payload the way telemetry arrives and validates it.
+func validateJSON(t *testing.T, s *jsonSchema, payload string) []string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(payload), &v); err != nil {
+		t.Fatal(err)
+	}
+	return s.validate("", v)
+}
+
+func TestSchemaRequired(t *testing.T) {
+	s := mustSchema(t, `{"type":"object","required":["temperature","humidity"],"properties":{"temperature":{"type":"number"}}}`)
+	if errs := validateJSON(t, s, `{"temperature":21.5,"humidity":40}`); len(errs) != 0 {
+		t.Fatalf("complete reading rejected: %v", errs)
+	}
+	errs := validateJSON(t, s, `{"temperature":21.5}`)
+	if len(errs) != 1 || !strings.Contains(errs[0], `missing required field "humidity"`) {
+		t.Fatalf("errors %v, want one for the missing humidity", errs)
+	}
+}
+
+func TestSchemaEnumComparesJSONTypes(t *testing.T) {
+	s := mustSchema(t, `{"enum":[1,"on",true,null,[1,"a"],{"mode":"eco"}]}`)
+	for _, c := range []struct {
+		payload string
+		ok      bool
+	}{
+		{`1`, true},
+		{`1.0`, true},
+		{`"1"`, false},
+		{`"on"`, true},
+		{`true`, true},
+		{`"true"`, false},
+		{`null`, true},
+		{`"<nil>"`, false},
+		{`[1,"a"]`, true},
+		{`["1","a"]`, false},
+		{`{"mode":"eco"}`, true},
+		{`{"mode":"eco","x":1}`, false},
+		{`2`, false},
+	} {
+		if errs := validateJSON(t, s, c.payload); (len(errs) == 0) != c.ok {
+			t.Errorf("%s: errors %v, want ok=%v", c.payload, errs, c.ok)
+		}
+	}
+}
+
+// useTelemetrySchema validates recorded telemetry against doc, with a fresh
+// history and rejection ring and no replication.
+func useTelemetrySchema(t *testing.T, doc string) {
+	t.Helper()
+	prevSchema, prevHist, prevRej, prevRepl := telemetrySchema, history, rejections, replication
+	t.Cleanup(func() { telemetrySchema, history, rejections, replication = prevSchema, prevHist, prevRej, prevRepl })
+	telemetrySchema = mustSchema(t, doc)
+	history = newTelemetryHistory(4)
+	rejections = newRejectedTelemetry(4)
+	replication = nil
+}
+
+const tempSchema = `{"type":"object","required":["temperature"],"properties":{"temperature":{"type":"number","maximum":100}}}`
+
+func TestRecordTelemetryRejectsWithoutGoodSnapshot(t *testing.T) {
+	useTelemetrySchema(t, tempSchema)
+	snap, err := recordTelemetry(TelemetryData{Timestamp: time.Now(), SensorData: map[string]interface{}{"temperature": "hot"}})
+	if !errors.Is(err, errTelemetryRejected) || snap != nil {
+		t.Fatalf("recordTelemetry = %v, %v; want errTelemetryRejected", snap, err)
+	}
+	if _, total := rejections.list(); total != 1 {
+		t.Fatalf("rejected_total %d, want 1", total)
+	}
+	w := httptest.NewRecorder()
+	writeRecordError(w, err)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", w.Code)
+	}
+}
+
+func TestRecordTelemetryKeepsLastGoodSnapshot(t *testing.T) {
+	useTelemetrySchema(t, tempSchema)
+	good, err := recordTelemetry(TelemetryData{Timestamp: time.Now(), SensorData: map[string]interface{}{"temperature": 21.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, bad := range []map[string]interface{}{
+		{"temperature": 150.0},
+		{"humidity": 40.0},
+	} {
+		snap, err := recordTelemetry(TelemetryData{Timestamp: time.Now(), SensorData: bad})
+		if err != nil || snap != good {
+			t.Fatalf("reading %v: got %v, %v; want the last good snapshot", bad, snap, err)
+		}
+		rejected, total := rejections.list()
+		if total != uint64(i+1) || len(rejected[0].Errors) == 0 {
+			t.Fatalf("after %v: rejected_total %d with errors %v, want %d", bad, total, rejected[0].Errors, i+1)
+		}
+	}
+	if recent := history.recent(4); len(recent) != 1 || recent[0] != good {
+		t.Fatalf("history holds %d snapshot(s), want only the good one", len(recent))
+	}
+}
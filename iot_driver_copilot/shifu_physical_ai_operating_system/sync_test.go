@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useReplication configures a single peer at 127.0.0.1 and a fresh history
+// and rejection ring for the test.
+func useReplication(t *testing.T) {
+	t.Helper()
+	prevRepl, prevHist, prevRej := replication, history, rejections
+	prevSecret, prevSchema := syncSecret, telemetrySchema
+	replication = newReplicator([]string{"http://127.0.0.1:8081"}, time.Second)
+	history = newTelemetryHistory(4)
+	rejections = newRejectedTelemetry(4)
+	t.Cleanup(func() {
+		replication, history, rejections = prevRepl, prevHist, prevRej
+		syncSecret, telemetrySchema = prevSecret, prevSchema
+	})
+}
+
+func postSync(remote, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/sync/receive", strings.NewReader(body))
+	r.RemoteAddr = remote
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	syncReceiveHandler(w, r)
+	return w
+}
+
+const syncReading = `{"timestamp":"2024-05-01T10:00:00Z","sensor_data":{"temp":21.5}}`
+
+func TestSyncReceiveAcceptsOnlyPeers(t *testing.T) {
+	useReplication(t)
+	if w := postSync("10.0.0.9:40000", "", syncReading); w.Code != http.StatusForbidden {
+		t.Fatalf("unknown host: status %d, want 403", w.Code)
+	}
+	if len(history.recent(1)) != 0 {
+		t.Fatal("reading from an unknown host was stored")
+	}
+	w := postSync("127.0.0.1:40000", "", syncReading)
+	if w.Code != http.StatusOK {
+		t.Fatalf("peer: status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var resp struct{ Applied bool }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Applied {
+		t.Fatalf("peer reading not applied: %s", w.Body.String())
+	}
+}
+
+func TestSyncReceiveRequiresSecret(t *testing.T) {
+	useReplication(t)
+	syncSecret = "s3cret"
+	for _, c := range []struct {
+		name, token string
+		want        int
+	}{
+		{"peer without token", "", http.StatusForbidden},
+		{"wrong token", "guess", http.StatusForbidden},
+		{"right token", "s3cret", http.StatusOK},
+	} {
+		if w := postSync("127.0.0.1:40000", c.token, syncReading); w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+func TestSyncReceiveLimitsBody(t *testing.T) {
+	useReplication(t)
+	big := `{"timestamp":"2024-05-01T10:00:00Z","custom_data":{"pad":"` + strings.Repeat("x", syncMaxBody) + `"}}`
+	if w := postSync("127.0.0.1:40000", "", big); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", w.Code)
+	}
+}
+
+func TestSyncReceiveValidatesSchema(t *testing.T) {
+	useReplication(t)
+	if err := json.Unmarshal([]byte(`{"type":"object","properties":{"temp":{"type":"number","maximum":100}}}`), &telemetrySchema); err != nil {
+		t.Fatal(err)
+	}
+	w := postSync("127.0.0.1:40000", "", `{"timestamp":"2024-05-01T10:00:00Z","sensor_data":{"temp":500}}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", w.Code, w.Body.String())
+	}
+	if rejected, total := rejections.list(); total != 1 || len(rejected) != 1 {
+		t.Fatalf("rejections = %d (total %d), want 1", len(rejected), total)
+	}
+	if len(history.recent(1)) != 0 {
+		t.Fatal("invalid reading reached the history")
+	}
+}
+
+func TestMetricsEscapesPeerLabel(t *testing.T) {
+	useReplication(t)
+	// Only \\, \" and \n are escapes in the text format; Go quoting would
+	// also turn the tab into \t
+	replication = newReplicator([]string{"http://peer.local:8081/a\"b\tc"}, time.Second)
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := "shifu_replication_lag_seconds{peer=\"http://peer.local:8081/a\\\"b\tc\"} 0"
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("metrics missing %s:\n%s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useReading makes t the snapshot GET /telemetry serves, as if the poller
+// had just recorded it.
+func useReading(t *testing.T, reading TelemetryData) *telemetrySnapshot {
+	t.Helper()
+	prevHist, prevPoll := history, pollInterval
+	history, pollInterval = newTelemetryHistory(4), 1
+	t.Cleanup(func() { history, pollInterval = prevHist, prevPoll })
+	snap, err := history.record(reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+func getTelemetryDoc(t *testing.T, query string) (int, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getTelemetry(w, httptest.NewRequest("GET", "/telemetry"+query, nil))
+	var doc map[string]interface{}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	return w.Code, doc
+}
+
+func near(got interface{}, want float64) bool {
+	f, ok := got.(float64)
+	return ok && math.Abs(f-want) < 1e-6
+}
+
+var unitsReading = TelemetryData{
+	Timestamp: time.Now().UTC(),
+	SensorData: map[string]interface{}{
+		"temperature": 100.0,
+		"speed":       10.0,
+		"engine":      map[string]interface{}{"pressure": 100.0},
+		"status":      "ok",
+		"pressure":    "n/a",
+	},
+}
+
+func TestTelemetryImperialUnits(t *testing.T) {
+	snap := useReading(t, unitsReading)
+	cached := string(snap.JSON)
+
+	code, doc := getTelemetryDoc(t, "?units=imperial")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	sensors := doc["sensor_data"].(map[string]interface{})
+	engine := sensors["engine"].(map[string]interface{})
+	switch {
+	case !near(sensors["temperature"], 212) || sensors["temperature_unit"] != "F":
+		t.Errorf("temperature = %v %v, want 212 F", sensors["temperature"], sensors["temperature_unit"])
+	case !near(sensors["speed"], 22.369362920544) || sensors["speed_unit"] != "mph":
+		t.Errorf("speed = %v %v, want 22.37 mph", sensors["speed"], sensors["speed_unit"])
+	case !near(engine["pressure"], 14.50377377) || engine["pressure_unit"] != "psi":
+		t.Errorf("nested pressure = %v %v, want 14.5 psi", engine["pressure"], engine["pressure_unit"])
+	case sensors["pressure"] != "n/a" || sensors["status"] != "ok":
+		t.Errorf("non-numeric fields changed: %v", sensors)
+	}
+	if string(history.recent(1)[0].JSON) != cached {
+		t.Error("conversion modified the cached snapshot")
+	}
+
+	_, doc = getTelemetryDoc(t, "?units=metric")
+	if sensors := doc["sensor_data"].(map[string]interface{}); !near(sensors["temperature"], 100) || sensors["temperature_unit"] != nil {
+		t.Errorf("metric temperature = %v %v", sensors["temperature"], sensors["temperature_unit"])
+	}
+	if code, _ := getTelemetryDoc(t, "?units=kelvin"); code != http.StatusBadRequest {
+		t.Errorf("units=kelvin: status %d, want 400", code)
+	}
+}
+
+func TestTelemetryUnitsMapByPath(t *testing.T) {
+	prev := unitsMap
+	t.Cleanup(func() { unitsMap = prev })
+	m, err := loadUnitsMap(`{"sensor_data.engine.pressure": "kPa"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unitsMap = m
+	useReading(t, unitsReading)
+	_, doc := getTelemetryDoc(t, "?units=imperial")
+	sensors := doc["sensor_data"].(map[string]interface{})
+	if !near(sensors["engine"].(map[string]interface{})["pressure"], 14.50377377) {
+		t.Errorf("engine pressure not converted: %v", sensors["engine"])
+	}
+	if !near(sensors["temperature"], 100) {
+		t.Errorf("temperature converted without a mapping: %v", sensors["temperature"])
+	}
+}
+
+func TestLoadUnitsMapRejectsUnknownUnit(t *testing.T) {
+	if _, err := loadUnitsMap(`{"temperature": "K"}`); err == nil {
+		t.Fatal("unit K accepted")
+	}
+}